@@ -32,9 +32,10 @@ var (
 	cmd        string = "[cmd]"
 
 	// run config
-	fpath  string
-	resume bool
-	rpcUrl string
+	fpath      string
+	resume     bool
+	rpcUrl     string
+	legacyKeys bool
 
 	// clone config
 	name                   string
@@ -57,6 +58,7 @@ func init() {
 	runflags.StringVar(&fpath, "file", "mvcompose.yaml", "configuration `file` or path")
 	runflags.BoolVar(&resume, "resume", false, "continue pipeline execution")
 	runflags.StringVar(&rpcUrl, "rpc", "https://mainnet.rpc.mavryk.network", "Mavryk node RPC url")
+	runflags.BoolVar(&legacyKeys, "legacy-keys", false, "derive child accounts like mvcompose releases before SLIP-10")
 
 	cloneflags.Usage = func() {}
 	cloneflags.StringVar(&indexUrl, "index", "https://api.mavryk.network", "Mavryk indexer url")
@@ -92,7 +94,8 @@ func run() error {
 		WithUrl(rpcUrl).
 		WithApiKey(os.Getenv("MVCOMPOSE_API_KEY")).
 		WithBase(os.Getenv("MVCOMPOSE_BASE_KEY")).
-		WithResume(resume)
+		WithResume(resume).
+		WithLegacyKeys(legacyKeys)
 
 	var err error
 	switch cmd {
@@ -72,15 +72,30 @@ func (h *BlockHeader) Sign(key mavryk.PrivateKey) error {
 	if h.Signature.IsValid() {
 		return nil
 	}
-	sig, err := key.Sign(h.Digest())
-	sig.Type = mavryk.SignatureTypeGeneric
+	sig, err := key.SignMessage(h.WatermarkedBytes())
 	if err != nil {
 		return err
 	}
+	// BLS signatures keep their type
+	if sig.Type != mavryk.SignatureTypeBls12_381 {
+		sig.Type = mavryk.SignatureTypeGeneric
+	}
 	h.Signature = sig
 	return nil
 }
 
+// Round returns the Tenderbake round at which the block was proposed. The
+// round is the last element of the block fitness. Round falls back to zero
+// when the fitness is not in Tenderbake format (five elements with a 4 byte
+// round), so callers which need the round for safety checks must validate
+// the fitness themselves.
+func (h BlockHeader) Round() int {
+	if len(h.Fitness) != 5 || len(h.Fitness[4]) != 4 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(h.Fitness[4]))
+}
+
 // WithChainId sets chain_id for this block to id. Use this only for remote signing
 // of blocks as it creates an invalid binary encoding otherwise.
 func (h *BlockHeader) WithChainId(id mavryk.ChainIdHash) *BlockHeader {
@@ -90,11 +105,13 @@ func (h *BlockHeader) WithChainId(id mavryk.ChainIdHash) *BlockHeader {
 }
 
 // WithSignature adds an externally created signature to the block header. Converts
-// any non-generic signature first. No signature validation is performed, it is
+// any non-generic signature except BLS first. No signature validation is performed, it is
 // assumed the signature is correct.
 func (h *BlockHeader) WithSignature(sig mavryk.Signature) *BlockHeader {
 	sig = sig.Clone()
-	sig.Type = mavryk.SignatureTypeGeneric
+	if sig.Type != mavryk.SignatureTypeBls12_381 {
+		sig.Type = mavryk.SignatureTypeGeneric
+	}
 	h.Signature = sig
 	return h
 }
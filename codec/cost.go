@@ -0,0 +1,257 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package codec
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/micheline"
+)
+
+// Gas costs of manager operations in milligas. Contract calls and
+// originations add the cost of executing, parsing and storing Michelson
+// as estimated by the micheline package.
+const (
+	GasManagerOperation  int64 = 100_000 // base cost of every manager operation
+	GasTransferContract  int64 = 1_000   // loading a contract for a call
+	GasOriginateContract int64 = 5_000   // creating a new contract
+	GasInternalOperation int64 = 1_000   // applying an internal operation
+)
+
+// maxInternalDepth limits nested contract calls during estimation.
+const maxInternalDepth = 32
+
+// Estimator computes gas, storage and burn costs of operations without a
+// node. Transfers, delegations and reveals only need protocol params. Contract
+// calls are executed by the local Michelson interpreter and require a
+// contract store which provides the callee's script, storage and balance.
+// With a contract store, transfers to empty implicit accounts are charged
+// for allocation. Operations in a batch are estimated independently against
+// the state provided by the store.
+//
+// Results are estimates. Use a gas margin when converting them to limits,
+// for example with Op.WithLimits.
+type Estimator struct {
+	Params    *mavryk.Params
+	Contracts micheline.ContractStore // optional, scripts and balances
+	Bigmaps   micheline.BigmapStore   // optional, on-chain big_map values
+	Now       time.Time               // block time seen by contracts
+	Level     int64                   // block level seen by contracts
+	ChainId   mavryk.ChainIdHash      // chain id seen by contracts
+}
+
+// NewEstimator returns an estimator for protocol params p. It defaults to
+// mavryk.DefaultParams when p is nil.
+func NewEstimator(p *mavryk.Params) *Estimator {
+	if p == nil {
+		p = mavryk.DefaultParams
+	}
+	return &Estimator{
+		Params: p,
+	}
+}
+
+// WithStore sets the contract and big_map store used for contract calls.
+func (e *Estimator) WithStore(contracts micheline.ContractStore, bigmaps micheline.BigmapStore) *Estimator {
+	e.Contracts = contracts
+	e.Bigmaps = bigmaps
+	return e
+}
+
+// Costs returns the estimated costs of each operation in o. Fees are
+// minimum fees for the estimated gas. Costs of internal operations are
+// included in the costs of the operation which emitted them.
+func (e *Estimator) Costs(ctx context.Context, o *Op) ([]mavryk.Costs, error) {
+	p := e.params(o)
+	costs := make([]mavryk.Costs, len(o.Contents))
+	for i, v := range o.Contents {
+		gas, c, err := e.estimate(ctx, v, p)
+		if err != nil {
+			return nil, fmt.Errorf("codec: estimate %s[%d]: %w", v.Kind(), i, err)
+		}
+		if i == 0 {
+			gas += micheline.SignatureGas(o.sourceKeyType(), int64(len(o.WatermarkedBytes())))
+		}
+		c.GasUsed = (gas + 999) / 1000
+		c.Fee = CalculateMinFee(v, c.GasUsed, i == 0, p)
+		c.Burn = c.StorageBurn + c.AllocationBurn
+		costs[i] = c
+	}
+	return costs, nil
+}
+
+// Limits returns the minimum gas and storage limits of each operation in o
+// based on estimated costs. Fees are zero. The result is suitable for
+// Op.WithLimits which also sets minimum fees.
+func (e *Estimator) Limits(ctx context.Context, o *Op) ([]mavryk.Limits, error) {
+	costs, err := e.Costs(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+	p := e.params(o)
+	lims := make([]mavryk.Limits, len(costs))
+	for i, v := range costs {
+		lims[i].GasLimit = v.GasUsed
+		lims[i].StorageLimit = v.StorageUsed + v.AllocationBurn/p.CostPerByte
+	}
+	return lims, nil
+}
+
+func (e *Estimator) params(o *Op) *mavryk.Params {
+	if e.Params != nil {
+		return e.Params
+	}
+	if o.Params != nil {
+		return o.Params
+	}
+	return mavryk.DefaultParams
+}
+
+// estimate returns milligas and storage costs of a single operation.
+func (e *Estimator) estimate(ctx context.Context, op Operation, p *mavryk.Params) (int64, mavryk.Costs, error) {
+	var c mavryk.Costs
+	gas := GasManagerOperation
+	switch v := op.(type) {
+	case *Transaction:
+		var param micheline.Parameters
+		if v.Parameters != nil {
+			param = *v.Parameters
+		}
+		g, err := e.transfer(ctx, v.Source, v.Source, v.Destination, v.Amount.Int64(), param, p, &c, 0)
+		if err != nil {
+			return 0, c, err
+		}
+		gas += g
+	case *Origination:
+		g, err := e.originate(v.Script, p, &c)
+		if err != nil {
+			return 0, c, err
+		}
+		gas += g
+	case *RegisterGlobalConstant:
+		gas += micheline.DecodingGas(micheline.Size(v.Value)) + micheline.TypecheckGas(v.Value)
+		c.StorageUsed = micheline.Size(v.Value)
+		c.StorageBurn = c.StorageUsed * p.CostPerByte
+	case *IncreasePaidStorage:
+		c.StorageUsed = v.Amount.Int64()
+		c.StorageBurn = c.StorageUsed * p.CostPerByte
+	}
+	return gas, c, nil
+}
+
+// transfer returns the milligas for sending amount and param from sender to
+// dst and adds storage costs to c. Calls to contracts run the contract's
+// script and their internal operations.
+func (e *Estimator) transfer(ctx context.Context, source, sender, dst mavryk.Address, amount int64, param micheline.Parameters, p *mavryk.Params, c *mavryk.Costs, depth int) (int64, error) {
+	if !dst.IsContract() {
+		if e.Contracts != nil {
+			bal, err := e.Contracts.GetBalance(ctx, dst)
+			if err != nil {
+				return 0, err
+			}
+			if bal == 0 && amount > 0 {
+				c.AllocationBurn += p.OriginationSize * p.CostPerByte
+			}
+		}
+		return 0, nil
+	}
+	if depth > maxInternalDepth {
+		return 0, fmt.Errorf("too many nested contract calls")
+	}
+	if e.Contracts == nil {
+		return 0, fmt.Errorf("missing contract store for call to %s", dst)
+	}
+	script, err := e.Contracts.GetScript(ctx, dst)
+	if err != nil {
+		return 0, err
+	}
+	if script == nil {
+		return 0, fmt.Errorf("contract %s not found", dst)
+	}
+	bal, err := e.Contracts.GetBalance(ctx, dst)
+	if err != nil {
+		return 0, err
+	}
+	value := param.Value
+	if !value.IsValid() {
+		value = micheline.NewCode(micheline.D_UNIT)
+	}
+	res, err := script.Code.Run(ctx, value, script.Storage, &micheline.RunEnv{
+		Self:       dst,
+		Source:     source,
+		Sender:     sender,
+		Amount:     amount,
+		Balance:    bal + amount,
+		Now:        e.Now,
+		Level:      e.Level,
+		ChainId:    e.ChainId,
+		Entrypoint: param.Entrypoint,
+		GasLimit:   p.HardGasLimitPerOperation,
+		Bigmaps:    e.Bigmaps,
+		Contracts:  e.Contracts,
+	})
+	if err != nil {
+		return 0, err
+	}
+	gas := GasTransferContract + res.ConsumedMilligas
+	c.StorageUsed += res.PaidStorageSizeDiff
+	c.StorageBurn += res.PaidStorageSizeDiff * p.CostPerByte
+	for _, op := range res.Operations {
+		gas += GasInternalOperation
+		switch op.Kind {
+		case mavryk.OpTypeTransaction:
+			var param micheline.Parameters
+			if op.Parameters != nil {
+				param = *op.Parameters
+			}
+			g, err := e.transfer(ctx, source, op.Source, *op.Destination, op.Amount, param, p, c, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			gas += g
+		case mavryk.OpTypeOrigination:
+			g, err := e.originate(*op.Script, p, c)
+			if err != nil {
+				return 0, err
+			}
+			gas += g
+		}
+	}
+	return gas, nil
+}
+
+// originate returns the milligas for originating script and adds storage
+// and allocation costs to c.
+func (e *Estimator) originate(script micheline.Script, p *mavryk.Params, c *mavryk.Costs) (int64, error) {
+	buf, err := script.Code.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	// storage is stored in optimized form
+	storage := micheline.Size(script.Storage)
+	if script.Code.Storage.IsValid() && len(script.Code.Storage.Args) > 0 {
+		storage = micheline.StorageSize(script.StorageType().Prim, script.Storage)
+	}
+	size := int64(len(buf)-4) + storage
+	gas := GasOriginateContract + micheline.DecodingGas(size) + micheline.WriteGas(size)
+	gas += micheline.CodeTypecheckGas(script.Code) + micheline.TypecheckGas(script.Storage)
+	c.StorageUsed += size
+	c.StorageBurn += size * p.CostPerByte
+	c.AllocationBurn += p.OriginationSize * p.CostPerByte
+	return gas, nil
+}
+
+// sourceKeyType returns the key type of the operation signer.
+func (o *Op) sourceKeyType() mavryk.KeyType {
+	src := o.Source
+	if len(o.Contents) > 0 {
+		if m, ok := o.Contents[0].(interface{ GetSource() mavryk.Address }); ok {
+			src = m.GetSource()
+		}
+	}
+	return src.KeyType()
+}
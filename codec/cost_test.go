@@ -0,0 +1,191 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package codec
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/micheline"
+)
+
+// testStore is an in-memory contract and big_map store.
+type testStore struct {
+	scripts  map[string]*micheline.Script
+	balances map[string]int64
+	bigmaps  map[int64]map[mavryk.ExprHash]micheline.Prim
+}
+
+func (s *testStore) GetScript(_ context.Context, addr mavryk.Address) (*micheline.Script, error) {
+	return s.scripts[addr.String()], nil
+}
+
+func (s *testStore) GetBalance(_ context.Context, addr mavryk.Address) (int64, error) {
+	return s.balances[addr.String()], nil
+}
+
+func (s *testStore) GetBigmapValue(_ context.Context, id int64, _ micheline.Prim, hash mavryk.ExprHash) (micheline.Prim, bool, error) {
+	v, ok := s.bigmaps[id][hash]
+	return v, ok, nil
+}
+
+var (
+	costSender   = mavryk.MustParseAddress("mv18Xi4qPNHQPyiiXGaj9kYdu6rqZGRLknGZ")
+	costReceiver = mavryk.MustParseAddress("mv1949pcbqwGsHfUCaVmNVRu21Cd4SnbpvpP")
+	costToken    = mavryk.MustParseAddress("KT1977zpPmwDqiDRqoGS47HRhQUaxcQigVYc")
+)
+
+func loadTokenScript(t *testing.T) *micheline.Script {
+	t.Helper()
+	buf, err := os.ReadFile("../examples/tzcompose/token/fa12_code.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var code micheline.Code
+	if err := json.Unmarshal(buf, &code); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := micheline.ParseMichelson(`Pair (Pair "` + costSender.String() + `" 5 6) False 7 100`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &micheline.Script{Code: code, Storage: storage}
+}
+
+func TestEstimateTransfer(t *testing.T) {
+	ctx := context.Background()
+	op := NewOp().WithSource(costSender).WithTransfer(costReceiver, 1000)
+	est := NewEstimator(nil)
+	costs, err := est.Costs(ctx, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// node receipts of mv1 transfers report 100000 consumed milligas, the
+	// ed25519 signature check adds 65.8 gas to the first operation
+	if got, want := costs[0].GasUsed, int64(166); got != want {
+		t.Errorf("gas mismatch: got %d want %d", got, want)
+	}
+	if costs[0].Burn != 0 || costs[0].StorageUsed != 0 {
+		t.Errorf("unexpected burn %d storage %d", costs[0].Burn, costs[0].StorageUsed)
+	}
+	if costs[0].Fee != 264 {
+		t.Errorf("unexpected fee %d", costs[0].Fee)
+	}
+
+	// transfer to an empty account allocates it
+	est.WithStore(&testStore{}, nil)
+	lims, err := est.Limits(ctx, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := lims[0].StorageLimit, mavryk.DefaultParams.OriginationSize; got != want {
+		t.Errorf("storage limit mismatch: got %d want %d", got, want)
+	}
+	op.WithLimits(lims, 100)
+	if l := op.Limits(); l.GasLimit != lims[0].GasLimit+100 || l.Fee == 0 {
+		t.Errorf("unexpected limits %+v", l)
+	}
+}
+
+func TestEstimateContractCall(t *testing.T) {
+	ctx := context.Background()
+	script := loadTokenScript(t)
+	key, err := micheline.NewKey(micheline.NewType(micheline.NewCode(micheline.T_ADDRESS)), micheline.NewString(costSender.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &testStore{
+		scripts: map[string]*micheline.Script{costToken.String(): script},
+		bigmaps: map[int64]map[mavryk.ExprHash]micheline.Prim{
+			5: {key.Hash(): micheline.NewPair(micheline.NewSeq(), micheline.NewInt64(100))},
+		},
+	}
+	args, err := micheline.ParseMichelson(`Pair "` + costSender.String() + `" "` + costReceiver.String() + `" 30`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := NewOp().
+		WithSource(costSender).
+		WithCall(costToken, micheline.Parameters{Entrypoint: "transfer", Value: args})
+
+	if _, err := NewEstimator(nil).Costs(ctx, op); err == nil {
+		t.Errorf("expected error without contract store")
+	}
+
+	costs, err := NewEstimator(nil).WithStore(store, store).Costs(ctx, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gas is pinned so that changes to interpreter gas constants show up
+	// here, update it only after checking against a node's simulation
+	c := costs[0]
+	if got, want := c.GasUsed, int64(1933); got != want {
+		t.Errorf("gas mismatch: got %d want %d", got, want)
+	}
+	// the receiver gets a new ledger entry, the sender entry is replaced by
+	// a value of the same size. Like paid_storage_size_diff in node receipts
+	// the new entry costs 65 bytes for its key hash plus its value
+	// Pair {} 30 (pair 2, empty seq 5, int 2 bytes).
+	if got, want := c.StorageUsed, int64(65+9); got != want {
+		t.Errorf("storage mismatch: got %d want %d", got, want)
+	}
+	if c.StorageBurn != 18_500 || c.Burn != 18_500 || c.AllocationBurn != 0 {
+		t.Errorf("unexpected burn %+v", c)
+	}
+	if c.Fee != 548 {
+		t.Errorf("unexpected fee %d", c.Fee)
+	}
+
+	// script execution alone, in milligas like consumed_milligas in receipts
+	res, err := script.Code.Run(ctx, args, script.Storage, &micheline.RunEnv{
+		Self:       costToken,
+		Source:     costSender,
+		Entrypoint: "transfer",
+		Bigmaps:    store,
+		Contracts:  store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.ConsumedMilligas, int64(1_766_059); got != want {
+		t.Errorf("script gas mismatch: got %d want %d", got, want)
+	}
+
+	// failing calls are reported
+	args, _ = micheline.ParseMichelson(`Pair "` + costSender.String() + `" "` + costReceiver.String() + `" 300`)
+	op.Contents[0].(*Transaction).Parameters.Value = args
+	if _, err := NewEstimator(nil).WithStore(store, store).Costs(ctx, op); err == nil {
+		t.Errorf("expected error on failing call")
+	}
+}
+
+func TestEstimateOrigination(t *testing.T) {
+	script := loadTokenScript(t)
+	op := NewOp().WithSource(costSender).WithOrigination(*script)
+	costs, err := NewEstimator(nil).Costs(context.Background(), op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// paid_storage_size_diff of an origination receipt is the size of code
+	// and storage. Storage is stored in optimized form, here 47 bytes for
+	// Pair (Pair "mv1.." 5 6) False 7 100: a sequence for the outer comb (5),
+	// nested pairs for the inner comb (4), a 22 byte address (27) and the
+	// remaining values (11).
+	buf, _ := script.Code.MarshalBinary()
+	size := int64(len(buf)-4) + 47
+	p := mavryk.DefaultParams
+	c := costs[0]
+	if c.StorageUsed != size {
+		t.Errorf("storage mismatch: got %d want %d", c.StorageUsed, size)
+	}
+	if c.AllocationBurn != p.OriginationSize*p.CostPerByte || c.Burn != (size+p.OriginationSize)*p.CostPerByte {
+		t.Errorf("unexpected burn %+v", c)
+	}
+	if c.GasUsed <= micheline.CodeTypecheckGas(script.Code)/1000 {
+		t.Errorf("unexpected gas %d", c.GasUsed)
+	}
+}
@@ -6,6 +6,7 @@ package codec
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"strconv"
 
 	"github.com/mavryk-network/gomavryk/mavryk"
@@ -44,6 +45,28 @@ func (o DalPublishCommitment) MarshalJSON() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// UnmarshalJSON decodes the operation with its nested slot header.
+func (o *DalPublishCommitment) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Manager
+		SlotHeader struct {
+			Level      int32           `json:"level"`
+			Index      byte            `json:"index"`
+			Commitment mavryk.HexBytes `json:"commitment"`
+			Proof      mavryk.HexBytes `json:"commitment_proof"`
+		} `json:"slot_header"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	o.Manager = v.Manager
+	o.Level = v.SlotHeader.Level
+	o.Index = v.SlotHeader.Index
+	o.Commitment = v.SlotHeader.Commitment
+	o.Proof = v.SlotHeader.Proof
+	return nil
+}
+
 func (o DalPublishCommitment) EncodeBuffer(buf *bytes.Buffer, p *mavryk.Params) error {
 	buf.WriteByte(o.Kind().TagVersion(p.OperationTagsVersion))
 	o.Manager.EncodeBuffer(buf, p)
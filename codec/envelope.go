@@ -0,0 +1,317 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+// EnvelopeVersion is the version of the envelope format produced by this package.
+const EnvelopeVersion = 1
+
+var (
+	// ErrEnvelopeMismatch is returned when the descriptive fields of an envelope
+	// do not match its forged operation bytes.
+	ErrEnvelopeMismatch = errors.New("codec: envelope does not match operation bytes")
+
+	// ErrEnvelopeUnsigned is returned when signed data is requested from an
+	// envelope without signature.
+	ErrEnvelopeUnsigned = errors.New("codec: envelope is not signed")
+)
+
+// Envelope is a portable container which carries an unsigned operation from an
+// online machine to an offline signer and the signed operation back for
+// broadcast. Envelopes use a JSON encoding.
+//
+// The forged operation in Bytes is authoritative. All other fields describe
+// the operation for humans and tools and are checked against Bytes when the
+// envelope is opened, so a modified summary cannot trick a signer into
+// signing something else.
+//
+// Summary holds one short line per operation. Signers that display operations
+// for review should render Bytes with contract.SummarizeOpBytes instead.
+type Envelope struct {
+	Version   int                 `json:"version"`
+	ChainId   mavryk.ChainIdHash  `json:"chain_id"`
+	Protocol  mavryk.ProtocolHash `json:"protocol"`
+	Branch    mavryk.BlockHash    `json:"branch"`
+	Source    mavryk.Address      `json:"source"`
+	Watermark mavryk.HexBytes     `json:"watermark"`
+	Counters  []int64             `json:"counters"`
+	Limits    EnvelopeLimits      `json:"limits"`
+	Summary   []string            `json:"summary"`
+	Contents  []Operation         `json:"contents"`
+	Bytes     mavryk.HexBytes     `json:"bytes"`
+	Signature mavryk.Signature    `json:"signature"`
+	Params    *mavryk.Params      `json:"-"` // optional, protocol to decode for
+}
+
+// EnvelopeLimits contains the total fee, gas limit and storage limit of all
+// operations in an envelope.
+type EnvelopeLimits struct {
+	Fee          int64 `json:"fee"`
+	GasLimit     int64 `json:"gas_limit"`
+	StorageLimit int64 `json:"storage_limit"`
+}
+
+// NewEnvelope creates an unsigned envelope for operation o. The operation
+// must have a branch, contents and a chain id. Existing signatures are
+// not copied.
+func NewEnvelope(o *Op) (*Envelope, error) {
+	if !o.Branch.IsValid() {
+		return nil, fmt.Errorf("codec: missing branch")
+	}
+	if len(o.Contents) == 0 {
+		return nil, fmt.Errorf("codec: empty operation contents")
+	}
+	if o.ChainId == nil || !o.ChainId.IsValid() {
+		return nil, fmt.Errorf("codec: missing chain id")
+	}
+	p := o.Params
+	if p == nil {
+		p = mavryk.DefaultParams
+	}
+	unsigned := &Op{
+		Branch:   o.Branch,
+		Contents: o.Contents,
+		ChainId:  o.ChainId,
+		Params:   p,
+	}
+	buf := unsigned.Bytes()
+	wm := unsigned.WatermarkedBytes()
+	e := &Envelope{
+		Version:   EnvelopeVersion,
+		ChainId:   *o.ChainId,
+		Protocol:  p.Protocol,
+		Branch:    o.Branch,
+		Watermark: wm[:len(wm)-len(buf)],
+		Counters:  make([]int64, 0),
+		Summary:   make([]string, 0, len(o.Contents)),
+		Contents:  o.Contents,
+		Bytes:     buf,
+		Signature: mavryk.InvalidSignature,
+		Params:    p,
+	}
+	for _, v := range o.Contents {
+		if src := operationSource(v); src.IsValid() && !e.Source.IsValid() {
+			e.Source = src
+		}
+		if c := v.GetCounter(); c >= 0 {
+			e.Counters = append(e.Counters, c)
+		}
+		l := v.Limits()
+		e.Limits.Fee += l.Fee
+		e.Limits.GasLimit += l.GasLimit
+		e.Limits.StorageLimit += l.StorageLimit
+		e.Summary = append(e.Summary, summarize(v))
+	}
+	return e, nil
+}
+
+// IsSigned returns true when the envelope contains a signature.
+func (e *Envelope) IsSigned() bool {
+	return e.Signature.IsValid()
+}
+
+// Op decodes the operation from the envelope's forged bytes and checks
+// that all descriptive fields match. The returned operation carries the
+// envelope's chain id and signature.
+func (e *Envelope) Op() (*Op, error) {
+	if e.Version != EnvelopeVersion {
+		return nil, fmt.Errorf("codec: unsupported envelope version %d", e.Version)
+	}
+	p := e.Params
+	if p == nil {
+		p = mavryk.DefaultParams
+	}
+	o, err := decodeOp(e.Bytes, p, false)
+	if err != nil {
+		return nil, err
+	}
+	id := e.ChainId
+	o.ChainId = &id
+	chk, err := NewEnvelope(o)
+	if err != nil {
+		return nil, err
+	}
+	chk.Protocol = e.Protocol
+	want, err := chk.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	have, err := e.unsigned().MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(have, want) {
+		return nil, ErrEnvelopeMismatch
+	}
+	o.Signature = e.Signature
+	return o, nil
+}
+
+// SignedBytes returns the signed binary operation ready for broadcast.
+func (e *Envelope) SignedBytes() ([]byte, error) {
+	if !e.IsSigned() {
+		return nil, ErrEnvelopeUnsigned
+	}
+	o, err := e.Op()
+	if err != nil {
+		return nil, err
+	}
+	return o.Bytes(), nil
+}
+
+// WithSignature adds a signature created by an offline signer.
+func (e *Envelope) WithSignature(sig mavryk.Signature) *Envelope {
+	e.Signature = sig
+	return e
+}
+
+func (e *Envelope) unsigned() *Envelope {
+	u := *e
+	u.Signature = mavryk.InvalidSignature
+	return &u
+}
+
+type envelopeJSON struct {
+	Version   int                 `json:"version"`
+	ChainId   mavryk.ChainIdHash  `json:"chain_id"`
+	Protocol  mavryk.ProtocolHash `json:"protocol"`
+	Branch    mavryk.BlockHash    `json:"branch"`
+	Source    mavryk.Address      `json:"source"`
+	Watermark mavryk.HexBytes     `json:"watermark"`
+	Counters  []int64             `json:"counters"`
+	Limits    EnvelopeLimits      `json:"limits"`
+	Summary   []string            `json:"summary"`
+	Contents  []json.RawMessage   `json:"contents"`
+	Bytes     mavryk.HexBytes     `json:"bytes"`
+	Signature string              `json:"signature,omitempty"`
+}
+
+// MarshalJSON encodes the envelope. The signature is omitted from unsigned
+// envelopes.
+func (e Envelope) MarshalJSON() ([]byte, error) {
+	v := envelopeJSON{
+		Version:   e.Version,
+		ChainId:   e.ChainId,
+		Protocol:  e.Protocol,
+		Branch:    e.Branch,
+		Source:    e.Source,
+		Watermark: e.Watermark,
+		Counters:  e.Counters,
+		Limits:    e.Limits,
+		Summary:   e.Summary,
+		Contents:  make([]json.RawMessage, len(e.Contents)),
+		Bytes:     e.Bytes,
+	}
+	for i, op := range e.Contents {
+		buf, err := op.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		v.Contents[i] = buf
+	}
+	if e.Signature.IsValid() {
+		v.Signature = e.Signature.String()
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes an envelope. Operation contents are decoded for the
+// protocol in Params which defaults to mavryk.DefaultParams. Use Op to check
+// the decoded envelope against its forged bytes.
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	var v envelopeJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	p := e.Params
+	if p == nil {
+		p = mavryk.DefaultParams
+	}
+	contents, err := decodeJSONContents(v.Contents, p)
+	if err != nil {
+		return err
+	}
+	sig := mavryk.InvalidSignature
+	if v.Signature != "" {
+		if err := sig.UnmarshalText([]byte(v.Signature)); err != nil {
+			return err
+		}
+	}
+	*e = Envelope{
+		Version:   v.Version,
+		ChainId:   v.ChainId,
+		Protocol:  v.Protocol,
+		Branch:    v.Branch,
+		Source:    v.Source,
+		Watermark: v.Watermark,
+		Counters:  v.Counters,
+		Limits:    v.Limits,
+		Summary:   v.Summary,
+		Contents:  contents,
+		Bytes:     v.Bytes,
+		Signature: sig,
+		Params:    e.Params,
+	}
+	return nil
+}
+
+// operationSource returns the source or sender of op if known.
+func operationSource(op Operation) mavryk.Address {
+	switch v := op.(type) {
+	case interface{ GetSource() mavryk.Address }:
+		return v.GetSource()
+	case *Ballot:
+		return v.Source
+	case *Proposals:
+		return v.Source
+	default:
+		return mavryk.InvalidAddress
+	}
+}
+
+// summarize returns a short single line description of op. It is meant as a
+// quick hint for signers only. Use contract.SummarizeOp for the full rendering
+// with decoded parameters and token transfers.
+func summarize(op Operation) string {
+	var b strings.Builder
+	switch v := op.(type) {
+	case *Transaction:
+		fmt.Fprintf(&b, "transfer %s %s from %s to %s", mavryk.FormatMumav(v.Amount.Int64()), mavryk.Symbol, v.Source, v.Destination)
+		if v.Parameters != nil && v.Parameters.Entrypoint != "" && v.Parameters.Entrypoint != "default" {
+			fmt.Fprintf(&b, " calling %s", v.Parameters.Entrypoint)
+		}
+	case *Origination:
+		fmt.Fprintf(&b, "originate contract from %s with balance %s %s", v.Source, mavryk.FormatMumav(v.Balance.Int64()), mavryk.Symbol)
+		if v.Delegate.IsValid() {
+			fmt.Fprintf(&b, " delegated to %s", v.Delegate)
+		}
+	case *Delegation:
+		if v.Delegate.IsValid() {
+			fmt.Fprintf(&b, "delegate %s to %s", v.Source, v.Delegate)
+		} else {
+			fmt.Fprintf(&b, "withdraw delegation of %s", v.Source)
+		}
+	case *Reveal:
+		fmt.Fprintf(&b, "reveal key %s of %s", v.PublicKey, v.Source)
+	default:
+		b.WriteString(op.Kind().String())
+		if src := operationSource(op); src.IsValid() {
+			fmt.Fprintf(&b, " from %s", src)
+		}
+	}
+	if op.GetCounter() >= 0 {
+		l := op.Limits()
+		fmt.Fprintf(&b, ", fee %s %s, gas limit %d, storage limit %d", mavryk.FormatMumav(l.Fee), mavryk.Symbol, l.GasLimit, l.StorageLimit)
+	}
+	return b.String()
+}
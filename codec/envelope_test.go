@@ -0,0 +1,135 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/micheline"
+)
+
+func TestEnvelope(t *testing.T) {
+	var (
+		branch  = mavryk.MustParseBlockHash("BKnYk1T5a49bb8me4WfQeugyFnMEH9h8cm6jqvL3BxRwE23EVBJ")
+		chainId = mavryk.MustParseChainIdHash("NetXdQprcVkpaWU")
+		key     = mavryk.MustParsePrivateKey("edsk4FTF78Qf1m2rykGpHqostAiq5gYW4YZEoGUSWBTJr2njsDHSnd")
+		dest    = mavryk.MustParseAddress("KT1EMQxfYVvhTJTqMiVs2ho2dqjbYfYKk6BY")
+	)
+	op := NewOp().
+		WithBranch(branch).
+		WithChainId(chainId).
+		WithSource(key.Address()).
+		WithTransfer(dest, 1500000).
+		WithCall(dest, micheline.Parameters{Entrypoint: "mint", Value: micheline.NewInt64(1)}).
+		WithLimits([]mavryk.Limits{
+			{Fee: 500, GasLimit: 2000, StorageLimit: 100},
+			{Fee: 700, GasLimit: 3000, StorageLimit: 0},
+		}, 0)
+	op.Contents[0].WithCounter(7)
+	op.Contents[1].WithCounter(8)
+
+	if _, err := NewEnvelope(NewOp().WithBranch(branch).WithTransfer(dest, 1)); err == nil {
+		t.Errorf("missing chain id: expected error")
+	}
+
+	env, err := NewEnvelope(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !env.Source.Equal(key.Address()) {
+		t.Errorf("mismatched source got=%s", env.Source)
+	}
+	if got, want := env.Watermark.String(), "03"; got != want {
+		t.Errorf("mismatched watermark got=%s want=%s", got, want)
+	}
+	if len(env.Counters) != 2 || env.Counters[0] != 7 || env.Counters[1] != 8 {
+		t.Errorf("mismatched counters got=%v", env.Counters)
+	}
+	if want := (EnvelopeLimits{Fee: 1200, GasLimit: 5000, StorageLimit: 100}); env.Limits != want {
+		t.Errorf("mismatched limits got=%+v want=%+v", env.Limits, want)
+	}
+	if got, want := env.Summary[0], "transfer 1.500000 MVRK from "+key.Address().String()+" to "+dest.String()+", fee 0.000500 MVRK, gas limit 2000, storage limit 100"; got != want {
+		t.Errorf("mismatched summary\n    have: %s\n    want: %s", got, want)
+	}
+	if !strings.Contains(env.Summary[1], "calling mint") {
+		t.Errorf("missing entrypoint in summary: %s", env.Summary[1])
+	}
+	if !bytes.Equal(env.Bytes, op.Bytes()) {
+		t.Errorf("mismatched bytes")
+	}
+
+	// carry to offline machine
+	buf, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf, []byte(`"signature"`)) {
+		t.Errorf("unsigned envelope contains signature: %s", buf)
+	}
+	var offline Envelope
+	if err := json.Unmarshal(buf, &offline); err != nil {
+		t.Fatal(err)
+	}
+	if p := offline.Contents[1].(*Transaction).Parameters; p == nil || p.Entrypoint != "mint" || p.Value.Int.Int64() != 1 {
+		t.Errorf("mismatched call parameters after decode: %+v", p)
+	}
+	if _, err := offline.SignedBytes(); !errors.Is(err, ErrEnvelopeUnsigned) {
+		t.Errorf("unsigned: unexpected error %v", err)
+	}
+	o, err := offline.Op()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	offline.WithSignature(o.Signature)
+
+	// carry back and broadcast
+	buf, err = json.Marshal(offline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var online Envelope
+	if err := json.Unmarshal(buf, &online); err != nil {
+		t.Fatal(err)
+	}
+	if !online.IsSigned() {
+		t.Fatal("signature lost")
+	}
+	signed, err := online.SignedBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := op.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(signed, op.Bytes()) {
+		t.Errorf("mismatched signed bytes:\n    have: %x\n    want: %x", signed, op.Bytes())
+	}
+
+	// descriptive fields must match bytes
+	tampered := []func(e *Envelope){
+		func(e *Envelope) { e.Summary[0] = "transfer 1 MVRK" },
+		func(e *Envelope) { e.Contents[0].(*Transaction).Amount = mavryk.NewN(1) },
+		func(e *Envelope) { e.Limits.Fee = 1 },
+		func(e *Envelope) { e.Counters[1] = 9 },
+		func(e *Envelope) { e.Watermark = mavryk.HexBytes{0x11} },
+	}
+	for i, fn := range tampered {
+		var e Envelope
+		if err := json.Unmarshal(buf, &e); err != nil {
+			t.Fatal(err)
+		}
+		fn(&e)
+		if _, err := e.Op(); !errors.Is(err, ErrEnvelopeMismatch) {
+			t.Errorf("tampered %d: unexpected error %v", i, err)
+		}
+	}
+}
@@ -96,6 +96,10 @@ func (o *Manager) WithCounter(c int64) {
 	o.Counter.SetInt64(c)
 }
 
+func (o Manager) GetSource() mavryk.Address {
+	return o.Source
+}
+
 func (o Manager) GetCounter() int64 {
 	return o.Counter.Int64()
 }
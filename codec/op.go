@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"encoding"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"strconv"
@@ -488,7 +489,7 @@ func (o *Op) Sign(key mavryk.PrivateKey) error {
 	if len(o.Contents) == 0 {
 		return fmt.Errorf("mavryk: empty operation contents")
 	}
-	sig, err := key.Sign(o.Digest())
+	sig, err := key.SignMessage(o.WatermarkedBytes())
 	if err != nil {
 		return err
 	}
@@ -504,6 +505,33 @@ func (o *Op) Hash() (h mavryk.OpHash) {
 	return
 }
 
+// ContractAddresses returns the predicted addresses of contracts created by
+// origination operations in contents order. Addresses depend on the operation
+// hash, so the operation must be signed. Predictions assume no contract call
+// earlier in the batch creates internal originations, because these consume
+// origination nonces as well. Returns nil for unsigned operations.
+func (o *Op) ContractAddresses() []mavryk.Address {
+	if !o.Signature.IsValid() {
+		return nil
+	}
+	var (
+		addrs []mavryk.Address
+		hash  mavryk.OpHash
+		index uint32
+	)
+	for _, v := range o.Contents {
+		if v.Kind() != mavryk.OpTypeOrigination {
+			continue
+		}
+		if index == 0 {
+			hash = o.Hash()
+		}
+		addrs = append(addrs, mavryk.ContractAddressFromOrigination(hash, index))
+		index++
+	}
+	return addrs
+}
+
 // MarshalJSON conditionally marshals the JSON format of the operation with checks
 // for required fields. Omits signature for unsigned ops so that the encoding is
 // compatible with remote forging.
@@ -537,9 +565,74 @@ func (o *Op) MarshalJSON() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// UnmarshalJSON decodes an operation from its JSON representation as used by
+// node RPCs. Hash, protocol and chain_id fields as well as operation
+// receipts (metadata) are ignored. Operations are decoded for the protocol
+// defined in Params which defaults to mavryk.DefaultParams.
+func (o *Op) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Branch    mavryk.BlockHash  `json:"branch"`
+		Contents  []json.RawMessage `json:"contents"`
+		Signature string            `json:"signature"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if o.Params == nil {
+		o.Params = mavryk.DefaultParams
+	}
+	contents, err := decodeJSONContents(v.Contents, o.Params)
+	if err != nil {
+		return err
+	}
+	o.Branch = v.Branch
+	o.Contents = contents
+	o.Signature = mavryk.InvalidSignature
+	if v.Signature != "" {
+		if err := o.Signature.UnmarshalText([]byte(v.Signature)); err != nil {
+			return err
+		}
+		if o.Signature.Type == mavryk.SignatureTypeGenericAggregate {
+			o.Signature.Type = mavryk.SignatureTypeBls12_381
+		}
+	}
+	return nil
+}
+
+// decodeJSONContents decodes a list of JSON operations based on their kind.
+func decodeJSONContents(list []json.RawMessage, p *mavryk.Params) ([]Operation, error) {
+	contents := make([]Operation, 0, len(list))
+	for _, buf := range list {
+		var kind struct {
+			Kind string `json:"kind"`
+		}
+		if err := json.Unmarshal(buf, &kind); err != nil {
+			return nil, err
+		}
+		op := newOperation(mavryk.ParseOpType(kind.Kind), p)
+		if op == nil {
+			return nil, fmt.Errorf("mavryk: unsupported operation kind %q", kind.Kind)
+		}
+		if err := json.Unmarshal(buf, op); err != nil {
+			return nil, fmt.Errorf("mavryk: decoding %s: %w", kind.Kind, err)
+		}
+		contents = append(contents, op)
+	}
+	return contents, nil
+}
+
 // DecodeOp decodes an operation from its binary representation. The encoded
-// data may or may not contain a signature.
+// data may or may not contain a signature. Signatures are either 64 bytes or
+// 96 bytes (BLS) long. The signature length is derived from the source of
+// manager operations when possible, otherwise trailing data is treated as
+// signature when it cannot be decoded as operation.
 func DecodeOp(data []byte) (*Op, error) {
+	return decodeOp(data, mavryk.DefaultParams, true)
+}
+
+// decodeOp decodes a binary operation for protocol params p. Trailing data
+// is only considered a signature when the operation may be signed.
+func decodeOp(data []byte, p *mavryk.Params, maybeSigned bool) (*Op, error) {
 	// check for shortest message
 	if len(data) < 32+5 {
 		return nil, io.ErrShortBuffer
@@ -549,108 +642,164 @@ func DecodeOp(data []byte) (*Op, error) {
 	buf := bytes.NewBuffer(data)
 	o := &Op{
 		Contents: make([]Operation, 0),
-		Params:   mavryk.DefaultParams,
+		Params:   p,
 	}
 	if err := o.Branch.UnmarshalBinary(buf.Next(32)); err != nil {
 		return nil, err
 	}
 	for buf.Len() > 0 {
-		var op Operation
-		tag, _ := buf.ReadByte()
-		buf.UnreadByte()
-		switch mavryk.ParseOpTag(tag) {
-		case mavryk.OpTypeEndorsement:
-			if o.Params.OperationTagsVersion < 2 {
-				op = new(Endorsement)
-			} else {
-				op = new(TenderbakeEndorsement)
-			}
-		case mavryk.OpTypePreattestation:
-			op = new(TenderbakePreendorsement)
-		case mavryk.OpTypeEndorsementWithSlot:
-			op = new(EndorsementWithSlot)
-		case mavryk.OpTypeSeedNonceRevelation:
-			op = new(SeedNonceRevelation)
-		case mavryk.OpTypeDoubleAttestationEvidence:
-			if o.Params.OperationTagsVersion < 2 {
-				op = new(DoubleEndorsementEvidence)
-			} else {
-				op = new(TenderbakeDoubleEndorsementEvidence)
-			}
-		case mavryk.OpTypeDoublePreattestationEvidence:
-			op = new(TenderbakeDoublePreendorsementEvidence)
-		case mavryk.OpTypeDoubleBakingEvidence:
-			op = new(DoubleBakingEvidence)
-		case mavryk.OpTypeActivateAccount:
-			op = new(ActivateAccount)
-		case mavryk.OpTypeProposals:
-			op = new(Proposals)
-		case mavryk.OpTypeBallot:
-			op = new(Ballot)
-		case mavryk.OpTypeReveal:
-			op = new(Reveal)
-		case mavryk.OpTypeTransaction:
-			op = new(Transaction)
-		case mavryk.OpTypeOrigination:
-			op = new(Origination)
-		case mavryk.OpTypeDelegation:
-			op = new(Delegation)
-		case mavryk.OpTypeFailingNoop:
-			op = new(FailingNoop)
-		case mavryk.OpTypeRegisterConstant:
-			op = new(RegisterGlobalConstant)
-		case mavryk.OpTypeSetDepositsLimit:
-			op = new(SetDepositsLimit)
-		case mavryk.OpTypeTransferTicket:
-			op = new(TransferTicket)
-		case mavryk.OpTypeVdfRevelation:
-			op = new(VdfRevelation)
-		case mavryk.OpTypeIncreasePaidStorage:
-			op = new(IncreasePaidStorage)
-		case mavryk.OpTypeDrainDelegate:
-			op = new(DrainDelegate)
-		case mavryk.OpTypeUpdateConsensusKey:
-			op = new(UpdateConsensusKey)
-		case mavryk.OpTypeSmartRollupOriginate:
-			op = new(SmartRollupOriginate)
-		case mavryk.OpTypeSmartRollupAddMessages:
-			op = new(SmartRollupAddMessages)
-		case mavryk.OpTypeSmartRollupCement:
-			op = new(SmartRollupCement)
-		case mavryk.OpTypeSmartRollupPublish:
-			op = new(SmartRollupPublish)
-		// TODO
-		// case mavryk.OpTypeSmartRollupRefute:
-		// 	op = new(SmartRollupRefute)
-		case mavryk.OpTypeSmartRollupTimeout:
-			op = new(SmartRollupTimeout)
-		case mavryk.OpTypeSmartRollupExecuteOutboxMessage:
-			op = new(SmartRollupExecuteOutboxMessage)
-		case mavryk.OpTypeSmartRollupRecoverBond:
-			op = new(SmartRollupRecoverBond)
-		case mavryk.OpTypeDalPublishCommitment:
-			op = new(DalPublishCommitment)
-
-		default:
-			// stop if rest looks like a signature
-			// FIXME: BLS sigs are 96 bytes, but accepting this here will
-			// collide with detecting valid operation types in a batch
-			if buf.Len() == 64 {
-				break
-			}
-			return nil, fmt.Errorf("mavryk: unsupported operation tag %d", tag)
+		// stop if rest looks like a signature
+		if maybeSigned && isSignatureTrailer(buf.Bytes(), o.signatureLen(), o.Params) {
+			break
 		}
-		if err := op.DecodeBuffer(buf, mavryk.DefaultParams); err != nil {
+		op, err := decodeOperation(buf, o.Params)
+		if err != nil {
 			return nil, err
 		}
 		o.Contents = append(o.Contents, op)
 	}
 
 	if buf.Len() > 0 {
-		// FIXME: BLS sigs are 96 byte
-		if err := o.Signature.UnmarshalBinary(buf.Next(64)); err != nil {
+		if err := o.Signature.UnmarshalBinary(buf.Next(buf.Len())); err != nil {
 			return nil, err
 		}
+		if o.Signature.Type == mavryk.SignatureTypeGenericAggregate {
+			o.Signature.Type = mavryk.SignatureTypeBls12_381
+		}
 	}
 	return o, nil
 }
+
+// signatureLen returns the expected signature length based on the source
+// of manager operations or zero when unknown.
+func (o *Op) signatureLen() int {
+	for _, v := range o.Contents {
+		m, ok := v.(interface{ GetSource() mavryk.Address })
+		if !ok {
+			continue
+		}
+		if m.GetSource().Type() == mavryk.AddressTypeBls12_381 {
+			return mavryk.SignatureTypeBls12_381.Len()
+		}
+		return mavryk.SignatureTypeGeneric.Len()
+	}
+	return 0
+}
+
+// isSignatureTrailer returns true when buf contains a signature only. When the
+// expected signature length is unknown (sigLen = 0) buf is considered a
+// signature if it has signature length and does not decode as a sequence of
+// operations.
+func isSignatureTrailer(buf []byte, sigLen int, p *mavryk.Params) bool {
+	switch l := len(buf); {
+	case sigLen > 0:
+		return l == sigLen
+	case l != mavryk.SignatureTypeGeneric.Len() && l != mavryk.SignatureTypeBls12_381.Len():
+		return false
+	}
+	b := bytes.NewBuffer(buf)
+	for b.Len() > 0 {
+		typ := mavryk.ParseOpTag(b.Bytes()[0])
+		if !typ.IsValid() || b.Len() < typ.MinSizeVersion(p.OperationTagsVersion) {
+			return true
+		}
+		if _, err := decodeOperation(b, p); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeOperation decodes a single operation from buf.
+func decodeOperation(buf *bytes.Buffer, p *mavryk.Params) (Operation, error) {
+	tag, _ := buf.ReadByte()
+	buf.UnreadByte()
+	op := newOperation(mavryk.ParseOpTag(tag), p)
+	if op == nil {
+		return nil, fmt.Errorf("mavryk: unsupported operation tag %d", tag)
+	}
+	if err := op.DecodeBuffer(buf, p); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// newOperation returns an empty operation of type typ for protocol params p
+// or nil when the type is not supported. Consensus operations are accepted
+// under their endorsement and attestation names.
+func newOperation(typ mavryk.OpType, p *mavryk.Params) Operation {
+	var op Operation
+	switch typ {
+	case mavryk.OpTypeEndorsement, mavryk.OpTypeAttestation:
+		if p.OperationTagsVersion < 2 {
+			op = new(Endorsement)
+		} else {
+			op = new(TenderbakeEndorsement)
+		}
+	case mavryk.OpTypePreendorsement, mavryk.OpTypePreattestation:
+		op = new(TenderbakePreendorsement)
+	case mavryk.OpTypeEndorsementWithSlot:
+		op = new(EndorsementWithSlot)
+	case mavryk.OpTypeSeedNonceRevelation:
+		op = new(SeedNonceRevelation)
+	case mavryk.OpTypeDoubleEndorsementEvidence, mavryk.OpTypeDoubleAttestationEvidence:
+		if p.OperationTagsVersion < 2 {
+			op = new(DoubleEndorsementEvidence)
+		} else {
+			op = new(TenderbakeDoubleEndorsementEvidence)
+		}
+	case mavryk.OpTypeDoublePreendorsementEvidence, mavryk.OpTypeDoublePreattestationEvidence:
+		op = new(TenderbakeDoublePreendorsementEvidence)
+	case mavryk.OpTypeDoubleBakingEvidence:
+		op = new(DoubleBakingEvidence)
+	case mavryk.OpTypeActivateAccount:
+		op = new(ActivateAccount)
+	case mavryk.OpTypeProposals:
+		op = new(Proposals)
+	case mavryk.OpTypeBallot:
+		op = new(Ballot)
+	case mavryk.OpTypeReveal:
+		op = new(Reveal)
+	case mavryk.OpTypeTransaction:
+		op = new(Transaction)
+	case mavryk.OpTypeOrigination:
+		op = new(Origination)
+	case mavryk.OpTypeDelegation:
+		op = new(Delegation)
+	case mavryk.OpTypeFailingNoop:
+		op = new(FailingNoop)
+	case mavryk.OpTypeRegisterConstant:
+		op = new(RegisterGlobalConstant)
+	case mavryk.OpTypeSetDepositsLimit:
+		op = new(SetDepositsLimit)
+	case mavryk.OpTypeTransferTicket:
+		op = new(TransferTicket)
+	case mavryk.OpTypeVdfRevelation:
+		op = new(VdfRevelation)
+	case mavryk.OpTypeIncreasePaidStorage:
+		op = new(IncreasePaidStorage)
+	case mavryk.OpTypeDrainDelegate:
+		op = new(DrainDelegate)
+	case mavryk.OpTypeUpdateConsensusKey:
+		op = new(UpdateConsensusKey)
+	case mavryk.OpTypeSmartRollupOriginate:
+		op = new(SmartRollupOriginate)
+	case mavryk.OpTypeSmartRollupAddMessages:
+		op = new(SmartRollupAddMessages)
+	case mavryk.OpTypeSmartRollupCement:
+		op = new(SmartRollupCement)
+	case mavryk.OpTypeSmartRollupPublish:
+		op = new(SmartRollupPublish)
+	case mavryk.OpTypeSmartRollupRefute:
+		op = new(SmartRollupRefute)
+	case mavryk.OpTypeSmartRollupTimeout:
+		op = new(SmartRollupTimeout)
+	case mavryk.OpTypeSmartRollupExecuteOutboxMessage:
+		op = new(SmartRollupExecuteOutboxMessage)
+	case mavryk.OpTypeSmartRollupRecoverBond:
+		op = new(SmartRollupRecoverBond)
+	case mavryk.OpTypeDalPublishCommitment:
+		op = new(DalPublishCommitment)
+	}
+	return op
+}
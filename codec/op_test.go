@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -525,6 +526,16 @@ func TestOp(t *testing.T) {
 			}
 		}
 
+		// json decode
+		o2 := new(Op)
+		if err := json.Unmarshal(j2, o2); err != nil {
+			t.Errorf("%q: JSON unmarshal failed: %v", c.name, err)
+		} else if buf := o2.Bytes(); !bytes.Equal(buf, c.data.Bytes()) {
+			t.Errorf("%q: JSON decode mismatch:\n    have: %s\n    want: %s\n", c.name,
+				mavryk.HexBytes(buf), c.data,
+			)
+		}
+
 		// binary encode
 		// we're using DefaultParams here, to change use op.WithParams()
 		buf := c.op.Bytes()
@@ -535,3 +546,350 @@ func TestOp(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeOpRoundTrip(t *testing.T) {
+	var (
+		branch = mavryk.MustParseBlockHash("BKnYk1T5a49bb8me4WfQeugyFnMEH9h8cm6jqvL3BxRwE23EVBJ")
+		rollup = mavryk.MustParseAddress("sr1Ghq66tYK9y3r8CC1Tf8i8m5nxh8nTvZEf")
+		edKey  = mavryk.MustParsePrivateKey("edsk4FTF78Qf1m2rykGpHqostAiq5gYW4YZEoGUSWBTJr2njsDHSnd")
+		blsKey = mavryk.MustParsePrivateKey("BLsk1eGhiPQXKtvvkBeXzmtVVJs6KPhEF45drF7MLjoCDcSnTGuyjL")
+		state  = mavryk.NewSmartRollupStateHash(bytes.Repeat([]byte{1}, 32))
+	)
+
+	manager := func(src mavryk.Address) Manager {
+		return Manager{
+			Source:       src,
+			Fee:          1000,
+			Counter:      12345,
+			GasLimit:     10000,
+			StorageLimit: 0,
+		}
+	}
+
+	refute := func(src mavryk.Address, r SmartRollupRefutation) Operation {
+		return &SmartRollupRefute{
+			Manager:    manager(src),
+			Rollup:     rollup,
+			Opponent:   mavryk.MustParseAddress("mv1GSSYcW7vUGkoXRpbj8nrXYjWyar1pyDpt"),
+			Refutation: r,
+		}
+	}
+
+	type testcase struct {
+		name string
+		key  *mavryk.PrivateKey
+		ops  []Operation
+	}
+
+	var cases = []testcase{
+		{
+			name: "refute start",
+			key:  &edKey,
+			ops: []Operation{refute(edKey.Address(), SmartRollupRefutation{
+				Kind:         "start",
+				PlayerHash:   mavryk.NewSmartRollupCommitHash(bytes.Repeat([]byte{2}, 32)),
+				OpponentHash: mavryk.NewSmartRollupCommitHash(bytes.Repeat([]byte{3}, 32)),
+			})},
+		},
+		{
+			name: "refute dissection",
+			key:  &edKey,
+			ops: []Operation{refute(edKey.Address(), SmartRollupRefutation{
+				Kind:   "move",
+				Choice: 1000,
+				Step: SmartRollupRefuteStep{
+					Ticks: []SmartRollupTick{
+						{State: &state, Tick: 0},
+						{Tick: 500},
+						{State: &state, Tick: 1000},
+					},
+				},
+			})},
+		},
+		{
+			name: "refute inbox proof",
+			ops: []Operation{refute(edKey.Address(), SmartRollupRefutation{
+				Kind:   "move",
+				Choice: 42,
+				Step: SmartRollupRefuteStep{
+					Proof: &SmartRollupProof{
+						PvmStep: asHex("0300020c4a316fa1"),
+						InputProof: &SmartRollupInputProof{
+							Kind:    "inbox_proof",
+							Level:   12345,
+							Counter: 7,
+							Proof:   asHex("deadbeef"),
+						},
+					},
+				},
+			})},
+		},
+		{
+			name: "refute reveal proof",
+			key:  &blsKey,
+			ops: []Operation{refute(blsKey.Address(), SmartRollupRefutation{
+				Kind:   "move",
+				Choice: 42,
+				Step: SmartRollupRefuteStep{
+					Proof: &SmartRollupProof{
+						PvmStep: asHex("0300020c4a316fa1"),
+						InputProof: &SmartRollupInputProof{
+							Kind: "reveal_proof",
+							RevealProof: &SmartRollupRevealProof{
+								Kind:    "raw_data_proof",
+								RawData: asHex("cafe"),
+							},
+						},
+					},
+				},
+			})},
+		},
+		{
+			name: "refute dal page proof",
+			key:  &edKey,
+			ops: []Operation{refute(edKey.Address(), SmartRollupRefutation{
+				Kind:   "move",
+				Choice: 42,
+				Step: SmartRollupRefuteStep{
+					Proof: &SmartRollupProof{
+						PvmStep: asHex("0300020c4a316fa1"),
+						InputProof: &SmartRollupInputProof{
+							Kind: "reveal_proof",
+							RevealProof: &SmartRollupRevealProof{
+								Kind:      "dal_page_proof",
+								DalPageId: &DalPageId{PublishedLevel: 100, SlotIndex: 3, PageIndex: 12},
+								DalProof:  asHex("beef"),
+							},
+						},
+					},
+				},
+			})},
+		},
+		{
+			name: "bls transaction batch",
+			key:  &blsKey,
+			ops: []Operation{
+				&Transaction{
+					Manager:     manager(blsKey.Address()),
+					Amount:      1000000,
+					Destination: edKey.Address(),
+				},
+				&Transaction{
+					Manager:     manager(blsKey.Address()),
+					Amount:      2000000,
+					Destination: edKey.Address(),
+				},
+			},
+		},
+		{
+			name: "bls attestation",
+			key:  &blsKey,
+			ops: []Operation{
+				&TenderbakeEndorsement{
+					Slot:             1,
+					Level:            2,
+					Round:            0,
+					BlockPayloadHash: mavryk.MustParsePayloadHash("vh1uq2uMDFaJAZZcydX5QeW2dG3Mpc2y31tT621LuEppkxfy11SK"),
+				},
+			},
+		},
+		{
+			name: "ed25519 attestation",
+			key:  &edKey,
+			ops: []Operation{
+				&TenderbakeEndorsement{
+					Slot:             1,
+					Level:            2,
+					Round:            0,
+					BlockPayloadHash: mavryk.MustParsePayloadHash("vh1uq2uMDFaJAZZcydX5QeW2dG3Mpc2y31tT621LuEppkxfy11SK"),
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		op := NewOp().WithBranch(branch)
+		for _, v := range c.ops {
+			op.WithContents(v)
+		}
+		if c.key != nil {
+			if err := op.Sign(*c.key); err != nil {
+				t.Fatalf("%q: sign failed: %v", c.name, err)
+			}
+		}
+		buf := op.Bytes()
+
+		o, err := DecodeOp(buf)
+		if err != nil {
+			t.Fatalf("%q: decode failed: %v", c.name, err)
+		}
+		if got, want := len(o.Contents), len(c.ops); got != want {
+			t.Errorf("%q: mismatched contents got=%d want=%d", c.name, got, want)
+		}
+		// decoded signatures are generic unless BLS
+		if !bytes.Equal(o.Signature.Data, op.Signature.Data) {
+			t.Errorf("%q: mismatched signature got=%s want=%s", c.name, o.Signature, op.Signature)
+		}
+		op.Signature.Type = o.Signature.Type
+		if !bytes.Equal(o.Bytes(), buf) {
+			t.Errorf("%q: encode failed:\n    have: %x\n    want: %x\n", c.name, o.Bytes(), buf)
+		}
+		if o.Hash() != op.Hash() {
+			t.Errorf("%q: mismatched hash got=%s want=%s", c.name, o.Hash(), op.Hash())
+		}
+
+		// compare json encodings
+		j1, err := o.MarshalJSON()
+		if err != nil {
+			t.Errorf("%q: JSON marshal from decoded op failed: %v", c.name, err)
+		}
+		j2, err := op.MarshalJSON()
+		if err != nil {
+			t.Errorf("%q: JSON marshal failed: %v", c.name, err)
+		}
+		if !bytes.Equal(j1, j2) {
+			t.Errorf("%q: JSON mismatch:\n    1: %s\n    2: %s\n", c.name, string(j1), string(j2))
+		}
+
+		// json decode
+		o2 := new(Op)
+		if err := json.Unmarshal(j2, o2); err != nil {
+			t.Errorf("%q: JSON unmarshal failed: %v", c.name, err)
+		} else if o2.Hash() != op.Hash() {
+			t.Errorf("%q: mismatched JSON hash got=%s want=%s", c.name, o2.Hash(), op.Hash())
+		}
+
+		// verify signature
+		if c.key != nil {
+			msg := o.Digest()
+			if c.key.Type == mavryk.KeyTypeBls12_381 {
+				msg = o.WatermarkedBytes()
+			}
+			if err := c.key.Public().Verify(msg, o.Signature); err != nil {
+				t.Errorf("%q: verify failed: %v", c.name, err)
+			}
+		}
+	}
+}
+
+func TestContractAddresses(t *testing.T) {
+	key := mavryk.MustParsePrivateKey("edsk4FTF78Qf1m2rykGpHqostAiq5gYW4YZEoGUSWBTJr2njsDHSnd")
+	script := asScript(`{"code": [{"args": [{"prim": "string"}],"prim": "parameter"},{"args": [{"prim": "string"}],"prim": "storage"},{"args": [[{"prim": "CAR"},{"args": [{"prim": "operation"}],"prim": "NIL"},{"prim": "PAIR"}]],"prim": "code"}],"storage": {"string": "hello"}}`)
+	op := NewOp().
+		WithBranch(mavryk.MustParseBlockHash("BKnYk1T5a49bb8me4WfQeugyFnMEH9h8cm6jqvL3BxRwE23EVBJ")).
+		WithSource(key.Address()).
+		WithOrigination(script).
+		WithTransfer(key.Address(), 1).
+		WithOrigination(script)
+
+	if addrs := op.ContractAddresses(); addrs != nil {
+		t.Fatalf("expected no addresses for unsigned op, got %v", addrs)
+	}
+	if err := op.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	addrs := op.ContractAddresses()
+	if len(addrs) != 2 {
+		t.Fatalf("expected 2 addresses, got %d", len(addrs))
+	}
+	hash := op.Hash()
+	for i, a := range addrs {
+		if want := mavryk.ContractAddressFromOrigination(hash, uint32(i)); !a.Equal(want) {
+			t.Errorf("Case %d: mismatched address got=%s want=%s", i, a, want)
+		}
+	}
+}
+
+func TestUnmarshalNodeOp(t *testing.T) {
+	var (
+		branch = mavryk.MustParseBlockHash("BKnYk1T5a49bb8me4WfQeugyFnMEH9h8cm6jqvL3BxRwE23EVBJ")
+		key    = mavryk.MustParsePrivateKey("edsk4FTF78Qf1m2rykGpHqostAiq5gYW4YZEoGUSWBTJr2njsDHSnd")
+		dest   = mavryk.MustParseAddress("KT1EMQxfYVvhTJTqMiVs2ho2dqjbYfYKk6BY")
+	)
+
+	// node style attestation with metadata and a generic signature
+	att := NewOp().WithBranch(branch).WithContents(&TenderbakeEndorsement{
+		Slot:             1,
+		Level:            2,
+		Round:            0,
+		BlockPayloadHash: mavryk.MustParsePayloadHash("vh1uq2uMDFaJAZZcydX5QeW2dG3Mpc2y31tT621LuEppkxfy11SK"),
+	})
+	if err := att.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	sig := mavryk.Signature{Type: mavryk.SignatureTypeGeneric, Data: att.Signature.Data}
+	data := fmt.Sprintf(`{"protocol":"PtBoreasVEVcNvRvnZDMW8tJVPWsFRDJnq8DPngYkFjgoj5mvH3","chain_id":"NetXnHfVqm9iesp","hash":%q,"branch":%q,"contents":[{"kind":"attestation","slot":1,"level":2,"round":0,"block_payload_hash":"vh1uq2uMDFaJAZZcydX5QeW2dG3Mpc2y31tT621LuEppkxfy11SK","metadata":{"delegate":%q,"consensus_power":1}}],"signature":%q}`,
+		att.Hash(), branch, key.Address(), sig)
+
+	var o Op
+	if err := json.Unmarshal([]byte(data), &o); err != nil {
+		t.Fatalf("attestation: unmarshal failed: %v", err)
+	}
+	if o.Hash() != att.Hash() {
+		t.Errorf("attestation: mismatched hash got=%s want=%s", o.Hash(), att.Hash())
+	}
+	if got := o.Contents[0].Kind(); got != mavryk.OpTypeEndorsement {
+		t.Errorf("attestation: mismatched kind got=%s", got)
+	}
+
+	// manager operation batch with receipts
+	tx := NewOp().
+		WithBranch(branch).
+		WithSource(key.Address()).
+		WithTransfer(dest, 1000).
+		WithLimits([]mavryk.Limits{{Fee: 500, GasLimit: 2000, StorageLimit: 100}}, 0)
+	tx.Contents[0].WithCounter(42)
+	if err := tx.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	j, err := tx.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = strings.Replace(string(j), `,"amount"`, `,"metadata":{"balance_updates":[],"operation_result":{"status":"applied"}},"amount"`, 1)
+	o = Op{}
+	if err := json.Unmarshal([]byte(data), &o); err != nil {
+		t.Fatalf("transaction: unmarshal failed: %v", err)
+	}
+	if o.Hash() != tx.Hash() {
+		t.Errorf("transaction: mismatched hash got=%s want=%s", o.Hash(), tx.Hash())
+	}
+	if !bytes.Equal(o.Bytes(), tx.Bytes()) {
+		t.Errorf("transaction: mismatched bytes:\n    have: %x\n    want: %x\n", o.Bytes(), tx.Bytes())
+	}
+
+	// contract call with node style parameters
+	call := NewOp().
+		WithBranch(branch).
+		WithSource(key.Address()).
+		WithCall(dest, micheline.Parameters{
+			Entrypoint: "transfer",
+			Value: micheline.NewPair(
+				micheline.NewString(key.Address().String()),
+				micheline.NewPair(micheline.NewString(dest.String()), micheline.NewInt64(5)),
+			),
+		}).
+		WithLimits([]mavryk.Limits{{Fee: 700, GasLimit: 3000}}, 0)
+	call.Contents[0].WithCounter(43)
+	if err := call.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	data = fmt.Sprintf(`{"branch":%q,"contents":[{"kind":"transaction","source":%q,"fee":"700","counter":"43","gas_limit":"3000","storage_limit":"0","amount":"0","destination":%q,"parameters":{"entrypoint":"transfer","value":{"prim":"Pair","args":[{"string":%q},{"prim":"Pair","args":[{"string":%q},{"int":"5"}]}]}},"metadata":{"balance_updates":[],"operation_result":{"status":"applied","consumed_milligas":"2500000"}}}],"signature":%q}`,
+		branch, key.Address(), dest, key.Address(), dest, call.Signature)
+	o = Op{}
+	if err := json.Unmarshal([]byte(data), &o); err != nil {
+		t.Fatalf("call: unmarshal failed: %v", err)
+	}
+	if !bytes.Equal(o.Bytes(), call.Bytes()) {
+		t.Errorf("call: mismatched bytes:\n    have: %x\n    want: %x\n", o.Bytes(), call.Bytes())
+	}
+	if p := o.Contents[0].(*Transaction).Parameters; p == nil || p.Entrypoint != "transfer" {
+		t.Errorf("call: mismatched parameters %+v", p)
+	}
+
+	// unknown kinds are rejected
+	err = json.Unmarshal([]byte(`{"branch":"BKnYk1T5a49bb8me4WfQeugyFnMEH9h8cm6jqvL3BxRwE23EVBJ","contents":[{"kind":"unknown"}]}`), &o)
+	if err == nil {
+		t.Errorf("unknown kind: expected error")
+	}
+}
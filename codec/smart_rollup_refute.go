@@ -5,11 +5,13 @@ package codec
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
 
 	"github.com/mavryk-network/gomavryk/mavryk"
-	// "encoding/binary"
-	// "io"
-	// "strconv"
 )
 
 // Smart_rollup_refute (tag 204)
@@ -46,6 +48,25 @@ import (
 // +======+========+========================+
 // | Tag  | 1 byte | unsigned 8-bit integer |
 
+// dal page proof (tag 2)
+// ======================
+
+// | Name                  | Size     | Contents                |
+// +=======================+==========+=========================+
+// | Tag                   | 1 byte   | unsigned 8-bit integer  |
+// | published_level       | 4 bytes  | signed 32-bit integer   |
+// | slot_index            | 1 byte   | unsigned 8-bit integer  |
+// | page_index            | 2 bytes  | signed 16-bit integer   |
+// | # bytes in next field | 4 bytes  | unsigned 30-bit integer |
+// | dal_proof             | Variable | bytes                   |
+
+// dal parameters proof (tag 3)
+// ============================
+
+// | Name | Size   | Contents               |
+// +======+========+========================+
+// | Tag  | 1 byte | unsigned 8-bit integer |
+
 // X_21 (Determined from data, 8-bit tag)
 // **************************************
 
@@ -136,51 +157,96 @@ type SmartRollupRefute struct {
 	Refutation SmartRollupRefutation `json:"refutation"`
 }
 
+// SmartRollupRefutation is either a game start (player and opponent commitment
+// hashes) or a move (choice and step).
 type SmartRollupRefutation struct {
 	Kind         string                       `json:"refutation_kind"`
 	PlayerHash   mavryk.SmartRollupCommitHash `json:"player_commitment_hash"`
 	OpponentHash mavryk.SmartRollupCommitHash `json:"opponent_commitment_hash"`
-	Choice       mavryk.Z                     `json:"choice"`
+	Choice       mavryk.N                     `json:"choice"`
 	Step         SmartRollupRefuteStep        `json:"step"`
 }
 
+// SmartRollupRefuteStep is either a dissection (list of ticks) or a proof.
 type SmartRollupRefuteStep struct {
 	Ticks []SmartRollupTick
 	Proof *SmartRollupProof
 }
 
 type SmartRollupProof struct {
-	PvmStep    mavryk.HexBytes       `json:"pvm_step"`
-	InputProof SmartRollupInputProof `json:"input_proof"`
+	PvmStep    mavryk.HexBytes        `json:"pvm_step"`
+	InputProof *SmartRollupInputProof `json:"input_proof,omitempty"`
 }
 
 type SmartRollupTick struct {
-	State mavryk.SmartRollupStateHash `json:"state"`
-	Tick  mavryk.Z                    `json:"tick"`
+	State *mavryk.SmartRollupStateHash `json:"state,omitempty"`
+	Tick  mavryk.N                     `json:"tick"`
 }
 
 type SmartRollupInputProof struct {
-	Kind    string          `json:"input_proof_kind"`
-	Level   int64           `json:"level"`
-	Counter mavryk.Z        `json:"message_counter"`
-	Proof   mavryk.HexBytes `json:"serialized_proof"`
+	Kind        string                  `json:"input_proof_kind"`
+	Level       int32                   `json:"level,omitempty"`
+	Counter     mavryk.N                `json:"message_counter,omitempty"`
+	Proof       mavryk.HexBytes         `json:"serialized_proof,omitempty"`
+	RevealProof *SmartRollupRevealProof `json:"reveal_proof,omitempty"`
+}
+
+type SmartRollupRevealProof struct {
+	Kind      string          `json:"reveal_proof_kind"`
+	RawData   mavryk.HexBytes `json:"raw_data,omitempty"`
+	DalPageId *DalPageId      `json:"dal_page_id,omitempty"`
+	DalProof  mavryk.HexBytes `json:"dal_proof,omitempty"`
 }
 
+type DalPageId struct {
+	PublishedLevel int32 `json:"published_level"`
+	SlotIndex      byte  `json:"slot_index"`
+	PageIndex      int16 `json:"page_index"`
+}
+
+const (
+	refutationKindStart = "start"
+	refutationKindMove  = "move"
+
+	inputProofKindInbox  = "inbox_proof"
+	inputProofKindReveal = "reveal_proof"
+	inputProofKindFirst  = "first_input"
+
+	revealProofKindRawData       = "raw_data_proof"
+	revealProofKindMetadata      = "metadata_proof"
+	revealProofKindDalPage       = "dal_page_proof"
+	revealProofKindDalParameters = "dal_parameters_proof"
+)
+
 func (o SmartRollupRefute) Kind() mavryk.OpType {
 	return mavryk.OpTypeSmartRollupRefute
 }
 
 func (o SmartRollupRefute) MarshalJSON() ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
-	// TODO if needed
+	buf.WriteByte('{')
+	buf.WriteString(`"kind":`)
+	buf.WriteString(strconv.Quote(o.Kind().String()))
+	buf.WriteByte(',')
+	o.Manager.EncodeJSON(buf)
+	buf.WriteString(`,"rollup":`)
+	buf.WriteString(strconv.Quote(o.Rollup.String()))
+	buf.WriteString(`,"opponent":`)
+	buf.WriteString(strconv.Quote(o.Opponent.String()))
+	buf.WriteString(`,"refutation":`)
+	if err := o.Refutation.EncodeJSON(buf); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('}')
 	return buf.Bytes(), nil
 }
 
 func (o SmartRollupRefute) EncodeBuffer(buf *bytes.Buffer, p *mavryk.Params) error {
 	buf.WriteByte(o.Kind().TagVersion(p.OperationTagsVersion))
 	o.Manager.EncodeBuffer(buf, p)
-	// TODO if needed
-	return nil
+	buf.Write(o.Rollup.Hash()) // 20 byte only
+	buf.Write(o.Opponent.Encode())
+	return o.Refutation.EncodeBuffer(buf)
 }
 
 func (o *SmartRollupRefute) DecodeBuffer(buf *bytes.Buffer, p *mavryk.Params) (err error) {
@@ -190,8 +256,11 @@ func (o *SmartRollupRefute) DecodeBuffer(buf *bytes.Buffer, p *mavryk.Params) (e
 	if err = o.Manager.DecodeBuffer(buf, p); err != nil {
 		return
 	}
-	// TODO if needed
-	return
+	o.Rollup = mavryk.NewAddress(mavryk.AddressTypeSmartRollup, buf.Next(20))
+	if err = o.Opponent.Decode(buf.Next(21)); err != nil {
+		return
+	}
+	return o.Refutation.DecodeBuffer(buf)
 }
 
 func (o SmartRollupRefute) MarshalBinary() ([]byte, error) {
@@ -203,3 +272,355 @@ func (o SmartRollupRefute) MarshalBinary() ([]byte, error) {
 func (o *SmartRollupRefute) UnmarshalBinary(data []byte) error {
 	return o.DecodeBuffer(bytes.NewBuffer(data), mavryk.DefaultParams)
 }
+
+func (r SmartRollupRefutation) EncodeJSON(buf *bytes.Buffer) error {
+	buf.WriteString(`{"refutation_kind":`)
+	buf.WriteString(strconv.Quote(r.Kind))
+	switch r.Kind {
+	case refutationKindStart:
+		buf.WriteString(`,"player_commitment_hash":`)
+		buf.WriteString(strconv.Quote(r.PlayerHash.String()))
+		buf.WriteString(`,"opponent_commitment_hash":`)
+		buf.WriteString(strconv.Quote(r.OpponentHash.String()))
+	case refutationKindMove:
+		buf.WriteString(`,"choice":`)
+		buf.WriteString(strconv.Quote(r.Choice.String()))
+		buf.WriteString(`,"step":`)
+		if err := r.Step.EncodeJSON(buf); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid refutation kind %q", r.Kind)
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func (r SmartRollupRefutation) EncodeBuffer(buf *bytes.Buffer) error {
+	switch r.Kind {
+	case refutationKindStart:
+		buf.WriteByte(0)
+		buf.Write(r.PlayerHash[:])
+		buf.Write(r.OpponentHash[:])
+	case refutationKindMove:
+		buf.WriteByte(1)
+		r.Choice.EncodeBuffer(buf)
+		return r.Step.EncodeBuffer(buf)
+	default:
+		return fmt.Errorf("invalid refutation kind %q", r.Kind)
+	}
+	return nil
+}
+
+func (r *SmartRollupRefutation) DecodeBuffer(buf *bytes.Buffer) (err error) {
+	var tag byte
+	if tag, err = readByte(buf.Next(1)); err != nil {
+		return
+	}
+	switch tag {
+	case 0:
+		r.Kind = refutationKindStart
+		if b := buf.Next(32); len(b) != 32 {
+			return io.ErrShortBuffer
+		} else {
+			r.PlayerHash = mavryk.NewSmartRollupCommitHash(b)
+		}
+		if b := buf.Next(32); len(b) != 32 {
+			return io.ErrShortBuffer
+		} else {
+			r.OpponentHash = mavryk.NewSmartRollupCommitHash(b)
+		}
+	case 1:
+		r.Kind = refutationKindMove
+		if err = r.Choice.DecodeBuffer(buf); err != nil {
+			return
+		}
+		return r.Step.DecodeBuffer(buf)
+	default:
+		return fmt.Errorf("invalid refutation tag %d", tag)
+	}
+	return
+}
+
+func (s SmartRollupRefuteStep) EncodeJSON(buf *bytes.Buffer) error {
+	if s.Proof != nil {
+		buf.WriteString(`{"pvm_step":`)
+		buf.WriteString(strconv.Quote(s.Proof.PvmStep.String()))
+		if s.Proof.InputProof != nil {
+			buf.WriteString(`,"input_proof":`)
+			if err := s.Proof.InputProof.EncodeJSON(buf); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	}
+	buf.WriteByte('[')
+	for i, v := range s.Ticks {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('{')
+		if v.State != nil {
+			buf.WriteString(`"state":`)
+			buf.WriteString(strconv.Quote(v.State.String()))
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`"tick":`)
+		buf.WriteString(strconv.Quote(v.Tick.String()))
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+// UnmarshalJSON decodes a dissection (list of ticks) or a proof.
+func (s *SmartRollupRefuteStep) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		s.Proof = nil
+		return json.Unmarshal(data, &s.Ticks)
+	}
+	s.Ticks = nil
+	s.Proof = &SmartRollupProof{}
+	return json.Unmarshal(data, s.Proof)
+}
+
+func (s SmartRollupRefuteStep) EncodeBuffer(buf *bytes.Buffer) error {
+	if s.Proof != nil {
+		buf.WriteByte(1)
+		writeBytesWithLen(buf, s.Proof.PvmStep)
+		if s.Proof.InputProof == nil {
+			buf.WriteByte(0)
+			return nil
+		}
+		buf.WriteByte(255)
+		return s.Proof.InputProof.EncodeBuffer(buf)
+	}
+	buf.WriteByte(0)
+	ticks := bytes.NewBuffer(nil)
+	for _, v := range s.Ticks {
+		if v.State != nil {
+			ticks.WriteByte(255)
+			ticks.Write(v.State[:])
+		} else {
+			ticks.WriteByte(0)
+		}
+		v.Tick.EncodeBuffer(ticks)
+	}
+	return writeBytesWithLen(buf, ticks.Bytes())
+}
+
+func (s *SmartRollupRefuteStep) DecodeBuffer(buf *bytes.Buffer) (err error) {
+	var tag byte
+	if tag, err = readByte(buf.Next(1)); err != nil {
+		return
+	}
+	switch tag {
+	case 0:
+		var data mavryk.HexBytes
+		if data, err = readBytesWithLen(buf); err != nil {
+			return
+		}
+		ticks := bytes.NewBuffer(data)
+		s.Ticks = make([]SmartRollupTick, 0)
+		for ticks.Len() > 0 {
+			var (
+				tick SmartRollupTick
+				ok   bool
+			)
+			if ok, err = readBool(ticks.Next(1)); err != nil {
+				return
+			}
+			if ok {
+				b := ticks.Next(32)
+				if len(b) != 32 {
+					return io.ErrShortBuffer
+				}
+				h := mavryk.NewSmartRollupStateHash(b)
+				tick.State = &h
+			}
+			if err = tick.Tick.DecodeBuffer(ticks); err != nil {
+				return
+			}
+			s.Ticks = append(s.Ticks, tick)
+		}
+	case 1:
+		s.Proof = &SmartRollupProof{}
+		if s.Proof.PvmStep, err = readBytesWithLen(buf); err != nil {
+			return
+		}
+		var ok bool
+		if ok, err = readBool(buf.Next(1)); err != nil || !ok {
+			return
+		}
+		s.Proof.InputProof = &SmartRollupInputProof{}
+		return s.Proof.InputProof.DecodeBuffer(buf)
+	default:
+		return fmt.Errorf("invalid refutation step tag %d", tag)
+	}
+	return
+}
+
+func (p SmartRollupInputProof) EncodeJSON(buf *bytes.Buffer) error {
+	buf.WriteString(`{"input_proof_kind":`)
+	buf.WriteString(strconv.Quote(p.Kind))
+	switch p.Kind {
+	case inputProofKindInbox:
+		buf.WriteString(`,"level":`)
+		buf.WriteString(strconv.FormatInt(int64(p.Level), 10))
+		buf.WriteString(`,"message_counter":`)
+		buf.WriteString(strconv.Quote(p.Counter.String()))
+		buf.WriteString(`,"serialized_proof":`)
+		buf.WriteString(strconv.Quote(p.Proof.String()))
+	case inputProofKindReveal:
+		if p.RevealProof == nil {
+			return fmt.Errorf("missing reveal proof")
+		}
+		buf.WriteString(`,"reveal_proof":`)
+		if err := p.RevealProof.EncodeJSON(buf); err != nil {
+			return err
+		}
+	case inputProofKindFirst:
+	default:
+		return fmt.Errorf("invalid input proof kind %q", p.Kind)
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func (p SmartRollupInputProof) EncodeBuffer(buf *bytes.Buffer) error {
+	switch p.Kind {
+	case inputProofKindInbox:
+		buf.WriteByte(0)
+		binary.Write(buf, enc, p.Level)
+		p.Counter.EncodeBuffer(buf)
+		return writeBytesWithLen(buf, p.Proof)
+	case inputProofKindReveal:
+		if p.RevealProof == nil {
+			return fmt.Errorf("missing reveal proof")
+		}
+		buf.WriteByte(1)
+		return p.RevealProof.EncodeBuffer(buf)
+	case inputProofKindFirst:
+		buf.WriteByte(2)
+	default:
+		return fmt.Errorf("invalid input proof kind %q", p.Kind)
+	}
+	return nil
+}
+
+func (p *SmartRollupInputProof) DecodeBuffer(buf *bytes.Buffer) (err error) {
+	var tag byte
+	if tag, err = readByte(buf.Next(1)); err != nil {
+		return
+	}
+	switch tag {
+	case 0:
+		p.Kind = inputProofKindInbox
+		if p.Level, err = readInt32(buf.Next(4)); err != nil {
+			return
+		}
+		if err = p.Counter.DecodeBuffer(buf); err != nil {
+			return
+		}
+		p.Proof, err = readBytesWithLen(buf)
+	case 1:
+		p.Kind = inputProofKindReveal
+		p.RevealProof = &SmartRollupRevealProof{}
+		err = p.RevealProof.DecodeBuffer(buf)
+	case 2:
+		p.Kind = inputProofKindFirst
+	default:
+		err = fmt.Errorf("invalid input proof tag %d", tag)
+	}
+	return
+}
+
+func (p SmartRollupRevealProof) EncodeJSON(buf *bytes.Buffer) error {
+	buf.WriteString(`{"reveal_proof_kind":`)
+	buf.WriteString(strconv.Quote(p.Kind))
+	switch p.Kind {
+	case revealProofKindRawData:
+		buf.WriteString(`,"raw_data":`)
+		buf.WriteString(strconv.Quote(p.RawData.String()))
+	case revealProofKindDalPage:
+		if p.DalPageId == nil {
+			return fmt.Errorf("missing dal page id")
+		}
+		buf.WriteString(`,"dal_page_id":{"published_level":`)
+		buf.WriteString(strconv.FormatInt(int64(p.DalPageId.PublishedLevel), 10))
+		buf.WriteString(`,"slot_index":`)
+		buf.WriteString(strconv.Itoa(int(p.DalPageId.SlotIndex)))
+		buf.WriteString(`,"page_index":`)
+		buf.WriteString(strconv.Itoa(int(p.DalPageId.PageIndex)))
+		buf.WriteString(`},"dal_proof":`)
+		buf.WriteString(strconv.Quote(p.DalProof.String()))
+	case revealProofKindMetadata, revealProofKindDalParameters:
+	default:
+		return fmt.Errorf("invalid reveal proof kind %q", p.Kind)
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func (p SmartRollupRevealProof) EncodeBuffer(buf *bytes.Buffer) error {
+	switch p.Kind {
+	case revealProofKindRawData:
+		buf.WriteByte(0)
+		binary.Write(buf, enc, uint16(len(p.RawData)))
+		buf.Write(p.RawData)
+	case revealProofKindMetadata:
+		buf.WriteByte(1)
+	case revealProofKindDalPage:
+		if p.DalPageId == nil {
+			return fmt.Errorf("missing dal page id")
+		}
+		buf.WriteByte(2)
+		binary.Write(buf, enc, p.DalPageId.PublishedLevel)
+		buf.WriteByte(p.DalPageId.SlotIndex)
+		binary.Write(buf, enc, p.DalPageId.PageIndex)
+		return writeBytesWithLen(buf, p.DalProof)
+	case revealProofKindDalParameters:
+		buf.WriteByte(3)
+	default:
+		return fmt.Errorf("invalid reveal proof kind %q", p.Kind)
+	}
+	return nil
+}
+
+func (p *SmartRollupRevealProof) DecodeBuffer(buf *bytes.Buffer) (err error) {
+	var tag byte
+	if tag, err = readByte(buf.Next(1)); err != nil {
+		return
+	}
+	switch tag {
+	case 0:
+		p.Kind = revealProofKindRawData
+		var l int16
+		if l, err = readInt16(buf.Next(2)); err != nil {
+			return
+		}
+		err = p.RawData.ReadBytes(buf, int(uint16(l)))
+	case 1:
+		p.Kind = revealProofKindMetadata
+	case 2:
+		p.Kind = revealProofKindDalPage
+		p.DalPageId = &DalPageId{}
+		if p.DalPageId.PublishedLevel, err = readInt32(buf.Next(4)); err != nil {
+			return
+		}
+		if p.DalPageId.SlotIndex, err = readByte(buf.Next(1)); err != nil {
+			return
+		}
+		if p.DalPageId.PageIndex, err = readInt16(buf.Next(2)); err != nil {
+			return
+		}
+		p.DalProof, err = readBytesWithLen(buf)
+	case 3:
+		p.Kind = revealProofKindDalParameters
+	default:
+		err = fmt.Errorf("invalid reveal proof tag %d", tag)
+	}
+	return
+}
@@ -37,9 +37,9 @@ func (o TransferTicket) MarshalJSON() ([]byte, error) {
 	o.Contents.EncodeJSON(buf)
 	buf.WriteString(`,"ticket_ty":`)
 	o.Type.EncodeJSON(buf)
-	buf.WriteString(`,"ticketer":`)
+	buf.WriteString(`,"ticket_ticketer":`)
 	buf.WriteString(strconv.Quote(o.Ticketer.String()))
-	buf.WriteString(`,"amount":`)
+	buf.WriteString(`,"ticket_amount":`)
 	buf.WriteString(strconv.Quote(o.Amount.String()))
 	buf.WriteString(`,"destination":`)
 	buf.WriteString(strconv.Quote(o.Destination.String()))
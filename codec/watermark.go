@@ -0,0 +1,87 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+// DecodeWatermarkedOp decodes an unsigned operation in the watermarked format
+// produced by Op.WatermarkedBytes which remote signers receive. Consensus
+// operations carry a chain id which is stored in the returned operation.
+// Operations are decoded for protocol params p or mavryk.DefaultParams
+// when p is nil.
+func DecodeWatermarkedOp(data []byte, p *mavryk.Params) (*Op, error) {
+	if len(data) == 0 {
+		return nil, io.ErrShortBuffer
+	}
+	if p == nil {
+		p = mavryk.DefaultParams
+	}
+	var chainId *mavryk.ChainIdHash
+	switch data[0] {
+	case OperationWatermark:
+		data = data[1:]
+	case TenderbakePreendorsementWatermark, TenderbakeEndorsementWatermark:
+		if len(data) < 5 {
+			return nil, io.ErrShortBuffer
+		}
+		chainId = new(mavryk.ChainIdHash)
+		if err := chainId.UnmarshalBinary(data[1:5]); err != nil {
+			return nil, err
+		}
+		data = data[5:]
+	default:
+		return nil, fmt.Errorf("codec: unexpected operation watermark 0x%02x", data[0])
+	}
+	o, err := decodeOp(data, p, false)
+	if err != nil {
+		return nil, err
+	}
+	o.ChainId = chainId
+	return o, nil
+}
+
+// DecodeWatermarkedBlock decodes an unsigned block header in the watermarked
+// format produced by BlockHeader.WatermarkedBytes which remote signers receive.
+func DecodeWatermarkedBlock(data []byte) (*BlockHeader, error) {
+	if len(data) < 5 {
+		return nil, io.ErrShortBuffer
+	}
+	if data[0] != TenderbakeBlockWatermark {
+		return nil, fmt.Errorf("codec: unexpected block watermark 0x%02x", data[0])
+	}
+	h := new(BlockHeader)
+	var id mavryk.ChainIdHash
+	if err := id.UnmarshalBinary(data[1:5]); err != nil {
+		return nil, err
+	}
+	h.ChainId = &id
+	if err := h.DecodeBuffer(bytes.NewBuffer(data[5:])); err != nil {
+		return nil, err
+	}
+	if h.Signature.IsValid() {
+		return nil, fmt.Errorf("codec: unexpected signature in watermarked block header")
+	}
+	return h, nil
+}
+
+// WatermarkedMessage returns the watermarked bytes which sign the off-chain
+// message msg. Messages are wrapped into a failing noop operation with zero
+// branch hash which cannot be included on-chain. Operations with zero branch
+// have no Op encoding, so signers must use these bytes instead.
+func WatermarkedMessage(msg string, p *mavryk.Params) []byte {
+	if p == nil {
+		p = mavryk.DefaultParams
+	}
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(OperationWatermark)
+	buf.Write(mavryk.ZeroBlockHash.Bytes())
+	_ = FailingNoop{Arbitrary: msg}.EncodeBuffer(buf, p)
+	return buf.Bytes()
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package codec
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+func TestDecodeWatermarked(t *testing.T) {
+	var (
+		branch  = mavryk.MustParseBlockHash("BMdVJUZrmcLJBnXsxdJLJaTDFJYyqarwmst7hpPu53Z3xLPtnMF")
+		chainId = mavryk.MustParseChainIdHash("NetXdQprcVkpaWU")
+		dest    = mavryk.MustParseAddress("mv1949pcbqwGsHfUCaVmNVRu21Cd4SnbpvpP")
+	)
+
+	ops := []*Op{
+		NewOp().
+			WithBranch(branch).
+			WithSource(dest).
+			WithTransfer(dest, 1000000).
+			WithLimits([]mavryk.Limits{{Fee: 400, GasLimit: 1000}}, 0),
+		NewOp().
+			WithBranch(branch).
+			WithChainId(chainId).
+			WithContents(&TenderbakeEndorsement{
+				Slot:             18,
+				Level:            20877,
+				Round:            2,
+				BlockPayloadHash: mavryk.MustParsePayloadHash("vh1hqtJCryS2Uzb8KDU2PAp33U1nDCeUB4g9yWKTjgVhiy4x9pQA"),
+			}),
+		NewOp().
+			WithBranch(branch).
+			WithChainId(chainId).
+			WithContents(&TenderbakePreendorsement{
+				Slot:             18,
+				Level:            20877,
+				Round:            1,
+				BlockPayloadHash: mavryk.MustParsePayloadHash("vh1hqtJCryS2Uzb8KDU2PAp33U1nDCeUB4g9yWKTjgVhiy4x9pQA"),
+			}),
+	}
+	for i, op := range ops {
+		buf := op.WatermarkedBytes()
+		o, err := DecodeWatermarkedOp(buf, nil)
+		if err != nil {
+			t.Fatalf("op %d: %v", i, err)
+		}
+		if have := o.WatermarkedBytes(); !bytes.Equal(have, buf) {
+			t.Errorf("op %d: mismatched bytes\n    have: %x\n    want: %x", i, have, buf)
+		}
+		if (op.ChainId == nil) != (o.ChainId == nil) || op.ChainId != nil && !op.ChainId.Equal(*o.ChainId) {
+			t.Errorf("op %d: mismatched chain id", i)
+		}
+	}
+
+	head := BlockHeader{
+		Level:            306519,
+		Proto:            2,
+		Predecessor:      mavryk.MustParseBlockHash("BMJpBGs6rDpEGki8vLVd6VAcLrnEnAhxAwpGjExRcT8qDCmwQQm"),
+		Timestamp:        asTime("2022-03-29T10:41:45Z"),
+		ValidationPass:   4,
+		OperationsHash:   mavryk.MustParseOpListListHash("LLoatxVfWnkjHGYBuXL6ELtKqkX1EvLr5ffHSd5pySMY88AY2MeMr"),
+		Fitness:          []mavryk.HexBytes{asHex("02"), asHex("0004ad57"), asHex(""), asHex("ffffffff"), asHex("00000001")},
+		Context:          mavryk.MustParseContextHash("CoVTNsN2t3DU6m6nL2HL3qEzCA2jhiUEAnWZde7dPmzcdm61EYBp"),
+		PayloadHash:      mavryk.MustParsePayloadHash("vh2nZrxixzv4ZjAJn7PRj79GumUMAJzxuEYMjo496TYSaWhXYjZM"),
+		PayloadRound:     1,
+		ProofOfWorkNonce: asHex("df2ea592260c0100"),
+		LbVote:           mavryk.FeatureVoteOn,
+		AiVote:           mavryk.FeatureVoteOn,
+	}
+	head.WithChainId(chainId)
+	buf := head.WatermarkedBytes()
+	h, err := DecodeWatermarkedBlock(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Level != head.Level || h.Round() != 1 || h.PayloadRound != head.PayloadRound || !h.ChainId.Equal(chainId) {
+		t.Errorf("mismatched block header %+v", h)
+	}
+	if have := h.WatermarkedBytes(); !bytes.Equal(have, buf) {
+		t.Errorf("block: mismatched bytes\n    have: %x\n    want: %x", have, buf)
+	}
+
+	// messages use a zero branch
+	msg := WatermarkedMessage("hello", nil)
+	o, err := DecodeWatermarkedOp(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noop, ok := o.Contents[0].(*FailingNoop); !ok || noop.Arbitrary != "hello" || o.Branch.IsValid() || len(o.Contents) != 1 {
+		t.Errorf("mismatched message %+v", o)
+	}
+
+	// watermarks must match the decoder
+	if _, err := DecodeWatermarkedOp(buf, nil); err == nil {
+		t.Errorf("block as op: expected error")
+	}
+	if _, err := DecodeWatermarkedBlock(ops[1].WatermarkedBytes()); err == nil {
+		t.Errorf("op as block: expected error")
+	}
+}
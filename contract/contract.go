@@ -290,9 +290,11 @@ func (c *Contract) RunView(ctx context.Context, name string, args micheline.Prim
 		UnlimitedGas: true,
 		Mode:         "Readable",
 	}
-	var res rpc.RunViewResponse
-	err := c.rpc.RunView(ctx, rpc.Head, &req, &res)
-	return res.Data, err
+	res, err := c.rpc.RunScriptView(ctx, rpc.Head, req)
+	if err != nil {
+		return micheline.InvalidPrim, err
+	}
+	return res.Data, nil
 }
 
 func (c *Contract) RunViewExt(ctx context.Context, name string, args micheline.Prim, source, payer mavryk.Address, gas int64) (micheline.Prim, error) {
@@ -309,9 +311,11 @@ func (c *Contract) RunViewExt(ctx context.Context, name string, args micheline.P
 	if gas == 0 {
 		req.UnlimitedGas = true
 	}
-	var res rpc.RunViewResponse
-	err := c.rpc.RunView(ctx, rpc.Head, &req, &res)
-	return res.Data, err
+	res, err := c.rpc.RunScriptView(ctx, rpc.Head, req)
+	if err != nil {
+		return micheline.InvalidPrim, err
+	}
+	return res.Data, nil
 }
 
 // Executes TZIP-4 callback-based views from callback entrypoints
@@ -326,9 +330,11 @@ func (c *Contract) RunCallback(ctx context.Context, name string, args micheline.
 		Gas:        mavryk.N(1_000_000), // guess
 		Mode:       "Readable",
 	}
-	var res rpc.RunViewResponse
-	err := c.rpc.RunCallback(ctx, rpc.Head, &req, &res)
-	return res.Data, err
+	res, err := c.rpc.RunScriptCallback(ctx, rpc.Head, req)
+	if err != nil {
+		return micheline.InvalidPrim, err
+	}
+	return res.Data, nil
 }
 
 func (c *Contract) RunCallbackExt(ctx context.Context, name string, args micheline.Prim, source, payer mavryk.Address, gas int64) (micheline.Prim, error) {
@@ -342,9 +348,11 @@ func (c *Contract) RunCallbackExt(ctx context.Context, name string, args micheli
 		Gas:        mavryk.N(gas),
 		Mode:       "Readable",
 	}
-	var res rpc.RunViewResponse
-	err := c.rpc.RunCallback(ctx, rpc.Head, &req, &res)
-	return res.Data, err
+	res, err := c.rpc.RunScriptCallback(ctx, rpc.Head, req)
+	if err != nil {
+		return micheline.InvalidPrim, err
+	}
+	return res.Data, nil
 }
 
 func (c *Contract) Call(ctx context.Context, args CallArguments, opts *rpc.CallOptions) (*rpc.Receipt, error) {
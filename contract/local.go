@@ -0,0 +1,131 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package contract
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/micheline"
+	"github.com/mavryk-network/gomavryk/rpc"
+)
+
+// RpcStore implements micheline.BigmapStore and micheline.ContractStore on
+// top of an RPC client to let local script runs read on-chain state at a
+// specific block.
+type RpcStore struct {
+	cli   *rpc.Client
+	block rpc.BlockID
+}
+
+var (
+	_ micheline.BigmapStore   = (*RpcStore)(nil)
+	_ micheline.ContractStore = (*RpcStore)(nil)
+)
+
+func NewRpcStore(cli *rpc.Client, id rpc.BlockID) *RpcStore {
+	if id == nil {
+		id = rpc.Head
+	}
+	return &RpcStore{
+		cli:   cli,
+		block: id,
+	}
+}
+
+func (s *RpcStore) GetBigmapValue(ctx context.Context, id int64, _ micheline.Prim, hash mavryk.ExprHash) (micheline.Prim, bool, error) {
+	prim, err := s.cli.GetBigmapValue(ctx, id, hash, s.block)
+	if err != nil {
+		if rpc.ErrorStatus(err) == 404 {
+			return micheline.InvalidPrim, false, nil
+		}
+		return micheline.InvalidPrim, false, err
+	}
+	return prim, true, nil
+}
+
+func (s *RpcStore) GetScript(ctx context.Context, addr mavryk.Address) (*micheline.Script, error) {
+	u := fmt.Sprintf("chains/main/blocks/%s/context/contracts/%s/script", s.block, addr)
+	script := micheline.NewScript()
+	if err := s.cli.Get(ctx, u, script); err != nil {
+		if rpc.ErrorStatus(err) == 404 {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return script, nil
+}
+
+func (s *RpcStore) GetBalance(ctx context.Context, addr mavryk.Address) (int64, error) {
+	bal, err := s.cli.GetContractBalance(ctx, addr, s.block)
+	if err != nil {
+		return 0, err
+	}
+	return bal.Int64(), nil
+}
+
+// callbackAddress is the destination of callbacks in local TZIP-4 view runs.
+var callbackAddress = mavryk.MustParseAddress("KT1977zpPmwDqiDRqoGS47HRhQUaxcQigVYc")
+
+// RunViewLocal executes on-chain view name with the local Michelson interpreter
+// using the contract's script and current storage. Fields missing in env default
+// to the contract's address and, when the contract has an RPC client, on-chain
+// big_map and contract lookups at head.
+func (c *Contract) RunViewLocal(ctx context.Context, name string, args micheline.Prim, env *micheline.RunEnv) (micheline.Prim, error) {
+	if c.script == nil || c.store == nil {
+		return micheline.InvalidPrim, fmt.Errorf("contract %s: script not loaded", c.addr)
+	}
+	script := *c.script
+	script.Storage = *c.store
+	return script.RunView(ctx, name, args, c.localEnv(env))
+}
+
+// RunCallbackLocal executes TZIP-4 callback-based view name with the local
+// Michelson interpreter and returns the value the contract sends to the
+// callback.
+func (c *Contract) RunCallbackLocal(ctx context.Context, name string, args micheline.Prim, env *micheline.RunEnv) (micheline.Prim, error) {
+	if c.script == nil || c.store == nil {
+		return micheline.InvalidPrim, fmt.Errorf("contract %s: script not loaded", c.addr)
+	}
+	e := c.localEnv(env)
+	e.Entrypoint = name
+	param := micheline.NewPair(args, micheline.NewString(callbackAddress.String()))
+	res, err := c.script.Code.Run(ctx, param, *c.store, e)
+	if err != nil {
+		return micheline.InvalidPrim, err
+	}
+	for _, op := range res.Operations {
+		if op.Destination != nil && op.Destination.Equal(callbackAddress) && op.Parameters != nil {
+			return op.Parameters.Value, nil
+		}
+	}
+	return micheline.InvalidPrim, fmt.Errorf("contract %s: entrypoint %s did not call back", c.addr, name)
+}
+
+// localEnv returns a copy of env with defaults from the contract.
+func (c *Contract) localEnv(env *micheline.RunEnv) *micheline.RunEnv {
+	var e micheline.RunEnv
+	if env != nil {
+		e = *env
+	}
+	if !e.Self.IsValid() {
+		e.Self = c.addr
+	}
+	if c.rpc != nil {
+		if !e.ChainId.IsValid() {
+			e.ChainId = c.rpc.ChainId
+		}
+		if e.Bigmaps == nil || e.Contracts == nil {
+			store := NewRpcStore(c.rpc, rpc.Head)
+			if e.Bigmaps == nil {
+				e.Bigmaps = store
+			}
+			if e.Contracts == nil {
+				e.Contracts = store
+			}
+		}
+	}
+	return &e
+}
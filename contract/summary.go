@@ -0,0 +1,332 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package contract
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/micheline"
+)
+
+// ScriptSource provides contract scripts used to decode call parameters.
+// *rpc.Client implements ScriptSource.
+type ScriptSource interface {
+	GetContractScript(ctx context.Context, addr mavryk.Address) (*micheline.Script, error)
+}
+
+// Scripts is an offline ScriptSource. Unknown contracts have no script.
+type Scripts map[mavryk.Address]*micheline.Script
+
+func (s Scripts) GetContractScript(_ context.Context, addr mavryk.Address) (*micheline.Script, error) {
+	return s[addr], nil
+}
+
+// OpSummary is a human-readable description of an operation which lets
+// operators review what they sign. Use String for a text rendering and
+// encoding/json for a structured rendering.
+type OpSummary struct {
+	Branch       mavryk.BlockHash `json:"branch"`
+	Hash         string           `json:"hash,omitempty"`
+	Fee          string           `json:"fee"`
+	GasLimit     int64            `json:"gas_limit"`
+	StorageLimit int64            `json:"storage_limit"`
+	Contents     []ContentSummary `json:"contents"`
+}
+
+// ContentSummary describes a single operation in an operation's contents
+// list. Amounts and fees are in MVRK. Parameters contain the decoded call
+// arguments when the destination script is known and the raw Micheline
+// value otherwise.
+type ContentSummary struct {
+	Kind           mavryk.OpType   `json:"kind"`
+	Source         string          `json:"source,omitempty"`
+	Destination    string          `json:"destination,omitempty"`
+	Delegate       string          `json:"delegate,omitempty"`
+	Amount         string          `json:"amount,omitempty"`
+	Fee            string          `json:"fee,omitempty"`
+	Counter        int64           `json:"counter,omitempty"`
+	GasLimit       int64           `json:"gas_limit,omitempty"`
+	StorageLimit   int64           `json:"storage_limit,omitempty"`
+	Entrypoint     string          `json:"entrypoint,omitempty"`
+	Parameters     interface{}     `json:"parameters,omitempty"`
+	TokenTransfers []TokenTransfer `json:"token_transfers,omitempty"`
+}
+
+// TokenTransfer is a FA1.2 or FA2 token transfer requested by a contract
+// call. Amounts are in token units without decimals. Verified is true when
+// the destination script implements the token standard. Unverified
+// transfers were only recognized by their parameters and the destination
+// may not be a token contract at all.
+type TokenTransfer struct {
+	Standard string `json:"standard"`
+	Token    string `json:"token"`
+	TokenId  string `json:"token_id,omitempty"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Amount   string `json:"amount"`
+	Verified bool   `json:"verified"`
+}
+
+// SummarizeOpBytes decodes a binary operation with or without signature and
+// summarizes it. Scripts is optional.
+func SummarizeOpBytes(ctx context.Context, data []byte, scripts ScriptSource) (*OpSummary, error) {
+	o, err := codec.DecodeOp(data)
+	if err != nil {
+		return nil, err
+	}
+	return SummarizeOp(ctx, o, scripts)
+}
+
+// SummarizeOp summarizes operation o. When scripts is not nil, it is used
+// to look up destination scripts of contract calls for decoding entrypoints,
+// parameters and token transfers. Without a destination script only standard
+// FA1.2 and FA2 transfer parameters are recognized and the resulting token
+// transfers are unverified.
+func SummarizeOp(ctx context.Context, o *codec.Op, scripts ScriptSource) (*OpSummary, error) {
+	s := &OpSummary{
+		Branch:   o.Branch,
+		Contents: make([]ContentSummary, 0, len(o.Contents)),
+	}
+	if o.Signature.IsValid() {
+		s.Hash = o.Hash().String()
+	}
+	var fee int64
+	for _, v := range o.Contents {
+		c, err := summarizeContent(ctx, v, scripts)
+		if err != nil {
+			return nil, err
+		}
+		l := v.Limits()
+		fee += l.Fee
+		s.GasLimit += l.GasLimit
+		s.StorageLimit += l.StorageLimit
+		s.Contents = append(s.Contents, c)
+	}
+	s.Fee = mavryk.FormatMumav(fee)
+	return s, nil
+}
+
+func summarizeContent(ctx context.Context, op codec.Operation, scripts ScriptSource) (ContentSummary, error) {
+	c := ContentSummary{
+		Kind: op.Kind(),
+	}
+	if m, ok := op.(interface{ GetSource() mavryk.Address }); ok {
+		l := op.Limits()
+		c.Source = m.GetSource().String()
+		c.Fee = mavryk.FormatMumav(l.Fee)
+		c.Counter = op.GetCounter()
+		c.GasLimit = l.GasLimit
+		c.StorageLimit = l.StorageLimit
+	}
+	switch v := op.(type) {
+	case *codec.Transaction:
+		if v.Amount < 0 {
+			return c, fmt.Errorf("contract: invalid transaction amount")
+		}
+		c.Destination = v.Destination.String()
+		c.Amount = v.Amount.Decimals(mavryk.Decimals)
+		if v.Parameters != nil {
+			if err := summarizeCall(ctx, &c, v, scripts); err != nil {
+				return c, err
+			}
+		}
+	case *codec.Origination:
+		if v.Balance < 0 {
+			return c, fmt.Errorf("contract: invalid origination balance")
+		}
+		c.Amount = v.Balance.Decimals(mavryk.Decimals)
+		if v.Delegate.IsValid() {
+			c.Delegate = v.Delegate.String()
+		}
+	case *codec.Delegation:
+		if v.Delegate.IsValid() {
+			c.Delegate = v.Delegate.String()
+		}
+	case *codec.Ballot:
+		c.Source = v.Source.String()
+	case *codec.Proposals:
+		c.Source = v.Source.String()
+	case *codec.IncreasePaidStorage:
+		c.Destination = v.Destination.String()
+	case *codec.TransferTicket:
+		c.Destination = v.Destination.String()
+		c.Entrypoint = v.Entrypoint
+	case *codec.DrainDelegate:
+		c.Delegate = v.Delegate.String()
+		c.Destination = v.Destination.String()
+	}
+	return c, nil
+}
+
+// summarizeCall decodes entrypoint, parameters and token transfers of a
+// contract call.
+func summarizeCall(ctx context.Context, c *ContentSummary, tx *codec.Transaction, scripts ScriptSource) error {
+	var script *micheline.Script
+	if scripts != nil && tx.Destination.IsContract() {
+		var err error
+		script, err = scripts.GetContractScript(ctx, tx.Destination)
+		if err != nil {
+			return err
+		}
+	}
+	params := tx.Parameters
+	c.Entrypoint = params.Entrypoint
+	c.Parameters = params.Value
+	prim := params.Value
+	if script != nil {
+		ep, p, err := params.MapEntrypoint(script.ParamType())
+		if err == nil {
+			c.Entrypoint = ep.Name
+			prim = p
+			val := micheline.NewValue(ep.Type(), p)
+			if m, err := val.Map(); err == nil {
+				c.Parameters = m
+			}
+		}
+	}
+	if c.Entrypoint != "transfer" {
+		return nil
+	}
+	isFA12 := script == nil || script.Implements(micheline.ITzip7)
+	isFA2 := script == nil || script.Implements(micheline.ITzip12)
+	if isFA12 {
+		if xfer, ok := decodeFA1Transfer(prim); ok {
+			if script == nil {
+				c.Parameters = standardParameters(micheline.ITzip7, prim)
+			}
+			c.TokenTransfers = []TokenTransfer{{
+				Standard: TokenKindFA1_2.String(),
+				Token:    tx.Destination.String(),
+				From:     xfer.From.String(),
+				To:       xfer.To.String(),
+				Amount:   xfer.Amount.String(),
+				Verified: script != nil,
+			}}
+			return nil
+		}
+	}
+	if isFA2 {
+		if list, ok := decodeFA2Transfers(prim); ok {
+			if script == nil {
+				c.Parameters = standardParameters(micheline.ITzip12, prim)
+			}
+			c.TokenTransfers = make([]TokenTransfer, len(list))
+			for i, xfer := range list {
+				c.TokenTransfers[i] = TokenTransfer{
+					Standard: TokenKindFA2.String(),
+					Token:    tx.Destination.String(),
+					TokenId:  xfer.TokenId.String(),
+					From:     xfer.From.String(),
+					To:       xfer.To.String(),
+					Amount:   xfer.Amount.String(),
+					Verified: script != nil,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// standardParameters decodes transfer parameters with the type defined by
+// token standard i.
+func standardParameters(i micheline.Interface, prim micheline.Prim) interface{} {
+	val := micheline.NewValue(i.TypeOf("transfer"), prim)
+	m, err := val.Map()
+	if err != nil {
+		return prim
+	}
+	return m
+}
+
+func decodeFA1Transfer(prim micheline.Prim) (FA1Transfer, bool) {
+	var xfer FA1Transfer
+	val := micheline.NewValue(micheline.ITzip7.TypeOf("transfer"), prim)
+	if err := val.Unmarshal(&xfer); err != nil {
+		return xfer, false
+	}
+	return xfer, xfer.From.IsValid() && xfer.To.IsValid()
+}
+
+func decodeFA2Transfers(prim micheline.Prim) (FA2TransferList, bool) {
+	var list FA2TransferList
+	val := micheline.NewValue(micheline.ITzip12.TypeOf("transfer"), prim)
+	if err := val.Unmarshal(&list); err != nil || len(list) == 0 {
+		return nil, false
+	}
+	for _, v := range list {
+		if !v.From.IsValid() || !v.To.IsValid() {
+			return nil, false
+		}
+	}
+	return list, true
+}
+
+// String renders the summary as text.
+func (s OpSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Branch         %s\n", s.Branch)
+	if s.Hash != "" {
+		fmt.Fprintf(&b, "Hash           %s\n", s.Hash)
+	}
+	fmt.Fprintf(&b, "Total fee      %s %s\n", s.Fee, mavryk.Symbol)
+	fmt.Fprintf(&b, "Gas limit      %d\n", s.GasLimit)
+	fmt.Fprintf(&b, "Storage limit  %d\n", s.StorageLimit)
+	for i, c := range s.Contents {
+		fmt.Fprintf(&b, "#%d %s\n", i, c.Kind)
+		c.render(&b)
+	}
+	return b.String()
+}
+
+// String renders the content summary as text.
+func (c ContentSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", c.Kind)
+	c.render(&b)
+	return b.String()
+}
+
+func (c ContentSummary) render(b *strings.Builder) {
+	line := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(b, "  %-14s %s\n", name, value)
+		}
+	}
+	line("Source", c.Source)
+	line("Destination", c.Destination)
+	line("Delegate", c.Delegate)
+	if c.Amount != "" {
+		line("Amount", c.Amount+" "+mavryk.Symbol)
+	}
+	if c.Fee != "" {
+		line("Fee", c.Fee+" "+mavryk.Symbol)
+		line("Counter", strconv.FormatInt(c.Counter, 10))
+		line("Gas limit", strconv.FormatInt(c.GasLimit, 10))
+		line("Storage limit", strconv.FormatInt(c.StorageLimit, 10))
+	}
+	line("Entrypoint", c.Entrypoint)
+	if c.Parameters != nil {
+		buf, err := json.Marshal(c.Parameters)
+		if err == nil {
+			line("Parameters", string(buf))
+		}
+	}
+	for _, t := range c.TokenTransfers {
+		token := t.Token
+		if t.TokenId != "" {
+			token += " #" + t.TokenId
+		}
+		msg := fmt.Sprintf("%s %s %s from %s to %s", t.Amount, t.Standard, token, t.From, t.To)
+		if !t.Verified {
+			msg += " (unverified)"
+		}
+		line("Token transfer", msg)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package contract
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/micheline"
+)
+
+var (
+	testKey    = mavryk.MustParsePrivateKey("edsk4FTF78Qf1m2rykGpHqostAiq5gYW4YZEoGUSWBTJr2njsDHSnd")
+	testDest   = mavryk.MustParseAddress("mv1949pcbqwGsHfUCaVmNVRu21Cd4SnbpvpP")
+	testToken  = mavryk.MustParseAddress("KT1977zpPmwDqiDRqoGS47HRhQUaxcQigVYc")
+	testBranch = mavryk.MustParseBlockHash("BKnYk1T5a49bb8me4WfQeugyFnMEH9h8cm6jqvL3BxRwE23EVBJ")
+)
+
+func loadScript(t *testing.T, name string) *micheline.Script {
+	t.Helper()
+	buf, err := os.ReadFile("../examples/tzcompose/token/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var code micheline.Code
+	if err := json.Unmarshal(buf, &code); err != nil {
+		t.Fatal(err)
+	}
+	return &micheline.Script{Code: code}
+}
+
+func testFA1Op() *codec.Op {
+	src := testKey.Address()
+	args := NewFA1TransferArgs().WithTransfer(src, testDest, mavryk.NewZ(30))
+	return codec.NewOp().
+		WithBranch(testBranch).
+		WithSource(src).
+		WithCall(testToken, *args.Parameters()).
+		WithLimits([]mavryk.Limits{{Fee: 1234, GasLimit: 2000, StorageLimit: 100}}, 0)
+}
+
+func TestSummarizeTransfer(t *testing.T) {
+	src := testKey.Address()
+	op := codec.NewOp().
+		WithBranch(testBranch).
+		WithSource(src).
+		WithTransfer(testDest, 1_500_000).
+		WithLimits([]mavryk.Limits{{Fee: 400, GasLimit: 200}}, 0)
+	op.Contents[0].WithCounter(11)
+	s, err := SummarizeOp(context.Background(), op, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "" +
+		"Branch         " + testBranch.String() + "\n" +
+		"Total fee      0.000400 " + mavryk.Symbol + "\n" +
+		"Gas limit      200\n" +
+		"Storage limit  0\n" +
+		"#0 transaction\n" +
+		"  Source         " + src.String() + "\n" +
+		"  Destination    " + testDest.String() + "\n" +
+		"  Amount         1.500000 " + mavryk.Symbol + "\n" +
+		"  Fee            0.000400 " + mavryk.Symbol + "\n" +
+		"  Counter        11\n" +
+		"  Gas limit      200\n" +
+		"  Storage limit  0\n"
+	if got := s.String(); got != want {
+		t.Errorf("mismatched text\n--- got:\n%s--- want:\n%s", got, want)
+	}
+
+	// amounts which do not fit mutez are rejected
+	op.Contents[0].(*codec.Transaction).Amount = -1
+	if _, err := SummarizeOp(context.Background(), op, nil); err == nil {
+		t.Errorf("expected error for invalid amount")
+	}
+}
+
+func TestSummarizeTokenTransfer(t *testing.T) {
+	ctx := context.Background()
+	src := testKey.Address()
+
+	// without script the transfer is recognized from its parameters only
+	s, err := SummarizeOp(ctx, testFA1Op(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.Contents[0]
+	if len(c.TokenTransfers) != 1 {
+		t.Fatalf("mismatched token transfers got=%d want=%d", len(c.TokenTransfers), 1)
+	}
+	want := TokenTransfer{
+		Standard: TokenKindFA1_2.String(),
+		Token:    testToken.String(),
+		From:     src.String(),
+		To:       testDest.String(),
+		Amount:   "30",
+	}
+	if c.TokenTransfers[0] != want {
+		t.Errorf("mismatched token transfer got=%+v want=%+v", c.TokenTransfers[0], want)
+	}
+	line := "  Token transfer 30 " + want.Standard + " " + want.Token + " from " + want.From + " to " + want.To + " (unverified)\n"
+	if text := c.String(); !strings.Contains(text, line) {
+		t.Errorf("missing unverified token transfer in\n%s", text)
+	}
+
+	// a script which implements FA1.2 verifies the transfer
+	scripts := Scripts{testToken: loadScript(t, "fa12_code.json")}
+	s, err = SummarizeOp(ctx, testFA1Op(), scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = s.Contents[0]
+	want.Verified = true
+	if len(c.TokenTransfers) != 1 || c.TokenTransfers[0] != want {
+		t.Errorf("mismatched verified token transfer got=%+v", c.TokenTransfers)
+	}
+	if text := c.String(); strings.Contains(text, "unverified") {
+		t.Errorf("unexpected unverified token transfer in\n%s", text)
+	}
+
+	// FA1.2 parameters sent to an FA2 contract are no token transfer
+	scripts[testToken] = loadScript(t, "fa2_nft.json")
+	s, err = SummarizeOp(ctx, testFA1Op(), scripts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Contents[0].TokenTransfers); n != 0 {
+		t.Errorf("unexpected token transfers %+v", s.Contents[0].TokenTransfers)
+	}
+
+	// FA2 transfers without script are unverified as well
+	args := NewFA2TransferArgs().WithTransfer(src, testDest, mavryk.NewZ(7), mavryk.NewZ(1))
+	op := codec.NewOp().WithBranch(testBranch).WithSource(src).WithCall(testToken, *args.Parameters())
+	s, err = SummarizeOp(ctx, op, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := s.Contents[0].TokenTransfers
+	if len(list) != 1 || list[0].Standard != TokenKindFA2.String() || list[0].TokenId != "7" || list[0].Verified {
+		t.Errorf("mismatched FA2 token transfers %+v", list)
+	}
+}
+
+func TestSummaryJSON(t *testing.T) {
+	s, err := SummarizeOp(context.Background(), testFA1Op(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Branch       string `json:"branch"`
+		Fee          string `json:"fee"`
+		GasLimit     int64  `json:"gas_limit"`
+		StorageLimit int64  `json:"storage_limit"`
+		Contents     []struct {
+			Kind           string          `json:"kind"`
+			Amount         string          `json:"amount"`
+			Entrypoint     string          `json:"entrypoint"`
+			Parameters     json.RawMessage `json:"parameters"`
+			TokenTransfers []struct {
+				Standard string `json:"standard"`
+				Amount   string `json:"amount"`
+				Verified *bool  `json:"verified"`
+			} `json:"token_transfers"`
+		} `json:"contents"`
+	}
+	if err := json.Unmarshal(buf, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Branch != testBranch.String() || res.Fee != "0.001234" || res.GasLimit != 2000 || res.StorageLimit != 100 {
+		t.Errorf("mismatched summary %s", string(buf))
+	}
+	if len(res.Contents) != 1 {
+		t.Fatalf("mismatched contents %s", string(buf))
+	}
+	c := res.Contents[0]
+	if c.Kind != "transaction" || c.Amount != "0.000000" || c.Entrypoint != "transfer" {
+		t.Errorf("mismatched content %s", string(buf))
+	}
+	if !strings.Contains(string(c.Parameters), `"value":"30"`) {
+		t.Errorf("mismatched parameters %s", string(c.Parameters))
+	}
+	if len(c.TokenTransfers) != 1 || c.TokenTransfers[0].Verified == nil || *c.TokenTransfers[0].Verified {
+		t.Errorf("mismatched token transfers %s", string(buf))
+	}
+}
+
+func TestSummarizeOpBytes(t *testing.T) {
+	ctx := context.Background()
+	op := testFA1Op()
+	op.Contents[0].WithCounter(12)
+
+	// unsigned operations have no hash
+	s, err := SummarizeOpBytes(ctx, op.Bytes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Hash != "" || len(s.Contents) != 1 || s.Contents[0].Counter != 12 {
+		t.Errorf("mismatched unsigned summary %+v", s)
+	}
+	if len(s.Contents[0].TokenTransfers) != 1 {
+		t.Errorf("missing token transfer in decoded operation")
+	}
+
+	if err := op.Sign(testKey); err != nil {
+		t.Fatal(err)
+	}
+	s, err = SummarizeOpBytes(ctx, op.Bytes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := op.Hash().String(); s.Hash != want {
+		t.Errorf("mismatched hash got=%s want=%s", s.Hash, want)
+	}
+	if !strings.Contains(s.String(), "Hash           "+s.Hash+"\n") {
+		t.Errorf("missing hash in\n%s", s)
+	}
+
+	if _, err := SummarizeOpBytes(ctx, []byte{1, 2, 3}, nil); err == nil {
+		t.Errorf("expected decode error")
+	}
+}
@@ -131,52 +131,31 @@ func (v *Tz16View) Run(ctx context.Context, contract *Contract, args micheline.P
 	return v.Implementations[0].Storage.Run(ctx, contract, args)
 }
 
+func (v *Tz16View) RunLocal(ctx context.Context, contract *Contract, args micheline.Prim, env *micheline.RunEnv) (micheline.Prim, error) {
+	if len(v.Implementations) == 0 || v.Implementations[0].Storage == nil {
+		return micheline.InvalidPrim, fmt.Errorf("missing storage view impl")
+	}
+	return v.Implementations[0].Storage.RunLocal(ctx, contract, args, env)
+}
+
 // Run executes the TZIP-16 off-chain view using script and storage from contract and
 // passed args. Returns the result as primitive which matches the view's return type.
 // Note this method does not check or patch the view code to replace illegal instructions
 // or inject current context.
 func (v *Tz16StorageView) Run(ctx context.Context, contract *Contract, args micheline.Prim) (micheline.Prim, error) {
-	// fill empty arguments
-	code := v.Code.Clone()
-	paramType := v.ParamType
-	if !paramType.IsValid() {
-		paramType = micheline.NewCode(micheline.T_UNIT)
-		if !args.IsValid() {
-			args = micheline.NewCode(micheline.D_UNIT)
-		}
-		code.Args = append(micheline.PrimList{micheline.NewCode(micheline.I_CDR)}, code.Args...)
-	}
+	script, input := v.script(contract, args)
 
 	// construct request
 	req := rpc.RunCodeRequest{
 		ChainId: contract.rpc.ChainId,
-		Script: micheline.Code{
-			Param: micheline.NewCode(
-				micheline.K_PARAMETER,
-				micheline.NewPairType(paramType, contract.script.Code.Storage.Args[0]),
-			),
-			Storage: micheline.NewCode(
-				micheline.K_STORAGE,
-				micheline.NewCode(micheline.T_OPTION, v.ReturnType),
-			),
-			Code: micheline.NewCode(
-				micheline.K_CODE,
-				micheline.NewSeq(
-					micheline.NewCode(micheline.I_CAR),
-					v.Code,
-					micheline.NewCode(micheline.I_SOME),
-					micheline.NewCode(micheline.I_NIL, micheline.NewCode(micheline.T_OPERATION)),
-					micheline.NewCode(micheline.I_PAIR),
-				),
-			),
-		},
-		Input:   micheline.NewPair(args, *contract.store),
+		Script:  script,
+		Input:   input,
 		Storage: micheline.NewCode(micheline.D_NONE),
 		Amount:  mavryk.N(0),
 		Balance: mavryk.N(0),
 	}
-	var resp rpc.RunCodeResponse
-	if err := contract.rpc.RunCode(ctx, rpc.Head, req, &resp); err != nil {
+	resp, err := contract.rpc.RunScript(ctx, rpc.Head, req)
+	if err != nil {
 		return micheline.InvalidPrim, err
 	}
 
@@ -184,6 +163,60 @@ func (v *Tz16StorageView) Run(ctx context.Context, contract *Contract, args mich
 	return resp.Storage.Args[0], nil
 }
 
+// RunLocal executes the TZIP-16 off-chain view like Run, but uses the local
+// Michelson interpreter instead of a node. Fields missing in env default to the
+// contract's address and, when the contract has an RPC client, on-chain
+// big_map and contract lookups at head.
+func (v *Tz16StorageView) RunLocal(ctx context.Context, contract *Contract, args micheline.Prim, env *micheline.RunEnv) (micheline.Prim, error) {
+	if contract.script == nil || contract.store == nil {
+		return micheline.InvalidPrim, fmt.Errorf("contract %s: script not loaded", contract.addr)
+	}
+	script, input := v.script(contract, args)
+	res, err := script.Run(ctx, input, micheline.NewCode(micheline.D_NONE), contract.localEnv(env))
+	if err != nil {
+		return micheline.InvalidPrim, err
+	}
+
+	// strip the extra D_SOME
+	return res.Storage.Args[0], nil
+}
+
+// script wraps the view code into a contract script that takes args and the
+// contract's storage as parameter and returns the view result as storage.
+func (v *Tz16StorageView) script(contract *Contract, args micheline.Prim) (micheline.Code, micheline.Prim) {
+	// fill empty arguments
+	code := v.Code.Clone()
+	paramType := v.ParamType
+	if !paramType.IsValid() {
+		paramType = micheline.NewCode(micheline.T_UNIT)
+		if !args.IsValid() {
+			args = micheline.NewCode(micheline.D_UNIT)
+		}
+		code.Args = append(micheline.PrimList{micheline.NewCode(micheline.I_CDR)}, code.Args...)
+	}
+	script := micheline.Code{
+		Param: micheline.NewCode(
+			micheline.K_PARAMETER,
+			micheline.NewPairType(paramType, contract.script.Code.Storage.Args[0]),
+		),
+		Storage: micheline.NewCode(
+			micheline.K_STORAGE,
+			micheline.NewCode(micheline.T_OPTION, v.ReturnType),
+		),
+		Code: micheline.NewCode(
+			micheline.K_CODE,
+			micheline.NewSeq(
+				micheline.NewCode(micheline.I_CAR),
+				code,
+				micheline.NewCode(micheline.I_SOME),
+				micheline.NewCode(micheline.I_NIL, micheline.NewCode(micheline.T_OPERATION)),
+				micheline.NewCode(micheline.I_PAIR),
+			),
+		),
+	}
+	return script, micheline.NewPair(args, *contract.store)
+}
+
 func (c *Contract) ResolveTz16Uri(ctx context.Context, uri string, result interface{}, checksum []byte) error {
 	protoIdx := strings.Index(uri, ":")
 	if protoIdx < 0 {
@@ -0,0 +1,95 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package contract
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/micheline"
+	"github.com/mavryk-network/gomavryk/rpc"
+)
+
+const (
+	testViewScript = `{"code":[{"prim":"parameter","args":[{"prim":"unit"}]},{"prim":"storage","args":[{"prim":"int"}]},{"prim":"code","args":[[{"prim":"CDR"},{"prim":"NIL","args":[{"prim":"operation"}]},{"prim":"PAIR"}]]}],"storage":{"int":"40"}}`
+
+	// parameterless view returning storage + 2
+	testViewStorage = `{"name":"get","implementations":[{"michelsonStorageView":{"returnType":{"prim":"int"},"code":[{"prim":"PUSH","args":[{"prim":"int"},{"int":"2"}]},{"prim":"ADD"}]}}]}`
+
+	// view returning param + storage
+	testViewParam = `{"name":"add","implementations":[{"michelsonStorageView":{"parameter":{"prim":"int"},"returnType":{"prim":"int"},"code":[{"prim":"UNPAIR"},{"prim":"ADD"}]}}]}`
+)
+
+// runCodeNode executes run_code requests with the local interpreter.
+func runCodeNode(t *testing.T) *rpc.Client {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chains/main/blocks/head/helpers/scripts/run_code" {
+			http.NotFound(w, r)
+			return
+		}
+		var req rpc.RunCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err := req.Script.Run(r.Context(), req.Input, req.Storage, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rpc.RunCodeResponse{Storage: res.Storage})
+	}))
+	t.Cleanup(ts.Close)
+	c, err := rpc.NewClient(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTz16StorageViewRun(t *testing.T) {
+	var script micheline.Script
+	if err := json.Unmarshal([]byte(testViewScript), &script); err != nil {
+		t.Fatal(err)
+	}
+	c := NewContract(testToken, runCodeNode(t)).WithScript(&script).WithStorage(&script.Storage)
+
+	cases := []struct {
+		View string
+		Args micheline.Prim
+		Want int64
+	}{
+		{View: testViewStorage, Want: 42},
+		{View: testViewParam, Args: micheline.NewInt64(2), Want: 42},
+	}
+	for i, tc := range cases {
+		var view Tz16View
+		if err := json.Unmarshal([]byte(tc.View), &view); err != nil {
+			t.Fatalf("Case %d: %v", i, err)
+		}
+		res, err := view.Run(context.Background(), c, tc.Args)
+		if err != nil {
+			t.Errorf("Case %d %s: run failed: %v", i, view.Name, err)
+			continue
+		}
+		if got := res.Int.Int64(); got != tc.Want {
+			t.Errorf("Case %d %s: mismatched result got=%d want=%d", i, view.Name, got, tc.Want)
+		}
+
+		// the local interpreter must agree with the node
+		res, err = view.RunLocal(context.Background(), c, tc.Args, nil)
+		if err != nil {
+			t.Errorf("Case %d %s: local run failed: %v", i, view.Name, err)
+			continue
+		}
+		if got := res.Int.Int64(); got != tc.Want {
+			t.Errorf("Case %d %s: mismatched local result got=%d want=%d", i, view.Name, got, tc.Want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ module github.com/mavryk-network/gomavryk
 go 1.19
 
 require (
+	github.com/cloudflare/circl v1.3.7
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.2.0
 	github.com/echa/bson v0.0.0-20220430141917-c0fbdf7f8b79
 	github.com/echa/log v1.2.4
@@ -11,7 +12,7 @@ require (
 	github.com/pmezard/go-difflib v1.0.0
 	github.com/stretchr/testify v1.8.4
 	github.com/tidwall/gjson v1.17.0
-	github.com/tyler-smith/go-bip32 v1.0.0
+	github.com/tyler-smith/go-bip39 v1.1.0
 	golang.org/x/crypto v0.18.0
 	golang.org/x/exp v0.0.0-20240112132812-db7319d0e0e3
 	golang.org/x/term v0.16.0
@@ -19,8 +20,6 @@ require (
 )
 
 require (
-	github.com/FactomProject/basen v0.0.0-20150613233007-fe3947df716e // indirect
-	github.com/FactomProject/btcutilecc v0.0.0-20130527213604-d3a63a5752ec // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fatih/color v1.16.0 // indirect
 	github.com/kr/pretty v0.3.0 // indirect
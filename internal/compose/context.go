@@ -44,6 +44,7 @@ type Context struct {
 	apiKey       string      // RPC service API key
 	path         string      // current compose file path
 	resume       bool        // continue pipeline execution were we left off
+	legacyKeys   bool        // derive child accounts like earlier releases
 	mode         RunMode     // selected engine run mode
 	cache        *PipelineCache
 	savedLoggers [2]log.Logger
@@ -84,6 +85,13 @@ func (c *Context) WithResume(b bool) *Context {
 	return c
 }
 
+// WithLegacyKeys selects the child account derivation of earlier mvcompose
+// releases, so accounts created by those releases keep their addresses.
+func (c *Context) WithLegacyKeys(b bool) *Context {
+	c.legacyKeys = b
+	return c
+}
+
 func (c *Context) WithMode(m RunMode) *Context {
 	c.mode = m
 	return c
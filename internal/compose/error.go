@@ -8,13 +8,14 @@ import (
 )
 
 var (
-	ErrNoVersion      = errors.New("missing engine version")
-	ErrInvalidVersion = errors.New("unsupported engine version")
-	ErrNoPipeline     = errors.New("missing pipeline definition")
-	ErrNoBaseKey      = errors.New("missing base account key, set with MVCOMPOSE_BASE_KEY")
-	ErrNoAccount      = errors.New("missing account")
-	ErrNoAccountName  = errors.New("emoty account name")
-	ErrNoPipelineName = errors.New("empty pipeline name")
-	ErrNoTaskType     = errors.New("missing task type")
-	ErrSkip           = errors.New("skip task")
+	ErrNoVersion        = errors.New("missing engine version")
+	ErrInvalidVersion   = errors.New("unsupported engine version")
+	ErrNoPipeline       = errors.New("missing pipeline definition")
+	ErrNoBaseKey        = errors.New("missing base account key, set with MVCOMPOSE_BASE_KEY")
+	ErrNoAccount        = errors.New("missing account")
+	ErrNoAccountName    = errors.New("emoty account name")
+	ErrInvalidAccountId = errors.New("invalid account id")
+	ErrNoPipelineName   = errors.New("empty pipeline name")
+	ErrNoTaskType       = errors.New("missing task type")
+	ErrSkip             = errors.New("skip task")
 )
@@ -0,0 +1,9 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package compose
+
+// SetCacheDir moves the pipeline cache for tests.
+func SetCacheDir(p string) {
+	cacheFullPath = p
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package compose_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/internal/compose"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/rpc/mocknode"
+	"github.com/mavryk-network/gomavryk/rpc/rpctest"
+
+	_ "github.com/mavryk-network/gomavryk/internal/compose/alpha"
+	_ "github.com/mavryk-network/gomavryk/internal/compose/alpha/task"
+)
+
+const testBaseKey = "edsk4FTF78Qf1m2rykGpHqostAiq5gYW4YZEoGUSWBTJr2njsDHSnd"
+
+func TestRunMocknode(t *testing.T) {
+	compose.SetCacheDir(t.TempDir())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	base := mavryk.MustParsePrivateKey(testBaseKey)
+	srv := mocknode.NewServer(nil, 10*time.Millisecond)
+	defer srv.Close()
+	srv.Chain().SetAccount(base.Address(), rpctest.Account{
+		Balance: 1_000_000_000,
+		Key:     base.Public(),
+	})
+
+	ectx := compose.NewContext(ctx)
+	ectx.WithUrl(srv.URL).WithBase(testBaseKey)
+	if err := compose.Run(ectx, "../../examples/tzcompose/transfer/transfer.yaml", compose.RunModeExecute); err != nil {
+		t.Fatal(err)
+	}
+
+	// both pipelines fund account-1 and account-2, account-1 also pays
+	// account-2 from its own balance
+	want := map[int]int64{1: 19_000_000, 2: 21_000_000}
+	for _, acc := range ectx.Accounts {
+		if acc.Id < 1 {
+			continue
+		}
+		got, _ := srv.Chain().Account(acc.Address)
+		if acc.Id == 1 {
+			// account-1 pays fees and its reveal
+			if got.Balance >= want[1] || got.Balance < want[1]-10_000 || !got.Key.IsValid() {
+				t.Errorf("account %d: mismatched balance=%d revealed=%t", acc.Id, got.Balance, got.Key.IsValid())
+			}
+			continue
+		}
+		if got.Balance != want[acc.Id] {
+			t.Errorf("account %d: mismatched balance got=%d want=%d", acc.Id, got.Balance, want[acc.Id])
+		}
+	}
+	if len(ectx.Accounts) != 3 {
+		t.Errorf("mismatched accounts got=%d want=%d", len(ectx.Accounts), 3)
+	}
+}
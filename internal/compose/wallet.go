@@ -5,11 +5,21 @@ package compose
 
 import (
 	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
 
 	"github.com/mavryk-network/gomavryk/mavryk"
-	"github.com/tyler-smith/go-bip32"
+	"github.com/mavryk-network/gomavryk/mavryk/hd"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 )
 
+// maxAccountId is the first account id that cannot be used for child keys.
+// Ids at or above this value would be hardened path indices.
+const maxAccountId = 1 << 31
+
 func (c *Context) MakeAccount(id int, alias string) (Account, error) {
 	if alias == "" {
 		return Account{}, ErrNoAccountName
@@ -23,9 +33,13 @@ func (c *Context) MakeAccount(id int, alias string) (Account, error) {
 	if id < 0 {
 		id = c.MaxId + 1
 	}
-	sk, err := deriveChildKey(c.BaseAccount.PrivateKey, id)
+	derive := deriveChildKey
+	if c.legacyKeys {
+		derive = deriveLegacyChildKey
+	}
+	sk, err := derive(c.BaseAccount.PrivateKey, id)
 	if err != nil {
-		return Account{}, nil
+		return Account{}, err
 	}
 	acc := Account{
 		Id:         id,
@@ -39,19 +53,55 @@ func (c *Context) MakeAccount(id int, alias string) (Account, error) {
 	return acc, nil
 }
 
-func deriveChildKey(seed mavryk.PrivateKey, id int) (mavryk.PrivateKey, error) {
-	var sk mavryk.PrivateKey
-	masterKey, err := bip32.NewMasterKey(seed.Data)
+// deriveChildKey derives the Ed25519 key for account id along the wallet path
+// m/44'/1729'/id'/0' using SLIP-10 with the base key as seed.
+func deriveChildKey(base mavryk.PrivateKey, id int) (mavryk.PrivateKey, error) {
+	if id < 0 || id >= maxAccountId {
+		return mavryk.PrivateKey{}, fmt.Errorf("%w %d", ErrInvalidAccountId, id)
+	}
+	master, err := hd.NewMasterKey(mavryk.KeyTypeEd25519, base.Data)
 	if err != nil {
-		return sk, err
+		return mavryk.PrivateKey{}, err
 	}
-	bip32ChildKey, err := masterKey.NewChildKey(uint32(id))
+	key, err := master.DerivePath(hd.NewAccountPath(uint32(id)))
 	if err != nil {
-		return sk, err
+		return mavryk.PrivateKey{}, err
 	}
-	sk = mavryk.PrivateKey{
-		Type: mavryk.KeyTypeEd25519,
-		Data: ed25519.NewKeyFromSeed(bip32ChildKey.Key),
+	return key.PrivateKey(), nil
+}
+
+// deriveLegacyChildKey derives the Ed25519 key for account id the way earlier
+// mvcompose releases did. It computes the non-hardened BIP32 secp256k1 child
+// key id of a master key created from the base key and uses the result as
+// Ed25519 seed. Only use it to access accounts created by those releases.
+func deriveLegacyChildKey(base mavryk.PrivateKey, id int) (mavryk.PrivateKey, error) {
+	if id < 0 || id >= maxAccountId {
+		return mavryk.PrivateKey{}, fmt.Errorf("%w %d", ErrInvalidAccountId, id)
+	}
+
+	// master key and chain code
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(base.Data)
+	sum := mac.Sum(nil)
+	var parent secp256k1.ModNScalar
+	if overflow := parent.SetByteSlice(sum[:32]); overflow || parent.IsZero() {
+		return mavryk.PrivateKey{}, fmt.Errorf("invalid legacy master key")
 	}
-	return sk, nil
+
+	// non-hardened child from the compressed parent public key
+	pub := secp256k1.NewPrivateKey(&parent).PubKey().SerializeCompressed()
+	mac = hmac.New(sha512.New, sum[32:])
+	mac.Write(binary.BigEndian.AppendUint32(pub, uint32(id)))
+	sum = mac.Sum(nil)
+	var child secp256k1.ModNScalar
+	child.SetByteSlice(sum[:32])
+	child.Add(&parent)
+	if child.IsZero() {
+		return mavryk.PrivateKey{}, fmt.Errorf("invalid legacy child key %d", id)
+	}
+	seed := child.Bytes()
+	return mavryk.PrivateKey{
+		Type: mavryk.KeyTypeEd25519,
+		Data: ed25519.NewKeyFromSeed(seed[:]),
+	}, nil
 }
@@ -0,0 +1,72 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package compose
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+var testBaseKey = mavryk.MustParsePrivateKey("edsk3nM41ygNfSxVU4w1uAW3G9EnTQEB5rjojeZedLTGmiGRcierVv")
+
+// Addresses created by mvcompose releases which used go-bip32 for child keys.
+func TestDeriveLegacyChildKey(t *testing.T) {
+	for _, c := range []struct {
+		Id      int
+		Address string
+	}{
+		{0, "mv1QaQU8xQ1KjtmiMtNhaRywKSSxrz9cxBmd"},
+		{1, "mv1P56b7YAyscRt8WJ6kzJ9aoT1aWpp8hJqT"},
+		{7, "mv1PVCATsrhZACpLze9HmaQ7eLVuft3VCd4G"},
+	} {
+		sk, err := deriveLegacyChildKey(testBaseKey, c.Id)
+		if err != nil {
+			t.Fatalf("id %d: %v", c.Id, err)
+		}
+		if got := sk.Address().String(); got != c.Address {
+			t.Errorf("id %d: mismatched address got=%s want=%s", c.Id, got, c.Address)
+		}
+	}
+}
+
+func TestDeriveChildKeyRange(t *testing.T) {
+	for _, fn := range []func(mavryk.PrivateKey, int) (mavryk.PrivateKey, error){
+		deriveChildKey,
+		deriveLegacyChildKey,
+	} {
+		for _, id := range []int{-1, maxAccountId, 1<<32 + 1} {
+			if _, err := fn(testBaseKey, id); !errors.Is(err, ErrInvalidAccountId) {
+				t.Errorf("id %d: expected invalid id error, got %v", id, err)
+			}
+		}
+		if _, err := fn(testBaseKey, maxAccountId-1); err != nil {
+			t.Errorf("id %d: %v", maxAccountId-1, err)
+		}
+	}
+}
+
+func TestMakeAccountLegacy(t *testing.T) {
+	ctx := NewContext(context.Background())
+	ctx.WithBase(testBaseKey.String())
+	acc, err := ctx.MakeAccount(1, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := NewContext(context.Background())
+	legacy.WithBase(testBaseKey.String())
+	legacy.WithLegacyKeys(true)
+	lacc, err := legacy.MakeAccount(1, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := lacc.Address.String(), "mv1P56b7YAyscRt8WJ6kzJ9aoT1aWpp8hJqT"; got != want {
+		t.Errorf("mismatched legacy address got=%s want=%s", got, want)
+	}
+	if acc.Address.Equal(lacc.Address) {
+		t.Errorf("expected SLIP-10 and legacy accounts to differ")
+	}
+}
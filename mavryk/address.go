@@ -4,12 +4,14 @@
 package mavryk
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
 
 	"github.com/mavryk-network/gomavryk/base58"
+	"golang.org/x/crypto/blake2b"
 )
 
 var (
@@ -371,6 +373,21 @@ func (a Address) SmartRollupAddress() string {
 	return EncodeAddress(AddressTypeSmartRollup, a[1:])
 }
 
+// ContractAddressFromOrigination computes the address of a contract originated
+// by operation opHash. The protocol assigns an origination nonce to each
+// contract created while applying an operation group, starting at index 0
+// and counting both explicit and internal originations in execution order.
+// The address hash is blake2b-160 of the binary encoded nonce (operation hash
+// followed by the big-endian index).
+func ContractAddressFromOrigination(opHash OpHash, index uint32) Address {
+	var nonce [36]byte
+	copy(nonce[:], opHash[:])
+	binary.BigEndian.PutUint32(nonce[32:], index)
+	h, _ := blake2b.New(20, nil)
+	h.Write(nonce[:])
+	return NewAddress(AddressTypeContract, h.Sum(nil))
+}
+
 // Set implements the flags.Value interface for use in command line argument parsing.
 func (a *Address) Set(addr string) (err error) {
 	*a, err = ParseAddress(addr)
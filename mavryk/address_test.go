@@ -233,3 +233,26 @@ func BenchmarkAddressEncode(b *testing.B) {
 		_ = a.String()
 	}
 }
+
+func TestContractAddressFromOrigination(t *testing.T) {
+	// genesis bootstrap contracts use a fixed origination nonce
+	d := Digest([]byte("Un festival de GADT."))
+	h := NewOpHash(d[:])
+	cases := []struct {
+		Index uint32
+		Addr  string
+	}{
+		{0, "KT1QuofAgnsWffHzLA7D78rxytJruGHDe7XG"},
+		{1, "KT1CSKPf2jeLpMmrgKquN2bCjBTkAcAdRVDy"},
+		{31, "KT1VvXEpeBpreAVpfp4V8ZujqWu2gVykwXBJ"},
+	}
+	for i, c := range cases {
+		a := ContractAddressFromOrigination(h, c.Index)
+		if got := a.String(); got != c.Addr {
+			t.Errorf("Case %d: mismatched address got=%s want=%s", i, got, c.Addr)
+		}
+		if !a.IsContract() {
+			t.Errorf("Case %d: expected contract address type, got %s", i, a.Type())
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package mavryk
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	bls "github.com/cloudflare/circl/ecc/bls12381"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Mavryk uses the BLS12-381 min-pk variant (public keys in G1, signatures in G2)
+// with the message augmentation scheme for regular signatures and a separate
+// ciphersuite for proofs of possession.
+var (
+	blsSigDst = []byte("BLS_SIG_BLS12381G2_XMD:SHA-256_SSWU_RO_AUG_")
+	blsPopDst = []byte("BLS_POP_BLS12381G2_XMD:SHA-256_SSWU_RO_POP_")
+
+	blsKeygenSalt = []byte("BLS-SIG-KEYGEN-SALT-")
+)
+
+// blsKeyGen derives a secret key from input key material as defined in
+// https://datatracker.ietf.org/doc/html/draft-irtf-cfrg-bls-signature-05#section-2.3
+// The key is returned in the little-endian byte order used by Mavryk.
+func blsKeyGen(ikm []byte) ([]byte, error) {
+	if len(ikm) < 32 {
+		return nil, fmt.Errorf("mavryk: bls key material too short")
+	}
+	var (
+		sk   bls.Scalar
+		salt = blsKeygenSalt
+		okm  = make([]byte, 48)
+		km   = append(append([]byte{}, ikm...), 0)
+	)
+	for sk.IsZero() == 1 {
+		h := sha256.Sum256(salt)
+		salt = h[:]
+		r := hkdf.New(sha256.New, km, salt, []byte{0, 48})
+		if _, err := io.ReadFull(r, okm); err != nil {
+			return nil, err
+		}
+		sk.SetBytes(okm)
+	}
+	return blsScalarBytes(&sk), nil
+}
+
+func blsGenerateKey() ([]byte, error) {
+	ikm := make([]byte, 32)
+	if _, err := rand.Read(ikm); err != nil {
+		return nil, err
+	}
+	return blsKeyGen(ikm)
+}
+
+// blsScalarBytes encodes a scalar in little-endian byte order.
+func blsScalarBytes(s *bls.Scalar) []byte {
+	buf, _ := s.MarshalBinary()
+	reverseBytes(buf)
+	return buf
+}
+
+// blsScalarFromBytes decodes a little-endian encoded non-zero scalar.
+func blsScalarFromBytes(b []byte) (*bls.Scalar, error) {
+	if len(b) != bls.ScalarSize {
+		return nil, fmt.Errorf("mavryk: invalid bls secret key length %d", len(b))
+	}
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	reverseBytes(buf)
+	s := new(bls.Scalar)
+	if err := s.UnmarshalBinary(buf); err != nil || s.IsZero() == 1 {
+		return nil, fmt.Errorf("mavryk: invalid bls secret key")
+	}
+	return s, nil
+}
+
+func blsPublicKey(sk []byte) ([]byte, error) {
+	s, err := blsScalarFromBytes(sk)
+	if err != nil {
+		return nil, err
+	}
+	var pk bls.G1
+	pk.ScalarMult(s, bls.G1Generator())
+	return pk.BytesCompressed(), nil
+}
+
+func blsPublicKeyFromBytes(b []byte) (*bls.G1, error) {
+	pk := new(bls.G1)
+	if err := pk.SetBytes(b); err != nil {
+		return nil, fmt.Errorf("mavryk: invalid bls public key: %w", err)
+	}
+	if pk.IsIdentity() {
+		return nil, fmt.Errorf("mavryk: invalid bls public key: identity")
+	}
+	return pk, nil
+}
+
+func blsSignatureFromBytes(b []byte) (*bls.G2, error) {
+	sig := new(bls.G2)
+	if err := sig.SetBytes(b); err != nil {
+		return nil, fmt.Errorf("mavryk: invalid bls signature: %w", err)
+	}
+	return sig, nil
+}
+
+// blsSign signs msg (prefixed with the public key when aug is true) under
+// the domain separation tag dst.
+func blsSign(sk, msg, dst []byte, aug bool) ([]byte, error) {
+	s, err := blsScalarFromBytes(sk)
+	if err != nil {
+		return nil, err
+	}
+	if aug {
+		var pk bls.G1
+		pk.ScalarMult(s, bls.G1Generator())
+		msg = append(pk.BytesCompressed(), msg...)
+	}
+	var h bls.G2
+	h.Hash(msg, dst)
+	h.ScalarMult(s, &h)
+	return h.BytesCompressed(), nil
+}
+
+// blsVerify checks e(pk, H(msg)) == e(g1, sig) where msg is prefixed with
+// the public key when aug is true.
+func blsVerify(pk, msg, sig, dst []byte, aug bool) bool {
+	p, err := blsPublicKeyFromBytes(pk)
+	if err != nil {
+		return false
+	}
+	s, err := blsSignatureFromBytes(sig)
+	if err != nil {
+		return false
+	}
+	if aug {
+		msg = append(append([]byte{}, pk...), msg...)
+	}
+	var h bls.G2
+	h.Hash(msg, dst)
+	res := bls.ProdPairFrac(
+		[]*bls.G1{p, bls.G1Generator()},
+		[]*bls.G2{&h, s},
+		[]int{1, -1},
+	)
+	return res.IsIdentity()
+}
+
+func reverseBytes(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+// ProvePossession generates a proof of possession for a BLS12-381 private key.
+// The proof is a signature over the public key using the proof-of-possession
+// ciphersuite and is required when registering tz4 consensus keys.
+func (k PrivateKey) ProvePossession() (Signature, error) {
+	if k.Type != KeyTypeBls12_381 {
+		return InvalidSignature, ErrUnknownKeyType
+	}
+	pk, err := blsPublicKey(k.Data)
+	if err != nil {
+		return InvalidSignature, err
+	}
+	sig, err := blsSign(k.Data, pk, blsPopDst, false)
+	if err != nil {
+		return InvalidSignature, err
+	}
+	return NewSignature(SignatureTypeBls12_381, sig), nil
+}
+
+// VerifyPossession checks a proof of possession for a BLS12-381 public key.
+func (k Key) VerifyPossession(proof Signature) error {
+	if k.Type != KeyTypeBls12_381 {
+		return ErrUnknownKeyType
+	}
+	if len(proof.Data) != SignatureTypeBls12_381.Len() {
+		return ErrSignature
+	}
+	if !blsVerify(k.Data, k.Data, proof.Data, blsPopDst, false) {
+		return ErrSignature
+	}
+	return nil
+}
+
+// AggregateSignatures combines multiple BLS12-381 signatures into a single
+// signature of the same size. The result can be checked with VerifyAggregate.
+// Signatures must be of BLS12-381 type or generic signatures of BLS length.
+func AggregateSignatures(sigs []Signature) (Signature, error) {
+	if len(sigs) == 0 {
+		return InvalidSignature, fmt.Errorf("mavryk: empty signature list")
+	}
+	var agg bls.G2
+	agg.SetIdentity()
+	for i, v := range sigs {
+		isBls := v.Type == SignatureTypeBls12_381 || v.Type == SignatureTypeGeneric
+		if !isBls || len(v.Data) != SignatureTypeBls12_381.Len() {
+			return InvalidSignature, fmt.Errorf("mavryk: signature %d is not a BLS signature", i)
+		}
+		s, err := blsSignatureFromBytes(v.Data)
+		if err != nil {
+			return InvalidSignature, err
+		}
+		agg.Add(&agg, s)
+	}
+	return NewSignature(SignatureTypeBls12_381, agg.BytesCompressed()), nil
+}
+
+// VerifyAggregate checks an aggregate signature created by keys over msgs where
+// msgs[i] was signed by keys[i]. When msgs contains a single entry all keys are
+// expected to have signed the same message. Like Key.Verify, messages must be
+// passed unhashed.
+func VerifyAggregate(msgs [][]byte, keys []Key, sig Signature) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("mavryk: empty key list")
+	}
+	if len(msgs) != 1 && len(msgs) != len(keys) {
+		return fmt.Errorf("mavryk: mismatched message count %d for %d keys", len(msgs), len(keys))
+	}
+	if len(sig.Data) != SignatureTypeBls12_381.Len() {
+		return ErrSignature
+	}
+	s, err := blsSignatureFromBytes(sig.Data)
+	if err != nil {
+		return ErrSignature
+	}
+	var (
+		g1    = make([]*bls.G1, 0, len(keys)+1)
+		g2    = make([]*bls.G2, 0, len(keys)+1)
+		signs = make([]int, 0, len(keys)+1)
+	)
+	for i, k := range keys {
+		if k.Type != KeyTypeBls12_381 {
+			return fmt.Errorf("mavryk: key %d is not a BLS key", i)
+		}
+		pk, err := blsPublicKeyFromBytes(k.Data)
+		if err != nil {
+			return err
+		}
+		msg := msgs[0]
+		if len(msgs) > 1 {
+			msg = msgs[i]
+		}
+		h := new(bls.G2)
+		h.Hash(append(append([]byte{}, k.Data...), msg...), blsSigDst)
+		g1 = append(g1, pk)
+		g2 = append(g2, h)
+		signs = append(signs, 1)
+	}
+	g1 = append(g1, bls.G1Generator())
+	g2 = append(g2, s)
+	signs = append(signs, -1)
+	if !bls.ProdPairFrac(g1, g2, signs).IsIdentity() {
+		return ErrSignature
+	}
+	return nil
+}
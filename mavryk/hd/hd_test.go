@@ -0,0 +1,213 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package hd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+// SLIP-10 test vector 1
+var testSeed, _ = hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+
+func TestDerive(t *testing.T) {
+	cases := []struct {
+		Type  mavryk.KeyType
+		Path  string
+		Key   string
+		Chain string
+	}{
+		{
+			Type:  mavryk.KeyTypeEd25519,
+			Path:  "m",
+			Key:   "2b4be7f19ee27bbf30c667b642d5f4aa69fd169872f8fc3059c08ebae2eb19e7",
+			Chain: "90046a93de5380a72b5e45010748567d5ea02bbf6522f979e05c0d8d8ca9fffb",
+		},
+		{
+			Type: mavryk.KeyTypeEd25519,
+			Path: "m/0H",
+			Key:  "68e0fe46dfb67e368c75379acec591dad19df3cde26e63b93a8e704f1dade7a3",
+		},
+		{
+			Type: mavryk.KeyTypeEd25519,
+			Path: "m/0H/1H",
+			Key:  "b1d0bad404bf35da785a64ca1ac54b2617211d2777696fbffaf208f746ae84f2",
+		},
+		{
+			Type:  mavryk.KeyTypeSecp256k1,
+			Path:  "m",
+			Key:   "e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35",
+			Chain: "873dff81c02f525623fd1fe5167eac3a55a049de3d314bb42ee227ffed37d508",
+		},
+		{
+			Type: mavryk.KeyTypeSecp256k1,
+			Path: "m/0H",
+			Key:  "edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea",
+		},
+		{
+			Type: mavryk.KeyTypeSecp256k1,
+			Path: "m/0H/1",
+			Key:  "3c6cb8d0f6a264c91ea8b5030fadaa8e538b020f0a387421a12de9319dc93368",
+		},
+		{
+			Type: mavryk.KeyTypeP256,
+			Path: "m",
+			Key:  "612091aaa12e22dd2abef664f8a01a82cae99ad7441b7ef8110424915c268bc2",
+		},
+		{
+			Type: mavryk.KeyTypeP256,
+			Path: "m/0H",
+			Key:  "6939694369114c67917a182c59ddb8cafc3004e63ca5d3b84403ba8613debc0c",
+		},
+		{
+			Type: mavryk.KeyTypeP256,
+			Path: "m/0H/1",
+			Key:  "284e9d38d07d21e4e281b645089a94f4cf5a5a81369acf151a1c3a57f18b2129",
+		},
+	}
+	for i, c := range cases {
+		master, err := NewMasterKey(c.Type, testSeed)
+		if err != nil {
+			t.Fatalf("Case %d: master key error: %v", i, err)
+		}
+		k, err := master.DerivePath(MustParsePath(c.Path))
+		if err != nil {
+			t.Fatalf("Case %d: derive error: %v", i, err)
+		}
+		if got := hex.EncodeToString(k.Secret); got != c.Key {
+			t.Errorf("Case %d %s %s: key mismatch\n  have=%s\n  want=%s", i, c.Type, c.Path, got, c.Key)
+		}
+		if c.Chain != "" {
+			if got := hex.EncodeToString(k.ChainCode); got != c.Chain {
+				t.Errorf("Case %d %s %s: chain code mismatch\n  have=%s\n  want=%s", i, c.Type, c.Path, got, c.Chain)
+			}
+		}
+		sk := k.PrivateKey()
+		if !sk.IsValid() {
+			t.Errorf("Case %d: invalid private key", i)
+		}
+	}
+}
+
+func TestDeriveErrors(t *testing.T) {
+	master, err := NewMasterKey(mavryk.KeyTypeEd25519, testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.Derive(0); err != ErrHardenedOnly {
+		t.Errorf("expected ErrHardenedOnly, got %v", err)
+	}
+	if _, err := NewMasterKey(mavryk.KeyTypeBls12_381, testSeed); err == nil {
+		t.Errorf("expected error for bls key type")
+	}
+	if _, err := NewMasterKey(mavryk.KeyTypeEd25519, testSeed[:8]); err != ErrInvalidSeed {
+		t.Errorf("expected ErrInvalidSeed, got %v", err)
+	}
+}
+
+func TestMnemonic(t *testing.T) {
+	const mnemonic = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+	if !IsMnemonicValid(mnemonic) {
+		t.Fatalf("expected valid mnemonic")
+	}
+	if IsMnemonicValid("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon") {
+		t.Errorf("expected invalid checksum")
+	}
+	// BIP39 reference vector
+	seed, err := NewSeed(mnemonic, "TREZOR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := hex.DecodeString("c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04")
+	if !bytes.Equal(seed, want) {
+		t.Errorf("seed mismatch\n  have=%x\n  want=%x", seed, want)
+	}
+	// extra whitespace is tolerated
+	seed2, err := NewSeed("  abandon abandon abandon abandon abandon abandon\tabandon abandon abandon abandon abandon about ", "TREZOR")
+	if err != nil || !bytes.Equal(seed, seed2) {
+		t.Errorf("normalized seed mismatch: %v", err)
+	}
+	if _, err := NewSeed("foo bar", ""); err != ErrInvalidMnemonic {
+		t.Errorf("expected ErrInvalidMnemonic, got %v", err)
+	}
+
+	m, err := NewMnemonic(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsMnemonicValid(m) {
+		t.Errorf("generated mnemonic is invalid: %s", m)
+	}
+
+	// keys at m/44'/1729'/0'/0' cross-checked against independent SLIP-10
+	// (anyproto/go-slip10) and BIP32 (btcutil/hdkeychain) implementations
+	accounts := []struct {
+		Type mavryk.KeyType
+		Key  string
+		Addr string
+	}{
+		{
+			Type: mavryk.KeyTypeEd25519,
+			Key:  "edpku4US3ZykcZifjzSGFCmFr3zRgCKndE82estE4irj4d5oqDNDvf",
+			Addr: "mv1HmdN1hRxhJW1aeLpGJdvAuBY48z38JjVq",
+		},
+		{
+			Type: mavryk.KeyTypeSecp256k1,
+			Key:  "sppk7aR8GfP4tzTJFAmUpZ98GtgroEauCDtsNQpzRWP4sN6nmytbx6Y",
+			Addr: "mv2gqwoWdAJopQWB3cQsue5RBaqrKrSmpGWa",
+		},
+	}
+	for i, c := range accounts {
+		k, err := NewKeyFromMnemonic(c.Type, mnemonic, "", DefaultPath)
+		if err != nil {
+			t.Fatalf("Case %d: %v", i, err)
+		}
+		if got := k.PrivateKey().Public().String(); got != c.Key {
+			t.Errorf("Case %d: key mismatch\n  have=%s\n  want=%s", i, got, c.Key)
+		}
+		if got := k.Address().String(); got != c.Addr {
+			t.Errorf("Case %d: address mismatch\n  have=%s\n  want=%s", i, got, c.Addr)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	cases := []struct {
+		In  string
+		Out string
+		Err bool
+	}{
+		{In: "m", Out: "m"},
+		{In: "m/44'/1729'/0'/0'", Out: "m/44'/1729'/0'/0'"},
+		{In: "m/44h/1729H/1'/0", Out: "m/44'/1729'/1'/0"},
+		{In: "44'/1729'", Err: true},
+		{In: "m/foo", Err: true},
+		{In: "m/2147483648", Err: true},
+	}
+	for i, c := range cases {
+		p, err := ParsePath(c.In)
+		if c.Err {
+			if err == nil {
+				t.Errorf("Case %d: expected error for %q", i, c.In)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Case %d: unexpected error: %v", i, err)
+			continue
+		}
+		if got := p.String(); got != c.Out {
+			t.Errorf("Case %d: have=%s want=%s", i, got, c.Out)
+		}
+	}
+	if got := NewAccountPath(3).String(); got != "m/44'/1729'/3'/0'" {
+		t.Errorf("account path mismatch: %s", got)
+	}
+	if !DefaultPath.IsHardened() {
+		t.Errorf("expected hardened default path")
+	}
+}
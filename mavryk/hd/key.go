@@ -0,0 +1,183 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+// Package hd implements BIP39 mnemonics and SLIP-10 hierarchical deterministic
+// key derivation for ed25519, secp256k1 and P256 keys. Derived keys are
+// compatible with common Mavryk and Tezos wallets which use the derivation
+// path m/44'/1729'/account'/0'.
+package hd
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+var (
+	// ErrHardenedOnly is returned when deriving a non-hardened child from
+	// an ed25519 key.
+	ErrHardenedOnly = errors.New("hd: ed25519 supports hardened derivation only")
+
+	// ErrInvalidSeed is returned when the seed length is out of range.
+	ErrInvalidSeed = errors.New("hd: invalid seed length")
+)
+
+// curve seeds as defined in SLIP-10
+var (
+	ed25519Seed   = []byte("ed25519 seed")
+	secp256k1Seed = []byte("Bitcoin seed")
+	p256Seed      = []byte("Nist256p1 seed")
+)
+
+// Key is an extended private key consisting of a 32 byte secret and a
+// 32 byte chain code.
+type Key struct {
+	Type      mavryk.KeyType
+	Secret    []byte
+	ChainCode []byte
+}
+
+// NewMasterKey creates a SLIP-10 master key for the given curve from seed.
+func NewMasterKey(typ mavryk.KeyType, seed []byte) (*Key, error) {
+	if l := len(seed); l < 16 || l > 64 {
+		return nil, ErrInvalidSeed
+	}
+	var hmacKey []byte
+	switch typ {
+	case mavryk.KeyTypeEd25519:
+		hmacKey = ed25519Seed
+	case mavryk.KeyTypeSecp256k1:
+		hmacKey = secp256k1Seed
+	case mavryk.KeyTypeP256:
+		hmacKey = p256Seed
+	default:
+		return nil, fmt.Errorf("hd: unsupported key type %s", typ)
+	}
+	data := seed
+	for {
+		sum := hmacSha512(hmacKey, data)
+		k := &Key{
+			Type:      typ,
+			Secret:    sum[:32],
+			ChainCode: sum[32:],
+		}
+		if k.isValidSecret() {
+			return k, nil
+		}
+		data = sum
+	}
+}
+
+// NewKeyFromMnemonic derives a key for path from a BIP39 mnemonic and
+// optional password.
+func NewKeyFromMnemonic(typ mavryk.KeyType, mnemonic, password string, path Path) (*Key, error) {
+	seed, err := NewSeed(mnemonic, password)
+	if err != nil {
+		return nil, err
+	}
+	master, err := NewMasterKey(typ, seed)
+	if err != nil {
+		return nil, err
+	}
+	return master.DerivePath(path)
+}
+
+// DerivePath derives the child key at path relative to k.
+func (k *Key) DerivePath(path Path) (*Key, error) {
+	var err error
+	for _, i := range path {
+		k, err = k.Derive(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Derive derives the child key at index i. Indices at or above HardenedKeyStart
+// create hardened keys.
+func (k *Key) Derive(i uint32) (*Key, error) {
+	hardened := i >= HardenedKeyStart
+	if k.Type == mavryk.KeyTypeEd25519 && !hardened {
+		return nil, ErrHardenedOnly
+	}
+
+	data := make([]byte, 0, 37)
+	if hardened {
+		data = append(data, 0)
+		data = append(data, k.Secret...)
+	} else {
+		pk := k.PrivateKey().Public()
+		if !pk.IsValid() {
+			return nil, fmt.Errorf("hd: invalid %s key", k.Type)
+		}
+		data = append(data, pk.Data...)
+	}
+	data = binary.BigEndian.AppendUint32(data, i)
+
+	for {
+		sum := hmacSha512(k.ChainCode, data)
+		child := &Key{
+			Type:      k.Type,
+			Secret:    sum[:32],
+			ChainCode: sum[32:],
+		}
+		if k.Type == mavryk.KeyTypeEd25519 {
+			return child, nil
+		}
+
+		// k_i = parse256(IL) + k_par (mod n), retry when out of range
+		n := k.Type.Curve().Params().N
+		il := new(big.Int).SetBytes(child.Secret)
+		if il.Cmp(n) < 0 {
+			il.Add(il, new(big.Int).SetBytes(k.Secret))
+			il.Mod(il, n)
+			if il.Sign() != 0 {
+				child.Secret = il.FillBytes(make([]byte, 32))
+				return child, nil
+			}
+		}
+		data = append([]byte{1}, sum[32:]...)
+		data = binary.BigEndian.AppendUint32(data, i)
+	}
+}
+
+// PrivateKey converts the extended key into a Mavryk private key.
+func (k *Key) PrivateKey() mavryk.PrivateKey {
+	sk := mavryk.PrivateKey{
+		Type: k.Type,
+	}
+	switch k.Type {
+	case mavryk.KeyTypeEd25519:
+		sk.Data = []byte(ed25519.NewKeyFromSeed(k.Secret))
+	default:
+		sk.Data = make([]byte, len(k.Secret))
+		copy(sk.Data, k.Secret)
+	}
+	return sk
+}
+
+// Address returns the address of the derived key.
+func (k *Key) Address() mavryk.Address {
+	return k.PrivateKey().Address()
+}
+
+func (k *Key) isValidSecret() bool {
+	if k.Type == mavryk.KeyTypeEd25519 {
+		return true
+	}
+	s := new(big.Int).SetBytes(k.Secret)
+	return s.Sign() != 0 && s.Cmp(k.Type.Curve().Params().N) < 0
+}
+
+func hmacSha512(key, data []byte) []byte {
+	h := hmac.New(sha512.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
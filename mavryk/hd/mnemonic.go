@@ -0,0 +1,44 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package hd
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39"
+)
+
+// ErrInvalidMnemonic is returned when a mnemonic has unknown words or a
+// wrong checksum.
+var ErrInvalidMnemonic = errors.New("hd: invalid mnemonic")
+
+// NewMnemonic creates a random BIP39 mnemonic with the given entropy size in
+// bits. Size must be a multiple of 32 between 128 (12 words) and 256 (24 words).
+func NewMnemonic(bits int) (string, error) {
+	entropy, err := bip39.NewEntropy(bits)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// IsMnemonicValid checks words and checksum of a BIP39 mnemonic.
+func IsMnemonicValid(mnemonic string) bool {
+	return bip39.IsMnemonicValid(normalizeMnemonic(mnemonic))
+}
+
+// NewSeed converts a BIP39 mnemonic and optional password into a 64 byte seed
+// after validating the mnemonic checksum.
+func NewSeed(mnemonic, password string) ([]byte, error) {
+	mnemonic = normalizeMnemonic(mnemonic)
+	if !bip39.IsMnemonicValid(mnemonic) {
+		return nil, ErrInvalidMnemonic
+	}
+	return bip39.NewSeed(mnemonic, password), nil
+}
+
+func normalizeMnemonic(mnemonic string) string {
+	return strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+}
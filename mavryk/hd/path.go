@@ -0,0 +1,109 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package hd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// HardenedKeyStart is the index of the first hardened child key.
+const HardenedKeyStart uint32 = 0x80000000
+
+// MavrykCoinType is the SLIP-44 coin type used for Mavryk (and Tezos) keys.
+const MavrykCoinType uint32 = 1729
+
+// DefaultPath is the derivation path used by common Mavryk wallets for the
+// first account.
+var DefaultPath = MustParsePath("m/44'/1729'/0'/0'")
+
+// Path is a BIP32 derivation path represented as list of child indices.
+type Path []uint32
+
+// NewAccountPath returns the common wallet derivation path
+// m/44'/1729'/account'/0' for account.
+func NewAccountPath(account uint32) Path {
+	return Path{
+		44 | HardenedKeyStart,
+		MavrykCoinType | HardenedKeyStart,
+		account | HardenedKeyStart,
+		HardenedKeyStart,
+	}
+}
+
+// ParsePath parses a derivation path like m/44'/1729'/0'/0'. Hardened
+// indices are marked with a trailing ' or h.
+func ParsePath(s string) (Path, error) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts) == 0 || parts[0] != "m" {
+		return nil, fmt.Errorf("hd: invalid path %q", s)
+	}
+	p := make(Path, 0, len(parts)-1)
+	for _, v := range parts[1:] {
+		var offset uint32
+		if strings.HasSuffix(v, "'") || strings.HasSuffix(v, "h") || strings.HasSuffix(v, "H") {
+			offset = HardenedKeyStart
+			v = v[:len(v)-1]
+		}
+		i, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || uint32(i) >= HardenedKeyStart {
+			return nil, fmt.Errorf("hd: invalid path index %q in %q", v, s)
+		}
+		p = append(p, uint32(i)+offset)
+	}
+	return p, nil
+}
+
+func MustParsePath(s string) Path {
+	p, err := ParsePath(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// IsHardened returns true when all path elements are hardened.
+func (p Path) IsHardened() bool {
+	for _, v := range p {
+		if v < HardenedKeyStart {
+			return false
+		}
+	}
+	return true
+}
+
+func (p Path) String() string {
+	var b strings.Builder
+	b.WriteString("m")
+	for _, v := range p {
+		b.WriteByte('/')
+		if v >= HardenedKeyStart {
+			b.WriteString(strconv.FormatUint(uint64(v-HardenedKeyStart), 10))
+			b.WriteByte('\'')
+		} else {
+			b.WriteString(strconv.FormatUint(uint64(v), 10))
+		}
+	}
+	return b.String()
+}
+
+func (p Path) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Path) UnmarshalText(data []byte) error {
+	path, err := ParsePath(string(data))
+	if err != nil {
+		return err
+	}
+	*p = path
+	return nil
+}
+
+// Set implements the flags.Value interface for use in command line argument parsing.
+func (p *Path) Set(s string) (err error) {
+	*p, err = ParsePath(s)
+	return
+}
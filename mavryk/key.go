@@ -167,7 +167,7 @@ func (t KeyType) SkePrefixBytes() []byte {
 	case KeyTypeP256:
 		return P256_ENCRYPTED_SECRET_KEY_ID
 	case KeyTypeBls12_381:
-		return BLS12_381_SECRET_KEY_ID
+		return BLS12_381_ENCRYPTED_SECRET_KEY_ID
 	default:
 		return nil
 	}
@@ -320,7 +320,10 @@ func NewKey(typ KeyType, data []byte) Key {
 	}
 }
 
-// Verify verifies the signature using the public key.
+// Verify verifies the signature using the public key. For BLS12-381 keys
+// signatures are defined over the unhashed message, so hash must contain
+// the full (watermarked) message instead of its digest. Use VerifyMessage
+// to verify a message independent of the key type.
 func (k Key) Verify(hash []byte, sig Signature) error {
 	switch k.Type {
 	case KeyTypeEd25519:
@@ -338,11 +341,29 @@ func (k Key) Verify(hash []byte, sig Signature) error {
 			return ErrSignature
 		}
 	case KeyTypeBls12_381:
-		// TODO
+		if len(sig.Data) != SignatureTypeBls12_381.Len() {
+			return ErrSignature
+		}
+		if ok := blsVerify(k.Data, hash, sig.Data, blsSigDst, true); !ok {
+			return ErrSignature
+		}
+	default:
+		return ErrUnknownKeyType
 	}
 	return nil
 }
 
+// VerifyMessage verifies the signature over a full (watermarked) message.
+// BLS12-381 signatures cover the message itself, signatures of all other
+// key types cover its blake2b digest.
+func (k Key) VerifyMessage(msg []byte, sig Signature) error {
+	if k.Type == KeyTypeBls12_381 {
+		return k.Verify(msg, sig)
+	}
+	digest := Digest(msg)
+	return k.Verify(digest[:], sig)
+}
+
 func (k Key) IsValid() bool {
 	return k.Type.IsValid() && k.Type.PkHashType().Len == len(k.Data)
 }
@@ -567,7 +588,13 @@ func GenerateKey(typ KeyType) (PrivateKey, error) {
 		key.Data = make([]byte, typ.SkHashType().Len)
 		ecKey.D.FillBytes(key.Data)
 	case KeyTypeBls12_381:
-		// TODO
+		sk, err := blsGenerateKey()
+		if err != nil {
+			return key, err
+		}
+		key.Data = sk
+	default:
+		return key, ErrUnknownKeyType
 	}
 	return key, nil
 }
@@ -589,7 +616,14 @@ func (k PrivateKey) Public() Key {
 		}
 		pk.Data = elliptic.MarshalCompressed(curve, ecKey.PublicKey.X, ecKey.PublicKey.Y)
 	case KeyTypeBls12_381:
-		// TODO
+		buf, err := blsPublicKey(k.Data)
+		if err != nil {
+			pk.Type = KeyTypeInvalid
+			return pk
+		}
+		pk.Data = buf
+	default:
+		pk.Type = KeyTypeInvalid
 	}
 	return pk
 }
@@ -600,10 +634,10 @@ func (k PrivateKey) Encrypt(fn PassphraseFunc) (string, error) {
 	switch k.Type {
 	case KeyTypeEd25519:
 		buf = ed25519.PrivateKey(k.Data).Seed()
-	case KeyTypeSecp256k1, KeyTypeP256:
+	case KeyTypeSecp256k1, KeyTypeP256, KeyTypeBls12_381:
 		buf = k.Data
-	case KeyTypeBls12_381:
-		// TODO
+	default:
+		return "", ErrUnknownKeyType
 	}
 	enc, err := encryptPrivateKey(buf, fn)
 	if err != nil {
@@ -612,7 +646,10 @@ func (k PrivateKey) Encrypt(fn PassphraseFunc) (string, error) {
 	return base58.CheckEncode(enc, k.Type.SkePrefixBytes()), nil
 }
 
-// Sign signs the digest (hash) of a message with the private key.
+// Sign signs the digest (hash) of a message with the private key. BLS12-381
+// keys sign the unhashed message, so callers must pass the full (watermarked)
+// message instead of its digest. Use SignMessage to sign a message
+// independent of the key type.
 func (k PrivateKey) Sign(hash []byte) (Signature, error) {
 	switch k.Type {
 	case KeyTypeEd25519:
@@ -635,13 +672,28 @@ func (k PrivateKey) Sign(hash []byte) (Signature, error) {
 		sig.Data, err = ecSign(ecKey, hash)
 		return sig, err
 	case KeyTypeBls12_381:
-		// TODO
-		return Signature{}, ErrUnknownKeyType
+		sig := Signature{
+			Type: SignatureTypeBls12_381,
+		}
+		var err error
+		sig.Data, err = blsSign(k.Data, hash, blsSigDst, true)
+		return sig, err
 	default:
 		return Signature{}, ErrUnknownKeyType
 	}
 }
 
+// SignMessage signs a full (watermarked) message with the private key.
+// BLS12-381 keys sign the message itself, all other key types sign its
+// blake2b digest.
+func (k PrivateKey) SignMessage(msg []byte) (Signature, error) {
+	if k.Type == KeyTypeBls12_381 {
+		return k.Sign(msg)
+	}
+	digest := Digest(msg)
+	return k.Sign(digest[:])
+}
+
 // ParseEncryptedPrivateKey attempts to parse and optionally decrypt a
 // Mavryk private key. When an encrypted key is detected, fn is called
 // and expected to return the decoding passphrase.
@@ -4,6 +4,8 @@
 package mavryk
 
 import (
+	"encoding/hex"
+	"math/big"
 	"testing"
 )
 
@@ -35,11 +37,11 @@ func TestKey(t *testing.T) {
 			Address: MustParseAddress("mv3HZmYPLDjLYmRxv99GyRNHcAmCeVNVMgDR"),
 		},
 		// bls12_381 unencrypted
-		// {
-		//     Priv:    "BLsk1eGhiPQXKtvvkBeXzmtVVJs6KPhEF45drF7MLjoCDcSnTGuyjL",
-		//     Pub:     "BLpk1ur5XXicWYMMzCVZZWyLZhybtyX8Zot2uCzDCZW8KcC5BdZiLVXRZvZzi4GuZYL9SarUvKpE",
-		//     Address: MustParseAddress("tz4TFJdv9Jd44FtBMAxi3KQT7AtazhVyaPa6"),
-		// },
+		{
+			Priv:    "BLsk1eGhiPQXKtvvkBeXzmtVVJs6KPhEF45drF7MLjoCDcSnTGuyjL",
+			Pub:     "BLpk1ur5XXicWYMMzCVZZWyLZhybtyX8Zot2uCzDCZW8KcC5BdZiLVXRZvZzi4GuZYL9SarUvKpE",
+			Address: MustParseAddress("mv4exNvckxdb6QUqdaYycTabXyP4p2mNoios"),
+		},
 		// ed25519 encrypted
 		{
 			Priv:    "edesk1uiM6BaysskGto8pRtzKQqFqsy1sea1QRjTzaQYuBxYNhuN6eqEU78TGRXZocsVRJYcN7AaU9JDykwUd8KW",
@@ -61,6 +63,13 @@ func TestKey(t *testing.T) {
 			Address: MustParseAddress("mv3CwX4KpwPXcoU9hw4VFtNUpkcadtynsrxB"),
 			Pass:    "foo",
 		},
+		// bls12_381 encrypted
+		{
+			Priv:    "BLesk1iDqoKGMc9fNpgXcYTjgXQg2LTypGckeDVSNddUfyUQURSQjKKrmFUMj7ZUtHLaBz7KtxtXcwXMuoTLFPHL",
+			Pub:     "BLpk1ur5XXicWYMMzCVZZWyLZhybtyX8Zot2uCzDCZW8KcC5BdZiLVXRZvZzi4GuZYL9SarUvKpE",
+			Address: MustParseAddress("mv4exNvckxdb6QUqdaYycTabXyP4p2mNoios"),
+			Pass:    "foo",
+		},
 	}
 
 	for i, c := range cases {
@@ -131,6 +140,12 @@ func TestSign(t *testing.T) {
 			Pub:  "p2pk64zMPtYav6yiaHV2DhSQ65gbKMr3gkLQtK7TTQCpJEVUhxxEnxo",
 			Msg:  "hello",
 		},
+		// bls12_381 unencrypted
+		{
+			Priv: "BLsk1eGhiPQXKtvvkBeXzmtVVJs6KPhEF45drF7MLjoCDcSnTGuyjL",
+			Pub:  "BLpk1ur5XXicWYMMzCVZZWyLZhybtyX8Zot2uCzDCZW8KcC5BdZiLVXRZvZzi4GuZYL9SarUvKpE",
+			Msg:  "hello",
+		},
 	}
 
 	for i, c := range cases {
@@ -147,8 +162,146 @@ func TestSign(t *testing.T) {
 		if err := pk.Verify(digest[:], sig); err != nil {
 			t.Errorf("Case %d - Verify failed %v", i, err)
 		}
+
+		// message signatures hash the message unless the key is BLS
+		msig, err := sk.SignMessage([]byte(c.Msg))
+		if err != nil {
+			t.Errorf("Case %d - Signing message failed: %v", i, err)
+		}
+		if err := pk.VerifyMessage([]byte(c.Msg), msig); err != nil {
+			t.Errorf("Case %d - Verify message failed %v", i, err)
+		}
+		want := digest[:]
+		if sk.Type == KeyTypeBls12_381 {
+			want = []byte(c.Msg)
+		}
+		if err := pk.Verify(want, msig); err != nil {
+			t.Errorf("Case %d - Verify message signature failed %v", i, err)
+		}
+		if sig.Type == SignatureTypeBls12_381 {
+			// no generic 64 byte encoding for BLS signatures
+			continue
+		}
 		if err := pk.Verify(digest[:], MustParseSignature(sig.Generic())); err != nil {
 			t.Errorf("Case %d - Verify generic failed %v", i, err)
 		}
 	}
 }
+
+func TestBlsKey(t *testing.T) {
+	for i := 0; i < 4; i++ {
+		sk, err := GenerateKey(KeyTypeBls12_381)
+		if err != nil {
+			t.Fatalf("Case %d - Generate key: %v", i, err)
+		}
+		if !sk.IsValid() {
+			t.Fatalf("Case %d - Expected valid key %s", i, sk)
+		}
+		pk := sk.Public()
+		if !pk.IsValid() {
+			t.Fatalf("Case %d - Expected valid pubkey %s", i, pk)
+		}
+
+		// encrypted round-trip
+		pass := func() ([]byte, error) { return []byte("foo"), nil }
+		enc, err := sk.Encrypt(pass)
+		if err != nil {
+			t.Fatalf("Case %d - Encrypt key: %v", i, err)
+		}
+		if !IsEncryptedKey(enc) {
+			t.Errorf("Case %d - Expected encrypted key %s", i, enc)
+		}
+		sk2, err := ParseEncryptedPrivateKey(enc, pass)
+		if err != nil {
+			t.Fatalf("Case %d - Parsing encrypted key %s: %v", i, enc, err)
+		}
+		if sk2.String() != sk.String() {
+			t.Errorf("Case %d - Mismatch decrypted key have=%s want=%s", i, sk2, sk)
+		}
+
+		// signatures
+		msg := []byte("hello")
+		sig, err := sk.Sign(msg)
+		if err != nil {
+			t.Fatalf("Case %d - Signing failed: %v", i, err)
+		}
+		if !sig.IsValid() || sig.Type != SignatureTypeBls12_381 {
+			t.Errorf("Case %d - Invalid signature %s", i, sig)
+		}
+		if err := pk.Verify(msg, MustParseSignature(sig.String())); err != nil {
+			t.Errorf("Case %d - Verify failed %v", i, err)
+		}
+		if err := pk.Verify([]byte("hellO"), sig); err == nil {
+			t.Errorf("Case %d - Expected verify error on wrong message", i)
+		}
+		if err := MustParseKey("BLpk1ur5XXicWYMMzCVZZWyLZhybtyX8Zot2uCzDCZW8KcC5BdZiLVXRZvZzi4GuZYL9SarUvKpE").Verify(msg, sig); err == nil {
+			t.Errorf("Case %d - Expected verify error on wrong key", i)
+		}
+
+		// proof of possession
+		proof, err := sk.ProvePossession()
+		if err != nil {
+			t.Fatalf("Case %d - Proof of possession failed: %v", i, err)
+		}
+		if err := pk.VerifyPossession(proof); err != nil {
+			t.Errorf("Case %d - Verify proof failed %v", i, err)
+		}
+		if err := pk.VerifyPossession(sig); err == nil {
+			t.Errorf("Case %d - Expected proof error on regular signature", i)
+		}
+	}
+}
+
+// TestBlsVector pins keys and signatures of the min-pk augmented ciphersuite.
+// The secret key is test case 0 of EIP-2333 which uses the same HKDF key
+// derivation. Public key, signatures and proof of possession were produced by
+// this implementation to detect regressions, they are no external vectors.
+func TestBlsVector(t *testing.T) {
+	ikm, _ := hex.DecodeString("c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04")
+	buf, err := blsKeyGen(ikm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := append([]byte{}, buf...)
+	reverseBytes(be)
+	if got, want := new(big.Int).SetBytes(be).String(), "6083874454709270928345386274498605044986640685124978867557563392430687146096"; got != want {
+		t.Fatalf("mismatched secret key got=%s want=%s", got, want)
+	}
+	sk := PrivateKey{Type: KeyTypeBls12_381, Data: buf}
+	if got, want := sk.String(), "BLsk2MNnHg7PobiyXCdrrAzkXQxMBebhe1SghmYwUELjih2PKrXVqg"; got != want {
+		t.Errorf("mismatched private key got=%s want=%s", got, want)
+	}
+	pk := sk.Public()
+	if got, want := pk.String(), "BLpk1tzco2H1GP9tebXGHEdgvTtnAaL1u63jn74hK4kKdbcakEgQV5gLook6pNWb5mMQzbwumdcJ"; got != want {
+		t.Errorf("mismatched public key got=%s want=%s", got, want)
+	}
+	for _, v := range []struct {
+		msg string
+		sig string
+	}{
+		{"", "8776eb4ccc50b48c97357fefeb3428b5ed8282a85734a401a854975150e12be8ae278a2839c6c7faab0178914eee4ef0099fba95ff8e5795c21a4ff5123ec14a1061802831b1bda07794d4f539b5c67eb6cde3ea4c024147dcc1a5030ea58bab"},
+		{"abc", "96fdddee74c9f90d60b7f782bbdbdb38737e12c175c7fdefe112f8d32bfaa61529133865d99583b2d5669d6434458d1016f7db6bdecbcf84a90c6e20345ca4918bb7bb02519ba9e000cc8cd78e4d29854b8e1a85fdd474de9771830fd954a7d0"},
+	} {
+		sig, err := sk.Sign([]byte(v.msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(sig.Data); got != v.sig {
+			t.Errorf("%q: mismatched signature got=%s want=%s", v.msg, got, v.sig)
+		}
+		if err := pk.Verify([]byte(v.msg), sig); err != nil {
+			t.Errorf("%q: verify failed: %v", v.msg, err)
+		}
+		// the signed message is augmented with the public key
+		if blsVerify(pk.Data, []byte(v.msg), sig.Data, blsSigDst, false) {
+			t.Errorf("%q: signature verifies without augmentation", v.msg)
+		}
+	}
+	proof, err := sk.ProvePossession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := proof.String(), "BLsig9uUim6QBKXMLqVqAoCFeiJDcHQcuyASh9hFqbJN8iBivr1jem3i5z955UGjJv2tnQBBYVT2XkvnRgh8mTA8eWQXoKMkTXP8qUcYBCdfYahaCUVMN3wcFxqQH2PvSquZhY86ohZhhF"; got != want {
+		t.Errorf("mismatched proof of possession got=%s want=%s", got, want)
+	}
+}
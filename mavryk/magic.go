@@ -7,6 +7,9 @@ const (
 	Name   = "Mavryk"
 	Symbol = "MVRK"
 
+	// number of decimals in MVRK amounts, 1 MVRK = 10^6 mumav
+	Decimals = 6
+
 	// base58 prefixes for 4 byte hash magics
 	CHAIN_ID_PREFIX = "Net"
 
@@ -150,3 +150,158 @@ func TestInvalidSig(t *testing.T) {
 	//     t.Errorf("Expected unmarshal error from invalid buffer")
 	// }
 }
+
+func TestAggregateSig(t *testing.T) {
+	var (
+		keys = make([]Key, 3)
+		sigs = make([]Signature, 3)
+		msgs = make([][]byte, 3)
+		same = make([]Signature, 3)
+	)
+	for i := range keys {
+		sk, err := GenerateKey(KeyTypeBls12_381)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		keys[i] = sk.Public()
+		msgs[i] = []byte{byte(i), 'm', 's', 'g'}
+		sigs[i], err = sk.Sign(msgs[i])
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		same[i], err = sk.Sign([]byte("hello"))
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+	}
+
+	agg, err := AggregateSignatures(sigs)
+	if err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+
+	// text and binary round-trips
+	sig, err := ParseSignature(agg.String())
+	if err != nil {
+		t.Fatalf("parsing aggregate signature %s: %v", agg, err)
+	}
+	if !sig.Equal(agg) {
+		t.Errorf("mismatched signature got=%s want=%s", sig, agg)
+	}
+	buf, err := agg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal binary: %v", err)
+	}
+	var s2 Signature
+	if err := s2.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("unmarshal binary: %v", err)
+	}
+	if !s2.Equal(agg) {
+		t.Errorf("mismatched signature got=%s want=%s", s2, agg)
+	}
+
+	if err := VerifyAggregate(msgs, keys, sig); err != nil {
+		t.Errorf("verify aggregate: %v", err)
+	}
+	if err := VerifyAggregate(msgs[:2], keys[:2], sig); err == nil {
+		t.Errorf("expected verify error on missing signer")
+	}
+	msgs[0], msgs[1] = msgs[1], msgs[0]
+	if err := VerifyAggregate(msgs, keys, sig); err == nil {
+		t.Errorf("expected verify error on swapped messages")
+	}
+
+	// same message
+	agg, err = AggregateSignatures(same)
+	if err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	if err := VerifyAggregate([][]byte{[]byte("hello")}, keys, agg); err != nil {
+		t.Errorf("verify aggregate same message: %v", err)
+	}
+}
+
+func TestAggregateSigMixed(t *testing.T) {
+	sk, err := GenerateKey(KeyTypeBls12_381)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	bsig, err := sk.Sign([]byte("msg"))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	ed, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	esig, err := ed.Sign([]byte("msg"))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if _, err := AggregateSignatures([]Signature{bsig, esig}); err == nil {
+		t.Errorf("expected error on mixed signature types")
+	}
+	for _, typ := range []SignatureType{SignatureTypeEd25519, SignatureTypeSecp256k1, SignatureTypeP256} {
+		// non-BLS type with BLS sized data
+		fake := NewSignature(typ, bsig.Data)
+		if _, err := AggregateSignatures([]Signature{bsig, fake}); err == nil {
+			t.Errorf("expected error on %s signature", typ)
+		}
+	}
+	gen := NewSignature(SignatureTypeGeneric, bsig.Data)
+	if _, err := AggregateSignatures([]Signature{bsig, gen}); err != nil {
+		t.Errorf("generic BLS sized signature: %v", err)
+	}
+}
+
+func TestAggregateSigVector(t *testing.T) {
+	// keys derived from 32 byte key material 0x01.., 0x02.., 0x03.., each
+	// key i signs message {i, 'm', 's', 'g'}
+	var (
+		sks = []string{
+			"BLsk2RSaorNaYn3v7iVe1hrKQ7zKGnD3gG9AWkxCVqj8VgJ9eeet2u",
+			"BLsk2ahop6afgLEBwSiWbNRJRkorwVqirUovq7RVo5t7b5kBYeYFwm",
+			"BLsk3DoWyNZUgHseMYa1XTkBctaQxaEyPD95uTx4aTXRX7qcBpeWM2",
+		}
+		pks = []string{
+			"BLpk1qqW4ebiQL5vzoMZZQW2hk1pCqRAaLgKQGKDJN3wDtTmdHfFhh6hJtZqhwBpHGWTimUBiBdM",
+			"BLpk1wKszGvZAoYHvT97VQ22XgM3QpNmZF9bpSevZnKHoLR9CzftoPNdY5T1NMDionCgHuMGffPs",
+			"BLpk1r8kKD81TTMZQNWzNDkmJ2rEo1826w1vgQFh59RVYGHpBgevUEwk6YAZSZAnaV7Vw9HdhU12",
+		}
+		want = MustParseSignature("BLsig9a7KgoBuMwrGHn9DiiLFjqqh9qoyCL4m2DjDWcCzJ1KNAYiMQcu9EgqyN9vkLWzFPdzBjGjjNUqmLQ6oQAAtygCJDnWKNMY27LycTXASSgvfxLRi1ybkd1AstYDj4Pi7Cw1qUFPc1")
+		keys = make([]Key, len(pks))
+		sigs = make([]Signature, len(sks))
+		msgs = make([][]byte, len(sks))
+	)
+	for i := range sks {
+		sk := MustParsePrivateKey(sks[i])
+		ikm := bytes.Repeat([]byte{byte(i + 1)}, 32)
+		if data, err := blsKeyGen(ikm); err != nil || !bytes.Equal(data, sk.Data) {
+			t.Errorf("key %d: mismatched derived key got=%x want=%x", i, data, sk.Data)
+		}
+		keys[i] = MustParseKey(pks[i])
+		if sk.Public().String() != keys[i].String() {
+			t.Errorf("key %d: mismatched public key got=%s want=%s", i, sk.Public(), keys[i])
+		}
+		msgs[i] = []byte{byte(i), 'm', 's', 'g'}
+		var err error
+		sigs[i], err = sk.Sign(msgs[i])
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+	}
+	agg, err := AggregateSignatures(sigs)
+	if err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	if !agg.Equal(want) {
+		t.Errorf("mismatched aggregate signature got=%s want=%s", agg, want)
+	}
+	if err := VerifyAggregate(msgs, keys, want); err != nil {
+		t.Errorf("verify aggregate: %v", err)
+	}
+	msgs[2] = []byte{2, 'm', 's', 'G'}
+	if err := VerifyAggregate(msgs, keys, want); err == nil {
+		t.Errorf("expected verify error on modified message")
+	}
+}
@@ -91,6 +91,11 @@ func (r Ratio) Float64() float64 {
 	return float64(r.Num) / float64(r.Den)
 }
 
+// FormatMumav renders a mumav amount as MVRK with all decimals.
+func FormatMumav(v int64) string {
+	return NewZ(v).Decimals(Decimals)
+}
+
 func Short(v any) string {
 	var s string
 	if str, ok := v.(fmt.Stringer); ok {
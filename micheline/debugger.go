@@ -0,0 +1,187 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+var errDebugAborted = errors.New("micheline: debug session closed")
+
+type debugMode byte
+
+const (
+	debugStep debugMode = iota
+	debugContinue
+)
+
+// Debugger executes a script on the local interpreter step by step. It pauses
+// before instructions, either before every instruction when stepping or
+// at breakpoints when continuing. Breakpoints are canonical locations as
+// returned by Tracer.Location. Instructions of lambdas and views of other
+// contracts cannot be used as breakpoints but they can be stepped through.
+//
+// A Debugger is not safe for concurrent use. Close must be called when the
+// run is not executed to its end.
+type Debugger struct {
+	tracer   *Tracer
+	breaks   map[int]bool
+	mode     debugMode
+	cmd      chan debugMode
+	paused   chan TraceStep
+	abort    chan struct{}
+	done     chan struct{}
+	cur      TraceStep
+	started  bool
+	finished bool
+	closed   bool
+	res      *RunResult
+	err      error
+}
+
+// Debug prepares a local run of the contract code like Run without executing
+// it. Execution starts with the first call to Step or Continue. The source
+// map is optional.
+func (c Code) Debug(ctx context.Context, param, storage Prim, env *RunEnv, src *SourceMap) (*Debugger, error) {
+	t, err := NewTracer(c, src)
+	if err != nil {
+		return nil, err
+	}
+	d := &Debugger{
+		tracer: t,
+		breaks: make(map[int]bool),
+		cmd:    make(chan debugMode),
+		paused: make(chan TraceStep),
+		abort:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(d.done)
+		select {
+		case d.mode = <-d.cmd:
+		case <-d.abort:
+			d.err = errDebugAborted
+			return
+		}
+		d.res, d.err = c.run(ctx, param, storage, env, d.hook)
+	}()
+	return d, nil
+}
+
+// hook runs on the interpreter goroutine and blocks while execution is paused.
+func (d *Debugger) hook(ip *interp, in *instr, st Stack, after bool) error {
+	if after {
+		return nil
+	}
+	step := d.tracer.localStep(ip, in, in.in, st)
+	if d.mode != debugStep && (step.Location < 0 || !d.breaks[step.Location]) {
+		return nil
+	}
+	select {
+	case d.paused <- step:
+	case <-d.abort:
+		return errDebugAborted
+	}
+	select {
+	case d.mode = <-d.cmd:
+		return nil
+	case <-d.abort:
+		return errDebugAborted
+	}
+}
+
+// Tracer returns the tracer used to map locations of the debugged script.
+func (d *Debugger) Tracer() *Tracer {
+	return d.tracer
+}
+
+// SetBreakpoint adds a breakpoint at canonical location loc.
+func (d *Debugger) SetBreakpoint(loc int) {
+	d.breaks[loc] = true
+}
+
+// ClearBreakpoint removes the breakpoint at canonical location loc.
+func (d *Debugger) ClearBreakpoint(loc int) {
+	delete(d.breaks, loc)
+}
+
+// Breakpoints returns all breakpoint locations in ascending order.
+func (d *Debugger) Breakpoints() []int {
+	locs := make([]int, 0, len(d.breaks))
+	for loc := range d.breaks {
+		locs = append(locs, loc)
+	}
+	sort.Ints(locs)
+	return locs
+}
+
+// Step executes until before the next instruction. It returns false when
+// execution has finished.
+func (d *Debugger) Step() bool {
+	return d.resume(debugStep)
+}
+
+// Continue executes until before the next instruction at a breakpoint. It
+// returns false when execution has finished.
+func (d *Debugger) Continue() bool {
+	return d.resume(debugContinue)
+}
+
+func (d *Debugger) resume(mode debugMode) bool {
+	if d.finished || d.closed {
+		return false
+	}
+	d.started = true
+	d.cmd <- mode
+	select {
+	case d.cur = <-d.paused:
+		return true
+	case <-d.done:
+		d.finished = true
+		d.cur = TraceStep{}
+		return false
+	}
+}
+
+// Current returns the instruction execution is paused at. The stack holds
+// typed values before the instruction with the top element first. Gas is
+// the consumed milligas so far. It returns false when execution is not
+// paused.
+func (d *Debugger) Current() (TraceStep, bool) {
+	return d.cur, d.started && !d.finished && !d.closed
+}
+
+// Stack returns the typed stack at the current instruction with the top
+// element first.
+func (d *Debugger) Stack() []Value {
+	return d.cur.Stack
+}
+
+// Done returns true when execution has finished.
+func (d *Debugger) Done() bool {
+	return d.finished
+}
+
+// Result returns the result of a finished run. Failures are returned as
+// *RuntimeError like in Run.
+func (d *Debugger) Result() (*RunResult, error) {
+	if !d.finished {
+		return nil, errors.New("micheline: debug run not finished")
+	}
+	return d.res, d.err
+}
+
+// Close stops a run which has not finished and releases its resources.
+func (d *Debugger) Close() {
+	if d.closed {
+		return
+	}
+	d.closed = true
+	if !d.finished {
+		close(d.abort)
+		<-d.done
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+const michelsonIndent = "  "
+
+// Michelson returns p formatted in Michelson concrete syntax. Types and data
+// are printed on a single line while instruction sequences are printed with one
+// instruction per line.
+func (p Prim) Michelson() string {
+	var b strings.Builder
+	p.formatExpr(&b, 0)
+	return b.String()
+}
+
+// Michelson returns the contract formatted in Michelson concrete syntax as used
+// in .tz files.
+func (c Code) Michelson() string {
+	var b strings.Builder
+	list := []Prim{c.Param, c.Storage, c.Code}
+	list = append(list, c.View.Args...)
+	if c.BadCode.IsValid() {
+		list = []Prim{c.BadCode}
+	}
+	for _, v := range list {
+		if !v.IsValid() {
+			continue
+		}
+		v.formatExpr(&b, 0)
+		b.WriteString(";\n")
+	}
+	return b.String()
+}
+
+func (p Prim) michelsonName() string {
+	if p.IsMacro() {
+		return p.String
+	}
+	return p.OpCode.String()
+}
+
+// isBlock returns true for sequences which contain instructions. Blocks are
+// printed on multiple lines.
+func (p Prim) isBlock() bool {
+	if p.Type != PrimSequence {
+		return false
+	}
+	for _, v := range p.Args {
+		if v.IsSequence() || (v.Type >= PrimNullary && v.Type <= PrimVariadicAnno && v.IsInstruction()) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatExpr prints p in statement position, i.e. at the top level or inside a
+// sequence, where primitive applications need no parentheses.
+func (p Prim) formatExpr(b *strings.Builder, indent int) {
+	switch p.Type {
+	case PrimSequence:
+		p.formatSeq(b, indent)
+	case PrimInt, PrimString, PrimBytes:
+		p.formatArg(b)
+	default:
+		p.formatHead(b)
+
+		// keep leading non-block arguments on the first line, print blocks,
+		// sequences next to blocks and all following arguments on separate lines
+		split := len(p.Args)
+		for i, v := range p.Args {
+			if v.isBlock() {
+				split = i
+				break
+			}
+		}
+		if split < len(p.Args) {
+			for split > 0 && p.Args[split-1].IsSequence() {
+				split--
+			}
+		}
+		for _, v := range p.Args[:split] {
+			b.WriteByte(' ')
+			v.formatArg(b)
+		}
+		for _, v := range p.Args[split:] {
+			b.WriteByte('\n')
+			writeIndent(b, indent+1)
+			if v.IsSequence() {
+				v.formatSeq(b, indent+1)
+			} else {
+				v.formatArg(b)
+			}
+		}
+	}
+}
+
+// formatSeq prints a sequence. Blocks start a new line for each element.
+func (p Prim) formatSeq(b *strings.Builder, indent int) {
+	if !p.isBlock() {
+		p.formatArg(b)
+		return
+	}
+	b.WriteString("{\n")
+	for _, v := range p.Args {
+		writeIndent(b, indent+1)
+		v.formatExpr(b, indent+1)
+		b.WriteString(";\n")
+	}
+	writeIndent(b, indent)
+	b.WriteByte('}')
+}
+
+// formatHead prints a primitive name and its annotations.
+func (p Prim) formatHead(b *strings.Builder) {
+	b.WriteString(p.michelsonName())
+	for _, v := range p.Anno {
+		if v != "" {
+			b.WriteByte(' ')
+			b.WriteString(v)
+		}
+	}
+}
+
+// formatArg prints p on a single line in argument position where primitive
+// applications are wrapped in parentheses.
+func (p Prim) formatArg(b *strings.Builder) {
+	switch p.Type {
+	case PrimInt:
+		if p.Int == nil {
+			b.WriteByte('0')
+		} else {
+			b.WriteString(p.Int.Text(10))
+		}
+	case PrimString:
+		writeMichelsonString(b, p.String)
+	case PrimBytes:
+		b.WriteString("0x")
+		b.WriteString(hex.EncodeToString(p.Bytes))
+	case PrimSequence:
+		if len(p.Args) == 0 {
+			b.WriteString("{}")
+			return
+		}
+		b.WriteString("{ ")
+		for i, v := range p.Args {
+			if i > 0 {
+				b.WriteString(" ; ")
+			}
+			v.formatInline(b)
+		}
+		b.WriteString(" }")
+	default:
+		if len(p.Args) == 0 && !p.hasAnno() {
+			b.WriteString(p.michelsonName())
+			return
+		}
+		b.WriteByte('(')
+		p.formatInline(b)
+		b.WriteByte(')')
+	}
+}
+
+// formatInline prints p in statement position on a single line.
+func (p Prim) formatInline(b *strings.Builder) {
+	switch p.Type {
+	case PrimInt, PrimString, PrimBytes, PrimSequence:
+		p.formatArg(b)
+	default:
+		p.formatHead(b)
+		for _, v := range p.Args {
+			b.WriteByte(' ')
+			v.formatArg(b)
+		}
+	}
+}
+
+func (p Prim) hasAnno() bool {
+	for _, v := range p.Anno {
+		if v != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func writeIndent(b *strings.Builder, n int) {
+	for i := 0; i < n; i++ {
+		b.WriteString(michelsonIndent)
+	}
+}
+
+func writeMichelsonString(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+}
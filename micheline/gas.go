@@ -0,0 +1,400 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"math/bits"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+// Gas costs follow the protocol's Michelson cost model. All values are in
+// milligas. Costs that depend on the size of arguments use the same inputs
+// as the protocol (byte size of numbers, strings and bytes, number of
+// elements in collections), constants are rounded. Results are estimates
+// which typically stay within a few percent of on-chain consumption, callers
+// should add a safety margin when deriving gas limits.
+const (
+	GasPerDecodedByte   int64 = 20      // deserializing binary Micheline
+	GasPerEncodedByte   int64 = 10      // serializing binary Micheline
+	GasPerTypecheckNode int64 = 100     // typechecking a value node
+	GasPerCodeNode      int64 = 1_000   // typechecking a type or instruction node
+	GasPerUnparseNode   int64 = 50      // unparsing a value node
+	GasStorageRead      int64 = 230_000 // reading a big_map entry from context
+	GasStorageWrite     int64 = 200_000 // writing contract storage or a big_map entry
+	GasPerReadByte      int64 = 2       // per byte read from context
+	GasPerWrittenByte   int64 = 4       // per byte written to context
+
+	BigmapKeyOverhead int64 = 65 // bytes paid per new big_map entry for its key hash, keys are not stored
+)
+
+// gasBase lists constant instruction costs. Instructions not listed cost
+// gasDefault.
+var gasBase = map[OpCode]int64{
+	I_DROP:               10,
+	I_DUP:                10,
+	I_SWAP:               10,
+	I_PUSH:               10,
+	I_UNIT:               10,
+	I_SOME:               10,
+	I_NONE:               10,
+	I_LEFT:               10,
+	I_RIGHT:              10,
+	I_PAIR:               10,
+	I_UNPAIR:             10,
+	I_CAR:                10,
+	I_CDR:                10,
+	I_NIL:                10,
+	I_CONS:               15,
+	I_EMPTY_SET:          10,
+	I_EMPTY_MAP:          300,
+	I_EMPTY_BIG_MAP:      300,
+	I_IF:                 10,
+	I_IF_NONE:            10,
+	I_IF_LEFT:            10,
+	I_IF_CONS:            10,
+	I_LOOP:               10,
+	I_LOOP_LEFT:          10,
+	I_ITER:               20,
+	I_MAP:                20,
+	I_EXEC:               10,
+	I_APPLY:              140,
+	I_LAMBDA:             10,
+	I_LAMBDA_REC:         10,
+	I_FAILWITH:           0,
+	I_NEVER:              0,
+	I_EQ:                 10,
+	I_NEQ:                10,
+	I_LT:                 10,
+	I_GT:                 10,
+	I_LE:                 10,
+	I_GE:                 10,
+	I_SIZE:               10,
+	I_AMOUNT:             10,
+	I_BALANCE:            10,
+	I_NOW:                10,
+	I_LEVEL:              10,
+	I_SELF:               10,
+	I_SELF_ADDRESS:       10,
+	I_SOURCE:             10,
+	I_SENDER:             10,
+	I_CHAIN_ID:           15,
+	I_ADDRESS:            10,
+	I_IMPLICIT_ACCOUNT:   10,
+	I_CONTRACT:           30,
+	I_TRANSFER_TOKENS:    60,
+	I_SET_DELEGATE:       30,
+	I_CREATE_CONTRACT:    60,
+	I_EMIT:               30,
+	I_VIEW:               1_460,
+	I_TOTAL_VOTING_POWER: 450,
+	I_VOTING_POWER:       640,
+	I_MIN_BLOCK_TIME:     20,
+	I_TICKET:             10,
+	I_READ_TICKET:        10,
+	I_SPLIT_TICKET:       40,
+	I_JOIN_TICKETS:       40,
+	I_CAST:               0,
+	I_RENAME:             0,
+}
+
+const gasDefault int64 = 10
+
+// consume charges the cost of instruction in for the arguments on stack st.
+func (ip *interp) consume(in *instr, st Stack) error {
+	ip.gas += instrGas(in, st)
+	return ip.checkGas(in)
+}
+
+// checkGas fails when consumed gas exceeds the limit of the run. Instruction
+// in is nil for costs charged outside of script code.
+func (ip *interp) checkGas(in *instr) error {
+	if ip.env.GasLimit <= 0 || ip.gas <= ip.env.GasLimit*1000 {
+		return nil
+	}
+	if in == nil {
+		return &RuntimeError{Section: SectionCode, Message: "gas limit exceeded"}
+	}
+	return ip.errorf(in, "gas limit exceeded")
+}
+
+// instrGas returns the cost of executing instruction in on stack st.
+func instrGas(in *instr, st Stack) int64 {
+	arg := func(i int) Prim {
+		if i < len(st) {
+			return st[len(st)-1-i]
+		}
+		return InvalidPrim
+	}
+	p := in.prim
+	switch p.OpCode {
+	case I_DIG, I_DUG:
+		return 10 + int64(primN(p))
+	case I_DROP, I_DUP, I_PAIR, I_UNPAIR:
+		if len(p.Args) > 0 {
+			return 10 + int64(primN(p))/2
+		}
+		return gasBase[p.OpCode]
+	case I_GET, I_UPDATE:
+		if len(p.Args) > 0 {
+			return 10 + int64(primN(p))/2
+		}
+		return collectionGas(in, arg(0), arg(1))
+	case I_DIP:
+		if len(p.Args) > 1 {
+			return 15 + 4*int64(primN(p))
+		}
+		return 10
+	case I_ADD, I_SUB, I_SUB_MUMAV:
+		return 35 + max64(valueSize(arg(0)), valueSize(arg(1)))/2
+	case I_MUL:
+		return 50 + mulCost(valueSize(arg(0)), valueSize(arg(1)))
+	case I_EDIV:
+		return 80 + mulCost(valueSize(arg(0)), valueSize(arg(1)))
+	case I_NEG, I_ABS, I_ISNAT, I_INT, I_NAT, I_BYTES, I_NOT:
+		return 20 + valueSize(arg(0))/2
+	case I_LSL, I_LSR, I_AND, I_OR, I_XOR:
+		return 35 + max64(valueSize(arg(0)), valueSize(arg(1)))/2
+	case I_COMPARE:
+		return 35 + compareGas(arg(0), arg(1))
+	case I_CONCAT:
+		if len(in.in) > 0 && in.in[0].OpCode == T_LIST {
+			var n int64
+			for _, v := range arg(0).Args {
+				n += valueSize(v)
+			}
+			return 30 + n/8 + 2*int64(len(arg(0).Args))
+		}
+		return 30 + (valueSize(arg(0))+valueSize(arg(1)))/8
+	case I_SLICE:
+		return 25 + valueSize(arg(2))/8
+	case I_PACK:
+		return 10 + GasPerEncodedByte*nodeCount(arg(0))*4
+	case I_UNPACK:
+		return 260 + GasPerDecodedByte*valueSize(arg(0))
+	case I_BLAKE2B:
+		return 430 + valueSize(arg(0))*9/8
+	case I_SHA256:
+		return 600 + valueSize(arg(0))*19/4
+	case I_SHA512:
+		return 680 + valueSize(arg(0))*3
+	case I_KECCAK, I_SHA3:
+		return 1_350 + valueSize(arg(0))*33/4
+	case I_CHECK_SIGNATURE:
+		return signatureGas(arg(0), valueSize(arg(2)))
+	case I_HASH_KEY:
+		return 605
+	case I_MEM, I_GET_AND_UPDATE:
+		return collectionGas(in, arg(0), arg(1))
+	}
+	if c, ok := gasBase[p.OpCode]; ok {
+		return c
+	}
+	return gasDefault
+}
+
+// collectionGas returns the cost of a key lookup or update in the set, map
+// or big_map in the second stack position.
+func collectionGas(in *instr, key, coll Prim) int64 {
+	if len(in.in) < 2 {
+		return gasDefault
+	}
+	switch in.in[1].OpCode {
+	case T_BIG_MAP:
+		return 1_100 + GasPerEncodedByte*valueSize(key)
+	case T_SET, T_MAP:
+		n := int64(bits.Len(uint(len(coll.Args))))
+		return 80 + n*(35+valueSize(key)/2)
+	}
+	return gasDefault
+}
+
+// signatureGas returns the cost of CHECK_SIGNATURE with key k on a message
+// of n bytes.
+func signatureGas(k Prim, n int64) int64 {
+	typ := mavryk.KeyTypeEd25519
+	if key, err := keyValue(k); err == nil {
+		typ = key.Type
+	}
+	return SignatureGas(typ, n)
+}
+
+// SignatureGas returns the cost of verifying a signature of key type typ
+// on a message of n bytes.
+func SignatureGas(typ mavryk.KeyType, n int64) int64 {
+	switch typ {
+	case mavryk.KeyTypeSecp256k1:
+		return 51_600 + n*9/8
+	case mavryk.KeyTypeP256:
+		return 341_000 + n*9/8
+	case mavryk.KeyTypeBls12_381:
+		return 1_570_000 + n*3
+	default:
+		return 65_800 + n*9/8
+	}
+}
+
+// compareGas returns the size dependent part of comparing a and b.
+func compareGas(a, b Prim) int64 {
+	n := min64(valueSize(a), valueSize(b))
+	switch a.Type {
+	case PrimBinary, PrimBinaryAnno:
+		l, r := pairValueArgs(a)
+		k, s := pairValueArgs(b)
+		return 10 + compareGas(l, k) + compareGas(r, s)
+	}
+	return n / 2
+}
+
+// mulCost approximates the cost of multiplying numbers of a and b bytes.
+func mulCost(a, b int64) int64 {
+	return (a * b) / 16
+}
+
+// valueSize returns the size of a value in the units used by the cost
+// model: bytes for numbers, strings and bytes, elements for collections.
+func valueSize(p Prim) int64 {
+	switch p.Type {
+	case PrimInt:
+		if p.Int == nil {
+			return 1
+		}
+		return int64(len(p.Int.Bytes())) + 1
+	case PrimString:
+		return int64(len(p.String))
+	case PrimBytes:
+		return int64(len(p.Bytes))
+	case PrimSequence:
+		return int64(len(p.Args))
+	}
+	return 1
+}
+
+// nodeCount returns the number of Micheline nodes in p.
+func nodeCount(p Prim) int64 {
+	n := int64(1)
+	for _, v := range p.Args {
+		n += nodeCount(v)
+	}
+	return n
+}
+
+// DecodingGas returns the cost of deserializing buf bytes of binary
+// Micheline.
+func DecodingGas(n int64) int64 {
+	return GasPerDecodedByte * n
+}
+
+// TypecheckGas returns the cost of parsing and typechecking p.
+func TypecheckGas(p Prim) int64 {
+	return GasPerTypecheckNode * nodeCount(p)
+}
+
+// CodeTypecheckGas returns the cost of parsing and typechecking script c.
+func CodeTypecheckGas(c Code) int64 {
+	n := nodeCount(c.Param) + nodeCount(c.Storage) + nodeCount(c.Code) + nodeCount(c.View)
+	return GasPerCodeNode * n
+}
+
+// UnparseGas returns the cost of unparsing and serializing p.
+func UnparseGas(p Prim) int64 {
+	return GasPerUnparseNode * nodeCount(p)
+}
+
+// Size returns the binary encoded size of p in bytes.
+func Size(p Prim) int64 {
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		return 0
+	}
+	return int64(len(buf))
+}
+
+// StorageSize returns the binary size of value v of type t as stored in
+// contract storage. Values are stored in optimized form, so addresses, keys
+// and timestamps count with their binary size and long pair combs are
+// stored as sequences.
+func StorageSize(t, v Prim) int64 {
+	return Size(storageValue(t, optimize(t, v)))
+}
+
+// WriteGas returns the cost of writing n bytes to context.
+func WriteGas(n int64) int64 {
+	return GasStorageWrite + GasPerWrittenByte*n
+}
+
+// ReadGas returns the cost of reading n bytes from context.
+func ReadGas(n int64) int64 {
+	return GasStorageRead + GasPerReadByte*n
+}
+
+// applyBigmapDiff charges the cost of writing big_map events and returns
+// the storage size change they cause. Entries in on-chain big_maps are
+// looked up in the bigmap store to find the size of replaced values. Values
+// are stored in optimized form under their key hash.
+func (ip *interp) applyBigmapDiff(events BigmapEvents) (int64, error) {
+	var diff int64
+	for _, ev := range events {
+		switch ev.Action {
+		case DiffActionAlloc:
+			ip.gas += WriteGas(0)
+			diff += Size(ev.KeyType) + Size(ev.ValueType)
+		case DiffActionCopy:
+			ip.gas += WriteGas(0)
+		case DiffActionUpdate, DiffActionRemove:
+			var old int64
+			if ev.Id >= 0 && ip.env.Bigmaps != nil {
+				v, ok, err := ip.env.Bigmaps.GetBigmapValue(ip.ctx, ev.Id, ev.Key, ev.KeyHash)
+				if err != nil {
+					return 0, err
+				}
+				if ok {
+					old = BigmapKeyOverhead + ip.valueSize(ev.Id, v)
+				}
+			}
+			var cur int64
+			if ev.Action == DiffActionUpdate {
+				cur = BigmapKeyOverhead + ip.valueSize(ev.Id, ev.Value)
+			}
+			ip.gas += WriteGas(cur)
+			diff += cur - old
+		}
+	}
+	return diff, nil
+}
+
+// valueSize returns the stored size of value v in big_map id.
+func (ip *interp) valueSize(id int64, v Prim) int64 {
+	if t, ok := ip.vtypes[id]; ok {
+		return StorageSize(t, v)
+	}
+	return Size(v)
+}
+
+// primN returns the numeric argument of instructions like DIG n.
+func primN(p Prim) int {
+	if len(p.Args) > 0 && p.Args[0].Type == PrimInt && p.Args[0].Int != nil {
+		return int(p.Args[0].Int.Int64())
+	}
+	return 1
+}
+
+// gasUnits converts milligas to gas, rounding up.
+func gasUnits(milligas int64) int64 {
+	return (milligas + 999) / 1000
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,424 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+// BigmapStore provides read access to on-chain big_maps referenced by id
+// from storage or parameters. Key is the readable form of the key and hash
+// its script expression hash. Implementations return false when the key
+// does not exist.
+type BigmapStore interface {
+	GetBigmapValue(ctx context.Context, id int64, key Prim, hash mavryk.ExprHash) (Prim, bool, error)
+}
+
+// ContractStore provides the script, storage and balance of originated
+// contracts for CONTRACT and VIEW. GetScript returns a nil script when the
+// contract does not exist.
+type ContractStore interface {
+	GetScript(ctx context.Context, addr mavryk.Address) (*Script, error)
+	GetBalance(ctx context.Context, addr mavryk.Address) (int64, error)
+}
+
+// RunEnv defines the execution context of a local script run. Zero fields
+// resolve to neutral defaults, Self defaults to a dummy contract address
+// and Source to the zero address. Bigmaps and Contracts are optional, without
+// them on-chain big_maps appear empty and CONTRACT and VIEW on originated
+// contracts return None.
+type RunEnv struct {
+	Self             mavryk.Address // executing contract
+	Source           mavryk.Address // operation signer
+	Sender           mavryk.Address // caller, defaults to Source
+	Amount           int64          // transferred mumav
+	Balance          int64          // contract balance including Amount
+	Now              time.Time      // block timestamp
+	Level            int64          // block level
+	ChainId          mavryk.ChainIdHash
+	MinBlockTime     int64
+	TotalVotingPower int64
+	VotingPower      func(mavryk.Address) int64 // optional, used by VOTING_POWER
+	OpHash           mavryk.OpHash              // used to derive addresses of created contracts
+	Entrypoint       string                     // called entrypoint, defaults to default
+	GasLimit         int64                      // gas limit, zero means unlimited
+	Bigmaps          BigmapStore
+	Contracts        ContractStore
+}
+
+// RunResult is the outcome of a local script run. It mirrors the fields of
+// a run_code RPC response and adds estimated gas and storage costs.
+type RunResult struct {
+	Operations          []InternalOp `json:"operations"`
+	Storage             Prim         `json:"storage"`
+	BigmapDiff          BigmapEvents `json:"big_map_diff,omitempty"`
+	ConsumedMilligas    int64        `json:"consumed_milligas,string,omitempty"`
+	StorageSize         int64        `json:"storage_size,string,omitempty"`
+	PaidStorageSizeDiff int64        `json:"paid_storage_size_diff,string,omitempty"`
+}
+
+// Gas returns consumed gas rounded up to full gas units.
+func (r RunResult) Gas() int64 {
+	return gasUnits(r.ConsumedMilligas)
+}
+
+// InternalOp is an operation emitted by a script. Its JSON encoding matches
+// internal operations in run_code responses.
+type InternalOp struct {
+	Kind        mavryk.OpType   `json:"kind"`
+	Source      mavryk.Address  `json:"source"`
+	Nonce       int64           `json:"nonce"`
+	Amount      int64           `json:"amount,string"`
+	Destination *mavryk.Address `json:"destination,omitempty"`
+	Parameters  *Parameters     `json:"parameters,omitempty"`
+	Balance     int64           `json:"balance,string,omitempty"`
+	Delegate    *mavryk.Address `json:"delegate,omitempty"`
+	Script      *Script         `json:"script,omitempty"`
+	Type        *Prim           `json:"type,omitempty"`
+	Payload     *Prim           `json:"payload,omitempty"`
+	Tag         string          `json:"tag,omitempty"`
+}
+
+// RuntimeError is returned when script execution fails. For FAILWITH Value
+// holds the rejected value, otherwise Value is invalid. Path lists argument
+// indices from the root of Section to the failing instruction.
+type RuntimeError struct {
+	Section string
+	Path    []int
+	Prim    Prim
+	Value   Prim
+	Message string
+}
+
+func (e *RuntimeError) Error() string {
+	var b strings.Builder
+	b.WriteString("micheline: runtime error")
+	if e.Section != "" {
+		b.WriteString(" in ")
+		b.WriteString(e.Section)
+	}
+	if len(e.Path) > 0 {
+		fmt.Fprintf(&b, " at %v", e.Path)
+	}
+	if e.Prim.IsValid() && e.Prim.Type != PrimSequence {
+		b.WriteByte(' ')
+		b.WriteString(e.Prim.michelsonName())
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Message)
+	if e.Value.IsValid() {
+		b.WriteString(" with ")
+		b.WriteString(e.Value.Michelson())
+	}
+	return b.String()
+}
+
+// IsFailwith returns true when the script failed with FAILWITH.
+func (e *RuntimeError) IsFailwith() bool {
+	return e.Value.IsValid()
+}
+
+// Run executes the contract code locally with parameter and storage in
+// context env. The parameter is wrapped into the entrypoint selected by
+// env.Entrypoint. Code, parameter and storage are typechecked before
+// execution. Failures during execution are returned as *RuntimeError.
+func (c Code) Run(ctx context.Context, param, storage Prim, env *RunEnv) (*RunResult, error) {
+	return c.run(ctx, param, storage, env, nil)
+}
+
+func (c Code) run(ctx context.Context, param, storage Prim, env *RunEnv, hook execHook) (*RunResult, error) {
+	m, err := c.Typecheck()
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		env = &RunEnv{}
+	}
+	paramType, storageType := c.Param.Args[0], c.Storage.Args[0]
+	path, ok := entrypointPath(paramType, env.Entrypoint)
+	if !ok {
+		return nil, fmt.Errorf("micheline: unknown entrypoint %q", env.Entrypoint)
+	}
+	param = NewUnion(path, param)
+	if err := (Type{paramType}).TypecheckValue(param); err != nil {
+		return nil, err
+	}
+	if err := (Type{storageType}).TypecheckValue(storage); err != nil {
+		return nil, err
+	}
+	ip := newInterp(ctx, env)
+	ip.param = paramType
+	ip.hook = hook
+	ip.gas += DecodingGas(StorageSize(paramType, param)) + TypecheckGas(param)
+	ip.gas += DecodingGas(StorageSize(storageType, storage)) + TypecheckGas(storage)
+	code := ip.compile(m, SectionCode, c.Code.Args[0], nil)
+	st := Stack{NewPair(ip.load(paramType, param, false), ip.load(storageType, storage, true))}
+	if err := ip.exec(code, &st); err != nil {
+		return nil, err
+	}
+	res, err := ip.result(storageType, st[0])
+	if err != nil {
+		return nil, err
+	}
+	diff, err := ip.applyBigmapDiff(res.BigmapDiff)
+	if err != nil {
+		return nil, err
+	}
+	res.StorageSize = StorageSize(storageType, res.Storage)
+	if diff += res.StorageSize - StorageSize(storageType, storage); diff > 0 {
+		res.PaidStorageSizeDiff = diff
+	}
+	ip.gas += UnparseGas(res.Storage) + WriteGas(res.StorageSize)
+	if err := ip.checkGas(nil); err != nil {
+		return nil, err
+	}
+	res.ConsumedMilligas = ip.gas
+	return res, nil
+}
+
+// RunView executes on-chain view name of the script locally with input
+// and the script's storage in context env.
+func (s Script) RunView(ctx context.Context, name string, input Prim, env *RunEnv) (Prim, error) {
+	m, err := s.Code.Typecheck()
+	if err != nil {
+		return InvalidPrim, err
+	}
+	view, ok := findView(s.Code, name)
+	if !ok {
+		return InvalidPrim, fmt.Errorf("micheline: unknown view %q", name)
+	}
+	storageType := s.Code.Storage.Args[0]
+	if err := (Type{view.Args[1]}).TypecheckValue(input); err != nil {
+		return InvalidPrim, err
+	}
+	if err := (Type{storageType}).TypecheckValue(s.Storage); err != nil {
+		return InvalidPrim, err
+	}
+	if env == nil {
+		env = &RunEnv{}
+	}
+	ip := newInterp(ctx, env)
+	code := ip.compile(m, ViewSection(name), view.Args[3], []int{3})
+	st := Stack{NewPair(ip.load(view.Args[1], input, false), ip.load(storageType, s.Storage, true))}
+	if err := ip.exec(code, &st); err != nil {
+		return InvalidPrim, err
+	}
+	return ip.readable(view.Args[2], st[0]), nil
+}
+
+// findView returns the view named name.
+func findView(c Code, name string) (Prim, bool) {
+	for _, v := range c.View.Args {
+		if v.OpCode == K_VIEW && len(v.Args) == 4 && v.Args[0].String == name {
+			return v, true
+		}
+	}
+	return InvalidPrim, false
+}
+
+// entrypointPath returns the branch path of the named entrypoint in
+// parameter type t.
+func entrypointPath(t Prim, name string) ([]int, bool) {
+	if name == "" {
+		name = "default"
+	}
+	if path, ok := fieldPath(t, name, nil); ok {
+		return path, true
+	}
+	return nil, name == "default"
+}
+
+func fieldPath(t Prim, name string, path []int) ([]int, bool) {
+	if fieldAnno(t) == name {
+		return path, true
+	}
+	if t.OpCode != T_OR {
+		return nil, false
+	}
+	for i, v := range t.Args {
+		if p, ok := fieldPath(v, name, appendPath(path, i)); ok {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// instr is a compiled instruction with its static stack types. Stacks store
+// the top element first. Blocks hold compiled code arguments.
+type instr struct {
+	prim    Prim
+	path    []int
+	section string
+	in      []Prim
+	out     []Prim
+	blocks  [][]*instr
+}
+
+// lambdaCode is a compiled lambda body.
+type lambdaCode struct {
+	code []*instr
+	rec  bool
+}
+
+// interpState is shared between nested contract calls during a run.
+type interpState struct {
+	ctx     context.Context
+	env     *RunEnv
+	bigmaps []*bigmapState
+	owned   map[int64]bool // on-chain ids referenced from storage
+	ops     []*pendingOp
+	lambdas map[string]*lambdaCode
+	views   map[string][]*instr
+	nextId  int64
+	nonce   uint32
+	steps   int64
+	gas     int64        // consumed milligas
+	copies  BigmapEvents // copies of on-chain big_maps, applied first
+	events  BigmapEvents
+	vtypes  map[int64]Prim // value types of big_maps in events
+	hook    execHook       // optional, called around each instruction
+}
+
+// execHook observes execution before and after each instruction. Stack
+// st keeps the top element last. Returning an error stops execution.
+type execHook func(ip *interp, in *instr, st Stack, after bool) error
+
+// interp executes code on behalf of a single contract.
+type interp struct {
+	*interpState
+	self    mavryk.Address
+	sender  mavryk.Address
+	amount  int64
+	balance int64
+	param   Prim // parameter type, invalid in views and lambdas
+}
+
+// defaultRunSelf is the executing contract address when none is set.
+var defaultRunSelf = mavryk.MustParseAddress("KT1BEqzn5Wx8uJrZNvuS9DVHmLvG9td3fDLi")
+
+func newInterp(ctx context.Context, env *RunEnv) *interp {
+	e := *env
+	if !e.Self.IsValid() {
+		e.Self = defaultRunSelf
+	}
+	if !e.Source.IsValid() {
+		e.Source = mavryk.ZeroAddress
+	}
+	env = &e
+	ip := &interp{
+		interpState: &interpState{
+			ctx:     ctx,
+			env:     env,
+			owned:   make(map[int64]bool),
+			lambdas: make(map[string]*lambdaCode),
+			vtypes:  make(map[int64]Prim),
+			nextId:  -1,
+		},
+		self:    env.Self,
+		sender:  env.Sender,
+		amount:  env.Amount,
+		balance: env.Balance,
+	}
+	if !ip.sender.IsValid() {
+		ip.sender = env.Source
+	}
+	return ip
+}
+
+// compile builds the instruction tree of code from the stack types in m.
+func (ip *interp) compile(m TypeMap, section string, code Prim, path []int) []*instr {
+	idx := make(map[string]*InstrType, len(m))
+	for i := range m {
+		if m[i].Section == section {
+			idx[fmt.Sprint(m[i].Path)] = &m[i]
+		}
+	}
+	return compileSeq(idx, section, code, path)
+}
+
+func compileSeq(idx map[string]*InstrType, section string, code Prim, path []int) []*instr {
+	list := make([]*instr, 0, len(code.Args))
+	for i, v := range code.Args {
+		list = append(list, compileInstr(idx, section, v, appendPath(path, i)))
+	}
+	return list
+}
+
+func compileInstr(idx map[string]*InstrType, section string, p Prim, path []int) *instr {
+	in := &instr{
+		prim:    p,
+		path:    path,
+		section: section,
+	}
+	if p.Type == PrimSequence {
+		in.blocks = [][]*instr{compileSeq(idx, section, p, path)}
+		return in
+	}
+	if it, ok := idx[fmt.Sprint(path)]; ok {
+		in.in = reverseStack(it.Before)
+		in.out = reverseStack(it.After)
+	}
+	switch p.OpCode {
+	case I_IF, I_IF_NONE, I_IF_LEFT, I_IF_CONS, I_LOOP, I_LOOP_LEFT, I_MAP, I_ITER, I_DIP:
+		for i, v := range p.Args {
+			if v.Type == PrimSequence {
+				in.blocks = append(in.blocks, compileSeq(idx, section, v, appendPath(path, i)))
+			}
+		}
+	}
+	return in
+}
+
+// sectionLambda marks instructions of lambda values. Their paths are
+// relative to the lambda body.
+const sectionLambda = "lambda"
+
+func setSection(code []*instr, section string) {
+	for _, in := range code {
+		in.section = section
+		for _, b := range in.blocks {
+			setSection(b, section)
+		}
+	}
+}
+
+func reverseStack(s Stack) []Prim {
+	if s == nil {
+		return nil
+	}
+	return toStack(s)
+}
+
+// lambda returns the compiled body of lambda value v from type arg to type
+// ret. Bodies are typechecked on first use and cached.
+func (ip *interp) lambda(arg, ret, v Prim) (*lambdaCode, error) {
+	kbuf, _ := NewCode(T_LAMBDA, arg, ret).MarshalBinary()
+	vbuf, _ := v.MarshalBinary()
+	key := string(kbuf) + string(vbuf)
+	if l, ok := ip.lambdas[key]; ok {
+		return l, nil
+	}
+	var m TypeMap
+	tc := &typechecker{section: SectionCode, types: &m}
+	l := &lambdaCode{}
+	code := v
+	in := []Prim{arg}
+	if v.OpCode == D_LAMBDA_REC && v.Type != PrimSequence {
+		code = v.Args[0]
+		in = append(in, NewCode(T_LAMBDA, arg, ret))
+		l.rec = true
+	}
+	if err := tc.body(code, nil, in, []Prim{ret}); err != nil {
+		return nil, err
+	}
+	l.code = ip.compile(m, SectionCode, code, nil)
+	setSection(l.code, sectionLambda)
+	ip.lambdas[key] = l
+	return l, nil
+}
@@ -0,0 +1,439 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"sort"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+// Values on the interpreter stack use an internal form: pairs are binary,
+// timestamps are integers, tickets are legacy pairs and big_maps and
+// operations are integer handles into interpreter state.
+
+// bigmapState is a big_map value. Entries overlay the on-chain big_map src
+// and are sorted by key. Removed keys keep an entry with invalid value.
+type bigmapState struct {
+	src       int64 // on-chain id or -1
+	keyType   Prim
+	valueType Prim
+	entries   []bigmapEntry
+}
+
+type bigmapEntry struct {
+	key   Prim
+	value Prim
+}
+
+// find returns the position of key k in the overlay.
+func (b *bigmapState) find(k Prim) (int, bool) {
+	i := sort.Search(len(b.entries), func(i int) bool {
+		return compareValues(b.keyType, b.entries[i].key, k) >= 0
+	})
+	return i, i < len(b.entries) && compareValues(b.keyType, b.entries[i].key, k) == 0
+}
+
+// newBigmap registers a big_map value and returns its handle.
+func (ip *interp) newBigmap(src int64, kt, vt Prim, entries []bigmapEntry) Prim {
+	ip.bigmaps = append(ip.bigmaps, &bigmapState{
+		src:       src,
+		keyType:   kt,
+		valueType: vt,
+		entries:   entries,
+	})
+	return NewInt64(int64(len(ip.bigmaps) - 1))
+}
+
+func (ip *interp) bigmap(h Prim) *bigmapState {
+	return ip.bigmaps[h.Int.Int64()]
+}
+
+// bigmapGet looks up key k in big_map h, falling back to the on-chain
+// big_map through the bigmap store.
+func (ip *interp) bigmapGet(h, k Prim) (Prim, bool, error) {
+	b := ip.bigmap(h)
+	if i, ok := b.find(k); ok {
+		v := b.entries[i].value
+		return v, v.IsValid(), nil
+	}
+	if b.src < 0 || ip.env.Bigmaps == nil {
+		return InvalidPrim, false, nil
+	}
+	buf, _ := optimize(b.keyType, k).MarshalBinary()
+	v, ok, err := ip.env.Bigmaps.GetBigmapValue(ip.ctx, b.src, ip.readable(b.keyType, k), KeyHash(buf))
+	if err != nil || !ok {
+		ip.gas += ReadGas(0)
+		return InvalidPrim, false, err
+	}
+	ip.gas += ReadGas(Size(v)) + DecodingGas(Size(v))
+	return ip.load(b.valueType, v, false), true, nil
+}
+
+// bigmapUpdate returns a new big_map handle with key k set to v. An invalid
+// v removes the key.
+func (ip *interp) bigmapUpdate(h, k, v Prim) Prim {
+	b := ip.bigmap(h)
+	i, ok := b.find(k)
+	entries := make([]bigmapEntry, 0, len(b.entries)+1)
+	entries = append(entries, b.entries[:i]...)
+	if v.IsValid() || b.src >= 0 {
+		entries = append(entries, bigmapEntry{key: k, value: v})
+	}
+	if ok {
+		i++
+	}
+	entries = append(entries, b.entries[i:]...)
+	return ip.newBigmap(b.src, b.keyType, b.valueType, entries)
+}
+
+// load converts a typechecked value of type t into internal form. Big_map
+// ids found in storage are marked as owned by the contract.
+func (ip *interp) load(t, v Prim, storage bool) Prim {
+	switch t.OpCode {
+	case T_TIMESTAMP:
+		if v.Type == PrimString {
+			return NewBig(timestampValue(v))
+		}
+	case T_PAIR:
+		lt, rt, _ := pairArgs(t)
+		l, r := pairValueArgs(v)
+		return NewPair(ip.load(lt, l, storage), ip.load(rt, r, storage))
+	case T_OPTION:
+		if v.OpCode == D_SOME {
+			return NewOption(ip.load(t.Args[0], v.Args[0], storage))
+		}
+	case T_OR:
+		if v.OpCode == D_LEFT {
+			return NewCode(D_LEFT, ip.load(t.Args[0], v.Args[0], storage))
+		}
+		return NewCode(D_RIGHT, ip.load(t.Args[1], v.Args[0], storage))
+	case T_LIST, T_SET:
+		list := make([]Prim, len(v.Args))
+		for i, e := range v.Args {
+			list[i] = ip.load(t.Args[0], e, storage)
+		}
+		return NewSeq(list...)
+	case T_MAP:
+		list := make([]Prim, len(v.Args))
+		for i, e := range v.Args {
+			list[i] = NewMapElem(ip.load(t.Args[0], e.Args[0], storage), ip.load(t.Args[1], e.Args[1], storage))
+		}
+		return NewSeq(list...)
+	case T_BIG_MAP:
+		if v.Type == PrimInt {
+			id := v.Int.Int64()
+			if storage {
+				ip.owned[id] = true
+			}
+			return ip.newBigmap(id, t.Args[0], t.Args[1], nil)
+		}
+		entries := make([]bigmapEntry, len(v.Args))
+		for i, e := range v.Args {
+			entries[i] = bigmapEntry{
+				key:   ip.load(t.Args[0], e.Args[0], storage),
+				value: ip.load(t.Args[1], e.Args[1], storage),
+			}
+		}
+		return ip.newBigmap(-1, t.Args[0], t.Args[1], entries)
+	case T_TICKET:
+		if v.OpCode == D_TICKET && v.Type != PrimSequence && len(v.Args) == 4 {
+			return NewPair(v.Args[0], NewPair(ip.load(t.Args[0], v.Args[2], storage), v.Args[3]))
+		}
+		return ip.load(ticketType(t), v, storage)
+	}
+	return v
+}
+
+// ticketType returns the legacy pair type of ticket type t.
+func ticketType(t Prim) Prim {
+	return NewPairType(NewCode(T_ADDRESS), NewPairType(t.Args[0], NewCode(T_NAT)))
+}
+
+// readable converts a value of type t from internal form into readable
+// form. Right combs are flattened into n-ary pairs.
+func (ip *interp) readable(t, v Prim) Prim {
+	switch t.OpCode {
+	case T_TIMESTAMP:
+		if v.Type == PrimInt && v.Int.IsInt64() {
+			tm := time.Unix(v.Int.Int64(), 0).UTC()
+			if y := tm.Year(); y >= 0 && y <= 9999 {
+				return NewString(tm.Format(time.RFC3339))
+			}
+		}
+	case T_ADDRESS, T_CONTRACT, T_KEY_HASH:
+		if v.Type == PrimBytes {
+			if a, err := addressValue(v); err == nil {
+				s := a.String()
+				if ep := addressEntrypoint(v); ep != "" {
+					s += "%" + ep
+				}
+				return NewString(s)
+			}
+		}
+	case T_KEY:
+		if v.Type == PrimBytes {
+			if k, err := keyValue(v); err == nil {
+				return NewString(k.String())
+			}
+		}
+	case T_SIGNATURE:
+		if v.Type == PrimBytes {
+			var s mavryk.Signature
+			if err := s.UnmarshalBinary(v.Bytes); err == nil {
+				return NewString(s.String())
+			}
+		}
+	case T_CHAIN_ID:
+		if v.Type == PrimBytes && len(v.Bytes) == 4 {
+			return NewString(mavryk.NewChainIdHash(v.Bytes).String())
+		}
+	case T_PAIR:
+		lt, rt, _ := pairArgs(t)
+		l, r := pairValueArgs(v)
+		args := []Prim{ip.readable(lt, l)}
+		if rv := ip.readable(rt, r); rt.OpCode == T_PAIR && rv.OpCode == D_PAIR {
+			args = append(args, rv.Args...)
+		} else {
+			args = append(args, rv)
+		}
+		return NewCode(D_PAIR, args...)
+	case T_OPTION:
+		if v.OpCode == D_SOME {
+			return NewOption(ip.readable(t.Args[0], v.Args[0]))
+		}
+	case T_OR:
+		if v.OpCode == D_LEFT {
+			return NewCode(D_LEFT, ip.readable(t.Args[0], v.Args[0]))
+		}
+		return NewCode(D_RIGHT, ip.readable(t.Args[1], v.Args[0]))
+	case T_LIST, T_SET:
+		list := make([]Prim, len(v.Args))
+		for i, e := range v.Args {
+			list[i] = ip.readable(t.Args[0], e)
+		}
+		return NewSeq(list...)
+	case T_MAP, T_BIG_MAP:
+		if v.Type != PrimSequence {
+			return v
+		}
+		list := make([]Prim, len(v.Args))
+		for i, e := range v.Args {
+			list[i] = NewMapElem(ip.readable(t.Args[0], e.Args[0]), ip.readable(t.Args[1], e.Args[1]))
+		}
+		return NewSeq(list...)
+	case T_TICKET:
+		return ip.readable(ticketType(t), v)
+	}
+	return v
+}
+
+// optimize converts a value of type t from internal form into the binary
+// form used by PACK, big_map key hashes and contract storage.
+func optimize(t, v Prim) Prim {
+	switch t.OpCode {
+	case T_TIMESTAMP:
+		if v.Type == PrimString {
+			return NewBig(timestampValue(v))
+		}
+	case T_ADDRESS, T_CONTRACT:
+		if v.Type == PrimString {
+			if a, err := addressValue(v); err == nil {
+				return NewBytes(append(a.EncodePadded(), addressEntrypoint(v)...))
+			}
+		}
+	case T_KEY_HASH:
+		if v.Type == PrimString {
+			if a, err := addressValue(v); err == nil {
+				return NewBytes(a.Encode())
+			}
+		}
+	case T_KEY:
+		if v.Type == PrimString {
+			if k, err := keyValue(v); err == nil {
+				return NewBytes(k.Bytes())
+			}
+		}
+	case T_SIGNATURE:
+		if v.Type == PrimString {
+			if s, err := mavryk.ParseSignature(v.String); err == nil {
+				return NewBytes(s.Data)
+			}
+		}
+	case T_CHAIN_ID:
+		if v.Type == PrimString {
+			if h, err := mavryk.ParseChainIdHash(v.String); err == nil {
+				return NewBytes(h.Bytes())
+			}
+		}
+	case T_PAIR:
+		lt, rt, _ := pairArgs(t)
+		l, r := pairValueArgs(v)
+		return NewPair(optimize(lt, l), optimize(rt, r))
+	case T_OPTION:
+		if v.OpCode == D_SOME {
+			return NewOption(optimize(t.Args[0], v.Args[0]))
+		}
+	case T_OR:
+		if v.OpCode == D_LEFT {
+			return NewCode(D_LEFT, optimize(t.Args[0], v.Args[0]))
+		}
+		return NewCode(D_RIGHT, optimize(t.Args[1], v.Args[0]))
+	case T_LIST, T_SET:
+		list := make([]Prim, len(v.Args))
+		for i, e := range v.Args {
+			list[i] = optimize(t.Args[0], e)
+		}
+		return NewSeq(list...)
+	case T_MAP:
+		list := make([]Prim, len(v.Args))
+		for i, e := range v.Args {
+			list[i] = NewMapElem(optimize(t.Args[0], e.Args[0]), optimize(t.Args[1], e.Args[1]))
+		}
+		return NewSeq(list...)
+	}
+	return v
+}
+
+// storageValue converts an optimized value of type t into the form used for
+// contract storage. Right combs of four or more elements are stored as
+// sequences, smaller combs as nested pairs.
+func storageValue(t, v Prim) Prim {
+	switch t.OpCode {
+	case T_PAIR:
+		var list []Prim
+		for t.OpCode == T_PAIR {
+			lt, rt, ok := pairArgs(t)
+			l, r := pairValueArgs(v)
+			if !ok || !r.IsValid() {
+				if len(list) == 0 {
+					return v
+				}
+				break
+			}
+			list = append(list, storageValue(lt, l))
+			t, v = rt, r
+		}
+		list = append(list, storageValue(t, v))
+		if len(list) >= 4 {
+			return NewSeq(list...)
+		}
+		v = list[len(list)-1]
+		for i := len(list) - 2; i >= 0; i-- {
+			v = NewPair(list[i], v)
+		}
+		return v
+	case T_OPTION:
+		if v.OpCode == D_SOME {
+			return NewOption(storageValue(t.Args[0], v.Args[0]))
+		}
+	case T_OR:
+		if v.OpCode == D_LEFT {
+			return NewCode(D_LEFT, storageValue(t.Args[0], v.Args[0]))
+		}
+		return NewCode(D_RIGHT, storageValue(t.Args[1], v.Args[0]))
+	case T_LIST, T_SET:
+		list := make([]Prim, len(v.Args))
+		for i, e := range v.Args {
+			list[i] = storageValue(t.Args[0], e)
+		}
+		return NewSeq(list...)
+	case T_MAP:
+		list := make([]Prim, len(v.Args))
+		for i, e := range v.Args {
+			list[i] = NewMapElem(storageValue(t.Args[0], e.Args[0]), storageValue(t.Args[1], e.Args[1]))
+		}
+		return NewSeq(list...)
+	}
+	return v
+}
+
+// finalize replaces big_map handles in v by big_map ids and records the
+// corresponding big_map updates. With reuse set, on-chain big_maps owned by
+// the contract keep their id, otherwise they are copied to a new temporary
+// id.
+func (ip *interp) finalize(t, v Prim, reuse bool, claimed map[int64]bool) Prim {
+	switch t.OpCode {
+	case T_BIG_MAP:
+		return ip.finalizeBigmap(v, reuse, claimed)
+	case T_PAIR:
+		lt, rt, _ := pairArgs(t)
+		l, r := pairValueArgs(v)
+		return NewPair(ip.finalize(lt, l, reuse, claimed), ip.finalize(rt, r, reuse, claimed))
+	case T_OPTION:
+		if v.OpCode == D_SOME {
+			return NewOption(ip.finalize(t.Args[0], v.Args[0], reuse, claimed))
+		}
+	case T_OR:
+		if v.OpCode == D_LEFT {
+			return NewCode(D_LEFT, ip.finalize(t.Args[0], v.Args[0], reuse, claimed))
+		}
+		return NewCode(D_RIGHT, ip.finalize(t.Args[1], v.Args[0], reuse, claimed))
+	case T_LIST:
+		list := make([]Prim, len(v.Args))
+		for i, e := range v.Args {
+			list[i] = ip.finalize(t.Args[0], e, reuse, claimed)
+		}
+		return NewSeq(list...)
+	case T_MAP:
+		list := make([]Prim, len(v.Args))
+		for i, e := range v.Args {
+			list[i] = NewMapElem(e.Args[0], ip.finalize(t.Args[1], e.Args[1], reuse, claimed))
+		}
+		return NewSeq(list...)
+	}
+	return v
+}
+
+func (ip *interp) finalizeBigmap(h Prim, reuse bool, claimed map[int64]bool) Prim {
+	b := ip.bigmap(h)
+	var id int64
+	events := &ip.events
+	switch {
+	case reuse && b.src >= 0 && ip.owned[b.src] && !claimed[b.src]:
+		id = b.src
+		claimed[id] = true
+	case b.src >= 0:
+		// copies must read the source before it is updated
+		id = ip.tempId()
+		events = &ip.copies
+		ip.copies = append(ip.copies, BigmapEvent{
+			Action:   DiffActionCopy,
+			SourceId: b.src,
+			DestId:   id,
+		})
+	default:
+		id = ip.tempId()
+		ip.events = append(ip.events, BigmapEvent{
+			Action:    DiffActionAlloc,
+			Id:        id,
+			KeyType:   b.keyType,
+			ValueType: b.valueType,
+		})
+	}
+	ip.vtypes[id] = b.valueType
+	for _, e := range b.entries {
+		buf, _ := optimize(b.keyType, e.key).MarshalBinary()
+		ev := BigmapEvent{
+			Action:  DiffActionRemove,
+			Id:      id,
+			KeyHash: KeyHash(buf),
+			Key:     ip.readable(b.keyType, e.key),
+		}
+		if e.value.IsValid() {
+			ev.Action = DiffActionUpdate
+			ev.Value = ip.readable(b.valueType, e.value)
+		}
+		*events = append(*events, ev)
+	}
+	return NewInt64(id)
+}
+
+// tempId returns the next temporary big_map id.
+func (ip *interp) tempId() int64 {
+	id := ip.nextId
+	ip.nextId--
+	return id
+}
@@ -0,0 +1,1254 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	maxShift      = big.NewInt(256)
+	maxBytesShift = big.NewInt(64000)
+)
+
+// pendingOp is an operation created by the script. Value and its type are
+// kept in internal form until the operation is emitted.
+type pendingOp struct {
+	op    InternalOp
+	typ   Prim
+	value Prim
+}
+
+func (ip *interp) errorf(in *instr, format string, args ...interface{}) error {
+	return &RuntimeError{
+		Section: in.section,
+		Path:    in.path,
+		Prim:    in.prim,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// exec runs compiled code on stack st.
+func (ip *interp) exec(code []*instr, st *Stack) error {
+	for _, in := range code {
+		if in.prim.Type == PrimSequence {
+			if err := ip.exec(in.blocks[0], st); err != nil {
+				return err
+			}
+			continue
+		}
+		ip.steps++
+		if ip.steps&1023 == 0 {
+			if err := ip.ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if ip.hook != nil {
+			if err := ip.hook(ip, in, *st, false); err != nil {
+				return err
+			}
+		}
+		if err := ip.consume(in, *st); err != nil {
+			return err
+		}
+		if err := ip.apply(in, st); err != nil {
+			return err
+		}
+		if ip.hook != nil {
+			if err := ip.hook(ip, in, *st, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// result builds the run result from the final stack value.
+func (ip *interp) result(storageType, v Prim) (*RunResult, error) {
+	list, storage := pairValueArgs(v)
+	claimed := make(map[int64]bool)
+	res := &RunResult{
+		Operations: make([]InternalOp, 0, len(list.Args)),
+		Storage:    ip.readable(storageType, ip.finalize(storageType, storage, true, claimed)),
+	}
+	ids := make([]int64, 0, len(ip.owned))
+	for id := range ip.owned {
+		if !claimed[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		ip.events = append(ip.events, BigmapEvent{Action: DiffActionRemove, Id: id})
+	}
+	for i, h := range list.Args {
+		p := ip.ops[h.Int.Int64()]
+		op := p.op
+		op.Nonce = int64(i)
+		if p.typ.IsValid() {
+			val := ip.readable(p.typ, ip.finalize(p.typ, p.value, false, claimed))
+			switch op.Kind {
+			case mavryk.OpTypeTransaction:
+				op.Parameters = &Parameters{Entrypoint: op.Parameters.Entrypoint, Value: val}
+			case mavryk.OpTypeOrigination:
+				script := *op.Script
+				script.Storage = val
+				op.Script = &script
+			case mavryk.OpTypeEvent:
+				op.Payload = &val
+			}
+		}
+		res.Operations = append(res.Operations, op)
+	}
+	res.BigmapDiff = append(ip.copies, ip.events...)
+	return res, nil
+}
+
+// emit registers a new operation and returns its handle.
+func (ip *interp) emit(op InternalOp, typ, value Prim) Prim {
+	op.Source = ip.self
+	ip.ops = append(ip.ops, &pendingOp{op: op, typ: typ, value: value})
+	return NewInt64(int64(len(ip.ops) - 1))
+}
+
+func boolValue(b bool) Prim {
+	if b {
+		return NewCode(D_TRUE)
+	}
+	return NewCode(D_FALSE)
+}
+
+func (ip *interp) apply(in *instr, st *Stack) error {
+	p := in.prim
+	n := len(*st)
+	peek := func(i int) Prim {
+		return (*st)[n-1-i]
+	}
+	pop := func(k int) []Prim {
+		vals := make([]Prim, k)
+		for i := 0; i < k; i++ {
+			vals[i] = (*st)[len(*st)-1-i]
+		}
+		*st = (*st)[:len(*st)-k]
+		return vals
+	}
+	intArg := func(i int) int {
+		return int(p.Args[i].Int.Int64())
+	}
+	unsupported := func() error {
+		return ip.errorf(in, "instruction is not supported by the local interpreter")
+	}
+
+	switch p.OpCode {
+	// stack manipulation
+	case I_DROP:
+		k := 1
+		if len(p.Args) == 1 {
+			k = intArg(0)
+		}
+		pop(k)
+
+	case I_DUP:
+		k := 1
+		if len(p.Args) == 1 {
+			k = intArg(0)
+		}
+		st.Push(peek(k - 1))
+
+	case I_SWAP:
+		(*st)[n-1], (*st)[n-2] = (*st)[n-2], (*st)[n-1]
+
+	case I_DIG:
+		k := intArg(0)
+		v := (*st)[n-1-k]
+		copy((*st)[n-1-k:], (*st)[n-k:])
+		(*st)[n-1] = v
+
+	case I_DUG:
+		k := intArg(0)
+		v := (*st)[n-1]
+		copy((*st)[n-k:], (*st)[n-1-k:n-1])
+		(*st)[n-1-k] = v
+
+	case I_DIP:
+		k := 1
+		if len(p.Args) == 2 {
+			k = intArg(0)
+		}
+		saved := pop(k)
+		if err := ip.exec(in.blocks[0], st); err != nil {
+			return err
+		}
+		for i := k - 1; i >= 0; i-- {
+			st.Push(saved[i])
+		}
+
+	case I_PUSH:
+		st.Push(ip.load(p.Args[0], p.Args[1], false))
+
+	case I_UNIT:
+		st.Push(NewCode(D_UNIT))
+
+	case I_CAST, I_RENAME:
+
+	// control
+	case I_FAILWITH:
+		return &RuntimeError{
+			Section: in.section,
+			Path:    in.path,
+			Prim:    p,
+			Value:   ip.readable(in.in[0], peek(0)),
+			Message: "script rejected",
+		}
+
+	case I_NEVER:
+		return ip.errorf(in, "reached unreachable code")
+
+	case I_IF:
+		v := pop(1)[0]
+		b := 1
+		if v.OpCode == D_TRUE {
+			b = 0
+		}
+		return ip.exec(in.blocks[b], st)
+
+	case I_IF_NONE:
+		v := pop(1)[0]
+		if v.OpCode == D_NONE {
+			return ip.exec(in.blocks[0], st)
+		}
+		st.Push(v.Args[0])
+		return ip.exec(in.blocks[1], st)
+
+	case I_IF_LEFT:
+		v := pop(1)[0]
+		st.Push(v.Args[0])
+		if v.OpCode == D_LEFT {
+			return ip.exec(in.blocks[0], st)
+		}
+		return ip.exec(in.blocks[1], st)
+
+	case I_IF_CONS:
+		v := pop(1)[0]
+		if len(v.Args) == 0 {
+			return ip.exec(in.blocks[1], st)
+		}
+		st.Push(NewSeq(v.Args[1:]...))
+		st.Push(v.Args[0])
+		return ip.exec(in.blocks[0], st)
+
+	case I_LOOP:
+		for pop(1)[0].OpCode == D_TRUE {
+			if err := ip.exec(in.blocks[0], st); err != nil {
+				return err
+			}
+		}
+
+	case I_LOOP_LEFT:
+		for {
+			v := pop(1)[0]
+			st.Push(v.Args[0])
+			if v.OpCode != D_LEFT {
+				break
+			}
+			if err := ip.exec(in.blocks[0], st); err != nil {
+				return err
+			}
+		}
+
+	case I_LAMBDA:
+		st.Push(p.Args[2])
+
+	case I_LAMBDA_REC:
+		st.Push(NewCode(D_LAMBDA_REC, p.Args[2]))
+
+	case I_EXEC:
+		vals := pop(2)
+		res, err := ip.execLambda(in.in[1], vals[1], vals[0])
+		if err != nil {
+			return err
+		}
+		st.Push(res)
+
+	case I_APPLY:
+		vals := pop(2)
+		st.Push(applyLambda(in.in[1], in.in[0], ip.readable(in.in[0], vals[0]), vals[1]))
+
+	// options, unions, pairs
+	case I_SOME:
+		st.Push(NewOption(pop(1)[0]))
+
+	case I_NONE:
+		st.Push(NewOption())
+
+	case I_LEFT:
+		st.Push(NewCode(D_LEFT, pop(1)[0]))
+
+	case I_RIGHT:
+		st.Push(NewCode(D_RIGHT, pop(1)[0]))
+
+	case I_PAIR:
+		k := 2
+		if len(p.Args) == 1 {
+			k = intArg(0)
+		}
+		vals := pop(k)
+		v := vals[k-1]
+		for i := k - 2; i >= 0; i-- {
+			v = NewPair(vals[i], v)
+		}
+		st.Push(v)
+
+	case I_UNPAIR:
+		k := 2
+		if len(p.Args) == 1 {
+			k = intArg(0)
+		}
+		v := pop(1)[0]
+		vals := make([]Prim, 0, k)
+		for i := 0; i < k-1; i++ {
+			l, r := pairValueArgs(v)
+			vals = append(vals, l)
+			v = r
+		}
+		vals = append(vals, v)
+		for i := k - 1; i >= 0; i-- {
+			st.Push(vals[i])
+		}
+
+	case I_CAR, I_CDR:
+		l, r := pairValueArgs(pop(1)[0])
+		if p.OpCode == I_CAR {
+			st.Push(l)
+		} else {
+			st.Push(r)
+		}
+
+	case I_GET:
+		if len(p.Args) == 1 {
+			st.Push(combGet(pop(1)[0], intArg(0)))
+			break
+		}
+		vals := pop(2)
+		v, ok, err := ip.mapGet(in.in[1], vals[1], vals[0])
+		if err != nil {
+			return err
+		}
+		if ok {
+			st.Push(NewOption(v))
+		} else {
+			st.Push(NewOption())
+		}
+
+	case I_UPDATE:
+		if len(p.Args) == 1 {
+			vals := pop(2)
+			st.Push(combUpdate(vals[1], intArg(0), vals[0]))
+			break
+		}
+		vals := pop(3)
+		st.Push(ip.update(in.in[2], vals[2], vals[0], vals[1]))
+
+	case I_GET_AND_UPDATE:
+		vals := pop(3)
+		old, ok, err := ip.mapGet(in.in[2], vals[2], vals[0])
+		if err != nil {
+			return err
+		}
+		st.Push(ip.update(in.in[2], vals[2], vals[0], vals[1]))
+		if ok {
+			st.Push(NewOption(old))
+		} else {
+			st.Push(NewOption())
+		}
+
+	// collections
+	case I_NIL, I_EMPTY_SET, I_EMPTY_MAP:
+		st.Push(NewSeq())
+
+	case I_EMPTY_BIG_MAP:
+		st.Push(ip.newBigmap(-1, p.Args[0], p.Args[1], nil))
+
+	case I_CONS:
+		vals := pop(2)
+		list := make([]Prim, 0, len(vals[1].Args)+1)
+		list = append(list, vals[0])
+		st.Push(NewSeq(append(list, vals[1].Args...)...))
+
+	case I_SIZE:
+		v := pop(1)[0]
+		var l int
+		switch in.in[0].OpCode {
+		case T_STRING:
+			l = len(v.String)
+		case T_BYTES:
+			l = len(v.Bytes)
+		default:
+			l = len(v.Args)
+		}
+		st.Push(NewInt64(int64(l)))
+
+	case I_MEM:
+		vals := pop(2)
+		var ok bool
+		switch in.in[1].OpCode {
+		case T_SET:
+			_, ok = findElem(in.in[1].Args[0], vals[1].Args, vals[0], false)
+		default:
+			var err error
+			if _, ok, err = ip.mapGet(in.in[1], vals[1], vals[0]); err != nil {
+				return err
+			}
+		}
+		st.Push(boolValue(ok))
+
+	case I_MAP:
+		v := pop(1)[0]
+		typ := in.in[0]
+		switch typ.OpCode {
+		case T_OPTION:
+			if v.OpCode == D_NONE {
+				st.Push(v)
+				break
+			}
+			st.Push(v.Args[0])
+			if err := ip.exec(in.blocks[0], st); err != nil {
+				return err
+			}
+			st.Push(NewOption(pop(1)[0]))
+		default:
+			list := make([]Prim, len(v.Args))
+			for i, e := range v.Args {
+				if typ.OpCode == T_MAP {
+					st.Push(NewPair(e.Args[0], e.Args[1]))
+				} else {
+					st.Push(e)
+				}
+				if err := ip.exec(in.blocks[0], st); err != nil {
+					return err
+				}
+				list[i] = pop(1)[0]
+				if typ.OpCode == T_MAP {
+					list[i] = NewMapElem(e.Args[0], list[i])
+				}
+			}
+			st.Push(NewSeq(list...))
+		}
+
+	case I_ITER:
+		v := pop(1)[0]
+		for _, e := range v.Args {
+			if in.in[0].OpCode == T_MAP {
+				e = NewPair(e.Args[0], e.Args[1])
+			}
+			st.Push(e)
+			if err := ip.exec(in.blocks[0], st); err != nil {
+				return err
+			}
+		}
+
+	case I_CONCAT:
+		if in.in[0].OpCode == T_LIST {
+			list := pop(1)[0]
+			if in.in[0].Args[0].OpCode == T_STRING {
+				var b strings.Builder
+				for _, v := range list.Args {
+					b.WriteString(v.String)
+				}
+				st.Push(NewString(b.String()))
+			} else {
+				var b bytes.Buffer
+				for _, v := range list.Args {
+					b.Write(v.Bytes)
+				}
+				st.Push(NewBytes(b.Bytes()))
+			}
+			break
+		}
+		vals := pop(2)
+		if in.in[0].OpCode == T_STRING {
+			st.Push(NewString(vals[0].String + vals[1].String))
+		} else {
+			st.Push(NewBytes(append(append([]byte{}, vals[0].Bytes...), vals[1].Bytes...)))
+		}
+
+	case I_SLICE:
+		vals := pop(3)
+		off, l := vals[0].Int, vals[1].Int
+		size := len(vals[2].String)
+		if in.in[2].OpCode == T_BYTES {
+			size = len(vals[2].Bytes)
+		}
+		end := new(big.Int).Add(off, l)
+		if end.Cmp(big.NewInt(int64(size))) > 0 {
+			st.Push(NewOption())
+			break
+		}
+		i, j := off.Int64(), end.Int64()
+		if in.in[2].OpCode == T_BYTES {
+			st.Push(NewOption(NewBytes(append([]byte{}, vals[2].Bytes[i:j]...))))
+		} else {
+			st.Push(NewOption(NewString(vals[2].String[i:j])))
+		}
+
+	// arithmetic and logic
+	case I_ADD, I_SUB, I_MUL:
+		vals := pop(2)
+		if isBlsType(in.in[0]) || isBlsType(in.in[1]) {
+			return unsupported()
+		}
+		z := new(big.Int)
+		switch p.OpCode {
+		case I_ADD:
+			z.Add(vals[0].Int, vals[1].Int)
+		case I_SUB:
+			z.Sub(vals[0].Int, vals[1].Int)
+		case I_MUL:
+			z.Mul(vals[0].Int, vals[1].Int)
+		}
+		if in.out[0].OpCode == T_MUMAV && z.Cmp(maxMumav) > 0 {
+			return ip.errorf(in, "mumav overflow")
+		}
+		st.Push(NewBig(z))
+
+	case I_SUB_MUMAV:
+		vals := pop(2)
+		z := new(big.Int).Sub(vals[0].Int, vals[1].Int)
+		if z.Sign() < 0 {
+			st.Push(NewOption())
+		} else {
+			st.Push(NewOption(NewBig(z)))
+		}
+
+	case I_EDIV:
+		vals := pop(2)
+		if vals[1].Int.Sign() == 0 {
+			st.Push(NewOption())
+			break
+		}
+		q, r := new(big.Int).DivMod(vals[0].Int, vals[1].Int, new(big.Int))
+		st.Push(NewOption(NewPair(NewBig(q), NewBig(r))))
+
+	case I_ABS:
+		st.Push(NewBig(new(big.Int).Abs(pop(1)[0].Int)))
+
+	case I_NEG:
+		if isBlsType(in.in[0]) {
+			return unsupported()
+		}
+		st.Push(NewBig(new(big.Int).Neg(pop(1)[0].Int)))
+
+	case I_ISNAT:
+		v := pop(1)[0]
+		if v.Int.Sign() < 0 {
+			st.Push(NewOption())
+		} else {
+			st.Push(NewOption(v))
+		}
+
+	case I_INT:
+		v := pop(1)[0]
+		switch in.in[0].OpCode {
+		case T_BYTES:
+			st.Push(NewBig(bytesToInt(v.Bytes, true)))
+		case T_NAT:
+			st.Push(v)
+		default:
+			return unsupported()
+		}
+
+	case I_NAT:
+		st.Push(NewBig(bytesToInt(pop(1)[0].Bytes, false)))
+
+	case I_BYTES:
+		st.Push(NewBytes(intToBytes(pop(1)[0].Int)))
+
+	case I_COMPARE:
+		vals := pop(2)
+		st.Push(NewInt64(int64(compareValues(in.in[0], vals[0], vals[1]))))
+
+	case I_EQ, I_NEQ, I_LT, I_GT, I_LE, I_GE:
+		c := pop(1)[0].Int.Sign()
+		var b bool
+		switch p.OpCode {
+		case I_EQ:
+			b = c == 0
+		case I_NEQ:
+			b = c != 0
+		case I_LT:
+			b = c < 0
+		case I_GT:
+			b = c > 0
+		case I_LE:
+			b = c <= 0
+		case I_GE:
+			b = c >= 0
+		}
+		st.Push(boolValue(b))
+
+	case I_LSL, I_LSR:
+		vals := pop(2)
+		limit := maxShift
+		if in.in[0].OpCode == T_BYTES {
+			limit = maxBytesShift
+		}
+		if vals[1].Int.Cmp(limit) > 0 {
+			return ip.errorf(in, "shift overflow")
+		}
+		s := uint(vals[1].Int.Uint64())
+		if in.in[0].OpCode == T_BYTES {
+			st.Push(NewBytes(shiftBytes(vals[0].Bytes, s, p.OpCode == I_LSL)))
+		} else if p.OpCode == I_LSL {
+			st.Push(NewBig(new(big.Int).Lsh(vals[0].Int, s)))
+		} else {
+			st.Push(NewBig(new(big.Int).Rsh(vals[0].Int, s)))
+		}
+
+	case I_OR, I_AND, I_XOR:
+		vals := pop(2)
+		switch in.in[0].OpCode {
+		case T_BOOL:
+			a, b := vals[0].OpCode == D_TRUE, vals[1].OpCode == D_TRUE
+			switch p.OpCode {
+			case I_OR:
+				st.Push(boolValue(a || b))
+			case I_AND:
+				st.Push(boolValue(a && b))
+			default:
+				st.Push(boolValue(a != b))
+			}
+		case T_BYTES:
+			st.Push(NewBytes(bitwiseBytes(p.OpCode, vals[0].Bytes, vals[1].Bytes)))
+		default:
+			z := new(big.Int)
+			switch p.OpCode {
+			case I_OR:
+				z.Or(vals[0].Int, vals[1].Int)
+			case I_AND:
+				z.And(vals[0].Int, vals[1].Int)
+			default:
+				z.Xor(vals[0].Int, vals[1].Int)
+			}
+			st.Push(NewBig(z))
+		}
+
+	case I_NOT:
+		v := pop(1)[0]
+		switch in.in[0].OpCode {
+		case T_BOOL:
+			st.Push(boolValue(v.OpCode != D_TRUE))
+		case T_BYTES:
+			b := make([]byte, len(v.Bytes))
+			for i, c := range v.Bytes {
+				b[i] = ^c
+			}
+			st.Push(NewBytes(b))
+		default:
+			st.Push(NewBig(new(big.Int).Not(v.Int)))
+		}
+
+	// cryptography
+	case I_BLAKE2B, I_SHA256, I_SHA512, I_KECCAK, I_SHA3:
+		st.Push(NewBytes(hashBytes(p.OpCode, pop(1)[0].Bytes)))
+
+	case I_HASH_KEY:
+		k, err := keyValue(pop(1)[0])
+		if err != nil {
+			return ip.errorf(in, "invalid key: %v", err)
+		}
+		st.Push(NewString(k.Address().String()))
+
+	case I_CHECK_SIGNATURE:
+		vals := pop(3)
+		st.Push(boolValue(checkSignature(vals[0], vals[1], vals[2])))
+
+	case I_PACK:
+		buf, err := optimize(in.in[0], pop(1)[0]).MarshalBinary()
+		if err != nil {
+			return ip.errorf(in, "%v", err)
+		}
+		st.Push(NewBytes(append([]byte{0x05}, buf...)))
+
+	case I_UNPACK:
+		v, ok := unpackValue(p.Args[0], pop(1)[0].Bytes)
+		if !ok {
+			st.Push(NewOption())
+		} else {
+			st.Push(NewOption(ip.load(p.Args[0], v, false)))
+		}
+
+	// blockchain context
+	case I_SELF:
+		s := ip.self.String()
+		if ep := fieldAnno(p); ep != "" && ep != "default" {
+			s += "%" + ep
+		}
+		st.Push(NewString(s))
+
+	case I_SELF_ADDRESS:
+		st.Push(NewString(ip.self.String()))
+
+	case I_SENDER:
+		st.Push(NewString(ip.sender.String()))
+
+	case I_SOURCE:
+		st.Push(NewString(ip.env.Source.String()))
+
+	case I_AMOUNT:
+		st.Push(NewInt64(ip.amount))
+
+	case I_BALANCE:
+		st.Push(NewInt64(ip.balance))
+
+	case I_NOW:
+		var now int64
+		if !ip.env.Now.IsZero() {
+			now = ip.env.Now.Unix()
+		}
+		st.Push(NewInt64(now))
+
+	case I_LEVEL:
+		st.Push(NewInt64(ip.env.Level))
+
+	case I_CHAIN_ID:
+		st.Push(NewBytes(ip.env.ChainId.Bytes()))
+
+	case I_MIN_BLOCK_TIME:
+		st.Push(NewInt64(ip.env.MinBlockTime))
+
+	case I_TOTAL_VOTING_POWER:
+		st.Push(NewInt64(ip.env.TotalVotingPower))
+
+	case I_VOTING_POWER:
+		a, _ := addressValue(pop(1)[0])
+		var power int64
+		if ip.env.VotingPower != nil {
+			power = ip.env.VotingPower(a)
+		}
+		st.Push(NewInt64(power))
+
+	case I_ADDRESS:
+
+	case I_IMPLICIT_ACCOUNT:
+		a, _ := addressValue(pop(1)[0])
+		st.Push(NewString(a.String()))
+
+	case I_CONTRACT:
+		v, ok, err := ip.contract(p.Args[0], fieldAnno(p), pop(1)[0])
+		if err != nil {
+			return err
+		}
+		if ok {
+			st.Push(NewOption(v))
+		} else {
+			st.Push(NewOption())
+		}
+
+	case I_VIEW:
+		vals := pop(2)
+		v, ok, err := ip.view(p.Args[0].String, in.in[0], p.Args[1], vals[0], vals[1])
+		if err != nil {
+			return err
+		}
+		if ok {
+			st.Push(NewOption(v))
+		} else {
+			st.Push(NewOption())
+		}
+
+	// operations
+	case I_TRANSFER_TOKENS:
+		vals := pop(3)
+		dest, _ := addressValue(vals[2])
+		ep := addressEntrypoint(vals[2])
+		if ep == "" {
+			ep = "default"
+		}
+		op := InternalOp{
+			Kind:        mavryk.OpTypeTransaction,
+			Amount:      vals[1].Int.Int64(),
+			Destination: &dest,
+			Parameters:  &Parameters{Entrypoint: ep},
+		}
+		st.Push(ip.emit(op, in.in[0], vals[0]))
+
+	case I_SET_DELEGATE:
+		v := pop(1)[0]
+		op := InternalOp{Kind: mavryk.OpTypeDelegation}
+		if v.OpCode == D_SOME {
+			a, _ := addressValue(v.Args[0])
+			op.Delegate = &a
+		}
+		st.Push(ip.emit(op, InvalidPrim, InvalidPrim))
+
+	case I_CREATE_CONTRACT:
+		vals := pop(3)
+		code := contractLiteral(p.Args[0])
+		op := InternalOp{
+			Kind:    mavryk.OpTypeOrigination,
+			Balance: vals[1].Int.Int64(),
+			Script:  &Script{Code: code},
+		}
+		if vals[0].OpCode == D_SOME {
+			a, _ := addressValue(vals[0].Args[0])
+			op.Delegate = &a
+		}
+		addr := mavryk.ContractAddressFromOrigination(ip.env.OpHash, ip.nonce)
+		ip.nonce++
+		st.Push(NewString(addr.String()))
+		st.Push(ip.emit(op, code.Storage.Args[0], vals[2]))
+
+	case I_EMIT:
+		typ := in.in[0]
+		if len(p.Args) == 1 {
+			typ = p.Args[0]
+		}
+		op := InternalOp{
+			Kind: mavryk.OpTypeEvent,
+			Type: &typ,
+			Tag:  fieldAnno(p),
+		}
+		st.Push(ip.emit(op, typ, pop(1)[0]))
+
+	// tickets
+	case I_TICKET:
+		vals := pop(2)
+		if vals[1].Int.Sign() == 0 {
+			st.Push(NewOption())
+		} else {
+			st.Push(NewOption(NewPair(NewString(ip.self.String()), NewPair(vals[0], vals[1]))))
+		}
+
+	case I_READ_TICKET:
+		st.Push(peek(0))
+
+	case I_SPLIT_TICKET:
+		vals := pop(2)
+		ticketer, rest := pairValueArgs(vals[0])
+		content, amount := pairValueArgs(rest)
+		a, b := pairValueArgs(vals[1])
+		if a.Int.Sign() == 0 || b.Int.Sign() == 0 || new(big.Int).Add(a.Int, b.Int).Cmp(amount.Int) != 0 {
+			st.Push(NewOption())
+			break
+		}
+		st.Push(NewOption(NewPair(
+			NewPair(ticketer, NewPair(content, a)),
+			NewPair(ticketer, NewPair(content, b)),
+		)))
+
+	case I_JOIN_TICKETS:
+		l, r := pairValueArgs(pop(1)[0])
+		lt, lr := pairValueArgs(l)
+		rt, rr := pairValueArgs(r)
+		lc, la := pairValueArgs(lr)
+		rc, ra := pairValueArgs(rr)
+		ct := in.in[0].Args[0].Args[0]
+		if compareValues(NewCode(T_ADDRESS), lt, rt) != 0 || compareValues(ct, lc, rc) != 0 {
+			st.Push(NewOption())
+			break
+		}
+		st.Push(NewOption(NewPair(lt, NewPair(lc, NewBig(new(big.Int).Add(la.Int, ra.Int))))))
+
+	default:
+		return unsupported()
+	}
+	return nil
+}
+
+// execLambda runs lambda value l of type t with argument arg.
+func (ip *interp) execLambda(t, l, arg Prim) (Prim, error) {
+	code, err := ip.lambda(t.Args[0], t.Args[1], l)
+	if err != nil {
+		return InvalidPrim, err
+	}
+	st := Stack{}
+	if code.rec {
+		st.Push(l)
+	}
+	st.Push(arg)
+	sub := *ip
+	sub.param = InvalidPrim
+	if err := sub.exec(code.code, &st); err != nil {
+		return InvalidPrim, err
+	}
+	return st[0], nil
+}
+
+// applyLambda partially applies lambda l of type t to readable value v of
+// type vt.
+func applyLambda(t, vt, v, l Prim) Prim {
+	push := NewCode(I_PUSH, vt.CloneNoAnnots(), v)
+	if l.OpCode == D_LAMBDA_REC && l.Type != PrimSequence {
+		return NewSeq(
+			push,
+			NewCode(I_PAIR),
+			NewCode(I_LAMBDA_REC, t.Args[0], t.Args[1], l.Args[0]),
+			NewCode(I_SWAP),
+			NewCode(I_EXEC),
+		)
+	}
+	return NewSeq(push, NewCode(I_PAIR), l)
+}
+
+// combGet returns element k of a right comb value as accessed by GET k.
+func combGet(v Prim, k int) Prim {
+	for {
+		l, r := pairValueArgs(v)
+		switch k {
+		case 0:
+			return v
+		case 1:
+			return l
+		}
+		v, k = r, k-2
+	}
+}
+
+// combUpdate replaces element k of a right comb value as done by UPDATE k.
+func combUpdate(v Prim, k int, x Prim) Prim {
+	if k == 0 {
+		return x
+	}
+	l, r := pairValueArgs(v)
+	if k == 1 {
+		return NewPair(x, r)
+	}
+	return NewPair(l, combUpdate(r, k-2, x))
+}
+
+// findElem searches sorted set elements or map entries for key k.
+func findElem(kt Prim, list []Prim, k Prim, isMap bool) (int, bool) {
+	key := func(i int) Prim {
+		if isMap {
+			return list[i].Args[0]
+		}
+		return list[i]
+	}
+	i := sort.Search(len(list), func(i int) bool {
+		return compareValues(kt, key(i), k) >= 0
+	})
+	return i, i < len(list) && compareValues(kt, key(i), k) == 0
+}
+
+// mapGet looks up key k in map or big_map m of type t.
+func (ip *interp) mapGet(t, m, k Prim) (Prim, bool, error) {
+	if t.OpCode == T_BIG_MAP {
+		return ip.bigmapGet(m, k)
+	}
+	i, ok := findElem(t.Args[0], m.Args, k, true)
+	if !ok {
+		return InvalidPrim, false, nil
+	}
+	return m.Args[i].Args[1], true, nil
+}
+
+// update sets key k in set, map or big_map c of type t. For sets v is a
+// bool, for maps an option.
+func (ip *interp) update(t, c, k, v Prim) Prim {
+	var (
+		elem   Prim
+		remove bool
+	)
+	switch t.OpCode {
+	case T_SET:
+		elem, remove = k, v.OpCode != D_TRUE
+	case T_BIG_MAP:
+		if v.OpCode == D_SOME {
+			return ip.bigmapUpdate(c, k, v.Args[0])
+		}
+		return ip.bigmapUpdate(c, k, InvalidPrim)
+	default:
+		if v.OpCode == D_SOME {
+			elem = NewMapElem(k, v.Args[0])
+		} else {
+			remove = true
+		}
+	}
+	i, ok := findElem(t.Args[0], c.Args, k, t.OpCode != T_SET)
+	list := make([]Prim, 0, len(c.Args)+1)
+	list = append(list, c.Args[:i]...)
+	if !remove {
+		list = append(list, elem)
+	}
+	if ok {
+		i++
+	}
+	return NewSeq(append(list, c.Args[i:]...)...)
+}
+
+// contract resolves address value v to a contract value of parameter type t
+// at entrypoint ep.
+func (ip *interp) contract(t Prim, ep string, v Prim) (Prim, bool, error) {
+	a, err := addressValue(v)
+	if err != nil {
+		return InvalidPrim, false, nil
+	}
+	if vep := addressEntrypoint(v); vep != "" {
+		if ep != "" {
+			return InvalidPrim, false, nil
+		}
+		ep = vep
+	}
+	if ep == "" {
+		ep = "default"
+	}
+	var param Prim
+	switch {
+	case a.IsEOA():
+		if ep != "default" || t.OpCode != T_UNIT {
+			return InvalidPrim, false, nil
+		}
+		return NewString(a.String()), true, nil
+	case !a.IsContract():
+		return InvalidPrim, false, nil
+	case a.Equal(ip.self) && ip.param.IsValid():
+		param = ip.param
+	default:
+		if ip.env.Contracts == nil {
+			return InvalidPrim, false, nil
+		}
+		script, err := ip.env.Contracts.GetScript(ip.ctx, a)
+		if err != nil {
+			return InvalidPrim, false, err
+		}
+		if script == nil || len(script.Code.Param.Args) == 0 {
+			return InvalidPrim, false, nil
+		}
+		param = script.Code.Param.Args[0]
+	}
+	typ, ok := findEntrypointType(param, ep)
+	if !ok || !typesEqual(typ, t) {
+		return InvalidPrim, false, nil
+	}
+	s := a.String()
+	if ep != "default" {
+		s += "%" + ep
+	}
+	return NewString(s), true, nil
+}
+
+// view calls on-chain view name of the contract at address v with input of
+// type it and expected result type rt.
+func (ip *interp) view(name string, it, rt, input, v Prim) (Prim, bool, error) {
+	a, err := addressValue(v)
+	if err != nil || !a.IsContract() || ip.env.Contracts == nil {
+		return InvalidPrim, false, nil
+	}
+	script, err := ip.env.Contracts.GetScript(ip.ctx, a)
+	if err != nil {
+		return InvalidPrim, false, err
+	}
+	if script == nil {
+		return InvalidPrim, false, nil
+	}
+	view, ok := findView(script.Code, name)
+	if !ok || !typesEqual(view.Args[1], it) || !typesEqual(view.Args[2], rt) {
+		return InvalidPrim, false, nil
+	}
+	key := a.String() + " " + name
+	code, ok := ip.views[key]
+	if !ok {
+		m, err := script.Code.Typecheck()
+		if err != nil {
+			return InvalidPrim, false, err
+		}
+		code = ip.compile(m, ViewSection(name), view.Args[3], []int{3})
+		if ip.views == nil {
+			ip.views = make(map[string][]*instr)
+		}
+		ip.views[key] = code
+	}
+	balance, err := ip.env.Contracts.GetBalance(ip.ctx, a)
+	if err != nil {
+		return InvalidPrim, false, err
+	}
+	sub := &interp{
+		interpState: ip.interpState,
+		self:        a,
+		sender:      ip.self,
+		balance:     balance,
+	}
+	storageType := script.Code.Storage.Args[0]
+	st := Stack{NewPair(input, sub.load(storageType, script.Storage, false))}
+	if err := sub.exec(code, &st); err != nil {
+		return InvalidPrim, false, err
+	}
+	return st[0], true, nil
+}
+
+// contractLiteral returns the code sections of a CREATE_CONTRACT literal.
+func contractLiteral(p Prim) Code {
+	c := Code{View: NewSeq()}
+	for _, v := range p.Args {
+		switch v.OpCode {
+		case K_PARAMETER:
+			c.Param = v
+		case K_STORAGE:
+			c.Storage = v
+		case K_CODE:
+			c.Code = v
+		case K_VIEW:
+			c.View.Args = append(c.View.Args, v)
+		}
+	}
+	return c
+}
+
+// unpackValue decodes packed bytes into a value of type t.
+func unpackValue(t Prim, buf []byte) (Prim, bool) {
+	if len(buf) == 0 || buf[0] != 0x05 {
+		return InvalidPrim, false
+	}
+	var v Prim
+	r := bytes.NewBuffer(buf[1:])
+	if err := v.DecodeBuffer(r); err != nil || r.Len() > 0 {
+		return InvalidPrim, false
+	}
+	tc := &typechecker{section: SectionData}
+	if err := tc.data(t, v, nil); err != nil {
+		return InvalidPrim, false
+	}
+	return v, true
+}
+
+func isBlsType(t Prim) bool {
+	switch t.OpCode {
+	case T_BLS12_381_G1, T_BLS12_381_G2, T_BLS12_381_FR:
+		return true
+	}
+	return false
+}
+
+func hashBytes(op OpCode, buf []byte) []byte {
+	switch op {
+	case I_BLAKE2B:
+		h := blake2b.Sum256(buf)
+		return h[:]
+	case I_SHA256:
+		h := sha256.Sum256(buf)
+		return h[:]
+	case I_SHA512:
+		h := sha512.Sum512(buf)
+		return h[:]
+	case I_KECCAK:
+		h := sha3.NewLegacyKeccak256()
+		h.Write(buf)
+		return h.Sum(nil)
+	default:
+		h := sha3.Sum256(buf)
+		return h[:]
+	}
+}
+
+// checkSignature verifies signature s of message msg with key k. Messages
+// are hashed with blake2b except for BLS keys.
+func checkSignature(k, s, msg Prim) bool {
+	key, err := keyValue(k)
+	if err != nil {
+		return false
+	}
+	var sig mavryk.Signature
+	switch s.Type {
+	case PrimString:
+		if sig, err = mavryk.ParseSignature(s.String); err != nil {
+			return false
+		}
+	default:
+		if err := sig.UnmarshalBinary(s.Bytes); err != nil {
+			return false
+		}
+	}
+	return key.VerifyMessage(msg.Bytes, sig) == nil
+}
+
+// bytesToInt decodes big-endian bytes, as two's complement when signed.
+func bytesToInt(b []byte, signed bool) *big.Int {
+	z := new(big.Int).SetBytes(b)
+	if signed && len(b) > 0 && b[0]&0x80 != 0 {
+		z.Sub(z, new(big.Int).Lsh(big.NewInt(1), uint(len(b))*8))
+	}
+	return z
+}
+
+// intToBytes encodes z as minimal big-endian two's complement. Zero encodes
+// as empty bytes.
+func intToBytes(z *big.Int) []byte {
+	if z.Sign() == 0 {
+		return []byte{}
+	}
+	if z.Sign() > 0 {
+		b := z.Bytes()
+		if b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		return b
+	}
+	// negative: find the smallest n with -2^(8n-1) <= z
+	n := (new(big.Int).Not(z).BitLen())/8 + 1
+	u := new(big.Int).Add(z, new(big.Int).Lsh(big.NewInt(1), uint(n)*8))
+	b := u.Bytes()
+	for len(b) < n {
+		b = append([]byte{0xff}, b...)
+	}
+	return b
+}
+
+// shiftBytes shifts b by s bits. Left shifts grow the result, right shifts
+// drop whole bytes that were shifted out.
+func shiftBytes(b []byte, s uint, left bool) []byte {
+	z := new(big.Int).SetBytes(b)
+	var l int
+	if left {
+		z.Lsh(z, s)
+		l = len(b) + int((s+7)/8)
+	} else {
+		z.Rsh(z, s)
+		l = len(b) - int(s/8)
+		if l < 0 {
+			l = 0
+		}
+	}
+	out := make([]byte, l)
+	return z.FillBytes(out)
+}
+
+// bitwiseBytes applies a bitwise operation to byte strings aligned at the
+// least significant byte. AND truncates to the shorter input, OR and XOR
+// extend to the longer one.
+func bitwiseBytes(op OpCode, a, b []byte) []byte {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	n := len(a)
+	if op == I_AND {
+		n = len(b)
+	}
+	out := make([]byte, n)
+	for i := 1; i <= n; i++ {
+		x := a[len(a)-i]
+		var y byte
+		if i <= len(b) {
+			y = b[len(b)-i]
+		}
+		switch op {
+		case I_AND:
+			out[n-i] = x & y
+		case I_OR:
+			out[n-i] = x | y
+		default:
+			out[n-i] = x ^ y
+		}
+	}
+	return out
+}
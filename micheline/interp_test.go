@@ -0,0 +1,396 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+// testStore is an in-memory big_map and contract store.
+type testStore struct {
+	bigmaps  map[int64]map[mavryk.ExprHash]Prim
+	scripts  map[string]*Script
+	balances map[string]int64
+}
+
+func (s *testStore) GetBigmapValue(_ context.Context, id int64, _ Prim, hash mavryk.ExprHash) (Prim, bool, error) {
+	v, ok := s.bigmaps[id][hash]
+	return v, ok, nil
+}
+
+func (s *testStore) GetScript(_ context.Context, addr mavryk.Address) (*Script, error) {
+	return s.scripts[addr.String()], nil
+}
+
+func (s *testStore) GetBalance(_ context.Context, addr mavryk.Address) (int64, error) {
+	return s.balances[addr.String()], nil
+}
+
+const (
+	testAdmin    = "mv18Xi4qPNHQPyiiXGaj9kYdu6rqZGRLknGZ"
+	testUser     = "mv1949pcbqwGsHfUCaVmNVRu21Cd4SnbpvpP"
+	testContract = "KT1977zpPmwDqiDRqoGS47HRhQUaxcQigVYc"
+)
+
+func TestRunCode(t *testing.T) {
+	cases := []struct {
+		Param   string
+		Storage string
+		Code    string
+		Input   string
+		Init    string
+		Want    string
+		Err     bool
+	}{
+		{Param: `int`, Storage: `int`, Code: `{ UNPAIR ; ADD ; NIL operation ; PAIR }`, Input: `5`, Init: `7`, Want: `12`},
+		{Param: `unit`, Storage: `pair nat string bool`, Code: `{ CDR ; UNPAIR 3 ; PUSH nat 1 ; ADD ; PAIR 3 ; NIL operation ; PAIR }`, Input: `Unit`, Init: `Pair 1 "a" True`, Want: `Pair 2 "a" True`},
+		{Param: `unit`, Storage: `bytes`, Code: `{ DROP ; PUSH nat 1 ; PUSH string "a" ; PAIR ; PACK ; NIL operation ; PAIR }`, Input: `Unit`, Init: `0x`, Want: `0x0507070100000001610001`},
+		{Param: `bytes`, Storage: `option (pair string nat)`, Code: `{ CAR ; UNPACK (pair string nat) ; NIL operation ; PAIR }`, Input: `0x0507070100000001610001`, Init: `None`, Want: `Some (Pair "a" 1)`},
+		{Param: `unit`, Storage: `timestamp`, Code: `{ CDR ; PUSH int 60 ; ADD ; NIL operation ; PAIR }`, Input: `Unit`, Init: `"2024-01-01T00:00:00Z"`, Want: `"2024-01-01T00:01:00Z"`},
+		{Param: `list int`, Storage: `list int`, Code: `{ CAR ; MAP { PUSH int 2 ; MUL } ; NIL operation ; PAIR }`, Input: `{ 1 ; 2 ; 3 }`, Init: `{}`, Want: `{ 2 ; 4 ; 6 }`},
+		{Param: `set nat`, Storage: `set nat`, Code: `{ UNPAIR ; ITER { PUSH bool True ; SWAP ; UPDATE } ; NIL operation ; PAIR }`, Input: `{ 1 ; 3 ; 5 }`, Init: `{ 2 }`, Want: `{ 1 ; 2 ; 3 ; 5 }`},
+		{Param: `string`, Storage: `map string nat`, Code: `{ UNPAIR ; DIP { PUSH (option nat) (Some 9) } ; UPDATE ; NIL operation ; PAIR }`, Input: `"b"`, Init: `{ Elt "a" 1 }`, Want: `{ Elt "a" 1 ; Elt "b" 9 }`},
+		{Param: `int`, Storage: `bytes`, Code: `{ CAR ; BYTES ; NIL operation ; PAIR }`, Input: `-129`, Init: `0x`, Want: `0xff7f`},
+		{Param: `int`, Storage: `option (pair int nat)`, Code: `{ CAR ; PUSH int -3 ; SWAP ; EDIV ; NIL operation ; PAIR }`, Input: `7`, Init: `None`, Want: `Some (Pair -2 1)`},
+		{Param: `nat`, Storage: `nat`, Code: `{ CAR ; PUSH nat 0 ; SWAP ; DUP ; INT ; NEQ ; LOOP { DUP ; DIP { ADD } ; PUSH nat 1 ; SWAP ; SUB ; ABS ; DUP ; INT ; NEQ } ; DROP ; NIL operation ; PAIR }`, Input: `4`, Init: `0`, Want: `10`},
+		{Param: `nat`, Storage: `nat`, Code: `{ CAR ; LAMBDA_REC nat nat { DUP ; INT ; EQ ; IF { DIP { DROP } } { DUP ; PUSH nat 1 ; SWAP ; SUB ; ABS ; DIG 2 ; SWAP ; EXEC ; ADD } } ; SWAP ; EXEC ; NIL operation ; PAIR }`, Input: `10`, Init: `0`, Want: `55`},
+		{Param: `nat`, Storage: `nat`, Code: `{ CAR ; LAMBDA (pair nat nat) nat { UNPAIR ; ADD } ; SWAP ; APPLY ; PUSH nat 3 ; EXEC ; NIL operation ; PAIR }`, Input: `10`, Init: `0`, Want: `13`},
+		{Param: `unit`, Storage: `pair address address mumav`, Code: `{ DROP ; AMOUNT ; SENDER ; SELF_ADDRESS ; PAIR 3 ; NIL operation ; PAIR }`, Input: `Unit`, Init: `Pair "` + testUser + `" "` + testUser + `" 0`, Want: `Pair "` + testContract + `" "` + testAdmin + `" 5`},
+		{Param: `unit`, Storage: `pair timestamp nat`, Code: `{ DROP ; LEVEL ; NOW ; PAIR ; NIL operation ; PAIR }`, Input: `Unit`, Init: `Pair 0 0`, Want: `Pair "2024-05-01T12:00:00Z" 42`},
+		{Param: `nat`, Storage: `nat`, Code: `{ CAR ; PUSH nat 1 ; SWAP ; SUB ; ISNAT ; IF_NONE { PUSH string "underflow" ; FAILWITH } {} ; NIL operation ; PAIR }`, Input: `0`, Init: `0`, Err: true},
+		{Param: `mumav`, Storage: `mumav`, Code: `{ CAR ; PUSH mumav 9223372036854775807 ; ADD ; NIL operation ; PAIR }`, Input: `1`, Init: `0`, Err: true},
+	}
+	env := &RunEnv{
+		Self:   mavryk.MustParseAddress(testContract),
+		Sender: mavryk.MustParseAddress(testAdmin),
+		Amount: 5,
+		Now:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Level:  42,
+	}
+	for i, c := range cases {
+		code := mustMichelsonCode(t, "parameter ("+c.Param+"); storage ("+c.Storage+"); code "+c.Code+";")
+		res, err := code.Run(context.Background(), mustMichelson(t, c.Input), mustMichelson(t, c.Init), env)
+		if c.Err {
+			var e *RuntimeError
+			if !errors.As(err, &e) {
+				t.Errorf("case %d: expected runtime error, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		if got, want := res.Storage.Michelson(), mustMichelson(t, c.Want).Michelson(); got != want {
+			t.Errorf("case %d: storage mismatch\n got  %s\n want %s", i, got, want)
+		}
+	}
+}
+
+func TestRunFA12(t *testing.T) {
+	ctx := context.Background()
+	buf, err := os.ReadFile("../examples/tzcompose/token/fa12_code.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var code Code
+	if err := json.Unmarshal(buf, &code); err != nil {
+		t.Fatal(err)
+	}
+
+	// mint into fresh big_maps
+	storage := mustMichelson(t, `Pair (Pair "`+testAdmin+`" {} {}) False {} 0`)
+	env := &RunEnv{Sender: mavryk.MustParseAddress(testAdmin), Entrypoint: "mint"}
+	res, err := code.Run(ctx, mustMichelson(t, `Pair "`+testUser+`" 100`), storage, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Storage.Michelson(), `Pair (Pair "`+testAdmin+`" -1 -2) False -3 100`; got != want {
+		t.Errorf("mint storage mismatch\n got  %s\n want %s", got, want)
+	}
+	userHash := mustKeyHash(t, "address", `"`+testUser+`"`)
+	var allocs, updates int
+	for _, ev := range res.BigmapDiff {
+		switch ev.Action {
+		case DiffActionAlloc:
+			allocs++
+		case DiffActionUpdate:
+			updates++
+			if ev.Id != -1 || !ev.KeyHash.Equal(userHash) {
+				t.Errorf("unexpected update %d %s", ev.Id, ev.KeyHash)
+			}
+		}
+	}
+	if allocs != 3 || updates != 1 {
+		t.Errorf("mint diff mismatch: %d allocs %d updates", allocs, updates)
+	}
+
+	// transfer on existing big_maps
+	store := &testStore{bigmaps: map[int64]map[mavryk.ExprHash]Prim{
+		5: {userHash: mustMichelson(t, `Pair {} 100`)},
+	}}
+	storage = mustMichelson(t, `Pair (Pair "`+testAdmin+`" 5 6) False 7 100`)
+	env = &RunEnv{Sender: mavryk.MustParseAddress(testUser), Entrypoint: "transfer", Bigmaps: store}
+	res, err = code.Run(ctx, mustMichelson(t, `Pair "`+testUser+`" "`+testAdmin+`" 30`), storage, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.BigmapDiff) != 2 {
+		t.Fatalf("transfer diff mismatch: %d events", len(res.BigmapDiff))
+	}
+	for _, ev := range res.BigmapDiff {
+		if ev.Action != DiffActionUpdate || ev.Id != 5 {
+			t.Errorf("unexpected event %s on %d", ev.Action, ev.Id)
+		}
+		if ev.KeyHash.Equal(userHash) {
+			if got := ev.Value.Michelson(); got != `Pair {} 70` {
+				t.Errorf("sender balance mismatch: %s", got)
+			}
+		}
+	}
+
+	// insufficient balance fails
+	_, err = code.Run(ctx, mustMichelson(t, `Pair "`+testUser+`" "`+testAdmin+`" 300`), storage, env)
+	var e *RuntimeError
+	if !errors.As(err, &e) || !e.IsFailwith() {
+		t.Fatalf("expected FAILWITH, got %v", err)
+	}
+	if got := e.Value.Michelson(); got != `"FA1.2_InsufficientBalance"` {
+		t.Errorf("unexpected failwith value %s", got)
+	}
+
+	// callback view emits a transaction
+	env.Entrypoint = "getBalance"
+	res, err = code.Run(ctx, mustMichelson(t, `Pair "`+testUser+`" "`+testContract+`"`), storage, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Operations) != 1 {
+		t.Fatalf("expected 1 operation, got %d", len(res.Operations))
+	}
+	op := res.Operations[0]
+	if op.Kind != mavryk.OpTypeTransaction || op.Destination == nil || op.Destination.String() != testContract {
+		t.Errorf("unexpected operation %s to %v", op.Kind, op.Destination)
+	}
+	if op.Parameters == nil || op.Parameters.Value.Michelson() != "100" {
+		t.Errorf("unexpected callback parameters %v", op.Parameters)
+	}
+	if len(res.BigmapDiff) != 0 {
+		t.Errorf("unexpected big_map diff on view call")
+	}
+}
+
+func TestRunBigmapCopy(t *testing.T) {
+	src := `parameter unit;
+storage (pair (big_map nat string) (big_map nat string));
+code { CDR ; CAR ; DUP ; PUSH string "y" ; SOME ; PUSH nat 0 ; UPDATE ; PAIR ; NIL operation ; PAIR }`
+	code := mustMichelsonCode(t, src)
+	res, err := code.Run(context.Background(), NewCode(D_UNIT), mustMichelson(t, `Pair 3 4`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		Action DiffAction
+		Id     int64
+	}{
+		{DiffActionCopy, 0},
+		{DiffActionUpdate, 3},
+		{DiffActionRemove, 4},
+	}
+	if len(res.BigmapDiff) != len(want) {
+		t.Fatalf("diff mismatch: %d events", len(res.BigmapDiff))
+	}
+	for i, w := range want {
+		ev := res.BigmapDiff[i]
+		if ev.Action != w.Action || (w.Action != DiffActionCopy && ev.Id != w.Id) {
+			t.Errorf("event %d: got %s %d, want %s %d", i, ev.Action, ev.Id, w.Action, w.Id)
+		}
+	}
+	if ev := res.BigmapDiff[0]; ev.SourceId != 3 || ev.DestId >= 0 {
+		t.Errorf("unexpected copy %d -> %d", ev.SourceId, ev.DestId)
+	}
+}
+
+func TestRunView(t *testing.T) {
+	ctx := context.Background()
+	src := `parameter unit;
+storage (pair (big_map nat string) nat);
+code { CDR ; NIL operation ; PAIR } ;
+view "get" nat (option string) { UNPAIR ; DIP { CAR } ; GET } ;`
+	code := mustMichelsonCode(t, src)
+	store := &testStore{
+		bigmaps: map[int64]map[mavryk.ExprHash]Prim{
+			3: {mustKeyHash(t, "nat", "0"): NewString("z")},
+		},
+	}
+	script := &Script{Code: code, Storage: mustMichelson(t, `Pair 3 1`)}
+	v, err := script.RunView(ctx, "get", mustMichelson(t, "0"), &RunEnv{Bigmaps: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := v.Michelson(); got != `Some "z"` {
+		t.Errorf("view result mismatch: %s", got)
+	}
+	if _, err := script.RunView(ctx, "missing", NewNat(nil), nil); err == nil {
+		t.Errorf("expected error on unknown view")
+	}
+
+	// on-chain view call through the contract store
+	store.scripts = map[string]*Script{testContract: script}
+	caller := mustMichelsonCode(t, `parameter address; storage (option string);
+code { CAR ; PUSH nat 0 ; VIEW "get" (option string) ; IF_NONE { PUSH string "noview" ; FAILWITH } {} ; NIL operation ; PAIR }`)
+	res, err := caller.Run(ctx, NewString(testContract), NewOption(), &RunEnv{Bigmaps: store, Contracts: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Storage.Michelson(); got != `Some "z"` {
+		t.Errorf("VIEW result mismatch: %s", got)
+	}
+	_, err = caller.Run(ctx, NewString(testUser), NewOption(), &RunEnv{Bigmaps: store, Contracts: store})
+	var e *RuntimeError
+	if !errors.As(err, &e) || !e.IsFailwith() {
+		t.Errorf("expected FAILWITH on missing view, got %v", err)
+	}
+}
+
+func TestRunOperations(t *testing.T) {
+	code := mustMichelsonCode(t, `parameter unit; storage (option address);
+code { DROP ; PUSH nat 5 ; EMIT %hello ; UNIT ; PUSH mumav 10 ; NONE key_hash ;
+       CREATE_CONTRACT { parameter unit ; storage unit ; code { CDR ; NIL operation ; PAIR } } ;
+       DIP { SOME } ; NIL operation ; SWAP ; CONS ; DIG 2 ; CONS ; PAIR }`)
+	res, err := code.Run(context.Background(), NewCode(D_UNIT), NewOption(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Operations) != 2 {
+		t.Fatalf("expected 2 operations, got %d", len(res.Operations))
+	}
+	ev, orig := res.Operations[0], res.Operations[1]
+	if ev.Kind != mavryk.OpTypeEvent || ev.Tag != "hello" || ev.Nonce != 0 {
+		t.Errorf("unexpected event %s %q nonce %d", ev.Kind, ev.Tag, ev.Nonce)
+	}
+	if ev.Payload == nil || ev.Payload.Michelson() != "5" {
+		t.Errorf("unexpected event payload %v", ev.Payload)
+	}
+	if orig.Kind != mavryk.OpTypeOrigination || orig.Balance != 10 || orig.Nonce != 1 || orig.Script == nil {
+		t.Errorf("unexpected origination %s balance %d nonce %d", orig.Kind, orig.Balance, orig.Nonce)
+	}
+	if !res.Storage.IsValid() || res.Storage.OpCode != D_SOME {
+		t.Errorf("expected originated address in storage, got %s", res.Storage.Michelson())
+	}
+	buf, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var check struct {
+		Operations []map[string]json.RawMessage `json:"operations"`
+	}
+	if err := json.Unmarshal(buf, &check); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(check.Operations[1]["balance"]); got != `"10"` {
+		t.Errorf("unexpected JSON balance %s", got)
+	}
+}
+
+func mustMichelsonCode(t *testing.T, src string) Code {
+	t.Helper()
+	c, err := ParseMichelsonCode(src)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if err := c.ExpandMacros(); err != nil {
+		t.Fatalf("expand error: %v", err)
+	}
+	return c
+}
+
+func mustMichelson(t *testing.T, src string) Prim {
+	t.Helper()
+	p, err := ParseMichelson(src)
+	if err != nil {
+		t.Fatalf("parse error in %q: %v", src, err)
+	}
+	return p
+}
+
+func mustKeyHash(t *testing.T, typ, val string) mavryk.ExprHash {
+	t.Helper()
+	k, err := NewKey(mustMichelsonType(t, typ), mustMichelson(t, val))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.Hash()
+}
+
+func TestRunGas(t *testing.T) {
+	ctx := context.Background()
+	loop := mustMichelsonCode(t, `parameter nat; storage nat;
+code { CAR ; DUP ; INT ; NEQ ; LOOP { PUSH nat 1 ; SWAP ; SUB ; ABS ; DUP ; INT ; NEQ } ; NIL operation ; PAIR }`)
+	short, err := loop.Run(ctx, NewInt64(10), NewInt64(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := loop.Run(ctx, NewInt64(1000), NewInt64(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if short.ConsumedMilligas <= 0 || long.ConsumedMilligas <= short.ConsumedMilligas {
+		t.Errorf("unexpected gas %d / %d", short.ConsumedMilligas, long.ConsumedMilligas)
+	}
+	if got, want := long.Gas(), (long.ConsumedMilligas+999)/1000; got != want {
+		t.Errorf("gas rounding mismatch: %d != %d", got, want)
+	}
+	_, err = loop.Run(ctx, NewInt64(1000), NewInt64(0), &RunEnv{GasLimit: short.Gas()})
+	var e *RuntimeError
+	if !errors.As(err, &e) || e.IsFailwith() {
+		t.Errorf("expected gas exhaustion, got %v", err)
+	}
+
+	// new big_map entries pay for their value and the key hash
+	bm := mustMichelsonCode(t, `parameter (pair nat string); storage (big_map nat string);
+code { UNPAIR ; UNPAIR ; DIP { SOME } ; UPDATE ; NIL operation ; PAIR }`)
+	res, err := bm.Run(ctx, mustMichelson(t, `Pair 1 "abc"`), NewInt64(3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BigmapKeyOverhead + Size(NewString("abc"))
+	if res.PaidStorageSizeDiff != want {
+		t.Errorf("paid storage mismatch: got %d want %d", res.PaidStorageSizeDiff, want)
+	}
+	if res.StorageSize != Size(NewInt64(3)) {
+		t.Errorf("storage size mismatch: got %d", res.StorageSize)
+	}
+}
+
+func TestStorageSize(t *testing.T) {
+	for _, v := range []struct {
+		typ, val string
+		want     int64
+	}{
+		// right combs of four or more elements are stored as sequences
+		{`pair nat nat nat nat`, `Pair 1 2 3 4`, 5 + 4*2},
+		{`pair nat (pair nat (pair nat nat))`, `{ 1 ; 2 ; 3 ; 4 }`, 5 + 4*2},
+		// smaller combs as nested pairs
+		{`pair nat nat nat`, `Pair 1 2 3`, 2 + 2 + 2 + 2 + 2},
+		{`pair (pair nat nat) nat`, `Pair (Pair 1 2) 3`, 2 + 2 + 2 + 2 + 2},
+		// addresses, keys and timestamps in binary form
+		{`address`, `"mv1949pcbqwGsHfUCaVmNVRu21Cd4SnbpvpP"`, 5 + 22},
+		{`option address`, `Some "KT1Puc9St8wdNoGtLiD2WXaHbWU7styaxYhD%foo"`, 2 + 5 + 22 + 3},
+		{`timestamp`, `"1970-01-01T00:01:40Z"`, 3},
+		{`list address`, `{ "mv1949pcbqwGsHfUCaVmNVRu21Cd4SnbpvpP" }`, 5 + 5 + 22},
+	} {
+		typ, val := mustMichelson(t, v.typ), mustMichelson(t, v.val)
+		if got := StorageSize(typ, val); got != v.want {
+			t.Errorf("%s %s: mismatched size got=%d want=%d", v.typ, v.val, got, v.want)
+		}
+	}
+}
@@ -0,0 +1,598 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ExpandMacros returns a copy of p where all Michelson macros have been replaced
+// by primitive instructions. Expansions are identical to those of octez-client,
+// so contracts parsed from source produce the same primitive trees as scripts
+// fetched from a node.
+func (p Prim) ExpandMacros() (Prim, error) {
+	if len(p.Args) > 0 {
+		args := make([]Prim, len(p.Args))
+		for i, v := range p.Args {
+			a, err := v.ExpandMacros()
+			if err != nil {
+				return InvalidPrim, err
+			}
+			args[i] = a
+		}
+		p.Args = args
+	}
+	if !p.IsMacro() {
+		return p, nil
+	}
+	return expandMacro(p)
+}
+
+// ExpandMacros expands all macros in code and views.
+func (c *Code) ExpandMacros() error {
+	var err error
+	if c.Code, err = c.Code.ExpandMacros(); err != nil {
+		return err
+	}
+	if c.View, err = c.View.ExpandMacros(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func newInstr(op OpCode, anno []string, args ...Prim) Prim {
+	return Prim{
+		Type:   primTypeOf(len(args), len(anno) > 0),
+		OpCode: op,
+		Args:   args,
+		Anno:   anno,
+	}
+}
+
+func failSeq() Prim {
+	return NewSeq(newInstr(I_UNIT, nil), newInstr(I_FAILWITH, nil))
+}
+
+func dipN(depth int, code Prim, anno []string) Prim {
+	if depth == 1 {
+		return newInstr(I_DIP, anno, code)
+	}
+	return newInstr(I_DIP, anno, NewInt64(int64(depth)), code)
+}
+
+var compareOps = map[string]OpCode{
+	"EQ":  I_EQ,
+	"NEQ": I_NEQ,
+	"LT":  I_LT,
+	"GT":  I_GT,
+	"LE":  I_LE,
+	"GE":  I_GE,
+}
+
+func macroError(p Prim, format string, args ...interface{}) error {
+	return fmt.Errorf("micheline: macro %s: %s", p.String, fmt.Sprintf(format, args...))
+}
+
+func checkMacroArgs(p Prim, n int) error {
+	if len(p.Args) != n {
+		return macroError(p, "expected %d arguments, got %d", n, len(p.Args))
+	}
+	return nil
+}
+
+func checkMacroNoAnno(p Prim) error {
+	if len(p.Anno) > 0 {
+		return macroError(p, "unexpected annotation")
+	}
+	return nil
+}
+
+// checkLetters checks that all characters of s are in set.
+func checkLetters(s, set string) bool {
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(set, s[i]) < 0 {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+func expandMacro(p Prim) (Prim, error) {
+	name := p.String
+	n := len(name)
+	switch {
+	case name == "FAIL":
+		if err := checkMacroArgs(p, 0); err != nil {
+			return InvalidPrim, err
+		}
+		if err := checkMacroNoAnno(p); err != nil {
+			return InvalidPrim, err
+		}
+		return failSeq(), nil
+
+	case name == "IF_SOME":
+		if err := checkMacroArgs(p, 2); err != nil {
+			return InvalidPrim, err
+		}
+		return NewSeq(newInstr(I_IF_NONE, p.Anno, p.Args[1], p.Args[0])), nil
+
+	case name == "IF_RIGHT":
+		if err := checkMacroArgs(p, 2); err != nil {
+			return InvalidPrim, err
+		}
+		return NewSeq(newInstr(I_IF_LEFT, p.Anno, p.Args[1], p.Args[0])), nil
+
+	case strings.HasPrefix(name, "CMP"):
+		op, ok := compareOps[name[3:]]
+		if !ok {
+			break
+		}
+		if err := checkMacroArgs(p, 0); err != nil {
+			return InvalidPrim, err
+		}
+		return NewSeq(newInstr(I_COMPARE, nil), newInstr(op, p.Anno)), nil
+
+	case strings.HasPrefix(name, "IFCMP"):
+		op, ok := compareOps[name[5:]]
+		if !ok {
+			break
+		}
+		if err := checkMacroArgs(p, 2); err != nil {
+			return InvalidPrim, err
+		}
+		return NewSeq(
+			newInstr(I_COMPARE, nil),
+			newInstr(op, nil),
+			newInstr(I_IF, p.Anno, p.Args...),
+		), nil
+
+	case strings.HasPrefix(name, "IF"):
+		op, ok := compareOps[name[2:]]
+		if !ok {
+			break
+		}
+		if err := checkMacroArgs(p, 2); err != nil {
+			return InvalidPrim, err
+		}
+		return NewSeq(newInstr(op, nil), newInstr(I_IF, p.Anno, p.Args...)), nil
+
+	case strings.HasPrefix(name, "ASSERT"):
+		return expandAssert(p)
+
+	case n > 3 && name[0] == 'D' && name[n-1] == 'P' && checkLetters(name[1:n-1], "I"):
+		// DII+P code
+		if err := checkMacroArgs(p, 1); err != nil {
+			return InvalidPrim, err
+		}
+		if !p.Args[0].IsSequence() {
+			return InvalidPrim, macroError(p, "sequence expected")
+		}
+		return dipN(n-2, p.Args[0], p.Anno), nil
+
+	case n > 3 && name[0] == 'D' && name[n-1] == 'P' && checkLetters(name[1:n-1], "U"):
+		// DUU+P
+		if err := checkMacroArgs(p, 0); err != nil {
+			return InvalidPrim, err
+		}
+		return newInstr(I_DUP, p.Anno, NewInt64(int64(n-2))), nil
+
+	case n > 4 && name[0] == 'P' && name[n-1] == 'R' && checkLetters(name[1:n-1], "PAI"):
+		return expandPair(p)
+
+	case n >= 6 && strings.HasPrefix(name, "UNP") && name[n-1] == 'R' && checkLetters(name[3:n-1], "PAI"):
+		return expandUnpair(p)
+
+	case n > 3 && name[0] == 'C' && name[n-1] == 'R' && checkLetters(name[1:n-1], "AD"):
+		return expandCadr(p)
+
+	case n >= 7 && strings.HasPrefix(name, "SET_C") && name[n-1] == 'R' && checkLetters(name[5:n-1], "AD"):
+		return expandSetCadr(p)
+
+	case n >= 7 && strings.HasPrefix(name, "MAP_C") && name[n-1] == 'R' && checkLetters(name[5:n-1], "AD"):
+		return expandMapCadr(p)
+	}
+	return InvalidPrim, fmt.Errorf("micheline: unknown macro %s", name)
+}
+
+// expandAssert expands ASSERT, ASSERT_{NONE|SOME|LEFT|RIGHT}, ASSERT_{EQ|..} and
+// ASSERT_CMP{EQ|..} macros.
+func expandAssert(p Prim) (Prim, error) {
+	if err := checkMacroArgs(p, 0); err != nil {
+		return InvalidPrim, err
+	}
+	rename := NewSeq()
+	if len(p.Anno) > 0 {
+		rename = NewSeq(newInstr(I_RENAME, p.Anno))
+	}
+	failFalse := []Prim{rename, NewSeq(failSeq())}
+	failTrue := []Prim{NewSeq(failSeq()), rename}
+
+	switch p.String {
+	case "ASSERT":
+		if err := checkMacroNoAnno(p); err != nil {
+			return InvalidPrim, err
+		}
+		return NewSeq(newInstr(I_IF, nil, failFalse...)), nil
+	case "ASSERT_NONE":
+		if err := checkMacroNoAnno(p); err != nil {
+			return InvalidPrim, err
+		}
+		return NewSeq(newInstr(I_IF_NONE, nil, failFalse...)), nil
+	case "ASSERT_SOME":
+		return NewSeq(newInstr(I_IF_NONE, nil, failTrue...)), nil
+	case "ASSERT_LEFT":
+		return NewSeq(newInstr(I_IF_LEFT, nil, failFalse...)), nil
+	case "ASSERT_RIGHT":
+		return NewSeq(newInstr(I_IF_LEFT, nil, failTrue...)), nil
+	}
+
+	if !strings.HasPrefix(p.String, "ASSERT_") {
+		return InvalidPrim, fmt.Errorf("micheline: unknown macro %s", p.String)
+	}
+	if err := checkMacroNoAnno(p); err != nil {
+		return InvalidPrim, err
+	}
+	rest := p.String[7:]
+	if op, ok := compareOps[rest]; ok {
+		return NewSeq(newInstr(op, nil), newInstr(I_IF, nil, failFalse...)), nil
+	}
+	if strings.HasPrefix(rest, "CMP") {
+		if op, ok := compareOps[rest[3:]]; ok {
+			cmp := NewSeq(newInstr(I_COMPARE, nil), newInstr(op, nil))
+			return NewSeq(cmp, newInstr(I_IF, nil, failFalse...)), nil
+		}
+	}
+	return InvalidPrim, fmt.Errorf("micheline: unknown macro %s", p.String)
+}
+
+// pairNode is a node in the tree described by a P[AIP]+R macro name.
+type pairNode struct {
+	pos         int // position in macro name, -1 for leaves
+	left, right *pairNode
+}
+
+func (n *pairNode) isLeaf() bool {
+	return n.pos < 0
+}
+
+// parsePairMacro parses the pair tree of a P[AIP]+R macro name starting at
+// position start. A left leaf is written as A, a right leaf as I.
+func parsePairMacro(p Prim, start int) (*pairNode, error) {
+	name := p.String
+	n := len(name)
+	var parse func(i int, left bool) (int, *pairNode, error)
+	parse = func(i int, left bool) (int, *pairNode, error) {
+		switch {
+		case i >= n-1:
+		case name[i] == 'P':
+			next, l, err := parse(i+1, true)
+			if err != nil {
+				return 0, nil, err
+			}
+			next, r, err := parse(next, false)
+			if err != nil {
+				return 0, nil, err
+			}
+			return next, &pairNode{pos: i, left: l, right: r}, nil
+		case name[i] == 'A' && left:
+			return i + 1, &pairNode{pos: -1}, nil
+		case name[i] == 'I' && !left:
+			return i + 1, &pairNode{pos: -1}, nil
+		}
+		return 0, nil, fmt.Errorf("micheline: invalid pair macro %s", name)
+	}
+	last, root, err := parse(start, false)
+	if err != nil {
+		return nil, err
+	}
+	if last != n-1 || root.isLeaf() {
+		return nil, fmt.Errorf("micheline: invalid pair macro %s", name)
+	}
+	return root, nil
+}
+
+type pairAnnots struct {
+	car, cdr []string
+}
+
+// pairAnnotPositions distributes annotations in order over the leaves of a pair
+// tree and returns them keyed by the position of the leaves' parent node.
+func pairAnnotPositions(root *pairNode, annots []string) map[int]*pairAnnots {
+	res := make(map[int]*pairAnnots)
+	var walk func(parent int, n *pairNode, isLeft bool)
+	walk = func(parent int, n *pairNode, isLeft bool) {
+		if len(annots) == 0 {
+			return
+		}
+		if !n.isLeaf() {
+			walk(n.pos, n.left, true)
+			walk(n.pos, n.right, false)
+			return
+		}
+		pa, ok := res[parent]
+		if !ok {
+			pa = &pairAnnots{}
+			res[parent] = pa
+		}
+		if isLeft {
+			pa.car = []string{annots[0]}
+		} else {
+			pa.cdr = []string{annots[0]}
+		}
+		annots = annots[1:]
+	}
+	walk(root.pos, root, false)
+	return res
+}
+
+// splitFieldAnnots separates field annotations from other annotations.
+func splitFieldAnnots(anno []string) (fields, other []string) {
+	for _, v := range anno {
+		if strings.HasPrefix(v, "%") {
+			fields = append(fields, v)
+		} else {
+			other = append(other, v)
+		}
+	}
+	return
+}
+
+// expandPair expands P[AIP]+R macros into PAIR instructions. Field annotations
+// are distributed over leaves, other annotations are kept on the outer pair.
+func expandPair(p Prim) (Prim, error) {
+	if err := checkMacroArgs(p, 0); err != nil {
+		return InvalidPrim, err
+	}
+	root, err := parsePairMacro(p, 0)
+	if err != nil {
+		return InvalidPrim, err
+	}
+	fields, other := splitFieldAnnots(p.Anno)
+	pos := pairAnnotPositions(root, fields)
+
+	var (
+		list  []Prim
+		depth int
+	)
+	var walk func(n *pairNode)
+	walk = func(n *pairNode) {
+		if n.isLeaf() {
+			depth++
+			return
+		}
+		var anno []string
+		if pa, ok := pos[n.pos]; ok {
+			if len(pa.car) == 0 {
+				anno = append(anno, "%")
+			} else {
+				anno = append(anno, pa.car...)
+			}
+			anno = append(anno, pa.cdr...)
+		}
+		if n.pos == 0 {
+			anno = append(anno, other...)
+		}
+		pair := newInstr(I_PAIR, anno)
+		if depth > 0 {
+			pair = dipN(depth, NewSeq(pair), nil)
+		}
+		list = append([]Prim{pair}, list...)
+		walk(n.left)
+		walk(n.right)
+	}
+	walk(root)
+	return NewSeq(list...), nil
+}
+
+// expandUnpair expands UNP[AIP]+R macros into UNPAIR instructions. Variable
+// annotations are distributed over leaves.
+func expandUnpair(p Prim) (Prim, error) {
+	if err := checkMacroArgs(p, 0); err != nil {
+		return InvalidPrim, err
+	}
+	root, err := parsePairMacro(p, 2)
+	if err != nil {
+		return InvalidPrim, err
+	}
+	for _, v := range p.Anno {
+		if !strings.HasPrefix(v, "@") {
+			return InvalidPrim, macroError(p, "unexpected annotation %s", v)
+		}
+	}
+	pos := pairAnnotPositions(root, p.Anno)
+
+	var (
+		list  []Prim
+		depth int
+	)
+	var walk func(n *pairNode)
+	walk = func(n *pairNode) {
+		if n.isLeaf() {
+			depth++
+			return
+		}
+		var anno []string
+		if pa, ok := pos[n.pos]; ok {
+			if len(pa.car) == 0 {
+				anno = append(anno, "@")
+			} else {
+				anno = append(anno, pa.car...)
+			}
+			anno = append(anno, pa.cdr...)
+		}
+		unpair := newInstr(I_UNPAIR, anno)
+		if depth > 0 {
+			unpair = dipN(depth, NewSeq(unpair), nil)
+		}
+		list = append(list, unpair)
+		walk(n.left)
+		walk(n.right)
+	}
+	walk(root)
+	return NewSeq(list...), nil
+}
+
+// expandCadr expands C[AD]+R macros into CAR and CDR instructions. Annotations
+// are kept on the last instruction, field access annotations @% and @%% are
+// kept on all instructions.
+func expandCadr(p Prim) (Prim, error) {
+	if err := checkMacroArgs(p, 0); err != nil {
+		return InvalidPrim, err
+	}
+	var path []string
+	for _, v := range p.Anno {
+		if v == "@%" || v == "@%%" {
+			path = append(path, v)
+		}
+	}
+	letters := p.String[1 : len(p.String)-1]
+	list := make([]Prim, len(letters))
+	for i := range letters {
+		anno := path
+		if i == len(letters)-1 {
+			anno = p.Anno
+		}
+		op := I_CAR
+		if letters[i] == 'D' {
+			op = I_CDR
+		}
+		list[i] = newInstr(op, anno)
+	}
+	return NewSeq(list...), nil
+}
+
+// singleFieldAnnot returns at most one field annotation and all other annotations.
+func singleFieldAnnot(p Prim) (string, []string, error) {
+	fields, other := splitFieldAnnots(p.Anno)
+	switch len(fields) {
+	case 0:
+		return "", other, nil
+	case 1:
+		return fields[0], other, nil
+	default:
+		return "", nil, macroError(p, "unexpected annotation %s", fields[1])
+	}
+}
+
+// wrapCadr wraps an inner update sequence for all but the last letter of a
+// SET_C[AD]+R or MAP_C[AD]+R macro, starting from the innermost position.
+func wrapCadr(letters string, inner Prim, anno []string) Prim {
+	for i := len(letters) - 2; i >= 0; i-- {
+		var a []string
+		if i == 0 {
+			a = anno
+		}
+		pairAnno := append([]string{"%@", "%@"}, a...)
+		if letters[i] == 'A' {
+			inner = NewSeq(
+				newInstr(I_DUP, nil),
+				newInstr(I_DIP, nil, NewSeq(newInstr(I_CAR, []string{"@%%"}), inner)),
+				newInstr(I_CDR, []string{"@%%"}),
+				newInstr(I_SWAP, nil),
+				newInstr(I_PAIR, pairAnno),
+			)
+		} else {
+			inner = NewSeq(
+				newInstr(I_DUP, nil),
+				newInstr(I_DIP, nil, NewSeq(newInstr(I_CDR, []string{"@%%"}), inner)),
+				newInstr(I_CAR, []string{"@%%"}),
+				newInstr(I_PAIR, pairAnno),
+			)
+		}
+	}
+	return inner
+}
+
+// expandSetCadr expands SET_C[AD]+R macros.
+func expandSetCadr(p Prim) (Prim, error) {
+	if err := checkMacroArgs(p, 0); err != nil {
+		return InvalidPrim, err
+	}
+	field, other, err := singleFieldAnnot(p)
+	if err != nil {
+		return InvalidPrim, err
+	}
+	name := p.String
+	letters := name[5 : len(name)-1]
+	fieldOrEmpty := field
+	if fieldOrEmpty == "" {
+		fieldOrEmpty = "%"
+	}
+
+	var list []Prim
+	if letters[len(letters)-1] == 'A' {
+		if field != "" {
+			list = append(list,
+				newInstr(I_DUP, nil),
+				newInstr(I_CAR, []string{field}),
+				newInstr(I_DROP, nil),
+			)
+		}
+		list = append(list,
+			newInstr(I_CDR, []string{"@%%"}),
+			newInstr(I_SWAP, nil),
+			newInstr(I_PAIR, []string{fieldOrEmpty, "%@"}),
+		)
+	} else {
+		if field != "" {
+			list = append(list,
+				newInstr(I_DUP, nil),
+				newInstr(I_CDR, []string{field}),
+				newInstr(I_DROP, nil),
+			)
+		}
+		list = append(list,
+			newInstr(I_CAR, []string{"@%%"}),
+			newInstr(I_PAIR, []string{"%@", fieldOrEmpty}),
+		)
+	}
+	return wrapCadr(letters, NewSeq(list...), other), nil
+}
+
+// expandMapCadr expands MAP_C[AD]+R code macros.
+func expandMapCadr(p Prim) (Prim, error) {
+	if err := checkMacroArgs(p, 1); err != nil {
+		return InvalidPrim, err
+	}
+	code := p.Args[0]
+	if !code.IsSequence() {
+		return InvalidPrim, macroError(p, "sequence expected")
+	}
+	field, other, err := singleFieldAnnot(p)
+	if err != nil {
+		return InvalidPrim, err
+	}
+	name := p.String
+	letters := name[5 : len(name)-1]
+	fieldOrEmpty := field
+	if fieldOrEmpty == "" {
+		fieldOrEmpty = "%"
+	}
+	var varAnno []string
+	if field != "" {
+		varAnno = []string{"@" + field[1:]}
+	}
+
+	var inner Prim
+	if letters[len(letters)-1] == 'A' {
+		inner = NewSeq(
+			newInstr(I_DUP, nil),
+			newInstr(I_CDR, []string{"@%%"}),
+			newInstr(I_DIP, nil, NewSeq(newInstr(I_CAR, varAnno), code)),
+			newInstr(I_SWAP, nil),
+			newInstr(I_PAIR, []string{fieldOrEmpty, "%@"}),
+		)
+	} else {
+		inner = NewSeq(
+			newInstr(I_DUP, nil),
+			newInstr(I_CDR, varAnno),
+			code,
+			newInstr(I_SWAP, nil),
+			newInstr(I_CAR, []string{"@%%"}),
+			newInstr(I_PAIR, []string{"%@", fieldOrEmpty}),
+		)
+	}
+	return wrapCadr(letters, inner, other), nil
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestExpandMacros(t *testing.T) {
+	cases := []struct {
+		Macro string
+		Want  string
+	}{
+		{Macro: `FAIL`, Want: `{ UNIT ; FAILWITH }`},
+		{Macro: `CMPEQ @a`, Want: `{ COMPARE ; EQ @a }`},
+		{Macro: `IFCMPLT { DROP } { SWAP }`, Want: `{ COMPARE ; LT ; IF { DROP } { SWAP } }`},
+		{Macro: `IFGE { DROP } { SWAP }`, Want: `{ GE ; IF { DROP } { SWAP } }`},
+		{Macro: `IF_SOME { DROP } {}`, Want: `{ IF_NONE {} { DROP } }`},
+		{Macro: `IF_RIGHT { DROP } { SWAP }`, Want: `{ IF_LEFT { SWAP } { DROP } }`},
+		{Macro: `IF_SOME { FAIL } {}`, Want: `{ IF_NONE {} { { UNIT ; FAILWITH } } }`},
+		{Macro: `ASSERT`, Want: `{ IF {} { { UNIT ; FAILWITH } } }`},
+		{Macro: `ASSERT_NONE`, Want: `{ IF_NONE {} { { UNIT ; FAILWITH } } }`},
+		{Macro: `ASSERT_SOME`, Want: `{ IF_NONE { { UNIT ; FAILWITH } } {} }`},
+		{Macro: `ASSERT_SOME @x`, Want: `{ IF_NONE { { UNIT ; FAILWITH } } { RENAME @x } }`},
+		{Macro: `ASSERT_LEFT`, Want: `{ IF_LEFT {} { { UNIT ; FAILWITH } } }`},
+		{Macro: `ASSERT_RIGHT`, Want: `{ IF_LEFT { { UNIT ; FAILWITH } } {} }`},
+		{Macro: `ASSERT_NEQ`, Want: `{ NEQ ; IF {} { { UNIT ; FAILWITH } } }`},
+		{Macro: `ASSERT_CMPEQ`, Want: `{ { COMPARE ; EQ } ; IF {} { { UNIT ; FAILWITH } } }`},
+		{Macro: `DIIP { DROP }`, Want: `DIP 2 { DROP }`},
+		{Macro: `DIIIIP { DIIP { DROP } }`, Want: `DIP 4 { DIP 2 { DROP } }`},
+		{Macro: `DUUP @a`, Want: `DUP @a 2`},
+		{Macro: `DUUUUP`, Want: `DUP 4`},
+		{Macro: `PAPPAIIR`, Want: `{ DIP { PAIR } ; DIP { PAIR } ; PAIR }`},
+		{Macro: `PPAIPAIR`, Want: `{ DIP 2 { PAIR } ; PAIR ; PAIR }`},
+		{Macro: `PAPAIR @p %a %b %c`, Want: `{ DIP { PAIR %b %c } ; PAIR %a @p }`},
+		{Macro: `PAPAIR %a %b`, Want: `{ DIP { PAIR %b } ; PAIR %a }`},
+		{Macro: `PPAIIR %a`, Want: `{ PAIR %a ; PAIR }`},
+		{Macro: `UNPAPAIR`, Want: `{ UNPAIR ; DIP { UNPAIR } }`},
+		{Macro: `UNPPAIPAIR`, Want: `{ UNPAIR ; UNPAIR ; DIP 2 { UNPAIR } }`},
+		{Macro: `UNPAPAIR @a @b @c`, Want: `{ UNPAIR @a ; DIP { UNPAIR @b @c } }`},
+		{Macro: `CADR @x`, Want: `{ CAR ; CDR @x }`},
+		{Macro: `CDDAR @%%`, Want: `{ CDR @%% ; CDR @%% ; CAR @%% }`},
+		{Macro: `SET_CAR`, Want: `{ CDR @%% ; SWAP ; PAIR % %@ }`},
+		{Macro: `SET_CDR %b`, Want: `{ DUP ; CDR %b ; DROP ; CAR @%% ; PAIR %@ %b }`},
+		{
+			Macro: `SET_CADR @s`,
+			Want:  `{ DUP ; DIP { CAR @%% ; { CAR @%% ; PAIR %@ % } } ; CDR @%% ; SWAP ; PAIR %@ %@ @s }`,
+		},
+		{Macro: `MAP_CAR { SWAP }`, Want: `{ DUP ; CDR @%% ; DIP { CAR ; { SWAP } } ; SWAP ; PAIR % %@ }`},
+		{Macro: `MAP_CDR %x { DROP }`, Want: `{ DUP ; CDR @x ; { DROP } ; SWAP ; CAR @%% ; PAIR %@ %x }`},
+		{
+			Macro: `MAP_CDAR { DROP }`,
+			Want:  `{ DUP ; DIP { CDR @%% ; { DUP ; CDR @%% ; DIP { CAR ; { DROP } } ; SWAP ; PAIR % %@ } } ; CAR @%% ; PAIR %@ %@ }`,
+		},
+	}
+	for i, c := range cases {
+		p, err := ParseMichelson(c.Macro)
+		if err != nil {
+			t.Fatalf("Case %d %s: parse error: %v", i, c.Macro, err)
+		}
+		x, err := p.ExpandMacros()
+		if err != nil {
+			t.Errorf("Case %d %s: expand error: %v", i, c.Macro, err)
+			continue
+		}
+		want := MustParseMichelson(c.Want)
+		have, _ := x.MarshalJSON()
+		exp, _ := want.MarshalJSON()
+		if string(have) != string(exp) {
+			t.Errorf("Case %d %s: mismatch\n  have=%s\n  want=%s", i, c.Macro, have, exp)
+		}
+	}
+
+	// generated macros are identical to parsed and expanded macros
+	x, _ := MustParseMichelson(`ASSERT_CMPEQ`).ExpandMacros()
+	if !x.IsEqualWithAnno(ASSERT_CMPEQ()) {
+		t.Errorf("ASSERT_CMPEQ mismatch with builder")
+	}
+}
+
+func TestExpandMacrosErrors(t *testing.T) {
+	cases := []string{
+		`FOO`,
+		`FAIL @a`,
+		`FAIL 1`,
+		`CMPFOO`,
+		`IFEQ { DROP }`,
+		`DIIP`,
+		`DIIP 1`,
+		`DUUP { DROP }`,
+		`PAIIR`,
+		`PAPAR`,
+		`PAPAIRR`,
+		`UNPAIIR`,
+		`UNPAPAIR %a`,
+		`SET_CAR %a %b`,
+		`MAP_CAR DROP`,
+		`ASSERT_FOO`,
+		`ASSERT @a`,
+	}
+	for i, src := range cases {
+		p, err := ParseMichelson(src)
+		if err != nil {
+			t.Fatalf("Case %d %s: parse error: %v", i, src, err)
+		}
+		if _, err := p.ExpandMacros(); err == nil {
+			t.Errorf("Case %d %s: expected error", i, src)
+		}
+	}
+}
+
+func TestExpandMacrosScript(t *testing.T) {
+	src, err := os.ReadFile("../examples/tzcompose/hicetnunc/hic-market.tz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := ParseMichelsonCode(string(src))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if err := code.ExpandMacros(); err != nil {
+		t.Fatalf("expand error: %v", err)
+	}
+
+	buf, err := os.ReadFile("../examples/tzcompose/hicetnunc/hic-market.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want Code
+	if err := json.Unmarshal(buf, &want); err != nil {
+		t.Fatal(err)
+	}
+	have, _ := code.MarshalJSON()
+	exp, _ := want.MarshalJSON()
+	if string(have) != string(exp) {
+		t.Errorf("script mismatch after macro expansion")
+	}
+
+	// binary encoding works after expansion and matches the node format
+	b1, err := code.MarshalBinary()
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	b2, _ := want.MarshalBinary()
+	if string(b1) != string(b2) {
+		t.Errorf("binary mismatch after macro expansion")
+	}
+}
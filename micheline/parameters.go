@@ -175,10 +175,12 @@ func (p *Parameters) UnmarshalJSON(data []byte) error {
 		return json.Unmarshal(data, &p.Value)
 	} else {
 		// try entrypoint calling convention
-		type alias *Parameters
-		if err := json.Unmarshal(data, alias(p)); err != nil {
+		type alias Parameters
+		var a alias
+		if err := json.Unmarshal(data, &a); err != nil {
 			return err
 		}
+		*p = Parameters(a)
 		if p.Value.IsValid() {
 			return nil
 		}
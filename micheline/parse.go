@@ -0,0 +1,566 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// I_MACRO marks a Michelson macro which has not been expanded yet. The macro
+// name is kept in Prim.String. Macros have no binary representation and must
+// be expanded before a primitive is encoded.
+const I_MACRO OpCode = 0xFE
+
+// IsMacro returns true when p is an unexpanded Michelson macro.
+func (p Prim) IsMacro() bool {
+	return p.OpCode == I_MACRO && p.Type >= PrimNullary && p.Type <= PrimVariadicAnno
+}
+
+// ParseMichelson parses Michelson concrete syntax into a primitive tree. The
+// source may contain a single expression or a list of expressions separated by
+// semicolons which are returned as sequence. Comments and annotations are
+// supported. Macros are kept unexpanded.
+func ParseMichelson(src string) (Prim, error) {
+	p := &parser{lex: newLexer(src)}
+	return p.parse()
+}
+
+// MustParseMichelson parses Michelson concrete syntax and panics on error.
+func MustParseMichelson(src string) Prim {
+	p, err := ParseMichelson(src)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// ParseMichelsonType parses a type expression in Michelson concrete syntax.
+func ParseMichelsonType(src string) (Type, error) {
+	p, err := ParseMichelson(src)
+	if err != nil {
+		return Type{}, err
+	}
+	return NewType(p), nil
+}
+
+// ParseMichelsonCode parses a contract in Michelson concrete syntax (i.e. the
+// contents of a .tz file) consisting of parameter, storage, code and optional
+// view sections.
+func ParseMichelsonCode(src string) (Code, error) {
+	c, _, err := parseCode(src, false)
+	return c, err
+}
+
+// ParseMichelsonCodeWithSourceMap parses a contract like ParseMichelsonCode
+// and additionally returns the source positions of all script nodes. Positions
+// remain valid after Code.ExpandMacros since macros expand in place.
+func ParseMichelsonCodeWithSourceMap(src string) (Code, *SourceMap, error) {
+	return parseCode(src, true)
+}
+
+func parseCode(src string, withMap bool) (Code, *SourceMap, error) {
+	var c Code
+	p := &parser{lex: newLexer(src)}
+	if withMap {
+		p.pos = make(map[string]Position)
+	}
+	root, err := p.parse()
+	if err != nil {
+		return c, nil, err
+	}
+	if root.Type != PrimSequence {
+		root = NewSeq(root)
+	}
+	for _, v := range root.Args {
+		switch v.OpCode {
+		case K_PARAMETER:
+			c.Param = v
+		case K_STORAGE:
+			c.Storage = v
+		case K_CODE:
+			c.Code = v
+		case K_VIEW:
+			c.View.Args = append(c.View.Args, v)
+		default:
+			return c, nil, fmt.Errorf("micheline: unexpected program key %s", v.michelsonName())
+		}
+	}
+	switch {
+	case !c.Param.IsValid():
+		return c, nil, fmt.Errorf("micheline: missing parameter section")
+	case !c.Storage.IsValid():
+		return c, nil, fmt.Errorf("micheline: missing storage section")
+	case !c.Code.IsValid():
+		return c, nil, fmt.Errorf("micheline: missing code section")
+	}
+	if c.View.Args != nil {
+		c.View.Type = PrimSequence
+	}
+	if !withMap {
+		return c, nil, nil
+	}
+	return c, newSourceMap(root, p.pos), nil
+}
+
+type tokenType byte
+
+const (
+	tokEOF tokenType = iota
+	tokIdent
+	tokAnnot
+	tokInt
+	tokString
+	tokBytes
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokSemi
+)
+
+func (t tokenType) String() string {
+	switch t {
+	case tokEOF:
+		return "end of input"
+	case tokIdent:
+		return "primitive"
+	case tokAnnot:
+		return "annotation"
+	case tokInt:
+		return "int"
+	case tokString:
+		return "string"
+	case tokBytes:
+		return "bytes"
+	case tokLParen:
+		return "'('"
+	case tokRParen:
+		return "')'"
+	case tokLBrace:
+		return "'{'"
+	case tokRBrace:
+		return "'}'"
+	case tokSemi:
+		return "';'"
+	default:
+		return "invalid token"
+	}
+}
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+type lexer struct {
+	src       string
+	pos       int
+	line      int // current line, tracked while skipping whitespace and comments
+	lineStart int // offset of the current line
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src, line: 1}
+}
+
+// position returns line and column of a source offset. Offsets on the current
+// line, like those of the last token, resolve in constant time.
+func (l *lexer) position(pos int) (int, int) {
+	if pos >= l.lineStart {
+		return l.line, pos - l.lineStart + 1
+	}
+	line := strings.Count(l.src[:pos], "\n") + 1
+	col := pos - strings.LastIndexByte(l.src[:pos], '\n')
+	return line, col
+}
+
+// newline advances the current line past a newline at offset pos.
+func (l *lexer) newline(pos int) {
+	l.line++
+	l.lineStart = pos + 1
+}
+
+func (l *lexer) errorf(pos int, format string, args ...interface{}) error {
+	line, col := l.position(pos)
+	return fmt.Errorf("micheline: %d:%d: %s", line, col, fmt.Sprintf(format, args...))
+}
+
+func (l *lexer) skip() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.newline(l.pos)
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == '/' && strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf(l.pos, "unterminated comment")
+			}
+			for i := l.pos + 2; i < l.pos+2+end; i++ {
+				if l.src[i] == '\n' {
+					l.newline(i)
+				}
+			}
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skip(); err != nil {
+		return token{}, err
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{typ: tokEOF, pos: start}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case c == '(':
+		l.pos++
+		return token{typ: tokLParen, pos: start}, nil
+	case c == ')':
+		l.pos++
+		return token{typ: tokRParen, pos: start}, nil
+	case c == '{':
+		l.pos++
+		return token{typ: tokLBrace, pos: start}, nil
+	case c == '}':
+		l.pos++
+		return token{typ: tokRBrace, pos: start}, nil
+	case c == ';':
+		l.pos++
+		return token{typ: tokSemi, pos: start}, nil
+	case c == '"':
+		return l.lexString()
+	case c == '0' && l.pos+1 < len(l.src) && l.src[l.pos+1] == 'x':
+		l.pos += 2
+		for l.pos < len(l.src) && isHexChar(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{typ: tokBytes, val: l.src[start+2 : l.pos], pos: start}, l.checkEnd(start)
+	case c == '-' || isDigit(c):
+		l.pos++
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		if c == '-' && l.pos == start+1 {
+			return token{}, l.errorf(start, "invalid int")
+		}
+		return token{typ: tokInt, val: l.src[start:l.pos], pos: start}, l.checkEnd(start)
+	case c == '@' || c == ':' || c == '%':
+		l.pos++
+		for l.pos < len(l.src) && isAnnotChar(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{typ: tokAnnot, val: l.src[start:l.pos], pos: start}, l.checkEnd(start)
+	case isIdentChar(c):
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		return token{typ: tokIdent, val: l.src[start:l.pos], pos: start}, l.checkEnd(start)
+	default:
+		return token{}, l.errorf(start, "unexpected character %q", c)
+	}
+}
+
+// checkEnd ensures a token is followed by a separator.
+func (l *lexer) checkEnd(start int) error {
+	if l.pos >= len(l.src) {
+		return nil
+	}
+	switch l.src[l.pos] {
+	case ' ', '\t', '\n', '\r', '(', ')', '{', '}', ';', '#':
+		return nil
+	case '/':
+		if strings.HasPrefix(l.src[l.pos:], "/*") {
+			return nil
+		}
+	}
+	return l.errorf(start, "invalid token %q", l.src[start:l.pos+1])
+}
+
+func (l *lexer) lexString() (token, error) {
+	start := l.pos
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return token{typ: tokString, val: b.String(), pos: start}, l.checkEnd(start)
+		case '\n', '\r':
+			return token{}, l.errorf(l.pos, "newline in string")
+		case '\\':
+			if l.pos+1 >= len(l.src) {
+				return token{}, l.errorf(l.pos, "unterminated string")
+			}
+			switch e := l.src[l.pos+1]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'b':
+				b.WriteByte('\b')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '"':
+				b.WriteByte(e)
+			default:
+				return token{}, l.errorf(l.pos, "invalid escape sequence \\%c", e)
+			}
+			l.pos += 2
+		default:
+			b.WriteByte(c)
+			l.pos++
+		}
+	}
+	return token{}, l.errorf(start, "unterminated string")
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexChar(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isIdentChar(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+func isAnnotChar(c byte) bool {
+	return isIdentChar(c) || c == '.' || c == '%' || c == '@'
+}
+
+func isMacroName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'A' && c <= 'Z') && !isDigit(c) && c != '_' {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+type parser struct {
+	lex *lexer
+	tok token
+	pos map[string]Position // optional node positions by path
+}
+
+// parse parses the entire source. Top-level expressions have paths [i] in
+// the position map, also when the source contains a single expression.
+func (p *parser) parse() (Prim, error) {
+	if err := p.next(); err != nil {
+		return InvalidPrim, err
+	}
+	if p.tok.typ == tokEOF {
+		return InvalidPrim, fmt.Errorf("micheline: empty michelson source")
+	}
+	list, trailing, err := p.parseList(tokEOF, nil)
+	if err != nil {
+		return InvalidPrim, err
+	}
+	if len(list) == 1 && !trailing {
+		return list[0], nil
+	}
+	return NewSeq(list...), nil
+}
+
+// mark records the source position of the node at path.
+func (p *parser) mark(path []int, offset int) {
+	if p.pos == nil {
+		return
+	}
+	line, col := p.lex.position(offset)
+	p.pos[fmt.Sprint(path)] = Position{Line: line, Col: col}
+}
+
+func (p *parser) next() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) expect(typ tokenType) error {
+	if p.tok.typ != typ {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+func (p *parser) unexpected() error {
+	if p.tok.typ == tokIdent || p.tok.typ == tokAnnot {
+		return p.lex.errorf(p.tok.pos, "unexpected %s %s", p.tok.typ, p.tok.val)
+	}
+	return p.lex.errorf(p.tok.pos, "unexpected %s", p.tok.typ)
+}
+
+// parseList parses expressions separated by semicolons until the end token
+// and reports whether the list ended with a semicolon.
+func (p *parser) parseList(end tokenType, path []int) ([]Prim, bool, error) {
+	list := make([]Prim, 0)
+	trailing := false
+	for p.tok.typ != end {
+		node, err := p.parseExpr(appendPath(path, len(list)))
+		if err != nil {
+			return nil, false, err
+		}
+		list = append(list, node)
+		trailing = false
+		if p.tok.typ != tokSemi {
+			break
+		}
+		trailing = true
+		if err := p.next(); err != nil {
+			return nil, false, err
+		}
+	}
+	if p.tok.typ != end {
+		return nil, false, p.unexpected()
+	}
+	return list, trailing, nil
+}
+
+// parseExpr parses a primitive application with annotations and arguments or
+// a single atom.
+func (p *parser) parseExpr(path []int) (Prim, error) {
+	if p.tok.typ != tokIdent {
+		return p.parseAtom(path)
+	}
+	p.mark(path, p.tok.pos)
+	prim, err := p.newPrim(p.tok)
+	if err != nil {
+		return InvalidPrim, err
+	}
+	if err := p.next(); err != nil {
+		return InvalidPrim, err
+	}
+	for {
+		switch p.tok.typ {
+		case tokAnnot:
+			prim.Anno = append(prim.Anno, p.tok.val)
+			if err := p.next(); err != nil {
+				return InvalidPrim, err
+			}
+		case tokInt, tokString, tokBytes, tokLParen, tokLBrace, tokIdent:
+			arg, err := p.parseAtom(appendPath(path, len(prim.Args)))
+			if err != nil {
+				return InvalidPrim, err
+			}
+			prim.Args = append(prim.Args, arg)
+		default:
+			prim.Type = primTypeOf(len(prim.Args), len(prim.Anno) > 0)
+			return prim, nil
+		}
+	}
+}
+
+// parseAtom parses a literal, a nullary primitive without annotations, a
+// parenthesized expression or a sequence.
+func (p *parser) parseAtom(path []int) (Prim, error) {
+	tok := p.tok
+	if tok.typ != tokLParen {
+		p.mark(path, tok.pos)
+	}
+	switch tok.typ {
+	case tokInt:
+		i, ok := new(big.Int).SetString(tok.val, 10)
+		if !ok {
+			return InvalidPrim, p.lex.errorf(tok.pos, "invalid int %s", tok.val)
+		}
+		return NewBig(i), p.next()
+	case tokString:
+		return NewString(tok.val), p.next()
+	case tokBytes:
+		if len(tok.val)%2 != 0 {
+			return InvalidPrim, p.lex.errorf(tok.pos, "odd length bytes 0x%s", tok.val)
+		}
+		buf, err := hex.DecodeString(tok.val)
+		if err != nil {
+			return InvalidPrim, p.lex.errorf(tok.pos, "invalid bytes: %v", err)
+		}
+		return NewBytes(buf), p.next()
+	case tokIdent:
+		prim, err := p.newPrim(tok)
+		if err != nil {
+			return InvalidPrim, err
+		}
+		return prim, p.next()
+	case tokLParen:
+		if err := p.next(); err != nil {
+			return InvalidPrim, err
+		}
+		prim, err := p.parseExpr(path)
+		if err != nil {
+			return InvalidPrim, err
+		}
+		return prim, p.expect(tokRParen)
+	case tokLBrace:
+		if err := p.next(); err != nil {
+			return InvalidPrim, err
+		}
+		list, _, err := p.parseList(tokRBrace, path)
+		if err != nil {
+			return InvalidPrim, err
+		}
+		return NewSeq(list...), p.next()
+	default:
+		return InvalidPrim, p.unexpected()
+	}
+}
+
+// newPrim creates a nullary primitive from an identifier. Unknown upper case
+// identifiers are treated as macros.
+func (p *parser) newPrim(tok token) (Prim, error) {
+	if oc, err := ParseOpCode(tok.val); err == nil {
+		return Prim{Type: PrimNullary, OpCode: oc}, nil
+	}
+	if isMacroName(tok.val) {
+		return Prim{Type: PrimNullary, OpCode: I_MACRO, String: tok.val}, nil
+	}
+	return InvalidPrim, p.lex.errorf(tok.pos, "unknown primitive %s", tok.val)
+}
+
+func primTypeOf(n int, anno bool) PrimType {
+	switch n {
+	case 0:
+		if anno {
+			return PrimNullaryAnno
+		}
+		return PrimNullary
+	case 1:
+		if anno {
+			return PrimUnaryAnno
+		}
+		return PrimUnary
+	case 2:
+		if anno {
+			return PrimBinaryAnno
+		}
+		return PrimBinary
+	default:
+		return PrimVariadicAnno
+	}
+}
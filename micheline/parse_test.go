@@ -0,0 +1,158 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestParseMichelson(t *testing.T) {
+	cases := []struct {
+		Src  string
+		Json string
+	}{
+		{Src: `42`, Json: `{"int":"42"}`},
+		{Src: `-7`, Json: `{"int":"-7"}`},
+		{Src: `"a\"b\\c\n"`, Json: `{"string":"a\"b\\c\n"}`},
+		{Src: `0x00ff`, Json: `{"bytes":"00ff"}`},
+		{Src: `0x`, Json: `{"bytes":""}`},
+		{Src: `Unit`, Json: `{"prim":"Unit"}`},
+		{Src: `{}`, Json: `[]`},
+		{Src: `(Pair 1 "x")`, Json: `{"prim":"Pair","args":[{"int":"1"},{"string":"x"}]}`},
+		{Src: `Pair 1 2 3`, Json: `{"prim":"Pair","args":[{"int":"1"},{"int":"2"},{"int":"3"}]}`},
+		{Src: `{ Elt 1 True ; Elt 2 False }`, Json: `[{"prim":"Elt","args":[{"int":"1"},{"prim":"True"}]},{"prim":"Elt","args":[{"int":"2"},{"prim":"False"}]}]`},
+		{Src: `pair (nat %a) (option :t %b mumav)`, Json: `{"prim":"pair","args":[{"prim":"nat","annots":["%a"]},{"prim":"option","annots":[":t","%b"],"args":[{"prim":"mumav"}]}]}`},
+		{Src: `big_map %ledger address nat`, Json: `{"prim":"big_map","annots":["%ledger"],"args":[{"prim":"address"},{"prim":"nat"}]}`},
+		{Src: `DUP; CAR @x`, Json: `[{"prim":"DUP"},{"prim":"CAR","annots":["@x"]}]`},
+		{Src: `{ DUP ; CAR ; }`, Json: `[{"prim":"DUP"},{"prim":"CAR"}]`},
+		{Src: `DIP 2 { DROP }`, Json: `{"prim":"DIP","args":[{"int":"2"},[{"prim":"DROP"}]]}`},
+		{Src: `CONTRACT %transfer (list nat)`, Json: `{"prim":"CONTRACT","annots":["%transfer"],"args":[{"prim":"list","args":[{"prim":"nat"}]}]}`},
+		{Src: "# comment\n{ UNIT /* inline */ ; FAILWITH } # trailing", Json: `[{"prim":"UNIT"},{"prim":"FAILWITH"}]`},
+		{Src: `{ DIIP { SWAP } ; CMPEQ ; FAIL }`, Json: `[{"prim":"DIIP","args":[[{"prim":"SWAP"}]]},{"prim":"CMPEQ"},{"prim":"FAIL"}]`},
+		{Src: `{ { CAR } ; {} }`, Json: `[[{"prim":"CAR"}],[]]`},
+	}
+	for i, c := range cases {
+		p, err := ParseMichelson(c.Src)
+		if err != nil {
+			t.Errorf("Case %d %q: unexpected error: %v", i, c.Src, err)
+			continue
+		}
+		buf, _ := p.MarshalJSON()
+		if got := string(buf); got != c.Json {
+			t.Errorf("Case %d %q: mismatch\n  have=%s\n  want=%s", i, c.Src, got, c.Json)
+		}
+	}
+}
+
+func TestParseMichelsonErrors(t *testing.T) {
+	cases := []string{
+		``,
+		`# only a comment`,
+		`pair (nat`,
+		`pair nat)`,
+		`"abc`,
+		`"a\qb"`,
+		`0x0`,
+		`0xzz`,
+		`12ab`,
+		`-`,
+		`foo`,
+		`{ DUP ;; CAR }`,
+		`{ DUP CAR`,
+		`/* open`,
+		`DUP }`,
+		`$`,
+	}
+	for i, src := range cases {
+		if _, err := ParseMichelson(src); err == nil {
+			t.Errorf("Case %d %q: expected error", i, src)
+		}
+	}
+}
+
+func TestFormatMichelson(t *testing.T) {
+	cases := []struct {
+		Src  string
+		Want string
+	}{
+		{Src: `42`, Want: `42`},
+		{Src: `"a\"b"`, Want: `"a\"b"`},
+		{Src: `0xCAFE`, Want: `0xcafe`},
+		{Src: `pair   (nat %a)  ( pair int string )`, Want: `pair (nat %a) (pair int string)`},
+		{Src: `Pair (Some 1) { 1 ; 2 }`, Want: `Pair (Some 1) { 1 ; 2 }`},
+		{Src: `{}`, Want: `{}`},
+		{Src: `{ DUP ; CAR }`, Want: "{\n  DUP;\n  CAR;\n}"},
+		{
+			Src:  `{ IF_LEFT { DROP } { PUSH (lambda int int) { DUP ; ADD } ; EXEC } }`,
+			Want: "{\n  IF_LEFT\n    {\n      DROP;\n    }\n    {\n      PUSH (lambda int int)\n        {\n          DUP;\n          ADD;\n        };\n      EXEC;\n    };\n}",
+		},
+		{Src: `{ DIP 2 { SWAP } ; IF {} { FAIL } }`, Want: "{\n  DIP 2\n    {\n      SWAP;\n    };\n  IF\n    {}\n    {\n      FAIL;\n    };\n}"},
+	}
+	for i, c := range cases {
+		p, err := ParseMichelson(c.Src)
+		if err != nil {
+			t.Errorf("Case %d: unexpected error: %v", i, err)
+			continue
+		}
+		if got := p.Michelson(); got != c.Want {
+			t.Errorf("Case %d: mismatch\n  have=%s\n  want=%s", i, got, c.Want)
+		}
+		// formatted output must parse back into the same tree
+		p2, err := ParseMichelson(p.Michelson())
+		if err != nil {
+			t.Errorf("Case %d: reparse error: %v", i, err)
+			continue
+		}
+		if !p.IsEqualWithAnno(p2) {
+			t.Errorf("Case %d: reparse mismatch", i)
+		}
+	}
+}
+
+func TestParseMichelsonCode(t *testing.T) {
+	src, err := os.ReadFile("../examples/tzcompose/hicetnunc/hic-market.tz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := ParseMichelsonCode(string(src))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	buf, err := os.ReadFile("../examples/tzcompose/hicetnunc/hic-market.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want Code
+	if err := json.Unmarshal(buf, &want); err != nil {
+		t.Fatal(err)
+	}
+	if !code.Param.IsEqualWithAnno(want.Param) {
+		t.Errorf("parameter mismatch\n  have=%s\n  want=%s", code.Param.Dump(), want.Param.Dump())
+	}
+	if !code.Storage.IsEqualWithAnno(want.Storage) {
+		t.Errorf("storage mismatch\n  have=%s\n  want=%s", code.Storage.Dump(), want.Storage.Dump())
+	}
+	if _, err := code.MarshalBinary(); err == nil {
+		t.Errorf("expected error when encoding unexpanded macros")
+	}
+
+	// formatted code must parse back into the same tree
+	code2, err := ParseMichelsonCode(code.Michelson())
+	if err != nil {
+		t.Fatalf("reparse error: %v", err)
+	}
+	if !code.Code.IsEqualWithAnno(code2.Code) {
+		t.Errorf("code mismatch after formatting")
+	}
+
+	if _, err := ParseMichelsonCode(`parameter unit; storage unit`); err == nil {
+		t.Errorf("expected missing code error")
+	}
+	if _, err := ParseMichelsonCode(`parameter unit; storage unit; code {}; foo`); err == nil {
+		t.Errorf("expected unknown section error")
+	}
+}
@@ -1047,7 +1047,7 @@ func (p Prim) EncodeJSON(buf *bytes.Buffer) {
 
 	default:
 		buf.WriteString(`{"prim":"`)
-		buf.WriteString(p.OpCode.String())
+		buf.WriteString(p.michelsonName())
 		buf.WriteByte('"')
 		if len(p.Anno) > 0 && len(p.Anno[0]) > 0 {
 			buf.WriteString(`,"annots":[`)
@@ -1090,6 +1090,9 @@ func (p Prim) MarshalBinary() ([]byte, error) {
 }
 
 func (p Prim) EncodeBuffer(buf *bytes.Buffer) error {
+	if p.IsMacro() {
+		return fmt.Errorf("micheline: unexpanded macro %s", p.String)
+	}
 	buf.WriteByte(byte(p.Type))
 	switch p.Type {
 	case PrimInt:
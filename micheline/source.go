@@ -0,0 +1,89 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Position is a line and column in Michelson source, both starting at 1.
+type Position struct {
+	Line int
+	Col  int
+}
+
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// SourceMap holds source positions of script nodes parsed from Michelson
+// source. Nodes are identified by section and path like in TypeMap. Since
+// macros are expanded in place, nodes created by a macro expansion map to the
+// position of the macro.
+type SourceMap struct {
+	pos map[string]Position
+}
+
+// newSourceMap converts positions keyed by path from the root sequence of
+// script into positions keyed by section and path.
+func newSourceMap(root Prim, pos map[string]Position) *SourceMap {
+	m := &SourceMap{pos: make(map[string]Position, len(pos))}
+	for i, v := range root.Args {
+		var (
+			section string
+			prefix  []int
+		)
+		switch v.OpCode {
+		case K_PARAMETER:
+			section, prefix = SectionParameter, []int{i, 0}
+		case K_STORAGE:
+			section, prefix = SectionStorage, []int{i, 0}
+		case K_CODE:
+			section, prefix = SectionCode, []int{i, 0}
+		case K_VIEW:
+			if len(v.Args) == 0 {
+				continue
+			}
+			section, prefix = ViewSection(v.Args[0].String), []int{i}
+		default:
+			continue
+		}
+		head := strings.TrimSuffix(fmt.Sprint(prefix), "]")
+		for k, p := range pos {
+			if k == head+"]" {
+				m.pos[sourceKey(section, nil)] = p
+				continue
+			}
+			if !strings.HasPrefix(k, head+" ") {
+				continue
+			}
+			m.pos[section+":["+k[len(head)+1:]] = p
+		}
+	}
+	return m
+}
+
+func sourceKey(section string, path []int) string {
+	return section + ":" + fmt.Sprint(path)
+}
+
+// Lookup returns the source position of the node at path in section. When
+// the node has no position of its own, for example because it was created
+// by macro expansion, the position of the closest parent node is returned.
+func (m *SourceMap) Lookup(section string, path []int) (Position, bool) {
+	if m == nil {
+		return Position{}, false
+	}
+	for n := len(path); n >= 0; n-- {
+		if p, ok := m.pos[sourceKey(section, path[:n])]; ok {
+			return p, true
+		}
+	}
+	return Position{}, false
+}
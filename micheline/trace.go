@@ -0,0 +1,249 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"context"
+	"fmt"
+)
+
+// TraceStep is a typed execution step of a script. Stack holds the typed
+// stack values with the top element first.
+type TraceStep struct {
+	Location int      // canonical location of the instruction, -1 when unknown
+	Section  string   // script section, lambda for instructions of lambda values
+	Path     []int    // instruction path within section
+	Prim     Prim     // instruction
+	Position Position // source position when the script was parsed with a source map
+	Gas      int64    // remaining milligas in node traces, consumed milligas in local traces
+	Stack    []Value
+}
+
+// nodeLoc identifies a script node by section and path.
+type nodeLoc struct {
+	section string
+	path    []int
+}
+
+// Tracer maps execution trace locations of a script to instructions, stack
+// types and source positions.
+type Tracer struct {
+	code  Code
+	types map[string]*InstrType
+	locs  map[int]nodeLoc
+	index map[string]int
+	src   *SourceMap
+}
+
+// NewTracer typechecks code and prepares location lookups. The source map
+// is optional.
+func NewTracer(code Code, src *SourceMap) (*Tracer, error) {
+	m, err := code.Typecheck()
+	if err != nil {
+		return nil, err
+	}
+	t := &Tracer{
+		code:  code,
+		types: make(map[string]*InstrType, len(m)),
+		locs:  make(map[int]nodeLoc),
+		index: make(map[string]int),
+		src:   src,
+	}
+	for i := range m {
+		t.types[sourceKey(m[i].Section, m[i].Path)] = &m[i]
+	}
+	t.indexLocations()
+	return t, nil
+}
+
+// indexLocations assigns canonical Micheline locations. Locations number
+// all nodes of the script expression in pre-order, starting with 0 for the
+// root sequence of sections.
+func (t *Tracer) indexLocations() {
+	loc := 1
+	var walk func(p Prim, l *nodeLoc)
+	walk = func(p Prim, l *nodeLoc) {
+		if l != nil {
+			t.locs[loc] = *l
+			t.index[sourceKey(l.section, l.path)] = loc
+		}
+		loc++
+		for i, v := range p.Args {
+			if l == nil {
+				walk(v, nil)
+				continue
+			}
+			walk(v, &nodeLoc{section: l.section, path: appendPath(l.path, i)})
+		}
+	}
+	for _, sec := range []Prim{t.code.Param, t.code.Storage} {
+		walk(sec, nil)
+	}
+	// code section node, body paths are relative to the body sequence
+	loc++
+	for _, v := range t.code.Code.Args {
+		walk(v, &nodeLoc{section: SectionCode})
+	}
+	for _, v := range t.code.View.Args {
+		name := ""
+		if len(v.Args) > 0 {
+			name = v.Args[0].String
+		}
+		walk(v, &nodeLoc{section: ViewSection(name)})
+	}
+}
+
+// Locate returns section and path of the node at canonical location loc.
+func (t *Tracer) Locate(loc int) (string, []int, bool) {
+	l, ok := t.locs[loc]
+	return l.section, l.path, ok
+}
+
+// Location returns the canonical location of the node at path in section or
+// -1 when the node does not exist.
+func (t *Tracer) Location(section string, path []int) int {
+	if loc, ok := t.index[sourceKey(section, path)]; ok {
+		return loc
+	}
+	return -1
+}
+
+// Step builds a typed trace step for the instruction at location loc from an
+// untyped stack with the top element first. The stack is typed with the
+// stack types after the instruction, or before when the length does not
+// match, for example for lambda entries.
+func (t *Tracer) Step(loc int, gas int64, stack []Prim) TraceStep {
+	step := TraceStep{
+		Location: loc,
+		Gas:      gas,
+		Stack:    make([]Value, len(stack)),
+	}
+	var types []Prim
+	if section, path, ok := t.Locate(loc); ok {
+		step.Section, step.Path = section, path
+		step.Position, _ = t.src.Lookup(section, path)
+		if it, ok := t.types[sourceKey(section, path)]; ok {
+			step.Prim = it.Prim
+			switch {
+			case len(it.After) == len(stack):
+				types = reverseStack(it.After)
+			case len(it.Before) == len(stack):
+				types = reverseStack(it.Before)
+			}
+		}
+	}
+	for i, v := range stack {
+		var typ Prim
+		if i < len(types) {
+			typ = types[i]
+		}
+		step.Stack[i] = NewValue(NewType(typ), v)
+	}
+	return step
+}
+
+// Trace executes the contract code locally like Run and records a typed
+// trace step after each executed instruction. The source map is optional.
+func (c Code) Trace(ctx context.Context, param, storage Prim, env *RunEnv, src *SourceMap) (*RunResult, []TraceStep, error) {
+	t, err := NewTracer(c, src)
+	if err != nil {
+		return nil, nil, err
+	}
+	var steps []TraceStep
+	hook := func(ip *interp, in *instr, st Stack, after bool) error {
+		if after {
+			steps = append(steps, t.localStep(ip, in, in.out, st))
+		}
+		return nil
+	}
+	res, err := c.run(ctx, param, storage, env, hook)
+	return res, steps, err
+}
+
+// localStep builds a trace step from internal interpreter state. Stack
+// types are top first.
+func (t *Tracer) localStep(ip *interp, in *instr, types []Prim, st Stack) TraceStep {
+	step := TraceStep{
+		Location: -1,
+		Section:  in.section,
+		Path:     in.path,
+		Prim:     in.prim,
+		Gas:      ip.gas,
+		Stack:    make([]Value, len(st)),
+	}
+	// instructions of lambdas and views of other contracts have no location
+	if in.section != sectionLambda && ip.self.Equal(ip.env.Self) {
+		step.Location = t.Location(in.section, in.path)
+		step.Position, _ = t.src.Lookup(in.section, in.path)
+	}
+	for i := range st {
+		v := st[len(st)-1-i]
+		var typ Prim
+		if i < len(types) {
+			typ = types[i]
+			v = ip.inspect(typ, v)
+		}
+		step.Stack[i] = NewValue(NewType(typ), v)
+	}
+	return step
+}
+
+// inspect converts an internal value of type t into readable form for
+// display. Big_maps show their on-chain id or their local contents.
+func (ip *interp) inspect(t, v Prim) Prim {
+	return ip.readable(t, ip.resolveHandles(t, v))
+}
+
+func (ip *interp) resolveHandles(t, v Prim) Prim {
+	switch t.OpCode {
+	case T_BIG_MAP:
+		if v.Type != PrimInt || !v.Int.IsInt64() || v.Int.Int64() >= int64(len(ip.bigmaps)) {
+			return v
+		}
+		b := ip.bigmap(v)
+		if b.src >= 0 {
+			return NewInt64(b.src)
+		}
+		list := make([]Prim, 0, len(b.entries))
+		for _, e := range b.entries {
+			if e.value.IsValid() {
+				list = append(list, NewMapElem(e.key, e.value))
+			}
+		}
+		return NewSeq(list...)
+	case T_PAIR:
+		lt, rt, _ := pairArgs(t)
+		l, r := pairValueArgs(v)
+		return NewPair(ip.resolveHandles(lt, l), ip.resolveHandles(rt, r))
+	case T_OPTION:
+		if v.OpCode == D_SOME {
+			return NewOption(ip.resolveHandles(t.Args[0], v.Args[0]))
+		}
+	case T_OR:
+		if v.OpCode == D_LEFT || v.OpCode == D_RIGHT {
+			i := 0
+			if v.OpCode == D_RIGHT {
+				i = 1
+			}
+			return NewCode(v.OpCode, ip.resolveHandles(t.Args[i], v.Args[0]))
+		}
+	case T_LIST, T_SET:
+		list := make([]Prim, len(v.Args))
+		for i, e := range v.Args {
+			list[i] = ip.resolveHandles(t.Args[0], e)
+		}
+		return NewSeq(list...)
+	case T_MAP:
+		list := make([]Prim, len(v.Args))
+		for i, e := range v.Args {
+			list[i] = NewMapElem(e.Args[0], ip.resolveHandles(t.Args[1], e.Args[1]))
+		}
+		return NewSeq(list...)
+	case T_OPERATION:
+		if v.Type == PrimInt && v.Int.IsInt64() && v.Int.Int64() < int64(len(ip.ops)) {
+			return NewString(fmt.Sprintf("<%s>", ip.ops[v.Int.Int64()].op.Kind))
+		}
+	}
+	return v
+}
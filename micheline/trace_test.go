@@ -0,0 +1,285 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const traceTestScript = `parameter int;
+storage int;
+code { UNPAIR ;
+       ADD ;
+       DUP ;
+       PUSH int 100 ;
+       IFCMPLT { DROP ; PUSH int 0 } {} ;
+       NIL operation ;
+       PAIR }`
+
+func mustMichelsonCodeWithSourceMap(t *testing.T, src string) (Code, *SourceMap) {
+	t.Helper()
+	c, m, err := ParseMichelsonCodeWithSourceMap(src)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if err := c.ExpandMacros(); err != nil {
+		t.Fatalf("expand error: %v", err)
+	}
+	return c, m
+}
+
+func TestSourceMap(t *testing.T) {
+	_, src, err := ParseMichelsonCodeWithSourceMap(traceTestScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		Section string
+		Path    []int
+		Want    string
+	}{
+		{SectionParameter, nil, "1:11"},
+		{SectionStorage, nil, "2:9"},
+		{SectionCode, []int{0}, "3:8"},
+		{SectionCode, []int{5}, "8:8"},
+		{SectionCode, []int{5, 0}, "8:12"},
+		{SectionCode, []int{4}, "7:8"},
+		{SectionCode, []int{4, 2, 0}, "7:8"}, // expanded IF inside IFCMPLT
+	}
+	for _, c := range cases {
+		pos, ok := src.Lookup(c.Section, c.Path)
+		if !ok {
+			t.Errorf("%s %v: missing position", c.Section, c.Path)
+			continue
+		}
+		if got := pos.String(); got != c.Want {
+			t.Errorf("%s %v: got %s want %s", c.Section, c.Path, got, c.Want)
+		}
+	}
+	if _, ok := (*SourceMap)(nil).Lookup(SectionCode, nil); ok {
+		t.Errorf("nil source map: unexpected position")
+	}
+}
+
+func TestTraceLocal(t *testing.T) {
+	code, src := mustMichelsonCodeWithSourceMap(t, traceTestScript)
+	res, steps, err := code.Trace(context.Background(), NewInt64(5), NewInt64(7), nil, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Storage.Int.Int64(); got != 12 {
+		t.Errorf("storage: got %d want 12", got)
+	}
+	want := []struct {
+		Op    OpCode
+		Loc   int
+		Line  int
+		Stack int
+	}{
+		{I_UNPAIR, 7, 3, 2},
+		{I_ADD, 8, 4, 1},
+		{I_DUP, 9, 5, 2},
+		{I_PUSH, 10, 6, 3},
+		{I_COMPARE, 14, 7, 2},
+		{I_LT, 15, 7, 2},
+		{I_IF, 16, 7, 1},
+		{I_NIL, 23, 8, 2},
+		{I_PAIR, 25, 9, 1},
+	}
+	if len(steps) != len(want) {
+		t.Fatalf("steps: got %d want %d", len(steps), len(want))
+	}
+	var gas int64
+	for i, w := range want {
+		s := steps[i]
+		if s.Prim.OpCode != w.Op {
+			t.Errorf("step %d: got %s want %s", i, s.Prim.OpCode, w.Op)
+		}
+		if s.Location != w.Loc {
+			t.Errorf("step %d %s: got location %d want %d", i, w.Op, s.Location, w.Loc)
+		}
+		if s.Position.Line != w.Line {
+			t.Errorf("step %d %s: got line %d want %d", i, w.Op, s.Position.Line, w.Line)
+		}
+		if len(s.Stack) != w.Stack {
+			t.Errorf("step %d %s: got stack len %d want %d", i, w.Op, len(s.Stack), w.Stack)
+		}
+		if s.Gas < gas {
+			t.Errorf("step %d %s: gas decreased", i, w.Op)
+		}
+		gas = s.Gas
+	}
+	if top := steps[1].Stack[0]; top.Type.OpCode != T_INT || top.Value.Int.Int64() != 12 {
+		t.Errorf("ADD stack: got %s", top.Dump())
+	}
+	if top := steps[7].Stack[0]; top.Type.OpCode != T_LIST {
+		t.Errorf("NIL stack: got type %s", top.Type.OpCode)
+	}
+}
+
+func TestTraceLambda(t *testing.T) {
+	code := mustMichelsonCode(t, `parameter nat; storage nat; code { CAR ; LAMBDA nat nat { PUSH nat 1 ; ADD } ; SWAP ; EXEC ; NIL operation ; PAIR };`)
+	_, steps, err := code.Trace(context.Background(), NewInt64(1), NewInt64(0), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for _, s := range steps {
+		if s.Section == sectionLambda {
+			n++
+			if s.Location != -1 {
+				t.Errorf("lambda %s: unexpected location %d", s.Prim.OpCode, s.Location)
+			}
+		}
+	}
+	if n != 2 {
+		t.Errorf("lambda steps: got %d want 2", n)
+	}
+}
+
+func TestTracerStep(t *testing.T) {
+	code := mustMichelsonCode(t, traceTestScript)
+	tr, err := NewTracer(code, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if section, path, ok := tr.Locate(8); !ok || section != SectionCode || !pathEqual(path, []int{1}) {
+		t.Errorf("locate: got %s %v %t", section, path, ok)
+	}
+	if loc := tr.Location(SectionCode, []int{1}); loc != 8 {
+		t.Errorf("location: got %d want 8", loc)
+	}
+	if loc := tr.Location(SectionCode, []int{99}); loc != -1 {
+		t.Errorf("location: got %d want -1", loc)
+	}
+	// node traces list the stack after the instruction, top first
+	s := tr.Step(7, 1039991330, []Prim{NewInt64(5), NewInt64(7)})
+	if s.Prim.OpCode != I_UNPAIR || s.Gas != 1039991330 || len(s.Stack) != 2 {
+		t.Fatalf("step: got %s gas=%d stack=%d", s.Prim.OpCode, s.Gas, len(s.Stack))
+	}
+	for i, v := range s.Stack {
+		if v.Type.OpCode != T_INT {
+			t.Errorf("stack %d: got type %s", i, v.Type.OpCode)
+		}
+	}
+	if s := tr.Step(1000, 0, nil); s.Section != "" || s.Prim.IsValid() {
+		t.Errorf("unknown location: got %s %s", s.Section, s.Prim.OpCode)
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	code, src := mustMichelsonCodeWithSourceMap(t, traceTestScript)
+	d, err := code.Debug(context.Background(), NewInt64(5), NewInt64(7), nil, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, ok := d.Current(); ok {
+		t.Fatal("paused before start")
+	}
+	if !d.Step() {
+		t.Fatal("step: unexpected end")
+	}
+	cur, ok := d.Current()
+	if !ok || cur.Prim.OpCode != I_UNPAIR || cur.Location != 7 {
+		t.Fatalf("step: got %s at %d", cur.Prim.OpCode, cur.Location)
+	}
+	if st := d.Stack(); len(st) != 1 || st[0].Type.OpCode != T_PAIR {
+		t.Errorf("stack: got %d values", len(st))
+	}
+	brk := d.Tracer().Location(SectionCode, []int{5})
+	d.SetBreakpoint(brk)
+	d.SetBreakpoint(8)
+	if bp := d.Breakpoints(); len(bp) != 2 || bp[0] != 8 || bp[1] != brk {
+		t.Errorf("breakpoints: got %v", bp)
+	}
+	d.ClearBreakpoint(8)
+	if !d.Continue() {
+		t.Fatal("continue: unexpected end")
+	}
+	cur, _ = d.Current()
+	if cur.Prim.OpCode != I_NIL || cur.Position.Line != 8 {
+		t.Fatalf("continue: got %s at %s", cur.Prim.OpCode, cur.Position)
+	}
+	if st := d.Stack(); len(st) != 1 || st[0].Value.Int.Int64() != 12 {
+		t.Errorf("stack at NIL: got %d values", len(st))
+	}
+	if !d.Step() {
+		t.Fatal("step: unexpected end")
+	}
+	if cur, _ = d.Current(); cur.Prim.OpCode != I_PAIR {
+		t.Errorf("step: got %s want PAIR", cur.Prim.OpCode)
+	}
+	if _, err := d.Result(); err == nil {
+		t.Errorf("result before end: missing error")
+	}
+	if d.Continue() {
+		t.Fatal("continue: expected end")
+	}
+	if !d.Done() {
+		t.Errorf("done: got false")
+	}
+	res, err := d.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Storage.Int.Int64(); got != 12 {
+		t.Errorf("storage: got %d want 12", got)
+	}
+}
+
+func TestDebuggerClose(t *testing.T) {
+	code := mustMichelsonCode(t, traceTestScript)
+	d, err := code.Debug(context.Background(), NewInt64(5), NewInt64(7), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Step()
+	d.Close()
+	if d.Step() {
+		t.Errorf("step after close: expected false")
+	}
+	// closing an unstarted session must not block
+	d, _ = code.Debug(context.Background(), NewInt64(5), NewInt64(7), nil, nil)
+	d.Close()
+}
+
+func TestSourceMapComments(t *testing.T) {
+	src := "parameter unit; # first\n" +
+		"/* multi\n   line */ storage\n" +
+		"  unit;\r\n" +
+		"code { /* a */ CDR ; /*\n\n*/ NIL operation ;\n" +
+		"       PAIR }"
+	_, m, err := ParseMichelsonCodeWithSourceMap(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		Section string
+		Path    []int
+		Want    string
+	}{
+		{SectionParameter, nil, "1:11"},
+		{SectionStorage, nil, "4:3"},
+		{SectionCode, []int{0}, "5:16"},
+		{SectionCode, []int{1}, "7:4"},
+		{SectionCode, []int{2}, "8:8"},
+	} {
+		pos, ok := m.Lookup(c.Section, c.Path)
+		if !ok {
+			t.Errorf("%s %v: missing position", c.Section, c.Path)
+			continue
+		}
+		if got := pos.String(); got != c.Want {
+			t.Errorf("%s %v: got %s want %s", c.Section, c.Path, got, c.Want)
+		}
+	}
+
+	// errors after comments report the same positions
+	if _, err := ParseMichelson("/*\n*/ { DUP ;\n  $ }"); err == nil || !strings.Contains(err.Error(), "3:3") {
+		t.Errorf("mismatched error position: %v", err)
+	}
+}
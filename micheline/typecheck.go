@@ -0,0 +1,1426 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// TypeError is returned when a script, lambda or value does not typecheck.
+// Path lists argument indices from the root of Section to the offending
+// node. For instructions Stack contains the input stack types.
+type TypeError struct {
+	Section string
+	Path    []int
+	Prim    Prim
+	Stack   Stack
+	Message string
+}
+
+func (e *TypeError) Error() string {
+	var b strings.Builder
+	b.WriteString("micheline: typecheck")
+	if e.Section != "" {
+		b.WriteByte(' ')
+		b.WriteString(e.Section)
+	}
+	if len(e.Path) > 0 {
+		fmt.Fprintf(&b, " at %v", e.Path)
+	}
+	if e.Prim.IsValid() && e.Prim.IsInstruction() && e.Prim.Type != PrimSequence {
+		b.WriteByte(' ')
+		b.WriteString(e.Prim.michelsonName())
+	}
+	b.WriteString(": ")
+	b.WriteString(e.Message)
+	if e.Stack != nil {
+		b.WriteString(" with stack ")
+		b.WriteString(e.Stack.Michelson())
+	}
+	return b.String()
+}
+
+// InstrType holds the stack types before and after an instruction. Path
+// lists argument indices from the root of Section to the instruction. After
+// is nil when the instruction always fails.
+type InstrType struct {
+	Section string
+	Path    []int
+	Prim    Prim
+	Before  Stack
+	After   Stack
+	Failed  bool
+}
+
+// TypeMap lists the stack types of all instructions in a script or lambda
+// in pre-order.
+type TypeMap []InstrType
+
+// Find returns the stack types of the instruction at path in section.
+func (m TypeMap) Find(section string, path []int) (InstrType, bool) {
+	for _, v := range m {
+		if v.Section == section && pathEqual(v.Path, path) {
+			return v, true
+		}
+	}
+	return InstrType{}, false
+}
+
+// Michelson returns stack types in Michelson notation with the top element
+// first.
+func (s Stack) Michelson() string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i := len(s) - 1; i >= 0; i-- {
+		if i < len(s)-1 {
+			b.WriteString(" : ")
+		}
+		b.WriteString(typeName(s[i]))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// Section names used in type errors and type maps.
+const (
+	SectionParameter = "parameter"
+	SectionStorage   = "storage"
+	SectionCode      = "code"
+	SectionData      = "data"
+)
+
+// ViewSection returns the section name of view name.
+func ViewSection(name string) string {
+	return "view " + name
+}
+
+// Typecheck checks the script's code and views against its parameter and
+// storage types and the initial storage against the storage type. Macros
+// must be expanded before.
+func (s Script) Typecheck() (TypeMap, error) {
+	m, err := s.Code.Typecheck()
+	if err != nil {
+		return m, err
+	}
+	if err := s.StorageType().TypecheckValue(s.Storage); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// Typecheck checks code and views against the parameter and storage types
+// and returns the stack types at each instruction.
+func (c Code) Typecheck() (TypeMap, error) {
+	var m TypeMap
+	param, err := codeSection(c.Param, K_PARAMETER, SectionParameter)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTypeAttr(param, nil, attrPassable); err != nil {
+		return nil, withSection(err, SectionParameter)
+	}
+	if err := checkEntrypoints(param, nil, map[string]struct{}{}); err != nil {
+		return nil, withSection(err, SectionParameter)
+	}
+	storage, err := codeSection(c.Storage, K_STORAGE, SectionStorage)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTypeAttr(storage, nil, attrStorable); err != nil {
+		return nil, withSection(err, SectionStorage)
+	}
+	code, err := codeSection(c.Code, K_CODE, SectionCode)
+	if err != nil {
+		return nil, err
+	}
+	tc := &typechecker{
+		section: SectionCode,
+		param:   param,
+		types:   &m,
+	}
+	in := []Prim{NewPairType(param, storage)}
+	out := []Prim{NewPairType(NewCode(T_LIST, NewCode(T_OPERATION)), storage)}
+	if err := tc.body(code, nil, in, out); err != nil {
+		return m, err
+	}
+
+	// views
+	names := make(map[string]struct{})
+	for i, v := range c.View.Args {
+		if v.OpCode != K_VIEW || len(v.Args) != 4 || v.Args[0].Type != PrimString {
+			return m, &TypeError{Section: SectionCode, Path: []int{i}, Prim: v, Message: "malformed view"}
+		}
+		name := v.Args[0].String
+		if _, ok := names[name]; ok {
+			return m, &TypeError{Section: ViewSection(name), Prim: v, Message: "duplicate view name"}
+		}
+		names[name] = struct{}{}
+		vtc := &typechecker{
+			section: ViewSection(name),
+			view:    true,
+			types:   &m,
+		}
+		for _, k := range []int{1, 2} {
+			if err := checkTypeAttr(v.Args[k], []int{k}, attrPackable); err != nil {
+				return m, withSection(err, vtc.section)
+			}
+		}
+		in := []Prim{NewPairType(v.Args[1], storage)}
+		out := []Prim{v.Args[2]}
+		if err := vtc.body(v.Args[3], []int{3}, in, out); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+// TypecheckValue checks that value v is a valid instance of type t. Lambdas
+// contained in v are typechecked as well.
+func (t Type) TypecheckValue(v Prim) error {
+	if err := checkType(t.Prim, nil); err != nil {
+		return withSection(err, SectionData)
+	}
+	tc := &typechecker{section: SectionData}
+	return tc.data(t.Prim, v, nil)
+}
+
+// TypecheckLambda checks that code is a valid lambda from type arg to type
+// ret and returns the stack types at each instruction.
+func TypecheckLambda(arg, ret Type, code Prim) (TypeMap, error) {
+	var m TypeMap
+	for _, t := range []Type{arg, ret} {
+		if err := checkType(t.Prim, nil); err != nil {
+			return nil, withSection(err, SectionData)
+		}
+	}
+	tc := &typechecker{section: SectionCode, types: &m}
+	err := tc.body(code, nil, []Prim{arg.Prim}, []Prim{ret.Prim})
+	return m, err
+}
+
+func codeSection(p Prim, op OpCode, name string) (Prim, error) {
+	if p.OpCode != op || len(p.Args) != 1 || p.Type == PrimSequence {
+		return InvalidPrim, &TypeError{Section: name, Prim: p, Message: "missing or malformed section"}
+	}
+	return p.Args[0], nil
+}
+
+func withSection(err error, section string) error {
+	if e, ok := err.(*TypeError); ok && e.Section == "" {
+		e.Section = section
+	}
+	return err
+}
+
+// checkEntrypoints rejects duplicate entrypoint annotations in a parameter
+// type.
+func checkEntrypoints(t Prim, path []int, seen map[string]struct{}) error {
+	if name := fieldAnno(t); name != "" {
+		if _, ok := seen[name]; ok {
+			return newTypeError(path, t, "duplicate entrypoint %%%s", name)
+		}
+		seen[name] = struct{}{}
+	}
+	if t.OpCode != T_OR {
+		return nil
+	}
+	for i, v := range t.Args {
+		if err := checkEntrypoints(v, appendPath(path, i), seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pathEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// typechecker holds the context of a code body. Internally stacks store
+// the top element first.
+type typechecker struct {
+	section string
+	param   Prim     // contract parameter type, invalid inside lambdas and views
+	view    bool     // true inside views
+	types   *TypeMap // optional output
+}
+
+func toStack(s []Prim) Stack {
+	st := make(Stack, len(s))
+	for i, v := range s {
+		st[len(s)-1-i] = v
+	}
+	return st
+}
+
+func (tc *typechecker) errorf(path []int, p Prim, st []Prim, format string, args ...interface{}) error {
+	e := newTypeError(path, p, format, args...)
+	e.Section = tc.section
+	if st != nil {
+		e.Stack = toStack(st)
+	}
+	return e
+}
+
+// lambda returns a typechecker for a lambda body.
+func (tc *typechecker) lambda() *typechecker {
+	return &typechecker{
+		section: tc.section,
+		view:    tc.view,
+		types:   tc.types,
+	}
+}
+
+// body typechecks a code block that must turn stack in into stack out.
+func (tc *typechecker) body(code Prim, path []int, in, out []Prim) error {
+	if code.Type != PrimSequence {
+		return tc.errorf(path, code, nil, "expected an instruction sequence")
+	}
+	res, failed, err := tc.seq(code, path, in)
+	if err != nil || failed {
+		return err
+	}
+	if !stacksEqual(res, out) {
+		return tc.errorf(path, code, res, "expected result stack %s", toStack(out).Michelson())
+	}
+	return nil
+}
+
+func stacksEqual(a, b []Prim) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !typesEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// seq typechecks an instruction sequence. The returned flag is true when
+// the sequence always fails.
+func (tc *typechecker) seq(code Prim, path []int, st []Prim) ([]Prim, bool, error) {
+	var (
+		failed bool
+		err    error
+	)
+	for i, v := range code.Args {
+		if failed {
+			return nil, false, tc.errorf(appendPath(path, i), v, nil, "instruction is unreachable after a failing instruction")
+		}
+		st, failed, err = tc.instr(v, appendPath(path, i), st)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return st, failed, nil
+}
+
+// branch typechecks a block argument of a control instruction.
+func (tc *typechecker) branch(p Prim, i int, path []int, st []Prim) ([]Prim, bool, error) {
+	code := p.Args[i]
+	if code.Type != PrimSequence {
+		return nil, false, tc.errorf(appendPath(path, i), code, nil, "expected an instruction sequence")
+	}
+	return tc.seq(code, appendPath(path, i), st)
+}
+
+// merge joins the result stacks of two branches.
+func (tc *typechecker) merge(path []int, p Prim, a []Prim, af bool, b []Prim, bf bool) ([]Prim, bool, error) {
+	switch {
+	case af:
+		return b, bf, nil
+	case bf:
+		return a, false, nil
+	case !stacksEqual(a, b):
+		return nil, false, tc.errorf(path, p, nil, "branches have different stack types %s and %s",
+			toStack(a).Michelson(), toStack(b).Michelson())
+	default:
+		return a, false, nil
+	}
+}
+
+func (tc *typechecker) instr(p Prim, path []int, st []Prim) ([]Prim, bool, error) {
+	if p.Type == PrimSequence {
+		return tc.seq(p, path, st)
+	}
+	if p.IsMacro() {
+		return nil, false, tc.errorf(path, p, st, "unexpanded macro")
+	}
+	if !p.OpCode.IsValid() || p.Type == PrimInt || p.Type == PrimString || p.Type == PrimBytes || !p.IsInstruction() {
+		return nil, false, tc.errorf(path, p, st, "expected an instruction")
+	}
+	idx := -1
+	if tc.types != nil {
+		idx = len(*tc.types)
+		*tc.types = append(*tc.types, InstrType{
+			Section: tc.section,
+			Path:    path,
+			Prim:    p,
+			Before:  toStack(st),
+		})
+	}
+	out, failed, err := tc.apply(p, path, st)
+	if err != nil {
+		return nil, false, err
+	}
+	if idx >= 0 {
+		it := &(*tc.types)[idx]
+		it.Failed = failed
+		if !failed {
+			it.After = toStack(out)
+		}
+	}
+	return out, failed, nil
+}
+
+// nullaryTypes lists instructions that push a value of fixed type.
+var nullaryTypes = map[OpCode]OpCode{
+	I_UNIT:               T_UNIT,
+	I_NOW:                T_TIMESTAMP,
+	I_AMOUNT:             T_MUMAV,
+	I_BALANCE:            T_MUMAV,
+	I_CHAIN_ID:           T_CHAIN_ID,
+	I_SOURCE:             T_ADDRESS,
+	I_SENDER:             T_ADDRESS,
+	I_SELF_ADDRESS:       T_ADDRESS,
+	I_LEVEL:              T_NAT,
+	I_TOTAL_VOTING_POWER: T_NAT,
+	I_MIN_BLOCK_TIME:     T_NAT,
+}
+
+// unaryTypes lists the accepted argument and result types of instructions
+// that consume a single value.
+var unaryTypes = map[OpCode][][2]OpCode{
+	I_ABS:          {{T_INT, T_NAT}},
+	I_INT:          {{T_NAT, T_INT}, {T_BLS12_381_FR, T_INT}, {T_BYTES, T_INT}},
+	I_NAT:          {{T_BYTES, T_NAT}},
+	I_BYTES:        {{T_INT, T_BYTES}, {T_NAT, T_BYTES}},
+	I_NEG:          {{T_NAT, T_INT}, {T_INT, T_INT}, {T_BLS12_381_G1, T_BLS12_381_G1}, {T_BLS12_381_G2, T_BLS12_381_G2}, {T_BLS12_381_FR, T_BLS12_381_FR}},
+	I_NOT:          {{T_BOOL, T_BOOL}, {T_NAT, T_INT}, {T_INT, T_INT}, {T_BYTES, T_BYTES}},
+	I_EQ:           {{T_INT, T_BOOL}},
+	I_NEQ:          {{T_INT, T_BOOL}},
+	I_LT:           {{T_INT, T_BOOL}},
+	I_GT:           {{T_INT, T_BOOL}},
+	I_LE:           {{T_INT, T_BOOL}},
+	I_GE:           {{T_INT, T_BOOL}},
+	I_BLAKE2B:      {{T_BYTES, T_BYTES}},
+	I_SHA256:       {{T_BYTES, T_BYTES}},
+	I_SHA512:       {{T_BYTES, T_BYTES}},
+	I_KECCAK:       {{T_BYTES, T_BYTES}},
+	I_SHA3:         {{T_BYTES, T_BYTES}},
+	I_HASH_KEY:     {{T_KEY, T_KEY_HASH}},
+	I_VOTING_POWER: {{T_KEY_HASH, T_NAT}},
+}
+
+// binaryTypes lists the accepted argument and result types of arithmetic
+// and bitwise instructions.
+var binaryTypes = map[OpCode][][3]OpCode{
+	I_ADD: {
+		{T_NAT, T_NAT, T_NAT}, {T_NAT, T_INT, T_INT}, {T_INT, T_NAT, T_INT}, {T_INT, T_INT, T_INT},
+		{T_TIMESTAMP, T_INT, T_TIMESTAMP}, {T_INT, T_TIMESTAMP, T_TIMESTAMP}, {T_MUMAV, T_MUMAV, T_MUMAV},
+		{T_BLS12_381_G1, T_BLS12_381_G1, T_BLS12_381_G1}, {T_BLS12_381_G2, T_BLS12_381_G2, T_BLS12_381_G2},
+		{T_BLS12_381_FR, T_BLS12_381_FR, T_BLS12_381_FR},
+	},
+	I_SUB: {
+		{T_NAT, T_NAT, T_INT}, {T_NAT, T_INT, T_INT}, {T_INT, T_NAT, T_INT}, {T_INT, T_INT, T_INT},
+		{T_TIMESTAMP, T_INT, T_TIMESTAMP}, {T_TIMESTAMP, T_TIMESTAMP, T_INT},
+	},
+	I_MUL: {
+		{T_NAT, T_NAT, T_NAT}, {T_NAT, T_INT, T_INT}, {T_INT, T_NAT, T_INT}, {T_INT, T_INT, T_INT},
+		{T_MUMAV, T_NAT, T_MUMAV}, {T_NAT, T_MUMAV, T_MUMAV},
+		{T_BLS12_381_G1, T_BLS12_381_FR, T_BLS12_381_G1}, {T_BLS12_381_G2, T_BLS12_381_FR, T_BLS12_381_G2},
+		{T_BLS12_381_FR, T_BLS12_381_FR, T_BLS12_381_FR}, {T_NAT, T_BLS12_381_FR, T_BLS12_381_FR},
+		{T_INT, T_BLS12_381_FR, T_BLS12_381_FR}, {T_BLS12_381_FR, T_NAT, T_BLS12_381_FR},
+		{T_BLS12_381_FR, T_INT, T_BLS12_381_FR},
+	},
+	I_LSL: {{T_NAT, T_NAT, T_NAT}, {T_BYTES, T_NAT, T_BYTES}},
+	I_LSR: {{T_NAT, T_NAT, T_NAT}, {T_BYTES, T_NAT, T_BYTES}},
+	I_OR:  {{T_BOOL, T_BOOL, T_BOOL}, {T_NAT, T_NAT, T_NAT}, {T_BYTES, T_BYTES, T_BYTES}},
+	I_XOR: {{T_BOOL, T_BOOL, T_BOOL}, {T_NAT, T_NAT, T_NAT}, {T_BYTES, T_BYTES, T_BYTES}},
+	I_AND: {{T_BOOL, T_BOOL, T_BOOL}, {T_NAT, T_NAT, T_NAT}, {T_INT, T_NAT, T_NAT}, {T_BYTES, T_BYTES, T_BYTES}},
+}
+
+// edivTypes lists the quotient and remainder types of EDIV.
+var edivTypes = map[[2]OpCode][2]OpCode{
+	{T_NAT, T_NAT}:     {T_NAT, T_NAT},
+	{T_NAT, T_INT}:     {T_INT, T_NAT},
+	{T_INT, T_NAT}:     {T_INT, T_NAT},
+	{T_INT, T_INT}:     {T_INT, T_NAT},
+	{T_MUMAV, T_NAT}:   {T_MUMAV, T_MUMAV},
+	{T_MUMAV, T_MUMAV}: {T_NAT, T_MUMAV},
+}
+
+// maxInstrArg is the largest numeric argument accepted by DROP, DUP, DIG,
+// DUG, DIP, PAIR, UNPAIR, GET and UPDATE.
+var maxInstrArg = big.NewInt(1023)
+
+// instrArgs lists the accepted argument counts per instruction. Instructions
+// not listed take no arguments.
+var instrArgs = map[OpCode][]int{
+	I_DROP:                {0, 1},
+	I_DUP:                 {0, 1},
+	I_DIG:                 {1},
+	I_DUG:                 {1},
+	I_PUSH:                {2},
+	I_NONE:                {1},
+	I_IF_NONE:             {2},
+	I_PAIR:                {0, 1},
+	I_UNPAIR:              {0, 1},
+	I_LEFT:                {1},
+	I_RIGHT:               {1},
+	I_IF_LEFT:             {2},
+	I_NIL:                 {1},
+	I_IF_CONS:             {2},
+	I_EMPTY_SET:           {1},
+	I_EMPTY_MAP:           {2},
+	I_EMPTY_BIG_MAP:       {2},
+	I_MAP:                 {1},
+	I_ITER:                {1},
+	I_GET:                 {0, 1},
+	I_UPDATE:              {0, 1},
+	I_IF:                  {2},
+	I_LOOP:                {1},
+	I_LOOP_LEFT:           {1},
+	I_LAMBDA:              {3},
+	I_LAMBDA_REC:          {3},
+	I_DIP:                 {1, 2},
+	I_CAST:                {1},
+	I_UNPACK:              {1},
+	I_CONTRACT:            {1},
+	I_CREATE_CONTRACT:     {1},
+	I_SAPLING_EMPTY_STATE: {1},
+	I_VIEW:                {2},
+	I_EMIT:                {0, 1},
+}
+
+func (tc *typechecker) apply(p Prim, path []int, st []Prim) ([]Prim, bool, error) {
+	fail := func(format string, args ...interface{}) ([]Prim, bool, error) {
+		return nil, false, tc.errorf(path, p, st, format, args...)
+	}
+	need := func(n int) bool {
+		return len(st) >= n
+	}
+	push := func(t Prim, n int) []Prim {
+		out := make([]Prim, 0, len(st)-n+1)
+		out = append(out, t)
+		return append(out, st[n:]...)
+	}
+	intArg := func(i int) (int, error) {
+		a := p.Args[i]
+		if a.Type != PrimInt || a.Int.Sign() < 0 || a.Int.Cmp(maxInstrArg) > 0 {
+			return 0, tc.errorf(appendPath(path, i), a, nil, "expected a natural number argument up to 1023")
+		}
+		return int(a.Int.Int64()), nil
+	}
+	typeArg := func(i int, attrs ...typeAttr) error {
+		if err := checkType(p.Args[i], appendPath(path, i)); err != nil {
+			return withSection(err, tc.section)
+		}
+		for _, a := range attrs {
+			if !hasTypeAttr(p.Args[i], a) {
+				return tc.errorf(appendPath(path, i), p.Args[i], nil, "type %s is not %s", typeName(p.Args[i]), a)
+			}
+		}
+		return nil
+	}
+
+	// check argument counts
+	nargs := len(p.Args)
+	counts, ok := instrArgs[p.OpCode]
+	if !ok {
+		counts = []int{0}
+	}
+	if !containsInt(counts, nargs) {
+		return fail("unexpected number of arguments %d", nargs)
+	}
+
+	if tc.view || !tc.param.IsValid() {
+		switch p.OpCode {
+		case I_SELF:
+			if tc.view {
+				return fail("instruction is not allowed in views")
+			}
+			return fail("instruction is not allowed in lambdas")
+		case I_TRANSFER_TOKENS, I_SET_DELEGATE, I_CREATE_CONTRACT, I_EMIT:
+			if tc.view {
+				return fail("instruction is not allowed in views")
+			}
+		}
+	}
+
+	if t, ok := nullaryTypes[p.OpCode]; ok {
+		return push(NewCode(t), 0), false, nil
+	}
+	if rules, ok := unaryTypes[p.OpCode]; ok {
+		if !need(1) {
+			return fail("stack too short")
+		}
+		for _, r := range rules {
+			if st[0].OpCode == r[0] && len(st[0].Args) == 0 {
+				return push(NewCode(r[1]), 1), false, nil
+			}
+		}
+		return fail("unexpected argument type %s", typeName(st[0]))
+	}
+	if rules, ok := binaryTypes[p.OpCode]; ok {
+		if !need(2) {
+			return fail("stack too short")
+		}
+		for _, r := range rules {
+			if st[0].OpCode == r[0] && st[1].OpCode == r[1] && len(st[0].Args) == 0 && len(st[1].Args) == 0 {
+				return push(NewCode(r[2]), 2), false, nil
+			}
+		}
+		if p.OpCode == I_SUB && st[0].OpCode == T_MUMAV && st[1].OpCode == T_MUMAV {
+			return fail("SUB on mumav is deprecated, use SUB_MUMAV")
+		}
+		return fail("unexpected argument types %s and %s", typeName(st[0]), typeName(st[1]))
+	}
+
+	switch p.OpCode {
+	case I_DROP:
+		n := 1
+		if nargs == 1 {
+			var err error
+			if n, err = intArg(0); err != nil {
+				return nil, false, err
+			}
+		}
+		if !need(n) {
+			return fail("stack too short")
+		}
+		return st[n:], false, nil
+
+	case I_DUP:
+		n := 1
+		if nargs == 1 {
+			var err error
+			if n, err = intArg(0); err != nil {
+				return nil, false, err
+			}
+			if n == 0 {
+				return fail("DUP 0 is not allowed")
+			}
+		}
+		if !need(n) {
+			return fail("stack too short")
+		}
+		if !hasTypeAttr(st[n-1], attrDuplicable) {
+			return fail("type %s is not duplicable", typeName(st[n-1]))
+		}
+		return append([]Prim{st[n-1]}, st...), false, nil
+
+	case I_SWAP:
+		if !need(2) {
+			return fail("stack too short")
+		}
+		out := append([]Prim{st[1], st[0]}, st[2:]...)
+		return out, false, nil
+
+	case I_DIG, I_DUG:
+		n, err := intArg(0)
+		if err != nil {
+			return nil, false, err
+		}
+		if !need(n + 1) {
+			return fail("stack too short")
+		}
+		out := make([]Prim, 0, len(st))
+		if p.OpCode == I_DIG {
+			out = append(out, st[n])
+			out = append(out, st[:n]...)
+			out = append(out, st[n+1:]...)
+		} else {
+			out = append(out, st[1:n+1]...)
+			out = append(out, st[0])
+			out = append(out, st[n+1:]...)
+		}
+		return out, false, nil
+
+	case I_PUSH:
+		if err := typeArg(0, attrPushable); err != nil {
+			return nil, false, err
+		}
+		if err := tc.lambda().data(p.Args[0], p.Args[1], appendPath(path, 1)); err != nil {
+			return nil, false, err
+		}
+		return push(p.Args[0], 0), false, nil
+
+	case I_SOME:
+		if !need(1) {
+			return fail("stack too short")
+		}
+		return push(NewCode(T_OPTION, st[0]), 1), false, nil
+
+	case I_NONE:
+		if err := typeArg(0); err != nil {
+			return nil, false, err
+		}
+		return push(NewCode(T_OPTION, p.Args[0]), 0), false, nil
+
+	case I_NEVER:
+		if !need(1) || st[0].OpCode != T_NEVER {
+			return fail("expected never on top of stack")
+		}
+		return nil, true, nil
+
+	case I_IF_NONE, I_IF_LEFT, I_IF_CONS, I_IF:
+		if !need(1) {
+			return fail("stack too short")
+		}
+		var bt, bf []Prim
+		rest := st[1:]
+		switch p.OpCode {
+		case I_IF_NONE:
+			if st[0].OpCode != T_OPTION {
+				return fail("expected option on top of stack")
+			}
+			bt, bf = rest, push(st[0].Args[0], 1)
+		case I_IF_LEFT:
+			if st[0].OpCode != T_OR {
+				return fail("expected or on top of stack")
+			}
+			bt, bf = push(st[0].Args[0], 1), push(st[0].Args[1], 1)
+		case I_IF_CONS:
+			if st[0].OpCode != T_LIST {
+				return fail("expected list on top of stack")
+			}
+			bt = append([]Prim{st[0].Args[0]}, st...)
+			bf = rest
+		case I_IF:
+			if st[0].OpCode != T_BOOL {
+				return fail("expected bool on top of stack")
+			}
+			bt, bf = rest, rest
+		}
+		a, af, err := tc.branch(p, 0, path, bt)
+		if err != nil {
+			return nil, false, err
+		}
+		b, bfail, err := tc.branch(p, 1, path, bf)
+		if err != nil {
+			return nil, false, err
+		}
+		return tc.merge(path, p, a, af, b, bfail)
+
+	case I_PAIR:
+		n := 2
+		if nargs == 1 {
+			var err error
+			if n, err = intArg(0); err != nil {
+				return nil, false, err
+			}
+			if n < 2 {
+				return fail("PAIR requires at least 2 elements")
+			}
+		}
+		if !need(n) {
+			return fail("stack too short")
+		}
+		args := make([]Prim, n)
+		copy(args, st[:n])
+		return push(NewCode(T_PAIR, args...), n), false, nil
+
+	case I_UNPAIR:
+		n := 2
+		if nargs == 1 {
+			var err error
+			if n, err = intArg(0); err != nil {
+				return nil, false, err
+			}
+			if n < 2 {
+				return fail("UNPAIR requires at least 2 elements")
+			}
+		}
+		if !need(1) {
+			return fail("stack too short")
+		}
+		out := make([]Prim, 0, len(st)+n-1)
+		cur := st[0]
+		for i := 0; i < n-1; i++ {
+			l, r, ok := pairArgs(cur)
+			if !ok {
+				return fail("expected a pair with %d elements on top of stack", n)
+			}
+			out = append(out, l)
+			cur = r
+		}
+		out = append(out, cur)
+		return append(out, st[1:]...), false, nil
+
+	case I_CAR, I_CDR:
+		if !need(1) {
+			return fail("stack too short")
+		}
+		l, r, ok := pairArgs(st[0])
+		if !ok {
+			return fail("expected pair on top of stack")
+		}
+		if p.OpCode == I_CAR {
+			return push(l, 1), false, nil
+		}
+		return push(r, 1), false, nil
+
+	case I_LEFT, I_RIGHT:
+		if err := typeArg(0); err != nil {
+			return nil, false, err
+		}
+		if !need(1) {
+			return fail("stack too short")
+		}
+		if p.OpCode == I_LEFT {
+			return push(NewCode(T_OR, st[0], p.Args[0]), 1), false, nil
+		}
+		return push(NewCode(T_OR, p.Args[0], st[0]), 1), false, nil
+
+	case I_NIL:
+		if err := typeArg(0); err != nil {
+			return nil, false, err
+		}
+		return push(NewCode(T_LIST, p.Args[0]), 0), false, nil
+
+	case I_CONS:
+		if !need(2) {
+			return fail("stack too short")
+		}
+		if st[1].OpCode != T_LIST || !typesEqual(st[0], st[1].Args[0]) {
+			return fail("expected a list of %s", typeName(st[0]))
+		}
+		return st[1:], false, nil
+
+	case I_SIZE:
+		if !need(1) {
+			return fail("stack too short")
+		}
+		switch st[0].OpCode {
+		case T_SET, T_MAP, T_LIST, T_STRING, T_BYTES:
+			return push(NewCode(T_NAT), 1), false, nil
+		}
+		return fail("unexpected argument type %s", typeName(st[0]))
+
+	case I_EMPTY_SET:
+		if err := typeArg(0); err != nil {
+			return nil, false, err
+		}
+		if !isComparableType(p.Args[0]) {
+			return fail("set element type must be comparable")
+		}
+		return push(NewCode(T_SET, p.Args[0]), 0), false, nil
+
+	case I_EMPTY_MAP, I_EMPTY_BIG_MAP:
+		if err := typeArg(0); err != nil {
+			return nil, false, err
+		}
+		if !isComparableType(p.Args[0]) {
+			return fail("map key type must be comparable")
+		}
+		typ := T_MAP
+		if p.OpCode == I_EMPTY_BIG_MAP {
+			typ = T_BIG_MAP
+			if err := typeArg(1, attrBigMapValue); err != nil {
+				return nil, false, err
+			}
+		} else if err := typeArg(1); err != nil {
+			return nil, false, err
+		}
+		return push(NewCode(typ, p.Args[0], p.Args[1]), 0), false, nil
+
+	case I_MAP:
+		if !need(1) {
+			return fail("stack too short")
+		}
+		var elem Prim
+		switch st[0].OpCode {
+		case T_LIST, T_OPTION:
+			elem = st[0].Args[0]
+		case T_MAP:
+			elem = NewPairType(st[0].Args[0], st[0].Args[1])
+		default:
+			return fail("unexpected argument type %s", typeName(st[0]))
+		}
+		res, failed, err := tc.branch(p, 0, path, push(elem, 1))
+		if err != nil {
+			return nil, false, err
+		}
+		if failed {
+			return fail("MAP body must not always fail")
+		}
+		if len(res) == 0 || !stacksEqual(res[1:], st[1:]) {
+			return fail("MAP body must keep the stack below the element unchanged")
+		}
+		var out Prim
+		switch st[0].OpCode {
+		case T_MAP:
+			out = NewCode(T_MAP, st[0].Args[0], res[0])
+		default:
+			out = NewCode(st[0].OpCode, res[0])
+		}
+		return push(out, 1), false, nil
+
+	case I_ITER:
+		if !need(1) {
+			return fail("stack too short")
+		}
+		var elem Prim
+		switch st[0].OpCode {
+		case T_LIST, T_SET:
+			elem = st[0].Args[0]
+		case T_MAP:
+			elem = NewPairType(st[0].Args[0], st[0].Args[1])
+		default:
+			return fail("unexpected argument type %s", typeName(st[0]))
+		}
+		res, failed, err := tc.branch(p, 0, path, push(elem, 1))
+		if err != nil {
+			return nil, false, err
+		}
+		if !failed && !stacksEqual(res, st[1:]) {
+			return fail("ITER body must consume the element and keep the stack unchanged")
+		}
+		return st[1:], false, nil
+
+	case I_MEM:
+		if !need(2) {
+			return fail("stack too short")
+		}
+		switch st[1].OpCode {
+		case T_SET, T_MAP, T_BIG_MAP:
+			if !typesEqual(st[0], st[1].Args[0]) {
+				return fail("key type mismatch")
+			}
+			return push(NewCode(T_BOOL), 2), false, nil
+		}
+		return fail("expected set, map or big_map")
+
+	case I_GET:
+		if nargs == 1 {
+			n, err := intArg(0)
+			if err != nil {
+				return nil, false, err
+			}
+			if !need(1) {
+				return fail("stack too short")
+			}
+			t, ok := combGetType(st[0], n)
+			if !ok {
+				return fail("cannot access element %d of %s", n, typeName(st[0]))
+			}
+			return push(t, 1), false, nil
+		}
+		if !need(2) {
+			return fail("stack too short")
+		}
+		if st[1].OpCode != T_MAP && st[1].OpCode != T_BIG_MAP {
+			return fail("expected map or big_map")
+		}
+		if !typesEqual(st[0], st[1].Args[0]) {
+			return fail("key type mismatch")
+		}
+		return push(NewCode(T_OPTION, st[1].Args[1]), 2), false, nil
+
+	case I_UPDATE:
+		if nargs == 1 {
+			n, err := intArg(0)
+			if err != nil {
+				return nil, false, err
+			}
+			if !need(2) {
+				return fail("stack too short")
+			}
+			t, ok := combUpdateType(st[1], n, st[0])
+			if !ok {
+				return fail("cannot update element %d of %s", n, typeName(st[1]))
+			}
+			return push(t, 2), false, nil
+		}
+		if !need(3) {
+			return fail("stack too short")
+		}
+		switch st[2].OpCode {
+		case T_SET:
+			if !typesEqual(st[0], st[2].Args[0]) || st[1].OpCode != T_BOOL {
+				return fail("expected key and bool for set update")
+			}
+		case T_MAP, T_BIG_MAP:
+			if !typesEqual(st[0], st[2].Args[0]) || !typesEqual(st[1], NewCode(T_OPTION, st[2].Args[1])) {
+				return fail("expected key and optional value for map update")
+			}
+		default:
+			return fail("expected set, map or big_map")
+		}
+		return st[2:], false, nil
+
+	case I_GET_AND_UPDATE:
+		if !need(3) {
+			return fail("stack too short")
+		}
+		if st[2].OpCode != T_MAP && st[2].OpCode != T_BIG_MAP {
+			return fail("expected map or big_map")
+		}
+		if !typesEqual(st[0], st[2].Args[0]) || !typesEqual(st[1], NewCode(T_OPTION, st[2].Args[1])) {
+			return fail("expected key and optional value for map update")
+		}
+		return st[1:], false, nil
+
+	case I_LOOP:
+		if !need(1) || st[0].OpCode != T_BOOL {
+			return fail("expected bool on top of stack")
+		}
+		res, failed, err := tc.branch(p, 0, path, st[1:])
+		if err != nil {
+			return nil, false, err
+		}
+		if !failed && !stacksEqual(res, st) {
+			return fail("LOOP body must return a bool on top of the input stack")
+		}
+		return st[1:], false, nil
+
+	case I_LOOP_LEFT:
+		if !need(1) || st[0].OpCode != T_OR {
+			return fail("expected or on top of stack")
+		}
+		res, failed, err := tc.branch(p, 0, path, push(st[0].Args[0], 1))
+		if err != nil {
+			return nil, false, err
+		}
+		if !failed && !stacksEqual(res, st) {
+			return fail("LOOP_LEFT body must return the loop type on top of the input stack")
+		}
+		return push(st[0].Args[1], 1), false, nil
+
+	case I_LAMBDA, I_LAMBDA_REC:
+		if err := typeArg(0); err != nil {
+			return nil, false, err
+		}
+		if err := typeArg(1); err != nil {
+			return nil, false, err
+		}
+		typ := NewCode(T_LAMBDA, p.Args[0], p.Args[1])
+		in := []Prim{p.Args[0]}
+		if p.OpCode == I_LAMBDA_REC {
+			in = append(in, typ)
+		}
+		if err := tc.lambda().body(p.Args[2], appendPath(path, 2), in, []Prim{p.Args[1]}); err != nil {
+			return nil, false, err
+		}
+		return push(typ, 0), false, nil
+
+	case I_EXEC:
+		if !need(2) {
+			return fail("stack too short")
+		}
+		if st[1].OpCode != T_LAMBDA || !typesEqual(st[0], st[1].Args[0]) {
+			return fail("expected a lambda from %s", typeName(st[0]))
+		}
+		return push(st[1].Args[1], 2), false, nil
+
+	case I_APPLY:
+		if !need(2) {
+			return fail("stack too short")
+		}
+		if st[1].OpCode != T_LAMBDA {
+			return fail("expected lambda")
+		}
+		l, r, ok := pairArgs(st[1].Args[0])
+		if !ok || !typesEqual(st[0], l) {
+			return fail("expected a lambda from a pair of %s", typeName(st[0]))
+		}
+		if !hasTypeAttr(st[0], attrPushable) {
+			return fail("captured type %s is not pushable", typeName(st[0]))
+		}
+		return push(NewCode(T_LAMBDA, r, st[1].Args[1]), 2), false, nil
+
+	case I_DIP:
+		n, i := 1, 0
+		if nargs == 2 {
+			var err error
+			if n, err = intArg(0); err != nil {
+				return nil, false, err
+			}
+			i = 1
+		}
+		if !need(n) {
+			return fail("stack too short")
+		}
+		res, failed, err := tc.branch(p, i, path, st[n:])
+		if err != nil {
+			return nil, false, err
+		}
+		if failed {
+			return fail("DIP body must not always fail")
+		}
+		out := make([]Prim, 0, n+len(res))
+		out = append(out, st[:n]...)
+		return append(out, res...), false, nil
+
+	case I_FAILWITH:
+		if !need(1) {
+			return fail("stack too short")
+		}
+		if !hasTypeAttr(st[0], attrPushable) {
+			return fail("type %s cannot be used with FAILWITH", typeName(st[0]))
+		}
+		return nil, true, nil
+
+	case I_CAST:
+		if err := typeArg(0); err != nil {
+			return nil, false, err
+		}
+		if !need(1) || !typesEqual(st[0], p.Args[0]) {
+			return fail("cannot cast to %s", typeName(p.Args[0]))
+		}
+		return push(p.Args[0], 1), false, nil
+
+	case I_RENAME:
+		if !need(1) {
+			return fail("stack too short")
+		}
+		return st, false, nil
+
+	case I_CONCAT:
+		if !need(1) {
+			return fail("stack too short")
+		}
+		if st[0].OpCode == T_LIST {
+			switch st[0].Args[0].OpCode {
+			case T_STRING, T_BYTES:
+				return push(NewCode(st[0].Args[0].OpCode), 1), false, nil
+			}
+			return fail("expected a list of string or bytes")
+		}
+		if !need(2) {
+			return fail("stack too short")
+		}
+		if (st[0].OpCode == T_STRING || st[0].OpCode == T_BYTES) && st[1].OpCode == st[0].OpCode {
+			return push(NewCode(st[0].OpCode), 2), false, nil
+		}
+		return fail("unexpected argument types %s and %s", typeName(st[0]), typeName(st[1]))
+
+	case I_SLICE:
+		if !need(3) {
+			return fail("stack too short")
+		}
+		if st[0].OpCode != T_NAT || st[1].OpCode != T_NAT || (st[2].OpCode != T_STRING && st[2].OpCode != T_BYTES) {
+			return fail("expected offset, length and string or bytes")
+		}
+		return push(NewCode(T_OPTION, NewCode(st[2].OpCode)), 3), false, nil
+
+	case I_PACK:
+		if !need(1) {
+			return fail("stack too short")
+		}
+		if !hasTypeAttr(st[0], attrPackable) {
+			return fail("type %s is not packable", typeName(st[0]))
+		}
+		return push(NewCode(T_BYTES), 1), false, nil
+
+	case I_UNPACK:
+		if err := typeArg(0, attrPackable); err != nil {
+			return nil, false, err
+		}
+		if !need(1) || st[0].OpCode != T_BYTES {
+			return fail("expected bytes on top of stack")
+		}
+		return push(NewCode(T_OPTION, p.Args[0]), 1), false, nil
+
+	case I_SUB_MUMAV:
+		if !need(2) {
+			return fail("stack too short")
+		}
+		if st[0].OpCode != T_MUMAV || st[1].OpCode != T_MUMAV {
+			return fail("expected two mumav values")
+		}
+		return push(NewCode(T_OPTION, NewCode(T_MUMAV)), 2), false, nil
+
+	case I_EDIV:
+		if !need(2) {
+			return fail("stack too short")
+		}
+		r, ok := edivTypes[[2]OpCode{st[0].OpCode, st[1].OpCode}]
+		if !ok {
+			return fail("unexpected argument types %s and %s", typeName(st[0]), typeName(st[1]))
+		}
+		return push(NewOptType(NewPairType(NewCode(r[0]), NewCode(r[1]))), 2), false, nil
+
+	case I_ISNAT:
+		if !need(1) || st[0].OpCode != T_INT {
+			return fail("expected int on top of stack")
+		}
+		return push(NewOptType(NewCode(T_NAT)), 1), false, nil
+
+	case I_COMPARE:
+		if !need(2) {
+			return fail("stack too short")
+		}
+		if !isComparableType(st[0]) || !typesEqual(st[0], st[1]) {
+			return fail("cannot compare %s and %s", typeName(st[0]), typeName(st[1]))
+		}
+		return push(NewCode(T_INT), 2), false, nil
+
+	case I_SELF:
+		typ, ok := findEntrypointType(tc.param, fieldAnno(p))
+		if !ok {
+			return fail("unknown entrypoint %%%s", fieldAnno(p))
+		}
+		return push(NewCode(T_CONTRACT, typ), 0), false, nil
+
+	case I_CONTRACT:
+		if err := typeArg(0, attrPassable); err != nil {
+			return nil, false, err
+		}
+		if !need(1) || st[0].OpCode != T_ADDRESS {
+			return fail("expected address on top of stack")
+		}
+		return push(NewOptType(NewCode(T_CONTRACT, p.Args[0])), 1), false, nil
+
+	case I_TRANSFER_TOKENS:
+		if !need(3) {
+			return fail("stack too short")
+		}
+		if st[1].OpCode != T_MUMAV || st[2].OpCode != T_CONTRACT || !typesEqual(st[0], st[2].Args[0]) {
+			return fail("expected parameter, amount and contract")
+		}
+		return push(NewCode(T_OPERATION), 3), false, nil
+
+	case I_SET_DELEGATE:
+		if !need(1) || !typesEqual(st[0], NewOptType(NewCode(T_KEY_HASH))) {
+			return fail("expected option key_hash on top of stack")
+		}
+		return push(NewCode(T_OPERATION), 1), false, nil
+
+	case I_CREATE_CONTRACT:
+		storage, err := tc.createContract(p, path)
+		if err != nil {
+			return nil, false, err
+		}
+		if !need(3) {
+			return fail("stack too short")
+		}
+		if !typesEqual(st[0], NewOptType(NewCode(T_KEY_HASH))) || st[1].OpCode != T_MUMAV || !typesEqual(st[2], storage) {
+			return fail("expected delegate, balance and storage of type %s", typeName(storage))
+		}
+		return append([]Prim{NewCode(T_OPERATION), NewCode(T_ADDRESS)}, st[3:]...), false, nil
+
+	case I_IMPLICIT_ACCOUNT:
+		if !need(1) || st[0].OpCode != T_KEY_HASH {
+			return fail("expected key_hash on top of stack")
+		}
+		return push(NewCode(T_CONTRACT, NewCode(T_UNIT)), 1), false, nil
+
+	case I_ADDRESS:
+		if !need(1) || st[0].OpCode != T_CONTRACT {
+			return fail("expected contract on top of stack")
+		}
+		return push(NewCode(T_ADDRESS), 1), false, nil
+
+	case I_CHECK_SIGNATURE:
+		if !need(3) {
+			return fail("stack too short")
+		}
+		if st[0].OpCode != T_KEY || st[1].OpCode != T_SIGNATURE || st[2].OpCode != T_BYTES {
+			return fail("expected key, signature and bytes")
+		}
+		return push(NewCode(T_BOOL), 3), false, nil
+
+	case I_PAIRING_CHECK:
+		want := NewCode(T_LIST, NewPairType(NewCode(T_BLS12_381_G1), NewCode(T_BLS12_381_G2)))
+		if !need(1) || !typesEqual(st[0], want) {
+			return fail("expected %s on top of stack", typeName(want))
+		}
+		return push(NewCode(T_BOOL), 1), false, nil
+
+	case I_SAPLING_EMPTY_STATE:
+		if _, err := intArg(0); err != nil {
+			return nil, false, err
+		}
+		return push(NewCode(T_SAPLING_STATE, p.Args[0]), 0), false, nil
+
+	case I_SAPLING_VERIFY_UPDATE:
+		if !need(2) {
+			return fail("stack too short")
+		}
+		if st[0].OpCode != T_SAPLING_TRANSACTION || st[1].OpCode != T_SAPLING_STATE ||
+			!typesEqual(NewCode(T_SAPLING_STATE, st[0].Args[0]), st[1]) {
+			return fail("expected sapling transaction and state with equal memo size")
+		}
+		res := NewOptType(NewPairType(NewCode(T_BYTES), NewPairType(NewCode(T_INT), st[1])))
+		return push(res, 2), false, nil
+
+	case I_TICKET:
+		if !need(2) {
+			return fail("stack too short")
+		}
+		if !isComparableType(st[0]) || st[1].OpCode != T_NAT {
+			return fail("expected comparable content and nat amount")
+		}
+		return push(NewOptType(NewCode(T_TICKET, st[0])), 2), false, nil
+
+	case I_READ_TICKET:
+		if !need(1) || st[0].OpCode != T_TICKET {
+			return fail("expected ticket on top of stack")
+		}
+		info := NewCode(T_PAIR, NewCode(T_ADDRESS), st[0].Args[0], NewCode(T_NAT))
+		return append([]Prim{info}, st...), false, nil
+
+	case I_SPLIT_TICKET:
+		if !need(2) {
+			return fail("stack too short")
+		}
+		amounts := NewPairType(NewCode(T_NAT), NewCode(T_NAT))
+		if st[0].OpCode != T_TICKET || !typesEqual(st[1], amounts) {
+			return fail("expected ticket and a pair of amounts")
+		}
+		return push(NewOptType(NewPairType(st[0], st[0])), 2), false, nil
+
+	case I_JOIN_TICKETS:
+		if !need(1) {
+			return fail("stack too short")
+		}
+		l, r, ok := pairArgs(st[0])
+		if !ok || l.OpCode != T_TICKET || !typesEqual(l, r) {
+			return fail("expected a pair of tickets with equal content type")
+		}
+		return push(NewOptType(l), 1), false, nil
+
+	case I_OPEN_CHEST:
+		if !need(3) {
+			return fail("stack too short")
+		}
+		if st[0].OpCode != T_CHEST_KEY || st[1].OpCode != T_CHEST || st[2].OpCode != T_NAT {
+			return fail("expected chest_key, chest and nat")
+		}
+		return push(NewOptType(NewCode(T_BYTES)), 3), false, nil
+
+	case I_VIEW:
+		if p.Args[0].Type != PrimString {
+			return nil, false, tc.errorf(appendPath(path, 0), p.Args[0], nil, "expected view name")
+		}
+		if err := typeArg(1, attrPackable); err != nil {
+			return nil, false, err
+		}
+		if !need(2) {
+			return fail("stack too short")
+		}
+		if st[1].OpCode != T_ADDRESS {
+			return fail("expected input and address")
+		}
+		return push(NewOptType(p.Args[1]), 2), false, nil
+
+	case I_EMIT:
+		if !need(1) {
+			return fail("stack too short")
+		}
+		if nargs == 1 {
+			if err := typeArg(0, attrPackable); err != nil {
+				return nil, false, err
+			}
+			if !typesEqual(st[0], p.Args[0]) {
+				return fail("event type mismatch, expected %s", typeName(p.Args[0]))
+			}
+		} else if !hasTypeAttr(st[0], attrPackable) {
+			return fail("type %s is not packable", typeName(st[0]))
+		}
+		return push(NewCode(T_OPERATION), 1), false, nil
+
+	case I_STEPS_TO_QUOTA, I_CREATE_ACCOUNT, _I_TICKET:
+		return fail("deprecated instruction")
+
+	default:
+		return fail("unsupported instruction")
+	}
+}
+
+// createContract typechecks the contract literal of CREATE_CONTRACT and
+// returns its storage type.
+func (tc *typechecker) createContract(p Prim, path []int) (Prim, error) {
+	lit := p.Args[0]
+	if lit.Type != PrimSequence {
+		return InvalidPrim, tc.errorf(appendPath(path, 0), lit, nil, "expected a contract literal")
+	}
+	var c Code
+	c.View = NewSeq()
+	for _, v := range lit.Args {
+		switch v.OpCode {
+		case K_PARAMETER:
+			c.Param = v
+		case K_STORAGE:
+			c.Storage = v
+		case K_CODE:
+			c.Code = v
+		case K_VIEW:
+			c.View.Args = append(c.View.Args, v)
+		default:
+			return InvalidPrim, tc.errorf(appendPath(path, 0), lit, nil, "unexpected section %s", v.michelsonName())
+		}
+	}
+	if _, err := c.Typecheck(); err != nil {
+		if e, ok := err.(*TypeError); ok {
+			e.Message = fmt.Sprintf("in %s of created contract: %s", e.Section, e.Message)
+			e.Section = tc.section
+			e.Path = append(appendPath(path, 0), e.Path...)
+		}
+		return InvalidPrim, err
+	}
+	return c.Storage.Args[0], nil
+}
+
+// combGetType returns the type of element n in a right comb as accessed by
+// GET n.
+func combGetType(t Prim, n int) (Prim, bool) {
+	for {
+		switch n {
+		case 0:
+			return t, true
+		case 1:
+			l, _, ok := pairArgs(t)
+			return l, ok
+		}
+		_, r, ok := pairArgs(t)
+		if !ok {
+			return InvalidPrim, false
+		}
+		t, n = r, n-2
+	}
+}
+
+// combUpdateType returns the type of a right comb after replacing element n
+// by a value of type v as done by UPDATE n.
+func combUpdateType(t Prim, n int, v Prim) (Prim, bool) {
+	if n == 0 {
+		return v, true
+	}
+	l, r, ok := pairArgs(t)
+	if !ok {
+		return InvalidPrim, false
+	}
+	if n == 1 {
+		return NewPairType(v, r), true
+	}
+	r, ok = combUpdateType(r, n-2, v)
+	if !ok {
+		return InvalidPrim, false
+	}
+	return NewPairType(l, r), true
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
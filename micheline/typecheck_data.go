@@ -0,0 +1,479 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+var (
+	maxMumav = big.NewInt(math.MaxInt64)
+
+	errInvalidKey            = errors.New("invalid key")
+	errExpectedStringOrBytes = errors.New("expected string or bytes")
+)
+
+// data checks that v is a valid value of type t.
+func (tc *typechecker) data(t, v Prim, path []int) error {
+	fail := func(format string, args ...interface{}) error {
+		return tc.errorf(path, v, nil, format, args...)
+	}
+	if v.IsConstant() {
+		return fail("unexpanded global constant")
+	}
+	switch t.OpCode {
+	case T_INT:
+		if v.Type != PrimInt {
+			return fail("expected int")
+		}
+	case T_NAT:
+		if v.Type != PrimInt || v.Int.Sign() < 0 {
+			return fail("expected nat")
+		}
+	case T_MUMAV:
+		if v.Type != PrimInt || v.Int.Sign() < 0 || v.Int.Cmp(maxMumav) > 0 {
+			return fail("expected mumav")
+		}
+	case T_STRING:
+		if v.Type != PrimString {
+			return fail("expected string")
+		}
+		if !isMichelsonString(v.String) {
+			return fail("string contains non-printable characters")
+		}
+	case T_BYTES, T_CHEST, T_CHEST_KEY, T_SAPLING_TRANSACTION:
+		if v.Type != PrimBytes {
+			return fail("expected bytes")
+		}
+	case T_BOOL:
+		if (v.OpCode != D_TRUE && v.OpCode != D_FALSE) || !isDataPrim(v, 0) {
+			return fail("expected True or False")
+		}
+	case T_UNIT:
+		if v.OpCode != D_UNIT || !isDataPrim(v, 0) {
+			return fail("expected Unit")
+		}
+	case T_NEVER:
+		return fail("type never has no values")
+	case T_OPERATION:
+		return fail("operations cannot be written as values")
+	case T_TIMESTAMP:
+		switch v.Type {
+		case PrimInt:
+		case PrimString:
+			if _, err := time.Parse(time.RFC3339, v.String); err != nil {
+				return fail("invalid timestamp: %v", err)
+			}
+		default:
+			return fail("expected timestamp")
+		}
+	case T_KEY:
+		if _, err := keyValue(v); err != nil {
+			return fail("invalid key: %v", err)
+		}
+	case T_KEY_HASH:
+		a, err := addressValue(v)
+		if err != nil {
+			return fail("invalid key hash: %v", err)
+		}
+		if !a.IsEOA() || strings.Contains(v.String, "%") || (v.Type == PrimBytes && len(v.Bytes) != 21) {
+			return fail("expected key hash")
+		}
+	case T_SIGNATURE:
+		switch v.Type {
+		case PrimString:
+			if _, err := mavryk.ParseSignature(v.String); err != nil {
+				return fail("invalid signature: %v", err)
+			}
+		case PrimBytes:
+			if l := len(v.Bytes); l != 64 && l != 96 {
+				return fail("invalid signature length %d", l)
+			}
+		default:
+			return fail("expected signature")
+		}
+	case T_ADDRESS, T_CONTRACT:
+		if _, err := addressValue(v); err != nil {
+			return fail("invalid address: %v", err)
+		}
+		if ep := addressEntrypoint(v); len(ep) > 31 {
+			return fail("entrypoint name too long")
+		} else if v.Type == PrimString && strings.Contains(v.String, "%") && ep == "" {
+			return fail("empty entrypoint name")
+		}
+	case T_CHAIN_ID:
+		switch v.Type {
+		case PrimString:
+			if _, err := mavryk.ParseChainIdHash(v.String); err != nil {
+				return fail("invalid chain id: %v", err)
+			}
+		case PrimBytes:
+			if len(v.Bytes) != 4 {
+				return fail("invalid chain id length %d", len(v.Bytes))
+			}
+		default:
+			return fail("expected chain id")
+		}
+	case T_TX_ROLLUP_L2_ADDRESS:
+		switch v.Type {
+		case PrimString:
+			if !strings.HasPrefix(v.String, "txr1") {
+				return fail("invalid rollup l2 address")
+			}
+		case PrimBytes:
+			if len(v.Bytes) != 20 {
+				return fail("invalid rollup l2 address length %d", len(v.Bytes))
+			}
+		default:
+			return fail("expected rollup l2 address")
+		}
+	case T_BLS12_381_G1, T_BLS12_381_G2:
+		n := 96
+		if t.OpCode == T_BLS12_381_G2 {
+			n = 192
+		}
+		if v.Type != PrimBytes || len(v.Bytes) != n {
+			return fail("expected %d bytes", n)
+		}
+	case T_BLS12_381_FR:
+		switch v.Type {
+		case PrimInt:
+		case PrimBytes:
+			if len(v.Bytes) > 32 {
+				return fail("expected at most 32 bytes")
+			}
+		default:
+			return fail("expected int or bytes")
+		}
+	case T_OPTION:
+		switch {
+		case v.OpCode == D_NONE && isDataPrim(v, 0):
+		case v.OpCode == D_SOME && isDataPrim(v, 1):
+			return tc.data(t.Args[0], v.Args[0], appendPath(path, 0))
+		default:
+			return fail("expected Some or None")
+		}
+	case T_OR:
+		switch {
+		case v.OpCode == D_LEFT && isDataPrim(v, 1):
+			return tc.data(t.Args[0], v.Args[0], appendPath(path, 0))
+		case v.OpCode == D_RIGHT && isDataPrim(v, 1):
+			return tc.data(t.Args[1], v.Args[0], appendPath(path, 0))
+		default:
+			return fail("expected Left or Right")
+		}
+	case T_PAIR:
+		if v.Type != PrimSequence && (v.OpCode != D_PAIR || !isDataPrim(v, len(v.Args))) {
+			return fail("expected Pair")
+		}
+		if len(v.Args) < 2 {
+			return fail("expected at least 2 pair elements")
+		}
+		return tc.pairData(t, v.Args, path, 0)
+	case T_LIST:
+		if v.Type != PrimSequence {
+			return fail("expected list")
+		}
+		for i, e := range v.Args {
+			if err := tc.data(t.Args[0], e, appendPath(path, i)); err != nil {
+				return err
+			}
+		}
+	case T_SET:
+		if v.Type != PrimSequence {
+			return fail("expected set")
+		}
+		for i, e := range v.Args {
+			if err := tc.data(t.Args[0], e, appendPath(path, i)); err != nil {
+				return err
+			}
+			if i > 0 && compareValues(t.Args[0], v.Args[i-1], e) >= 0 {
+				return tc.errorf(appendPath(path, i), e, nil, "set elements must be in strictly ascending order")
+			}
+		}
+	case T_BIG_MAP:
+		if v.Type == PrimInt {
+			return nil
+		}
+		return tc.mapData(t, v, path)
+	case T_MAP:
+		return tc.mapData(t, v, path)
+	case T_LAMBDA:
+		lt := tc.lambda()
+		switch {
+		case v.Type == PrimSequence:
+			return lt.body(v, path, []Prim{t.Args[0]}, []Prim{t.Args[1]})
+		case v.OpCode == D_LAMBDA_REC && isDataPrim(v, 1):
+			return lt.body(v.Args[0], appendPath(path, 0), []Prim{t.Args[0], t}, []Prim{t.Args[1]})
+		default:
+			return fail("expected lambda")
+		}
+	case T_TICKET:
+		if v.OpCode == D_TICKET && v.Type != PrimSequence && len(v.Args) == 4 {
+			if err := tc.data(NewCode(T_ADDRESS), v.Args[0], appendPath(path, 0)); err != nil {
+				return err
+			}
+			if err := checkType(v.Args[1], appendPath(path, 1)); err != nil {
+				return withSection(err, tc.section)
+			}
+			if !typesEqual(v.Args[1], t.Args[0]) {
+				return tc.errorf(appendPath(path, 1), v.Args[1], nil, "ticket content type mismatch, expected %s", typeName(t.Args[0]))
+			}
+			if err := tc.data(t.Args[0], v.Args[2], appendPath(path, 2)); err != nil {
+				return err
+			}
+			return tc.data(NewCode(T_NAT), v.Args[3], appendPath(path, 3))
+		}
+		// legacy form: Pair ticketer content amount
+		legacy := NewCode(T_PAIR, NewCode(T_ADDRESS), t.Args[0], NewCode(T_NAT))
+		return tc.data(legacy, v, path)
+	case T_SAPLING_STATE:
+		if v.Type == PrimInt {
+			return nil
+		}
+		if v.Type != PrimSequence || len(v.Args) > 0 {
+			return fail("expected sapling state id or empty sequence")
+		}
+	default:
+		return fail("unsupported type %s", typeName(t))
+	}
+	return nil
+}
+
+// pairData checks pair elements vals[i:] against right comb type t.
+func (tc *typechecker) pairData(t Prim, vals []Prim, path []int, i int) error {
+	if i == len(vals)-1 {
+		return tc.data(t, vals[i], appendPath(path, i))
+	}
+	l, r, ok := pairArgs(t)
+	if !ok {
+		return tc.errorf(appendPath(path, i), vals[i], nil, "too many pair elements for type %s", typeName(t))
+	}
+	if err := tc.data(l, vals[i], appendPath(path, i)); err != nil {
+		return err
+	}
+	return tc.pairData(r, vals, path, i+1)
+}
+
+// mapData checks a map literal.
+func (tc *typechecker) mapData(t, v Prim, path []int) error {
+	if v.Type != PrimSequence {
+		return tc.errorf(path, v, nil, "expected map")
+	}
+	for i, e := range v.Args {
+		epath := appendPath(path, i)
+		if e.OpCode != D_ELT || !isDataPrim(e, 2) {
+			return tc.errorf(epath, e, nil, "expected Elt")
+		}
+		if err := tc.data(t.Args[0], e.Args[0], appendPath(epath, 0)); err != nil {
+			return err
+		}
+		if err := tc.data(t.Args[1], e.Args[1], appendPath(epath, 1)); err != nil {
+			return err
+		}
+		if i > 0 && compareValues(t.Args[0], v.Args[i-1].Args[0], e.Args[0]) >= 0 {
+			return tc.errorf(epath, e, nil, "map keys must be in strictly ascending order")
+		}
+	}
+	return nil
+}
+
+// isDataPrim checks that p is a primitive application with n arguments.
+func isDataPrim(p Prim, n int) bool {
+	switch p.Type {
+	case PrimInt, PrimString, PrimBytes, PrimSequence:
+		return false
+	}
+	return len(p.Args) == n
+}
+
+// isMichelsonString checks that s only contains printable ASCII characters
+// and newlines.
+func isMichelsonString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c != '\n' && (c < ' ' || c > '~') {
+			return false
+		}
+	}
+	return true
+}
+
+func keyValue(v Prim) (mavryk.Key, error) {
+	switch v.Type {
+	case PrimString:
+		return mavryk.ParseKey(v.String)
+	case PrimBytes:
+		k, err := mavryk.DecodeKey(v.Bytes)
+		if err == nil && !k.IsValid() {
+			err = errInvalidKey
+		}
+		return k, err
+	default:
+		return mavryk.Key{}, errExpectedStringOrBytes
+	}
+}
+
+func addressValue(v Prim) (mavryk.Address, error) {
+	switch v.Type {
+	case PrimString:
+		s, _, _ := strings.Cut(v.String, "%")
+		return mavryk.ParseAddress(s)
+	case PrimBytes:
+		var a mavryk.Address
+		if len(v.Bytes) < 21 {
+			return a, mavryk.ErrUnknownAddressType
+		}
+		err := a.Decode(v.Bytes)
+		return a, err
+	default:
+		return mavryk.Address{}, errExpectedStringOrBytes
+	}
+}
+
+// addressEntrypoint returns the entrypoint suffix of an address value.
+func addressEntrypoint(v Prim) string {
+	switch v.Type {
+	case PrimString:
+		_, ep, _ := strings.Cut(v.String, "%")
+		return ep
+	case PrimBytes:
+		if len(v.Bytes) > 22 {
+			return string(v.Bytes[22:])
+		}
+	}
+	return ""
+}
+
+// comparableBytes returns the binary form of key, key_hash, address,
+// signature and chain_id values which defines their order.
+func comparableBytes(t, v Prim) []byte {
+	if v.Type == PrimBytes {
+		if t.OpCode == T_KEY_HASH || t.OpCode == T_ADDRESS {
+			if a, err := addressValue(v); err == nil {
+				return append(a.EncodePadded(), addressEntrypoint(v)...)
+			}
+		}
+		return v.Bytes
+	}
+	switch t.OpCode {
+	case T_KEY:
+		if k, err := keyValue(v); err == nil {
+			return k.Bytes()
+		}
+	case T_KEY_HASH, T_ADDRESS:
+		if a, err := addressValue(v); err == nil {
+			return append(a.EncodePadded(), addressEntrypoint(v)...)
+		}
+	case T_SIGNATURE:
+		if s, err := mavryk.ParseSignature(v.String); err == nil {
+			return s.Data
+		}
+	case T_CHAIN_ID:
+		if h, err := mavryk.ParseChainIdHash(v.String); err == nil {
+			return h.Bytes()
+		}
+	}
+	return []byte(v.String)
+}
+
+// timestampValue returns the unix time of a timestamp value.
+func timestampValue(v Prim) *big.Int {
+	if v.Type == PrimInt {
+		return v.Int
+	}
+	tm, err := time.Parse(time.RFC3339, v.String)
+	if err != nil {
+		return new(big.Int)
+	}
+	return big.NewInt(tm.Unix())
+}
+
+// compareValues compares two valid values of comparable type t and returns
+// -1, 0 or 1 following Michelson's COMPARE semantics.
+func compareValues(t, a, b Prim) int {
+	switch t.OpCode {
+	case T_INT, T_NAT, T_MUMAV:
+		return a.Int.Cmp(b.Int)
+	case T_TIMESTAMP:
+		return timestampValue(a).Cmp(timestampValue(b))
+	case T_STRING:
+		return strings.Compare(a.String, b.String)
+	case T_BYTES:
+		return bytes.Compare(a.Bytes, b.Bytes)
+	case T_BOOL:
+		return compareInt(boolRank(a), boolRank(b))
+	case T_UNIT, T_NEVER:
+		return 0
+	case T_KEY, T_KEY_HASH, T_ADDRESS, T_SIGNATURE, T_CHAIN_ID, T_TX_ROLLUP_L2_ADDRESS:
+		return bytes.Compare(comparableBytes(t, a), comparableBytes(t, b))
+	case T_OPTION:
+		if a.OpCode != b.OpCode {
+			if a.OpCode == D_NONE {
+				return -1
+			}
+			return 1
+		}
+		if a.OpCode == D_NONE {
+			return 0
+		}
+		return compareValues(t.Args[0], a.Args[0], b.Args[0])
+	case T_OR:
+		if a.OpCode != b.OpCode {
+			if a.OpCode == D_LEFT {
+				return -1
+			}
+			return 1
+		}
+		if a.OpCode == D_LEFT {
+			return compareValues(t.Args[0], a.Args[0], b.Args[0])
+		}
+		return compareValues(t.Args[1], a.Args[0], b.Args[0])
+	case T_PAIR:
+		l, r, _ := pairArgs(t)
+		al, ar := pairValueArgs(a)
+		bl, br := pairValueArgs(b)
+		if c := compareValues(l, al, bl); c != 0 {
+			return c
+		}
+		return compareValues(r, ar, br)
+	}
+	return 0
+}
+
+// pairValueArgs splits a pair value into its left element and the remaining
+// right comb.
+func pairValueArgs(v Prim) (Prim, Prim) {
+	if len(v.Args) < 2 {
+		return InvalidPrim, InvalidPrim
+	}
+	if len(v.Args) == 2 {
+		return v.Args[0], v.Args[1]
+	}
+	return v.Args[0], NewCode(D_PAIR, v.Args[1:]...)
+}
+
+func boolRank(p Prim) int {
+	if p.OpCode == D_TRUE {
+		return 1
+	}
+	return 0
+}
+
+func compareInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
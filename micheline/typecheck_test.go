@@ -0,0 +1,209 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestTypecheckScript(t *testing.T) {
+	src, err := os.ReadFile("../examples/tzcompose/hicetnunc/hic-market.tz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := ParseMichelsonCode(string(src))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := code.Typecheck(); err == nil {
+		t.Errorf("expected error on unexpanded macros")
+	}
+	if err := code.ExpandMacros(); err != nil {
+		t.Fatalf("expand error: %v", err)
+	}
+	m, err := code.Typecheck()
+	if err != nil {
+		t.Fatalf("typecheck error: %v", err)
+	}
+	first, ok := m.Find(SectionCode, []int{0})
+	if !ok {
+		t.Fatalf("missing type info for first instruction")
+	}
+	want := Stack{NewPairType(code.Param.Args[0], code.Storage.Args[0])}
+	if !stacksEqual(first.Before, want) {
+		t.Errorf("first instruction stack mismatch: %s", first.Before.Michelson())
+	}
+
+	for _, name := range []string{"fa12_code", "fa2_nft", "fa2_single_asset"} {
+		buf, err := os.ReadFile("../examples/tzcompose/token/" + name + ".json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c Code
+		if err := json.Unmarshal(buf, &c); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Typecheck(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestTypecheckLambda(t *testing.T) {
+	cases := []struct {
+		Arg  string
+		Ret  string
+		Code string
+		Err  bool
+		Path []int
+	}{
+		{Arg: `nat`, Ret: `int`, Code: `{ PUSH int 1 ; ADD }`},
+		{Arg: `nat`, Ret: `nat`, Code: `{ PUSH int 1 ; ADD }`, Err: true},
+		{Arg: `pair nat string`, Ret: `string`, Code: `{ CDR }`},
+		{Arg: `pair nat string bool`, Ret: `bool`, Code: `{ GET 4 }`},
+		{Arg: `pair nat string bool`, Ret: `pair nat string int`, Code: `{ PUSH int 3 ; UPDATE 4 }`},
+		{Arg: `pair nat string bool`, Ret: `bool`, Code: `{ UNPAIR 3 ; DROP 2 }`},
+		{Arg: `unit`, Ret: `pair int nat string`, Code: `{ DROP ; PUSH string "a" ; PUSH nat 1 ; PUSH int 2 ; PAIR 3 }`},
+		{Arg: `option nat`, Ret: `nat`, Code: `{ IF_NONE { PUSH nat 0 } {} }`},
+		{Arg: `option nat`, Ret: `nat`, Code: `{ IF_NONE { PUSH string "none" ; FAILWITH } {} }`},
+		{Arg: `option nat`, Ret: `nat`, Code: `{ IF_NONE { PUSH int 0 } {} }`, Err: true, Path: []int{0}},
+		{Arg: `unit`, Ret: `nat`, Code: `{ FAILWITH ; PUSH nat 1 }`, Err: true, Path: []int{1}},
+		{Arg: `list int`, Ret: `list nat`, Code: `{ MAP { ABS } }`},
+		{Arg: `map string int`, Ret: `map string bool`, Code: `{ MAP { CDR ; GT } }`},
+		{Arg: `list int`, Ret: `int`, Code: `{ PUSH int 0 ; SWAP ; ITER { ADD } }`},
+		{Arg: `int`, Ret: `int`, Code: `{ PUSH bool True ; LOOP { PUSH int 1 ; ADD ; DUP ; GT ; NOT } }`},
+		{Arg: `or nat int`, Ret: `int`, Code: `{ LOOP_LEFT { INT ; RIGHT nat } }`},
+		{Arg: `nat`, Ret: `option (pair nat nat)`, Code: `{ DUP ; EDIV }`},
+		{Arg: `mumav`, Ret: `option mumav`, Code: `{ DUP ; SUB_MUMAV }`},
+		{Arg: `mumav`, Ret: `mumav`, Code: `{ DUP ; SUB }`, Err: true, Path: []int{1}},
+		{Arg: `unit`, Ret: `int`, Code: `{ DROP ; LAMBDA (pair nat int) int { UNPAIR ; ADD } ; PUSH nat 2 ; APPLY ; PUSH int 3 ; EXEC }`},
+		{Arg: `nat`, Ret: `nat`, Code: `{ DIP 2 { DROP } }`, Err: true, Path: []int{0}},
+		{Arg: `int`, Ret: `int`, Code: `{ DUP ; DIP { DROP } }`},
+		{Arg: `ticket nat`, Ret: `ticket nat`, Code: `{ DUP }`, Err: true, Path: []int{0}},
+		{Arg: `ticket nat`, Ret: `pair address nat nat`, Code: `{ READ_TICKET ; DIP { DROP } }`},
+		{Arg: `unit`, Ret: `unit`, Code: `{ DROP ; PUSH (big_map nat nat) {} ; DROP ; UNIT }`, Err: true, Path: []int{1, 0}},
+		{Arg: `unit`, Ret: `unit`, Code: `{ DROP ; PUSH nat -1 ; DROP ; UNIT }`, Err: true, Path: []int{1, 1}},
+		{Arg: `unit`, Ret: `contract unit`, Code: `{ DROP ; SELF }`, Err: true, Path: []int{1}},
+		{Arg: `address`, Ret: `option (contract nat)`, Code: `{ CONTRACT %foo nat }`},
+		{Arg: `unit`, Ret: `unit`, Code: `{ CMPEQ }`, Err: true, Path: []int{0}},
+		{Arg: `unit`, Ret: `bytes`, Code: `{ PACK }`},
+		{Arg: `operation`, Ret: `bytes`, Code: `{ PACK }`, Err: true},
+		{Arg: `pair nat nat`, Ret: `int`, Code: `{ UNPAIR ; COMPARE }`},
+		{Arg: `unit`, Ret: `lambda int int`, Code: `{ DROP ; LAMBDA int int { PUSH string "a" ; ADD } }`, Err: true, Path: []int{1, 2, 1}},
+	}
+	for i, c := range cases {
+		_, err := TypecheckLambda(mustMichelsonType(t, c.Arg), mustMichelsonType(t, c.Ret), MustParseMichelson(c.Code))
+		if c.Err != (err != nil) {
+			t.Errorf("Case %d %s: unexpected result: %v", i, c.Code, err)
+			continue
+		}
+		if c.Path != nil {
+			var e *TypeError
+			if !errors.As(err, &e) {
+				t.Errorf("Case %d: expected TypeError, got %T", i, err)
+				continue
+			}
+			if !pathEqual(e.Path, c.Path) {
+				t.Errorf("Case %d %s: error path mismatch have=%v want=%v (%v)", i, c.Code, e.Path, c.Path, err)
+			}
+		}
+	}
+}
+
+func TestTypecheckValue(t *testing.T) {
+	cases := []struct {
+		Type  string
+		Value string
+		Err   bool
+		Path  []int
+	}{
+		{Type: `nat`, Value: `1`},
+		{Type: `nat`, Value: `-1`, Err: true},
+		{Type: `mumav`, Value: `9223372036854775808`, Err: true},
+		{Type: `string`, Value: `"abc"`},
+		{Type: `timestamp`, Value: `"2024-01-01T00:00:00Z"`},
+		{Type: `timestamp`, Value: `"yesterday"`, Err: true},
+		{Type: `address`, Value: `"KT1Hkg5qeNhfwpKW4fXvq7HGZB9z2EnmCCA9%transfer"`},
+		{Type: `address`, Value: `"KT1Hkg5qeNhfwpKW4fXvq7HGZB9z2EnmCCA8"`, Err: true},
+		{Type: `key_hash`, Value: `"KT1Hkg5qeNhfwpKW4fXvq7HGZB9z2EnmCCA9"`, Err: true},
+		{Type: `pair nat string bool`, Value: `Pair 1 "a" True`},
+		{Type: `pair nat string bool`, Value: `Pair 1 (Pair "a" True)`},
+		{Type: `pair nat string bool`, Value: `{ 1 ; "a" ; True }`},
+		{Type: `pair nat string bool`, Value: `Pair 1 "a" 2`, Err: true, Path: []int{2}},
+		{Type: `option (or nat string)`, Value: `Some (Right 1)`, Err: true, Path: []int{0, 0}},
+		{Type: `set nat`, Value: `{ 1 ; 2 ; 3 }`},
+		{Type: `set nat`, Value: `{ 1 ; 3 ; 2 }`, Err: true, Path: []int{2}},
+		{Type: `map string nat`, Value: `{ Elt "a" 1 ; Elt "b" 2 }`},
+		{Type: `map string nat`, Value: `{ Elt "b" 1 ; Elt "a" 2 }`, Err: true, Path: []int{1}},
+		{Type: `map string nat`, Value: `{ Elt "a" -1 }`, Err: true, Path: []int{0, 1}},
+		{Type: `big_map nat nat`, Value: `42`},
+		{Type: `big_map nat nat`, Value: `{ Elt 1 1 }`},
+		{Type: `big_map nat (big_map nat nat)`, Value: `{}`, Err: true, Path: []int{1}},
+		{Type: `lambda nat nat`, Value: `{ PUSH nat 1 ; ADD }`},
+		{Type: `lambda nat nat`, Value: `{ PUSH int 1 ; ADD }`, Err: true},
+		{Type: `lambda nat nat`, Value: `Lambda_rec { DIP { DROP } }`},
+		{Type: `lambda unit address`, Value: `{ DROP ; SELF_ADDRESS }`},
+		{Type: `lambda unit (contract unit)`, Value: `{ DROP ; SELF }`, Err: true, Path: []int{1}},
+		{Type: `contract nat`, Value: `"KT1Hkg5qeNhfwpKW4fXvq7HGZB9z2EnmCCA9"`},
+		{Type: `ticket string`, Value: `Ticket "KT1Hkg5qeNhfwpKW4fXvq7HGZB9z2EnmCCA9" string "a" 1`},
+		{Type: `ticket string`, Value: `Ticket "KT1Hkg5qeNhfwpKW4fXvq7HGZB9z2EnmCCA9" nat 1 1`, Err: true, Path: []int{1}},
+		{Type: `ticket string`, Value: `Pair "KT1Hkg5qeNhfwpKW4fXvq7HGZB9z2EnmCCA9" "a" 1`},
+		{Type: `sapling_state 8`, Value: `{}`},
+		{Type: `sapling_state 8`, Value: `{ 1 }`, Err: true},
+		{Type: `never`, Value: `Unit`, Err: true},
+	}
+	for i, c := range cases {
+		err := mustMichelsonType(t, c.Type).TypecheckValue(MustParseMichelson(c.Value))
+		if c.Err != (err != nil) {
+			t.Errorf("Case %d %s: unexpected result: %v", i, c.Value, err)
+			continue
+		}
+		if c.Path != nil {
+			var e *TypeError
+			if !errors.As(err, &e) {
+				t.Errorf("Case %d: expected TypeError, got %T", i, err)
+				continue
+			}
+			if !pathEqual(e.Path, c.Path) {
+				t.Errorf("Case %d %s: error path mismatch have=%v want=%v (%v)", i, c.Value, e.Path, c.Path, err)
+			}
+		}
+	}
+}
+
+func TestTypecheckViews(t *testing.T) {
+	cases := []struct {
+		Src string
+		Err bool
+	}{
+		{Src: `parameter nat; storage nat; code { CAR ; NIL operation ; PAIR }; view "get" unit nat { CDR }`},
+		{Src: `parameter nat; storage nat; code { CAR ; NIL operation ; PAIR }; view "get" unit nat { CAR }`, Err: true},
+		{Src: `parameter (or (nat %a) (nat %a)); storage nat; code { CDR ; NIL operation ; PAIR }`, Err: true},
+		{Src: `parameter nat; storage (contract nat); code { CDR ; NIL operation ; PAIR }`, Err: true},
+		{Src: `parameter (or (nat %a) (int %b)); storage unit; code { CDR ; SELF %b ; PUSH mumav 0 ; PUSH int 1 ; TRANSFER_TOKENS ; NIL operation ; SWAP ; CONS ; PAIR }`},
+		{Src: `parameter unit; storage unit; code { CDR ; NIL operation ; PAIR }; view "v" unit unit { CDR ; SELF ; DROP }`, Err: true},
+		{Src: `parameter unit; storage unit; code { CDR ; NIL operation ; PAIR }; view "v" unit unit { CDR } ; view "v" unit unit { CDR }`, Err: true},
+	}
+	for i, c := range cases {
+		code, err := ParseMichelsonCode(c.Src)
+		if err != nil {
+			t.Fatalf("Case %d: parse error: %v", i, err)
+		}
+		if _, err := code.Typecheck(); c.Err != (err != nil) {
+			t.Errorf("Case %d: unexpected result: %v", i, err)
+		}
+	}
+}
+
+func mustMichelsonType(t *testing.T, s string) Type {
+	t.Helper()
+	typ, err := ParseMichelsonType(s)
+	if err != nil {
+		t.Fatalf("parse type %s: %v", s, err)
+	}
+	return typ
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package micheline
+
+import (
+	"fmt"
+	"strings"
+)
+
+// typeAttr is a property that restricts where a type may be used.
+type typeAttr byte
+
+const (
+	attrPassable    typeAttr = iota // contract parameters
+	attrStorable                    // contract storage
+	attrPushable                    // PUSH constants
+	attrPackable                    // PACK, UNPACK and FAILWITH
+	attrBigMapValue                 // big_map values
+	attrDuplicable                  // DUP
+)
+
+func (a typeAttr) String() string {
+	switch a {
+	case attrPassable:
+		return "passable"
+	case attrStorable:
+		return "storable"
+	case attrPushable:
+		return "pushable"
+	case attrPackable:
+		return "packable"
+	case attrBigMapValue:
+		return "allowed as big_map value"
+	case attrDuplicable:
+		return "duplicable"
+	default:
+		return "valid"
+	}
+}
+
+// forbids returns true when type op cannot appear anywhere inside a type
+// with attribute a.
+func (a typeAttr) forbids(op OpCode) bool {
+	switch a {
+	case attrPassable:
+		return op == T_OPERATION
+	case attrStorable:
+		return op == T_OPERATION || op == T_CONTRACT
+	case attrPushable:
+		switch op {
+		case T_OPERATION, T_BIG_MAP, T_CONTRACT, T_TICKET, T_SAPLING_STATE:
+			return true
+		}
+	case attrPackable:
+		switch op {
+		case T_OPERATION, T_BIG_MAP, T_TICKET, T_SAPLING_STATE:
+			return true
+		}
+	case attrBigMapValue:
+		switch op {
+		case T_OPERATION, T_BIG_MAP, T_SAPLING_STATE:
+			return true
+		}
+	case attrDuplicable:
+		return op == T_TICKET
+	}
+	return false
+}
+
+// hasTypeAttr checks whether type t has attribute a. Lambda and contract
+// arguments are opaque and not inspected.
+func hasTypeAttr(t Prim, a typeAttr) bool {
+	if a.forbids(t.OpCode) {
+		return false
+	}
+	switch t.OpCode {
+	case T_LAMBDA:
+		return true
+	case T_CONTRACT:
+		return true
+	}
+	for _, v := range t.Args {
+		if v.Type == PrimInt {
+			continue
+		}
+		if !hasTypeAttr(v, a) {
+			return false
+		}
+	}
+	return true
+}
+
+// isComparableType returns true when values of type t can be compared and
+// used as set elements, map keys or ticket contents.
+func isComparableType(t Prim) bool {
+	switch t.OpCode {
+	case T_UNIT, T_NEVER, T_BOOL, T_INT, T_NAT, T_STRING, T_CHAIN_ID, T_BYTES,
+		T_MUMAV, T_KEY_HASH, T_KEY, T_SIGNATURE, T_TIMESTAMP, T_ADDRESS,
+		T_TX_ROLLUP_L2_ADDRESS:
+		return len(t.Args) == 0
+	case T_OPTION, T_OR, T_PAIR:
+		for _, v := range t.Args {
+			if !isComparableType(v) {
+				return false
+			}
+		}
+		return len(t.Args) > 0
+	default:
+		return false
+	}
+}
+
+// typeArity returns the minimum and maximum number of type arguments.
+func typeArity(op OpCode) (int, int) {
+	switch op {
+	case T_OPTION, T_LIST, T_SET, T_CONTRACT, T_TICKET:
+		return 1, 1
+	case T_MAP, T_BIG_MAP, T_LAMBDA, T_OR:
+		return 2, 2
+	case T_PAIR:
+		return 2, -1
+	case T_SAPLING_STATE, T_SAPLING_TRANSACTION:
+		return 1, 1
+	default:
+		return 0, 0
+	}
+}
+
+// checkType checks that t is a well-formed type. Path is the position of t
+// inside the checked expression.
+func checkType(t Prim, path []int) error {
+	if t.Type == PrimSequence || t.Type == PrimInt || t.Type == PrimString || t.Type == PrimBytes {
+		return newTypeError(path, t, "expected a type")
+	}
+	if !t.OpCode.IsTypeCode() {
+		return newTypeError(path, t, "%s is not a type", t.michelsonName())
+	}
+	lo, hi := typeArity(t.OpCode)
+	if n := len(t.Args); n < lo || (hi >= 0 && n > hi) {
+		return newTypeError(path, t, "type %s expects %d arguments, got %d", t.OpCode, lo, n)
+	}
+	switch t.OpCode {
+	case T_SAPLING_STATE, T_SAPLING_TRANSACTION:
+		if t.Args[0].Type != PrimInt || t.Args[0].Int.Sign() < 0 {
+			return newTypeError(appendPath(path, 0), t.Args[0], "sapling memo size must be a natural number")
+		}
+		return nil
+	}
+	for i, v := range t.Args {
+		if err := checkType(v, appendPath(path, i)); err != nil {
+			return err
+		}
+	}
+	switch t.OpCode {
+	case T_SET, T_TICKET:
+		if !isComparableType(t.Args[0]) {
+			return newTypeError(appendPath(path, 0), t.Args[0], "%s element type must be comparable", t.OpCode)
+		}
+	case T_MAP:
+		if !isComparableType(t.Args[0]) {
+			return newTypeError(appendPath(path, 0), t.Args[0], "map key type must be comparable")
+		}
+	case T_BIG_MAP:
+		if !isComparableType(t.Args[0]) {
+			return newTypeError(appendPath(path, 0), t.Args[0], "big_map key type must be comparable")
+		}
+		if !hasTypeAttr(t.Args[1], attrBigMapValue) {
+			return newTypeError(appendPath(path, 1), t.Args[1], "type is not allowed as big_map value")
+		}
+	}
+	return nil
+}
+
+// checkTypeAttr checks that t is well-formed and has attribute a.
+func checkTypeAttr(t Prim, path []int, a typeAttr) error {
+	if err := checkType(t, path); err != nil {
+		return err
+	}
+	if !hasTypeAttr(t, a) {
+		return newTypeError(path, t, "type %s is not %s", t.Michelson(), a)
+	}
+	return nil
+}
+
+// pairArgs returns the left and right side of a pair type, unfolding n-ary
+// pairs into right combs.
+func pairArgs(t Prim) (Prim, Prim, bool) {
+	if t.OpCode != T_PAIR || t.Type == PrimSequence || len(t.Args) < 2 {
+		return InvalidPrim, InvalidPrim, false
+	}
+	if len(t.Args) == 2 {
+		return t.Args[0], t.Args[1], true
+	}
+	return t.Args[0], NewCode(T_PAIR, t.Args[1:]...), true
+}
+
+// typesEqual compares types structurally. Annotations are ignored and n-ary
+// pairs are equal to their right comb form.
+func typesEqual(a, b Prim) bool {
+	if a.OpCode != b.OpCode || a.Type == PrimSequence || b.Type == PrimSequence {
+		return false
+	}
+	switch a.OpCode {
+	case T_PAIR:
+		al, ar, ok1 := pairArgs(a)
+		bl, br, ok2 := pairArgs(b)
+		return ok1 && ok2 && typesEqual(al, bl) && typesEqual(ar, br)
+	case T_SAPLING_STATE, T_SAPLING_TRANSACTION:
+		return len(a.Args) == 1 && len(b.Args) == 1 &&
+			a.Args[0].Int != nil && b.Args[0].Int != nil &&
+			a.Args[0].Int.Cmp(b.Args[0].Int) == 0
+	}
+	if len(a.Args) != len(b.Args) {
+		return false
+	}
+	for i := range a.Args {
+		if !typesEqual(a.Args[i], b.Args[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// findEntrypointType returns the type of the named entrypoint in parameter
+// type t. The default entrypoint resolves to the root type unless a branch
+// is explicitly annotated %default.
+func findEntrypointType(t Prim, name string) (Prim, bool) {
+	if name == "" {
+		name = "default"
+	}
+	if typ, ok := findFieldType(t, name); ok {
+		return typ, true
+	}
+	if name == "default" {
+		return t, true
+	}
+	return InvalidPrim, false
+}
+
+func findFieldType(t Prim, name string) (Prim, bool) {
+	if fieldAnno(t) == name {
+		return t, true
+	}
+	if t.OpCode != T_OR {
+		return InvalidPrim, false
+	}
+	for _, v := range t.Args {
+		if typ, ok := findFieldType(v, name); ok {
+			return typ, true
+		}
+	}
+	return InvalidPrim, false
+}
+
+// fieldAnno returns the first %-annotation of p without prefix.
+func fieldAnno(p Prim) string {
+	for _, v := range p.Anno {
+		if strings.HasPrefix(v, "%") {
+			return v[1:]
+		}
+	}
+	return ""
+}
+
+// typeName returns a short printable form of type t.
+func typeName(t Prim) string {
+	if !t.IsValid() {
+		return "<invalid>"
+	}
+	return t.CloneNoAnnots().Michelson()
+}
+
+func appendPath(path []int, i ...int) []int {
+	p := make([]int, len(path), len(path)+len(i))
+	copy(p, path)
+	return append(p, i...)
+}
+
+func newTypeError(path []int, p Prim, format string, args ...interface{}) *TypeError {
+	return &TypeError{
+		Path:    path,
+		Prim:    p,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
@@ -0,0 +1,502 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/signer"
+)
+
+// batchOverhead reserves space for branch, signature and a reveal that may be
+// added during completion when estimating the size of an operation group.
+const batchOverhead = 32 + 96 + 128
+
+var (
+	// ErrBatcherClosed is returned for items added after a batcher was closed.
+	ErrBatcherClosed = errors.New("rpc: batcher closed")
+
+	errBatchFailed = errors.New("rpc: batch simulation failed")
+
+	// DefaultBatchOptions are used by NewBatcher when no options are given.
+	DefaultBatchOptions = BatchOptions{
+		MaxItems: 100,
+		MaxWait:  2 * time.Second,
+	}
+)
+
+// BatchOptions controls how a Batcher groups and sends operations.
+type BatchOptions struct {
+	MaxItems int           // max number of operations per group
+	MaxWait  time.Duration // max time an operation waits in queue before its group is sent
+	Call     *CallOptions  // options used for simulating and sending groups
+}
+
+// BatchResult is a future for a single operation added to a Batcher. It
+// completes when the operation group containing the operation has been
+// confirmed or when the operation has failed.
+type BatchResult struct {
+	op     codec.Operation
+	fee    int64 // user-defined fee
+	size   int   // encoded size in bytes
+	single bool  // failed in a group, simulate alone
+	rcpt   *Receipt
+	index  int
+	err    error
+	done   chan struct{}
+}
+
+func newBatchResult(op codec.Operation) *BatchResult {
+	return &BatchResult{
+		op:    op,
+		fee:   op.Limits().Fee,
+		index: -1,
+		done:  make(chan struct{}),
+	}
+}
+
+func (r *BatchResult) finish(rcpt *Receipt, index int, err error) {
+	r.rcpt = rcpt
+	r.index = index
+	r.err = err
+	close(r.done)
+}
+
+// Done returns a channel which is closed when the result is available.
+func (r *BatchResult) Done() <-chan struct{} {
+	return r.done
+}
+
+// Wait blocks until the result is available or ctx is canceled and returns
+// the operation's error.
+func (r *BatchResult) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.done:
+		return r.err
+	}
+}
+
+// Err returns the error of a completed operation. It is nil while the
+// operation is pending.
+func (r *BatchResult) Err() error {
+	select {
+	case <-r.done:
+		return r.err
+	default:
+		return nil
+	}
+}
+
+// Receipt returns the receipt of the operation group which contains the
+// operation or nil when the operation is pending or has failed.
+func (r *BatchResult) Receipt() *Receipt {
+	select {
+	case <-r.done:
+		return r.rcpt
+	default:
+		return nil
+	}
+}
+
+// Index returns the position of the operation inside its group's receipt
+// contents or -1 when the operation is pending or has failed.
+func (r *BatchResult) Index() int {
+	select {
+	case <-r.done:
+		return r.index
+	default:
+		return -1
+	}
+}
+
+// Batcher collects manager operations from many callers and sends them from a
+// single source account in as few operation groups as possible. Groups are
+// limited by MaxItems, the protocol's max operation size and the per-block gas
+// limit. Each group is simulated before sending. Operations which fail
+// simulation are split out and fail individually so that they do not affect
+// other operations in the same group.
+//
+// Groups are signed and broadcast exactly as simulated with limits derived
+// from the simulation. User-defined fees are kept when they exceed the minimum
+// fee. Each group waits until the previous group is confirmed or has failed,
+// because nodes accept one pending manager operation per source.
+type Batcher struct {
+	c       *Client
+	opts    BatchOptions
+	queue   chan *BatchResult
+	wg      sync.WaitGroup
+	mu      sync.RWMutex
+	closed  bool
+	stopped chan struct{}
+	ctx     context.Context
+}
+
+// NewBatcher creates and starts a batcher which sends operations using client c.
+// All requests use ctx, canceling ctx fails all pending operations.
+func NewBatcher(ctx context.Context, c *Client, opts *BatchOptions) *Batcher {
+	if opts == nil {
+		opts = &DefaultBatchOptions
+	}
+	b := &Batcher{
+		c:       c,
+		opts:    *opts,
+		stopped: make(chan struct{}),
+		ctx:     ctx,
+	}
+	if b.opts.MaxItems <= 0 {
+		b.opts.MaxItems = DefaultBatchOptions.MaxItems
+	}
+	if b.opts.MaxWait <= 0 {
+		b.opts.MaxWait = DefaultBatchOptions.MaxWait
+	}
+	if b.opts.Call == nil {
+		b.opts.Call = &DefaultOptions
+	}
+	b.queue = make(chan *BatchResult, b.opts.MaxItems)
+	go b.run()
+	return b
+}
+
+// Add queues a manager operation for sending and returns a future for its
+// result. Source, counter and limits are managed by the batcher. The operation
+// must not be modified until the result is available.
+func (b *Batcher) Add(op codec.Operation) *BatchResult {
+	r := newBatchResult(op)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		r.finish(nil, -1, ErrBatcherClosed)
+		return r
+	}
+	b.queue <- r
+	return r
+}
+
+// Close stops accepting new operations, sends all queued operations and waits
+// until all groups have completed.
+func (b *Batcher) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+	<-b.stopped
+}
+
+func (b *Batcher) run() {
+	defer close(b.stopped)
+	var (
+		pending []*BatchResult
+		timer   *time.Timer
+		timeout <-chan time.Time
+	)
+	stop := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+	}
+	for {
+		select {
+		case r, ok := <-b.queue:
+			if !ok {
+				stop()
+				b.flush(pending)
+				b.wg.Wait()
+				return
+			}
+			pending = append(pending, r)
+			if timer == nil {
+				timer = time.NewTimer(b.opts.MaxWait)
+				timeout = timer.C
+			}
+			if len(pending) >= b.opts.MaxItems {
+				stop()
+				b.flush(pending)
+				pending = nil
+			}
+		case <-timeout:
+			timer, timeout = nil, nil
+			b.flush(pending)
+			pending = nil
+		}
+	}
+}
+
+// flush splits items into groups, simulates and sends them. Failed items are
+// removed and completed with their simulation error.
+func (b *Batcher) flush(items []*BatchResult) {
+	if len(items) == 0 {
+		return
+	}
+	signer := b.c.Signer
+	if b.opts.Call.Signer != nil {
+		signer = b.opts.Call.Signer
+	}
+	addr := b.opts.Call.Sender
+	if !addr.IsValid() {
+		addrs, err := signer.ListAddresses(b.ctx)
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("rpc: no signer address")
+		}
+		if err != nil {
+			failBatch(items, err)
+			return
+		}
+		addr = addrs[0]
+	}
+	key, err := signer.GetKey(b.ctx, addr)
+	if err != nil {
+		failBatch(items, err)
+		return
+	}
+
+	p := b.c.Params
+	for _, r := range items {
+		r.op.WithSource(key.Address())
+		var buf bytes.Buffer
+		if err := r.op.EncodeBuffer(&buf, p); err != nil {
+			r.single = true
+		}
+		r.size = buf.Len()
+	}
+
+	limit := b.opts.MaxItems
+	for len(items) > 0 {
+		if err := b.ctx.Err(); err != nil {
+			failBatch(items, err)
+			return
+		}
+		n := b.pack(items, limit)
+		group := items[:n]
+
+		// wait for the previous group, nodes refuse a second pending
+		// operation from the same source
+		b.wg.Wait()
+
+		op, sim, release, err := b.simulate(group, key)
+		if err == nil && len(failedItems(sim, group)) > 0 {
+			// report the node's error like Send
+			if err = sim.Error(); err == nil {
+				err = errBatchFailed
+			}
+		}
+		if err != nil {
+			release(false)
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				failBatch(items, err)
+				return
+			}
+			if n == 1 {
+				// a single failing operation
+				group[0].finish(nil, -1, err)
+				items = items[1:]
+				limit = b.opts.MaxItems
+				continue
+			}
+			failed := failedItems(sim, group)
+			if len(failed) == 0 {
+				// cannot attribute the error, split the group in half
+				b.c.Log.Debugf("batch: group of %d failed: %v", n, err)
+				limit = (n + 1) / 2
+				continue
+			}
+			// retry failed items alone in case they failed due to default
+			// limits, retry remaining items without failed items
+			retry := make([]*BatchResult, 0, len(items))
+			for i, r := range group {
+				if failed[i] {
+					r.single = true
+					retry = append(retry, r)
+				}
+			}
+			for i, r := range group {
+				if !failed[i] {
+					retry = append(retry, r)
+				}
+			}
+			items = append(retry, items[n:]...)
+			continue
+		}
+		// cut group at the per-block gas limit and simulate the smaller
+		// group again, so that the sent operation matches its simulation
+		if m := b.fit(sim, group); m < n {
+			release(false)
+			limit = m
+			continue
+		}
+		limit = b.opts.MaxItems
+		items = items[n:]
+		b.send(group, op, sim, release, signer, addr)
+	}
+}
+
+// pack returns the number of leading items that fit into a group.
+func (b *Batcher) pack(items []*BatchResult, limit int) int {
+	if items[0].single {
+		return 1
+	}
+	size := batchOverhead
+	for i, r := range items {
+		if i >= limit || r.single || size+r.size > b.c.Params.MaxOperationDataLength {
+			if i == 0 {
+				return 1
+			}
+			return i
+		}
+		size += r.size
+	}
+	return len(items)
+}
+
+// fit returns the number of leading items in a simulated group that fit into
+// per-operation and per-block gas limits.
+func (b *Batcher) fit(sim *Receipt, group []*BatchResult) int {
+	p := b.c.Params
+	costs := sim.Costs()
+	ofs := len(costs) - len(group)
+	var total int64
+	for i := 0; i < ofs; i++ {
+		total += costs[i].GasUsed + b.opts.Call.ExtraGasMargin
+	}
+	for i := range group {
+		gas := costs[ofs+i].GasUsed + b.opts.Call.ExtraGasMargin
+		if gas > p.HardGasLimitPerOperation {
+			gas = p.HardGasLimitPerOperation
+		}
+		if i > 0 && total+gas > p.HardGasLimitPerBlock {
+			return i
+		}
+		total += gas
+	}
+	return len(group)
+}
+
+// limits applies simulated costs as limits to op. User-defined fees are kept
+// when they exceed the minimum fee.
+func (b *Batcher) limits(op *codec.Op, sim *Receipt, group []*BatchResult) {
+	p := b.c.Params
+	margin := b.opts.Call.ExtraGasMargin
+	lims := sim.MinLimits()
+	ofs := len(lims) - len(group)
+	for i := range lims {
+		if lims[i].GasLimit+margin > p.HardGasLimitPerOperation {
+			lims[i].GasLimit = p.HardGasLimitPerOperation - margin
+		}
+		if i >= ofs {
+			lims[i].Fee = group[i-ofs].fee
+		}
+	}
+	op.WithLimits(lims, margin)
+}
+
+// simulate completes and simulates a group of operations. Gas and storage
+// limits are shared between all operations in the group. Counters are
+// reserved when the client has a CounterManager. The returned release
+// function must be called with the final outcome of the group.
+func (b *Batcher) simulate(group []*BatchResult, key mavryk.Key) (*codec.Op, *Receipt, func(bool), error) {
+	p := b.c.Params
+	n := int64(len(group))
+	gas := p.HardGasLimitPerBlock / n
+	if gas > p.HardGasLimitPerOperation {
+		gas = p.HardGasLimitPerOperation
+	}
+	op := codec.NewOp().WithParams(p).WithTTL(b.opts.Call.TTL)
+	for _, r := range group {
+		r.op.WithCounter(0)
+		r.op.WithLimits(mavryk.Limits{
+			Fee:          r.fee,
+			GasLimit:     gas,
+			StorageLimit: p.HardStorageLimitPerOperation / n,
+		})
+		op.WithContents(r.op)
+	}
+	op.WithSource(key.Address())
+	release := func(bool) {}
+	if err := b.c.Complete(b.ctx, op, key); err != nil {
+		return nil, nil, release, err
+	}
+	if b.c.Counters != nil {
+		r, err := b.c.Counters.Reserve(b.ctx, key.Address(), op)
+		if err != nil {
+			return nil, nil, release, err
+		}
+		release = r
+	}
+	sim, err := b.c.Simulate(b.ctx, op, b.opts.Call)
+	return op, sim, release, err
+}
+
+// send signs and broadcasts a simulated group in the background and completes
+// all its items.
+func (b *Batcher) send(group []*BatchResult, op *codec.Op, sim *Receipt, release func(bool), signer signer.Signer, addr mavryk.Address) {
+	b.limits(op, sim, group)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.c.Log.Debugf("batch: sending group of %d operations", len(group))
+		var rcpt *Receipt
+		res, sent, err := b.c.signAndBroadcast(b.ctx, op, signer, addr, b.opts.Call)
+		if err == nil {
+			rcpt, err = waitReceipt(b.ctx, res)
+		}
+		release(!reuseCounters(sent, err))
+		for _, r := range group {
+			if err != nil {
+				r.finish(nil, -1, err)
+				continue
+			}
+			idx := -1
+			for i, v := range op.Contents {
+				if v == r.op {
+					idx = i
+					break
+				}
+			}
+			r.finish(rcpt, idx, nil)
+		}
+	}()
+}
+
+// failedItems returns a map of group positions whose simulation has failed.
+func failedItems(sim *Receipt, group []*BatchResult) map[int]bool {
+	if sim == nil || sim.Op == nil {
+		return nil
+	}
+	ofs := len(sim.Op.Contents) - len(group)
+	if ofs < 0 {
+		return nil
+	}
+	failed := make(map[int]bool)
+	for i := range group {
+		v := sim.Op.Contents[ofs+i]
+		if v.Result().Status == mavryk.OpStatusFailed {
+			failed[i] = true
+			continue
+		}
+		for _, vv := range v.Meta().InternalResults {
+			if vv.Result.Status == mavryk.OpStatusFailed {
+				failed[i] = true
+				break
+			}
+		}
+	}
+	return failed
+}
+
+func failBatch(items []*BatchResult, err error) {
+	for _, r := range items {
+		r.finish(nil, -1, err)
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/micheline"
+	"github.com/mavryk-network/gomavryk/rpc"
+	"github.com/mavryk-network/gomavryk/rpc/mocknode"
+	"github.com/mavryk-network/gomavryk/rpc/rpctest"
+	"github.com/mavryk-network/gomavryk/signer"
+)
+
+// batchNode records simulated and injected operations of a mock node and
+// fails simulations of transfers with amount badAmount.
+type batchNode struct {
+	sync.Mutex
+	chain     *rpctest.Fake
+	simulated []*codec.Op
+	injected  []*codec.Op
+}
+
+const badAmount = 13
+
+func (n *batchNode) handler(node *mocknode.Node) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(buf))
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/simulate_operation"):
+			req := struct {
+				Operation *codec.Op `json:"operation"`
+			}{Operation: &codec.Op{Params: n.chain.Params}}
+			if err := json.Unmarshal(buf, &req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			n.Lock()
+			n.simulated = append(n.simulated, req.Operation)
+			n.Unlock()
+			for _, v := range req.Operation.Contents {
+				if tx, ok := v.(*codec.Transaction); ok && tx.Amount.Int64() == badAmount {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusInternalServerError)
+					io.WriteString(w, `[{"kind":"temporary","id":"proto.alpha.contract.balance_too_low"}]`)
+					return
+				}
+			}
+		case strings.HasSuffix(r.URL.Path, "/injection/operation"):
+			var s string
+			_ = json.Unmarshal(buf, &s)
+			raw, _ := hex.DecodeString(s)
+			if op, err := codec.DecodeOp(raw); err == nil {
+				n.Lock()
+				n.injected = append(n.injected, op)
+				n.Unlock()
+			}
+		}
+		node.ServeHTTP(w, r)
+	})
+}
+
+func newBatchTest(t *testing.T) (*batchNode, *rpc.Client) {
+	t.Helper()
+	ctx := context.Background()
+	chain := rpctest.NewFake(nil)
+	chain.SetAccount(testKey.Address(), rpctest.Account{
+		Balance: 1_000_000_000,
+		Counter: 10,
+		Key:     testKey.Public(),
+	})
+	bn := &batchNode{chain: chain}
+	node := mocknode.New(chain)
+	ts := httptest.NewServer(bn.handler(node))
+	t.Cleanup(ts.Close)
+	t.Cleanup(node.Close)
+	c, err := rpc.NewClient(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	if err := c.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.Signer = signer.NewFromKey(testKey)
+
+	// include broadcast operations
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				if mem, _ := chain.GetMempool(ctx); len(mem.Applied) > 0 {
+					chain.Bake()
+				}
+			}
+		}
+	}()
+	t.Cleanup(func() { close(stop) })
+	return bn, c
+}
+
+func TestBatcherSend(t *testing.T) {
+	ctx := context.Background()
+	bn, c := newBatchTest(t)
+	opts := rpc.DefaultOptions
+	opts.Confirmations = 1
+	b := rpc.NewBatcher(ctx, c, &rpc.BatchOptions{
+		MaxItems: 10,
+		MaxWait:  time.Hour,
+		Call:     &opts,
+	})
+
+	ops := []*codec.Transaction{
+		{Amount: mavryk.N(1), Destination: testDest},
+		{Amount: mavryk.N(2), Destination: testDest},
+		{Amount: mavryk.N(badAmount), Destination: testDest},
+	}
+	ops[1].Fee = 50_000
+	res := make([]*rpc.BatchResult, len(ops))
+	for i, op := range ops {
+		res[i] = b.Add(op)
+	}
+	b.Close()
+
+	for i, r := range res[:2] {
+		if err := r.Wait(ctx); err != nil {
+			t.Fatalf("op %d: %v", i, err)
+		}
+		if r.Index() != i || r.Receipt() == nil {
+			t.Errorf("op %d: mismatched index %d", i, r.Index())
+		}
+	}
+	if err := res[2].Wait(ctx); err == nil {
+		t.Errorf("expected simulation error for failing operation")
+	}
+
+	bn.Lock()
+	defer bn.Unlock()
+
+	// the node fails the full group with an error list that cannot be
+	// attributed, the first two items are sent, the last fails alone
+	if len(bn.simulated) != 3 {
+		t.Fatalf("mismatched simulations got=%d want=%d", len(bn.simulated), 3)
+	}
+	if len(bn.injected) != 1 {
+		t.Fatalf("mismatched injections got=%d want=%d", len(bn.injected), 1)
+	}
+	sim, inj := bn.simulated[1], bn.injected[0]
+	if len(inj.Contents) != 2 || !inj.Branch.Equal(sim.Branch) {
+		t.Fatalf("injected operation differs from simulation")
+	}
+	if got, want := opCounters(inj), opCounters(sim); got != want || got != "11,12" {
+		t.Errorf("mismatched counters got=%s want=%s", got, want)
+	}
+	for i, v := range inj.Contents {
+		l, s := v.Limits(), sim.Contents[i].Limits()
+		if l.GasLimit <= 0 || l.GasLimit >= s.GasLimit {
+			t.Errorf("op %d: gas limit %d not derived from simulation", i, l.GasLimit)
+		}
+		if l.Fee <= 0 {
+			t.Errorf("op %d: missing fee", i)
+		}
+	}
+	if fee := inj.Contents[1].Limits().Fee; fee != 50_000 {
+		t.Errorf("mismatched user fee got=%d want=%d", fee, 50_000)
+	}
+}
+
+func TestBatcherCounterManager(t *testing.T) {
+	ctx := context.Background()
+	bn, c := newBatchTest(t)
+	c.Counters = rpc.NewCounterManager()
+	opts := rpc.DefaultOptions
+	opts.Confirmations = 1
+	b := rpc.NewBatcher(ctx, c, &rpc.BatchOptions{
+		MaxItems: 2,
+		MaxWait:  time.Hour,
+		Call:     &opts,
+	})
+	var res []*rpc.BatchResult
+	for i := 0; i < 4; i++ {
+		res = append(res, b.Add(&codec.Transaction{Amount: mavryk.N(int64(i + 1)), Destination: testDest}))
+	}
+	b.Close()
+	for i, r := range res {
+		if err := r.Wait(ctx); err != nil {
+			t.Fatalf("op %d: %v", i, err)
+		}
+	}
+
+	bn.Lock()
+	defer bn.Unlock()
+	if len(bn.simulated) != 2 || len(bn.injected) != 2 {
+		t.Fatalf("mismatched requests simulated=%d injected=%d", len(bn.simulated), len(bn.injected))
+	}
+	var sims, injs []string
+	for i := range bn.simulated {
+		sims = append(sims, opCounters(bn.simulated[i]))
+		injs = append(injs, opCounters(bn.injected[i]))
+	}
+	if got, want := strings.Join(injs, "|"), "11,12|13,14"; got != want {
+		t.Errorf("mismatched injected counters got=%s want=%s", got, want)
+	}
+	if got, want := strings.Join(sims, "|"), strings.Join(injs, "|"); got != want {
+		t.Errorf("mismatched simulated counters got=%s want=%s", got, want)
+	}
+	if acc, _ := bn.chain.Account(testKey.Address()); acc.Counter != 14 {
+		t.Errorf("mismatched chain counter got=%d want=%d", acc.Counter, 14)
+	}
+}
+
+func TestBatcherSequentialGroups(t *testing.T) {
+	ctx := context.Background()
+	bn, c := newBatchTest(t)
+	opts := rpc.DefaultOptions
+	opts.Confirmations = 1
+	bopts := rpc.DefaultBatchOptions
+	bopts.MaxItems = 2
+	bopts.MaxWait = time.Hour
+	bopts.Call = &opts
+	b := rpc.NewBatcher(ctx, c, &bopts)
+	var res []*rpc.BatchResult
+	for i := 0; i < 6; i++ {
+		res = append(res, b.Add(&codec.Transaction{Amount: mavryk.N(int64(i + 1)), Destination: testDest}))
+	}
+	b.Close()
+	for i, r := range res {
+		if err := r.Wait(ctx); err != nil {
+			t.Fatalf("op %d: %v", i, err)
+		}
+	}
+
+	// without a counter manager groups are sent after the previous group
+	// was included
+	bn.Lock()
+	defer bn.Unlock()
+	var injs []string
+	for _, op := range bn.injected {
+		injs = append(injs, opCounters(op))
+	}
+	if got, want := strings.Join(injs, "|"), "11,12|13,14|15,16"; got != want {
+		t.Errorf("mismatched injected counters got=%s want=%s", got, want)
+	}
+	if acc, _ := bn.chain.Account(testKey.Address()); acc.Counter != 16 {
+		t.Errorf("mismatched chain counter got=%d want=%d", acc.Counter, 16)
+	}
+}
+
+func TestBatcherFailedItems(t *testing.T) {
+	ctx := context.Background()
+	bn, c := newBatchTest(t)
+	code, err := micheline.ParseMichelsonCode(`parameter unit; storage unit; code { DROP ; PUSH string "no" ; FAILWITH }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kt1 := mavryk.NewAddress(mavryk.AddressTypeContract, make([]byte, 20))
+	bn.chain.SetAccount(kt1, rpctest.Account{
+		Script: &micheline.Script{Code: code, Storage: micheline.NewCode(micheline.D_UNIT)},
+	})
+	opts := rpc.DefaultOptions
+	opts.Confirmations = 1
+	b := rpc.NewBatcher(ctx, c, &rpc.BatchOptions{
+		MaxItems: 10,
+		MaxWait:  time.Hour,
+		Call:     &opts,
+	})
+	res := []*rpc.BatchResult{
+		b.Add(&codec.Transaction{Amount: mavryk.N(1), Destination: testDest}),
+		b.Add(&codec.Transaction{
+			Destination: kt1,
+			Parameters:  &micheline.Parameters{Entrypoint: "default", Value: micheline.NewCode(micheline.D_UNIT)},
+		}),
+		b.Add(&codec.Transaction{Amount: mavryk.N(2), Destination: testDest}),
+	}
+	b.Close()
+
+	// the failing call gets the node's error from its failed receipt
+	var gerr rpc.GenericError
+	if err := res[1].Wait(ctx); !errors.As(err, &gerr) || gerr.ID != "proto.rpctest.michelson_v1.script_rejected" {
+		t.Errorf("mismatched error got=%v", err)
+	}
+	for _, i := range []int{0, 2} {
+		if err := res[i].Wait(ctx); err != nil {
+			t.Fatalf("op %d: %v", i, err)
+		}
+	}
+
+	// the failed item is attributed from the group receipt, simulated alone
+	// and the remaining items are sent together
+	bn.Lock()
+	defer bn.Unlock()
+	if len(bn.simulated) != 3 || len(bn.simulated[1].Contents) != 1 {
+		t.Fatalf("mismatched simulations got=%d", len(bn.simulated))
+	}
+	if len(bn.injected) != 1 {
+		t.Fatalf("mismatched injections got=%d want=%d", len(bn.injected), 1)
+	}
+	if got := opCounters(bn.injected[0]); got != "11,12" {
+		t.Errorf("mismatched counters got=%s want=11,12", got)
+	}
+}
@@ -50,6 +50,10 @@ type Client struct {
 	MempoolObserver *Observer
 	// A default signer used for transaction sending
 	Signer signer.Signer
+	// Optional counter manager used to send concurrent operations from the
+	// same sender one after another, set to NewCounterManager() to enable.
+	// Without it Send always uses on-chain counters.
+	Counters *CounterManager
 	// MetadataMode defines the metadata reconstruction mode used for fetching
 	// block and operation receipts. Set this mode to `always` if an RPC node prunes
 	// metadata (i.e. you see metadata too large in certain operations)
@@ -59,6 +63,8 @@ type Client struct {
 	CloseConns bool
 	// Log is the logger implementation used by this client
 	Log log.Logger
+	// optional endpoint pool, see NewPoolClient
+	pool *Pool
 }
 
 // NewClient returns a new Mavryk RPC client.
@@ -114,7 +120,7 @@ func (c *Client) Client() *http.Client {
 }
 
 func (c *Client) Listen() {
-	// start observers
+	// start observers, the mempool stream opens on the first subscription
 	c.BlockObserver.Listen(c)
 	c.MempoolObserver.ListenMempool(c)
 }
@@ -122,6 +128,15 @@ func (c *Client) Listen() {
 func (c *Client) Close() {
 	c.BlockObserver.Close()
 	c.MempoolObserver.Close()
+	if c.pool != nil {
+		c.pool.Close()
+	}
+}
+
+// Pool returns the endpoint pool used by clients created with NewPoolClient
+// or nil otherwise.
+func (c *Client) Pool() *Pool {
+	return c.pool
 }
 
 func (c *Client) ResolveChainConfig(ctx context.Context) error {
@@ -0,0 +1,205 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+// CounterManager hands out manager operation counters for concurrent
+// operations from the same source. Nodes accept one pending manager operation
+// per source, so Reserve waits until the previous reservation for the same
+// source has been released, i.e. until its operation is included or has
+// failed, and then assigns counters following it.
+//
+// Operations are completed against on-chain state first, which may be outdated
+// once Reserve returns. Reserve moves their counters past counters of earlier
+// injected operations and drops reveals already sent in an earlier operation,
+// so that simulation and signing use the same counters. Counters of operations
+// which were never injected or which the node has finally refused are handed
+// out again.
+//
+// Counters of injected operations are never handed out again, even when
+// waiting for their inclusion failed, because the node may still include them.
+// They are kept until the on-chain counter reaches them or until the
+// operation's TTL has passed at minimal block delay. While such an operation is
+// pending, nodes refuse the next operation from the same source.
+type CounterManager struct {
+	mu       sync.Mutex
+	accounts map[mavryk.Address]*accountCounter
+}
+
+type accountCounter struct {
+	mu        sync.Mutex
+	busy      chan struct{} // closed on release of the reservation in flight, nil when idle
+	injected  int64         // last counter of injected operations which may still be included
+	revealing bool          // an injected operation reveals the key
+	expires   time.Time     // time after which injected operations are assumed expired
+}
+
+// counterRange is the first and last counter of a reservation.
+type counterRange struct {
+	first, last int64
+}
+
+func NewCounterManager() *CounterManager {
+	return &CounterManager{
+		accounts: make(map[mavryk.Address]*accountCounter),
+	}
+}
+
+func (m *CounterManager) account(addr mavryk.Address) *accountCounter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	acc, ok := m.accounts[addr]
+	if !ok {
+		acc = &accountCounter{}
+		m.accounts[addr] = acc
+	}
+	return acc
+}
+
+// InFlight returns the number of unreleased reservations for addr, which is
+// at most one.
+func (m *CounterManager) InFlight(addr mavryk.Address) int {
+	acc := m.account(addr)
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+	if acc.busy != nil {
+		return 1
+	}
+	return 0
+}
+
+// Reserve assigns counters to all manager operations in o which has already been
+// completed with on-chain counters. It waits until the previous reservation for
+// addr has been released or ctx is canceled. The returned function must be
+// called exactly once, with false only when the operation was never injected
+// or the node has finally refused it.
+func (m *CounterManager) Reserve(ctx context.Context, addr mavryk.Address, o *codec.Op) (func(ok bool), error) {
+	acc := m.account(addr)
+	acc.mu.Lock()
+	for acc.busy != nil {
+		busy := acc.busy
+		acc.mu.Unlock()
+		select {
+		case <-busy:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		acc.mu.Lock()
+	}
+	defer acc.mu.Unlock()
+	acc.busy = make(chan struct{})
+
+	acc.settle(firstCounter(o))
+	if acc.injected > 0 {
+		// drop a reveal added during completion when an earlier operation
+		// already reveals the key
+		if acc.revealing && len(o.Contents) > 1 && o.Contents[0].Kind() == mavryk.OpTypeReveal {
+			o.Contents = o.Contents[1:]
+		}
+
+		// continue after injected counters unless the chain is already ahead
+		next := acc.injected + 1
+		if first := firstCounter(o); first > next {
+			next = first
+		}
+		for _, op := range o.Contents {
+			// skip non-manager ops
+			if op.GetCounter() < 0 {
+				continue
+			}
+			op.WithCounter(next)
+			next++
+		}
+	}
+
+	reveal := len(o.Contents) > 0 && o.Contents[0].Kind() == mavryk.OpTypeReveal
+	r := counterRange{first: firstCounter(o)}
+	for _, op := range o.Contents {
+		if c := op.GetCounter(); c > r.last {
+			r.last = c
+		}
+	}
+
+	// injected operations may be included until their TTL has passed
+	p := o.Params
+	if p == nil {
+		p = mavryk.DefaultParams
+	}
+	ttl := o.TTL
+	if ttl <= 0 {
+		ttl = p.MaxOperationsTTL
+	}
+	expires := time.Now().Add(time.Duration(ttl) * p.MinimalBlockDelay)
+
+	var once sync.Once
+	return func(ok bool) {
+		once.Do(func() {
+			m.release(acc, r, reveal, ok, expires)
+		})
+	}, nil
+}
+
+func (m *CounterManager) release(acc *accountCounter, r counterRange, reveal, ok bool, expires time.Time) {
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+	if ok && r.last > 0 {
+		// keep counters of injected operations
+		if r.last > acc.injected {
+			acc.injected = r.last
+		}
+		if reveal {
+			acc.revealing = true
+		}
+		if expires.After(acc.expires) {
+			acc.expires = expires
+		}
+	}
+	close(acc.busy)
+	acc.busy = nil
+}
+
+// settle forgets injected counters once the on-chain counter has reached them,
+// i.e. the next on-chain counter first is beyond them, or when the injected
+// operations have expired.
+func (acc *accountCounter) settle(first int64) {
+	if acc.injected == 0 {
+		return
+	}
+	if first <= acc.injected && time.Now().Before(acc.expires) {
+		return
+	}
+	acc.injected = 0
+	acc.expires = time.Time{}
+	acc.revealing = false
+}
+
+// reuseCounters reports whether the counters of an operation may be handed
+// out again after sending it failed with err. This is only the case when the
+// operation was never sent to the node, the node rejected the injection or
+// has finally refused the operation later.
+func reuseCounters(sent bool, err error) bool {
+	if !sent {
+		return true
+	}
+	var merr *MempoolError
+	return errors.As(err, &merr) && merr.Status.IsFinal()
+}
+
+func firstCounter(o *codec.Op) int64 {
+	for _, op := range o.Contents {
+		if c := op.GetCounter(); c > 0 {
+			return c
+		}
+	}
+	return 0
+}
@@ -0,0 +1,408 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc_test
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/rpc"
+	"github.com/mavryk-network/gomavryk/rpc/mocknode"
+	"github.com/mavryk-network/gomavryk/rpc/rpctest"
+	"github.com/mavryk-network/gomavryk/signer"
+)
+
+var (
+	testKey  = mavryk.MustParsePrivateKey("edsk4FTF78Qf1m2rykGpHqostAiq5gYW4YZEoGUSWBTJr2njsDHSnd")
+	testDest = mavryk.MustParseAddress("mv1949pcbqwGsHfUCaVmNVRu21Cd4SnbpvpP")
+)
+
+// testCounterOp returns a transfer batch from the test key with on-chain
+// counters starting after counter and an optional reveal.
+func testCounterOp(counter int64, n int, reveal bool) *codec.Op {
+	op := codec.NewOp().WithSource(testKey.Address())
+	if reveal {
+		op.WithContents(&codec.Reveal{
+			Manager:   codec.Manager{Source: testKey.Address()},
+			PublicKey: testKey.Public(),
+		})
+	}
+	for i := 0; i < n; i++ {
+		op.WithTransfer(testDest, 1)
+	}
+	for _, v := range op.Contents {
+		counter++
+		v.WithCounter(counter)
+	}
+	return op
+}
+
+func opCounters(op *codec.Op) string {
+	var s []string
+	for _, v := range op.Contents {
+		s = append(s, fmt.Sprint(v.GetCounter()))
+	}
+	return strings.Join(s, ",")
+}
+
+// reserve reserves counters for op and fails the test on error.
+func reserve(t *testing.T, m *rpc.CounterManager, op *codec.Op) func(bool) {
+	t.Helper()
+	release, err := m.Reserve(context.Background(), testKey.Address(), op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return release
+}
+
+func TestCounterReserve(t *testing.T) {
+	m := rpc.NewCounterManager()
+	addr := testKey.Address()
+
+	// the first operation keeps on-chain counters
+	a := testCounterOp(10, 2, false)
+	releaseA := reserve(t, m, a)
+	if n := m.InFlight(addr); n != 1 {
+		t.Errorf("mismatched in flight got=%d want=%d", n, 1)
+	}
+
+	// later operations wait for the operation in flight
+	b := testCounterOp(10, 1, false)
+	done := make(chan func(bool))
+	go func() {
+		done <- reserve(t, m, b)
+	}()
+	select {
+	case <-done:
+		t.Fatal("reserved while another operation is in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// and continue after its counters once it was injected
+	releaseA(true)
+	releaseA(true) // repeated release is ignored
+	releaseB := <-done
+	if got := opCounters(b); got != "13" {
+		t.Errorf("mismatched counters got=%s want=13", got)
+	}
+
+	// waiting fails when ctx is canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.Reserve(ctx, addr, testCounterOp(10, 1, false)); err != context.DeadlineExceeded {
+		t.Errorf("mismatched error got=%v want=%v", err, context.DeadlineExceeded)
+	}
+	releaseB(true)
+
+	// the chain is ahead of injected counters
+	c := testCounterOp(20, 1, false)
+	releaseC := reserve(t, m, c)
+	if got := opCounters(c); got != "21" {
+		t.Errorf("chain ahead: mismatched counters got=%s want=21", got)
+	}
+	releaseC(true)
+
+	// the chain includes all injected operations
+	d := testCounterOp(21, 1, false)
+	releaseD := reserve(t, m, d)
+	if got := opCounters(d); got != "22" {
+		t.Errorf("included: mismatched counters got=%s want=22", got)
+	}
+	releaseD(false)
+	if n := m.InFlight(addr); n != 0 {
+		t.Errorf("mismatched in flight got=%d want=%d", n, 0)
+	}
+}
+
+func TestCounterFailure(t *testing.T) {
+	m := rpc.NewCounterManager()
+
+	// operations which were never injected return their counters
+	a := testCounterOp(10, 2, false)
+	reserve(t, m, a)(false)
+	b := testCounterOp(10, 1, false)
+	releaseB := reserve(t, m, b)
+	if got := opCounters(b); got != "11" {
+		t.Errorf("failed: mismatched counters got=%s want=11", got)
+	}
+
+	// failed operations after an injected operation continue after it
+	releaseB(true)
+	reserve(t, m, testCounterOp(10, 1, false))(false)
+	c := testCounterOp(10, 1, false)
+	defer reserve(t, m, c)(true)
+	if got := opCounters(c); got != "12" {
+		t.Errorf("failed after injected: mismatched counters got=%s want=12", got)
+	}
+}
+
+func TestCounterInjected(t *testing.T) {
+	m := rpc.NewCounterManager()
+
+	// waiting for an injected operation failed, the node may still include
+	// it, so its counter is not handed out again
+	reserve(t, m, testCounterOp(10, 1, false))(true) // 11
+	b := testCounterOp(10, 1, false)
+	releaseB := reserve(t, m, b)
+	if got := opCounters(b); got != "12" {
+		t.Errorf("injected: mismatched counters got=%s want=12", got)
+	}
+
+	// the node refused the next operation because the injected operation
+	// is still pending, its counter is handed out again
+	releaseB(false)
+	c := testCounterOp(10, 1, false)
+	releaseC := reserve(t, m, c)
+	if got := opCounters(c); got != "12" {
+		t.Errorf("refused after injected: mismatched counters got=%s want=12", got)
+	}
+	releaseC(false)
+
+	// the chain includes the injected operation
+	d := testCounterOp(11, 1, false)
+	defer reserve(t, m, d)(true)
+	if got := opCounters(d); got != "12" {
+		t.Errorf("included: mismatched counters got=%s want=12", got)
+	}
+
+	// expired injected operations are forgotten
+	m2 := rpc.NewCounterManager()
+	op := testCounterOp(10, 1, false)
+	op.Params = &mavryk.Params{MaxOperationsTTL: 2, MinimalBlockDelay: time.Millisecond}
+	op.TTL = 1
+	reserve(t, m2, op)(true)
+	time.Sleep(5 * time.Millisecond)
+	e := testCounterOp(10, 1, false)
+	defer reserve(t, m2, e)(true)
+	if got := opCounters(e); got != "11" {
+		t.Errorf("expired: mismatched counters got=%s want=11", got)
+	}
+}
+
+func TestCounterReveal(t *testing.T) {
+	m := rpc.NewCounterManager()
+	reserve(t, m, testCounterOp(0, 1, true))(true)
+
+	// a reveal sent earlier is not repeated
+	b := testCounterOp(0, 1, true)
+	releaseB := reserve(t, m, b)
+	if len(b.Contents) != 1 || b.Contents[0].Kind() != mavryk.OpTypeTransaction || opCounters(b) != "3" {
+		t.Errorf("mismatched contents %d %s", len(b.Contents), opCounters(b))
+	}
+	releaseB(true)
+
+	// the reveal failed, the next operation reveals again
+	m2 := rpc.NewCounterManager()
+	reserve(t, m2, testCounterOp(0, 1, true))(false)
+	c := testCounterOp(0, 1, true)
+	defer reserve(t, m2, c)(true)
+	if len(c.Contents) != 2 || c.Contents[0].Kind() != mavryk.OpTypeReveal || opCounters(c) != "1,2" {
+		t.Errorf("expected reveal after failed reveal, got %d ops %s", len(c.Contents), opCounters(c))
+	}
+}
+
+func TestCounterSend(t *testing.T) {
+	ctx := context.Background()
+	chain := rpctest.NewFake(nil)
+	chain.SetAccount(testKey.Address(), rpctest.Account{
+		Balance: 1_000_000_000,
+		Counter: 10,
+		Key:     testKey.Public(),
+	})
+	node := mocknode.New(chain)
+
+	// record counters of simulated and injected operations
+	var (
+		mu        sync.Mutex
+		simulated []string
+		injected  []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/simulate_operation"):
+			buf, _ := io.ReadAll(r.Body)
+			req := struct {
+				Operation *codec.Op `json:"operation"`
+			}{Operation: &codec.Op{Params: chain.Params}}
+			if err := json.Unmarshal(buf, &req); err == nil {
+				mu.Lock()
+				simulated = append(simulated, opCounters(req.Operation))
+				mu.Unlock()
+			}
+			r.Body = io.NopCloser(strings.NewReader(string(buf)))
+		case strings.HasSuffix(r.URL.Path, "/injection/operation"):
+			buf, _ := io.ReadAll(r.Body)
+			var s string
+			_ = json.Unmarshal(buf, &s)
+			raw, _ := hex.DecodeString(s)
+			if op, err := codec.DecodeOp(raw); err == nil {
+				mu.Lock()
+				injected = append(injected, opCounters(op))
+				mu.Unlock()
+			}
+			r.Body = io.NopCloser(strings.NewReader(string(buf)))
+		}
+		node.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	defer node.Close()
+
+	c, err := rpc.NewClient(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Counters != nil {
+		t.Fatal("counter manager must be opt-in")
+	}
+	if err := c.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.Counters = rpc.NewCounterManager()
+	opts := rpc.DefaultOptions
+	opts.Confirmations = 1
+	opts.Signer = signer.NewFromKey(testKey)
+
+	// send two operations concurrently, the second waits for inclusion of
+	// the first because a node accepts one pending operation per source
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.Send(ctx, codec.NewOp().WithTransfer(testDest, 1), &opts)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		waitFor(t, func() bool {
+			mem, _ := chain.GetMempool(ctx)
+			return len(mem.Applied) == 1
+		})
+		chain.Bake()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := strings.Join(injected, "|"), "11|12"; got != want {
+		t.Errorf("mismatched injected counters got=%s want=%s", got, want)
+	}
+	if got, want := strings.Join(simulated, "|"), strings.Join(injected, "|"); got != want {
+		t.Errorf("mismatched simulated counters got=%s want=%s", got, want)
+	}
+	if acc, _ := chain.Account(testKey.Address()); acc.Counter != 12 {
+		t.Errorf("mismatched chain counter got=%d want=%d", acc.Counter, 12)
+	}
+}
+
+func TestCounterSendTimeout(t *testing.T) {
+	ctx := context.Background()
+	chain := rpctest.NewFake(nil)
+	chain.SetAccount(testKey.Address(), rpctest.Account{
+		Balance: 1_000_000_000,
+		Counter: 10,
+		Key:     testKey.Public(),
+	})
+	node := mocknode.New(chain)
+	ts := httptest.NewServer(node)
+	defer ts.Close()
+	defer node.Close()
+	c, err := rpc.NewClient(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.Counters = rpc.NewCounterManager()
+	opts := rpc.DefaultOptions
+	opts.Confirmations = 1
+	opts.Signer = signer.NewFromKey(testKey)
+
+	// keep a block subscription, so the observer fetches block operations
+	// even when the block is baked before Send subscribes to its operation
+	c.Listen()
+	c.BlockObserver.Subscribe(mavryk.ZeroOpHash, func(*rpc.BlockHeaderLogEntry, int64, int, int, bool) bool {
+		return false
+	})
+
+	// waiting for the first operation fails after injection
+	tctx, cancel := context.WithCancel(ctx)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Send(tctx, codec.NewOp().WithTransfer(testDest, 1), &opts)
+		errs <- err
+	}()
+	waitFor(t, func() bool {
+		mem, _ := chain.GetMempool(ctx)
+		return len(mem.Applied) == 1
+	})
+	cancel()
+	if err := <-errs; err == nil {
+		t.Fatal("expected error after cancel")
+	}
+
+	// the next operation must not reuse its counter, the node refuses it
+	// while the first operation is pending
+	if _, err := c.Send(ctx, codec.NewOp().WithTransfer(testDest, 1), &opts); err == nil || !strings.Contains(err.Error(), "operation_rejected") {
+		t.Fatalf("mismatched error got=%v want=operation_rejected", err)
+	}
+
+	// the refused operation's counter is used once the first is included
+	chain.Bake()
+	go func() {
+		_, err := c.Send(ctx, codec.NewOp().WithTransfer(testDest, 1), &opts)
+		errs <- err
+	}()
+	waitFor(t, func() bool {
+		select {
+		case err := <-errs:
+			t.Fatal(err)
+		default:
+		}
+		mem, _ := chain.GetMempool(ctx)
+		return len(mem.Applied) == 1
+	})
+	mem, _ := chain.GetMempool(ctx)
+	if got := mem.Applied[0].Contents[0].(*rpc.Transaction).Counter; got != 12 {
+		t.Errorf("mismatched counter got=%d want=%d", got, 12)
+	}
+	chain.Bake()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if acc, _ := chain.Account(testKey.Address()); acc.Counter != 12 {
+		t.Errorf("mismatched chain counter got=%d want=%d", acc.Counter, 12)
+	}
+}
+
+func waitFor(t *testing.T, fn func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
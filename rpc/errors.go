@@ -6,6 +6,7 @@ package rpc
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/mavryk-network/gomavryk/micheline"
 )
@@ -17,12 +18,16 @@ const (
 	ErrorKindTemporary = "temporary"
 	// ErrorKindBranch Mavryk RPC error kind.
 	ErrorKindBranch = "branch"
+	// ErrorKindOutdated Mavryk RPC error kind.
+	ErrorKindOutdated = "outdated"
 )
 
 func ErrorStatus(err error) int {
 	switch e := err.(type) {
 	case *httpError:
 		return e.statusCode
+	case HTTPStatus:
+		return e.StatusCode()
 	default:
 		return 0
 	}
@@ -37,9 +42,10 @@ type Error interface {
 
 // GenericError is a basic error type
 type GenericError struct {
-	ID   string         `json:"id"`
-	Kind string         `json:"kind"`
-	With micheline.Prim `json:"with"`
+	ID       string         `json:"id"`
+	Kind     string         `json:"kind"`
+	With     micheline.Prim `json:"with"`
+	Location *int           `json:"location,omitempty"` // script errors only
 }
 
 func (e GenericError) Error() string {
@@ -172,6 +178,70 @@ func (e *rpcError) Errors() []Error {
 	return e.errors
 }
 
+// ScriptError is returned by typed script RPCs like RunScript when the node
+// rejects a script run. Location is the canonical Micheline location of the
+// failing instruction or -1 when unknown. For FAILWITH With holds the
+// rejected value, otherwise With is invalid.
+type ScriptError struct {
+	RPCError
+	Location int
+	With     micheline.Prim
+}
+
+func (e *ScriptError) Error() string {
+	var b strings.Builder
+	b.WriteString("rpc: script error")
+	if e.Location >= 0 {
+		fmt.Fprintf(&b, " at location %d", e.Location)
+	}
+	if e.With.IsValid() {
+		b.WriteString(" with ")
+		b.WriteString(e.With.Dump())
+	}
+	if id := e.ErrorID(); id != "" {
+		b.WriteString(": ")
+		b.WriteString(id)
+	}
+	return b.String()
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.RPCError
+}
+
+// IsFailwith returns true when the script failed with FAILWITH.
+func (e *ScriptError) IsFailwith() bool {
+	return e.With.IsValid()
+}
+
+// scriptError converts node errors from Michelson execution into a
+// *ScriptError and returns other errors unchanged.
+func scriptError(err error) error {
+	rerr, ok := err.(RPCError)
+	if !ok {
+		return err
+	}
+	serr := &ScriptError{RPCError: rerr, Location: -1}
+	var found bool
+	for _, v := range rerr.Errors() {
+		g, ok := v.(*GenericError)
+		if !ok || !strings.Contains(g.ID, "michelson_v1") {
+			continue
+		}
+		found = true
+		if g.Location != nil {
+			serr.Location = *g.Location
+		}
+		if strings.HasSuffix(g.ID, "script_rejected") && g.With.IsValid() {
+			serr.With = g.With
+		}
+	}
+	if !found {
+		return err
+	}
+	return serr
+}
+
 type plainError struct {
 	*httpError
 	msg string
@@ -185,4 +255,5 @@ var (
 	_ Error    = &GenericError{}
 	_ Error    = Errors{}
 	_ RPCError = &rpcError{}
+	_ RPCError = &ScriptError{}
 )
@@ -76,3 +76,67 @@ func (m *Mempool) UnmarshalJSON(data []byte) error {
 	}
 	return nil
 }
+
+// MempoolStatus is the classification a node assigns to an operation in its
+// mempool.
+type MempoolStatus byte
+
+const (
+	MempoolStatusInvalid MempoolStatus = iota
+	MempoolStatusValidated
+	MempoolStatusBranchDelayed
+	MempoolStatusBranchRefused
+	MempoolStatusOutdated
+	MempoolStatusRefused
+)
+
+var mempoolStatusNames = []string{
+	"",
+	"validated",
+	"branch_delayed",
+	"branch_refused",
+	"outdated",
+	"refused",
+}
+
+func (s MempoolStatus) IsValid() bool {
+	return s != MempoolStatusInvalid
+}
+
+func (s MempoolStatus) String() string {
+	if int(s) < len(mempoolStatusNames) {
+		return mempoolStatusNames[s]
+	}
+	return ""
+}
+
+// IsFinal returns true when the node will never include the operation again.
+// Branch refused and branch delayed operations may still become valid after
+// a reorg or when their branch is attached.
+func (s MempoolStatus) IsFinal() bool {
+	return s == MempoolStatusRefused || s == MempoolStatusOutdated
+}
+
+// MempoolStatusFromErrors derives the mempool classification from the error
+// trace the node attaches to an operation. Mempool classes directly map to
+// error kinds and the most severe kind wins.
+func MempoolStatusFromErrors(errs []OperationError) MempoolStatus {
+	status := MempoolStatusValidated
+	for _, v := range errs {
+		var s MempoolStatus
+		switch v.Kind {
+		case ErrorKindPermanent:
+			s = MempoolStatusRefused
+		case ErrorKindOutdated:
+			s = MempoolStatusOutdated
+		case ErrorKindBranch:
+			s = MempoolStatusBranchRefused
+		default:
+			s = MempoolStatusBranchDelayed
+		}
+		if s > status {
+			status = s
+		}
+	}
+	return status
+}
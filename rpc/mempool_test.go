@@ -0,0 +1,238 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/rpc"
+	"github.com/mavryk-network/gomavryk/rpc/mocknode"
+	"github.com/mavryk-network/gomavryk/rpc/rpctest"
+	"github.com/mavryk-network/gomavryk/signer"
+)
+
+// opError decodes a node error, errors keep their raw JSON for encoding.
+func opError(kind, id string) rpc.OperationError {
+	var e rpc.OperationError
+	if err := json.Unmarshal([]byte(`{"kind":"`+kind+`","id":"`+id+`"}`), &e); err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// mempoolOp returns an empty signed operation with hash oh as streamed by the
+// mempool monitor.
+func mempoolOp(oh mavryk.OpHash) *rpc.Operation {
+	return &rpc.Operation{
+		Hash:      oh,
+		Contents:  rpc.OperationList{},
+		Signature: mavryk.ZeroSignature,
+	}
+}
+
+func TestMempoolStatusFromErrors(t *testing.T) {
+	for _, v := range []struct {
+		errs []rpc.OperationError
+		want rpc.MempoolStatus
+	}{
+		{nil, rpc.MempoolStatusValidated},
+		{[]rpc.OperationError{opError(rpc.ErrorKindTemporary, "x")}, rpc.MempoolStatusBranchDelayed},
+		{[]rpc.OperationError{opError(rpc.ErrorKindBranch, "x")}, rpc.MempoolStatusBranchRefused},
+		{[]rpc.OperationError{opError(rpc.ErrorKindOutdated, "x")}, rpc.MempoolStatusOutdated},
+		{[]rpc.OperationError{opError(rpc.ErrorKindPermanent, "x")}, rpc.MempoolStatusRefused},
+		// the most severe kind wins regardless of order
+		{[]rpc.OperationError{
+			opError(rpc.ErrorKindPermanent, "x"),
+			opError(rpc.ErrorKindBranch, "y"),
+		}, rpc.MempoolStatusRefused},
+		{[]rpc.OperationError{
+			opError(rpc.ErrorKindTemporary, "x"),
+			opError(rpc.ErrorKindOutdated, "y"),
+		}, rpc.MempoolStatusOutdated},
+	} {
+		if got := rpc.MempoolStatusFromErrors(v.errs); got != v.want {
+			t.Errorf("%v: mismatched status got=%s want=%s", v.errs, got, v.want)
+		}
+	}
+	if rpc.MempoolStatusBranchRefused.IsFinal() || !rpc.MempoolStatusOutdated.IsFinal() {
+		t.Errorf("mismatched final status")
+	}
+}
+
+// mempoolTest is a mock node which counts open and opened mempool streams.
+type mempoolTest struct {
+	chain   *rpctest.Fake
+	node    *mocknode.Node
+	client  *rpc.Client
+	obs     *rpc.Observer
+	streams atomic.Int32
+	opened  atomic.Int32
+}
+
+func newMempoolTest(t *testing.T) *mempoolTest {
+	t.Helper()
+	mt := &mempoolTest{chain: rpctest.NewFake(nil)}
+	mt.node = mocknode.New(mt.chain)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/monitor_operations") {
+			mt.opened.Add(1)
+			mt.streams.Add(1)
+			defer mt.streams.Add(-1)
+		}
+		mt.node.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	t.Cleanup(mt.node.Close)
+	c, err := rpc.NewClient(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	mt.client = c
+	mt.obs = rpc.NewObserver()
+	t.Cleanup(mt.obs.Close)
+	mt.obs.ListenMempool(c)
+	return mt
+}
+
+func TestSubscribeMempool(t *testing.T) {
+	mt := newMempoolTest(t)
+	valid, refused := testOpHash(1), testOpHash(2)
+	mt.chain.AddMempool(mempoolOp(valid))
+	op := mempoolOp(refused)
+	op.Errors = []rpc.OperationError{opError(rpc.ErrorKindPermanent, "proto.alpha.counter_in_the_past")}
+	mt.chain.AddMempool(op)
+
+	// no stream is opened without subscriptions
+	time.Sleep(20 * time.Millisecond)
+	if n := mt.streams.Load(); n != 0 {
+		t.Fatalf("mismatched streams before subscribing got=%d want=%d", n, 0)
+	}
+
+	events := make(chan rpc.MempoolStatus, 4)
+	id := mt.obs.SubscribeMempool(valid, func(_ mavryk.OpHash, status rpc.MempoolStatus, _ []rpc.OperationError) bool {
+		events <- status
+		return false
+	})
+	waitFor(t, func() bool { return mt.streams.Load() == 1 })
+	select {
+	case status := <-events:
+		if status != rpc.MempoolStatusValidated {
+			t.Errorf("mismatched status got=%s want=%s", status, rpc.MempoolStatusValidated)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for mempool callback")
+	}
+
+	// results fail when the node refuses the operation
+	res := rpc.NewResult(refused)
+	res.ListenMempool(mt.obs)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !res.WaitContext(ctx) {
+		t.Fatal("timeout waiting for result")
+	}
+	var merr *rpc.MempoolError
+	if !errors.As(res.Err(), &merr) {
+		t.Fatalf("expected mempool error, got %v", res.Err())
+	}
+	if merr.Status != rpc.MempoolStatusRefused || merr.ErrorID() != "proto.alpha.counter_in_the_past" || !merr.Hash.Equal(refused) {
+		t.Errorf("mismatched mempool error %v", merr)
+	}
+
+	// known classifications are reported on subscribe
+	res = rpc.NewResult(refused)
+	res.ListenMempool(mt.obs)
+	select {
+	case <-res.Done():
+	default:
+		t.Fatal("expected direct match of refused operation")
+	}
+	if !errors.As(res.Err(), &merr) {
+		t.Errorf("expected mempool error, got %v", res.Err())
+	}
+
+	// the stream closes with the last subscription
+	mt.obs.Unsubscribe(id)
+	waitFor(t, func() bool { return mt.streams.Load() == 0 })
+
+	// and opens again with a new one
+	id = mt.obs.SubscribeMempool(testOpHash(3), func(mavryk.OpHash, rpc.MempoolStatus, []rpc.OperationError) bool {
+		return false
+	})
+	waitFor(t, func() bool { return mt.streams.Load() == 1 })
+	mt.obs.Unsubscribe(id)
+	waitFor(t, func() bool { return mt.streams.Load() == 0 })
+}
+
+func TestListenMempoolBeforeListen(t *testing.T) {
+	mt := newMempoolTest(t)
+	mt.obs.Listen(mt.client)
+
+	// results listening to one observer for mempool and blocks are confirmed
+	oh := testOpHash(1)
+	res := rpc.NewResult(oh).WithConfirmations(1)
+	res.Listen(mt.obs)
+	res.ListenMempool(mt.obs)
+	mt.chain.AddMempool(mempoolOp(oh))
+	mt.chain.Bake()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !res.WaitContext(ctx) {
+		t.Fatal("timeout waiting for result")
+	}
+	if err := res.Err(); err != nil {
+		t.Errorf("unexpected result error: %v", err)
+	}
+}
+
+func TestSendMempoolStream(t *testing.T) {
+	ctx := context.Background()
+	mt := newMempoolTest(t)
+	mt.chain.SetAccount(testKey.Address(), rpctest.Account{
+		Balance: 1_000_000_000,
+		Counter: 10,
+		Key:     testKey.Public(),
+	})
+	c := mt.client
+	if err := c.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// listening clients keep no mempool stream open
+	c.Listen()
+	time.Sleep(20 * time.Millisecond)
+	if n := mt.opened.Load(); n != 0 {
+		t.Fatalf("mismatched streams after listen got=%d want=%d", n, 0)
+	}
+
+	// send watches the mempool until the operation is confirmed
+	opts := rpc.DefaultOptions
+	opts.Confirmations = 1
+	opts.Signer = signer.NewFromKey(testKey)
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Send(ctx, codec.NewOp().WithTransfer(testDest, 1), &opts)
+		done <- err
+	}()
+	waitFor(t, func() bool {
+		mem, _ := mt.chain.GetMempool(ctx)
+		return len(mem.Applied) == 1 && mt.streams.Load() == 1
+	})
+	mt.chain.Bake()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return mt.streams.Load() == 0 })
+}
@@ -0,0 +1,589 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+// Package mocknode implements an in-process Mavryk node for integration
+// tests. It serves the subset of node RPC endpoints used by this library from
+// an in-memory chain and produces blocks on a timer which include injected
+// operations. This allows to exercise rpc.Client.Send, observers, result
+// confirmations and mvcompose runs end-to-end without network access.
+package mocknode
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/micheline"
+	"github.com/mavryk-network/gomavryk/rpc"
+	"github.com/mavryk-network/gomavryk/rpc/rpctest"
+)
+
+// Node is a http.Handler which serves node RPC endpoints from an in-memory
+// chain. Supported are
+//
+//   - version, chain id, bootstrap status
+//   - blocks, headers, metadata, hashes and operations
+//   - protocol constants
+//   - contracts, balances, counters, manager keys, delegates, scripts,
+//     storage, entrypoints and big_map values, raw contract context
+//   - operation simulation, forging and injection
+//   - mempool contents and mempool and head monitors
+//
+// Other endpoints return 404 Not Found.
+type Node struct {
+	Chain *rpctest.Fake // chain state, use it to fund accounts and bake blocks
+
+	mu   sync.Mutex
+	subs map[chan *rpc.Operation]struct{}
+	quit chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// New returns a node serving chain. It creates an empty chain with default
+// params when chain is nil.
+func New(chain *rpctest.Fake) *Node {
+	if chain == nil {
+		chain = rpctest.NewFake(nil)
+	}
+	return &Node{
+		Chain: chain,
+		subs:  make(map[chan *rpc.Operation]struct{}),
+		quit:  make(chan struct{}),
+	}
+}
+
+// Run bakes a new block every d until the node is closed.
+func (n *Node) Run(d time.Duration) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-n.quit:
+				return
+			case <-ticker.C:
+				n.Chain.Bake()
+			}
+		}
+	}()
+}
+
+// Close stops block production and terminates open monitor streams.
+func (n *Node) Close() {
+	n.once.Do(func() {
+		close(n.quit)
+	})
+	n.wg.Wait()
+}
+
+// ServeHTTP implements http.Handler.
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case match(path, "version"):
+		n.serveVersion(w)
+	case match(path, "chains", "main", "chain_id"):
+		writeJSON(w, n.Chain.Params.ChainId)
+	case match(path, "chains", "main", "is_bootstrapped"):
+		writeJSON(w, rpc.Status{Bootstrapped: true, SyncState: "synced"})
+	case match(path, "chains", "main", "mempool", "pending_operations"):
+		mem, _ := n.Chain.GetMempool(r.Context())
+		writeJSON(w, mem)
+	case match(path, "chains", "main", "mempool", "monitor_operations"):
+		n.serveMempoolMonitor(w, r)
+	case match(path, "monitor", "heads", "main"):
+		n.serveHeadMonitor(w, r)
+	case match(path, "injection", "operation") && r.Method == http.MethodPost:
+		n.serveInjection(w, r)
+	case len(path) >= 4 && match(path[:3], "chains", "main", "blocks"):
+		n.serveBlock(w, r, blockID(path[3]), path[4:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (n *Node) serveVersion(w http.ResponseWriter) {
+	var v rpc.VersionInfo
+	v.NodeVersion.Major = 19
+	v.NetworkVersion.ChainName = n.Chain.Params.Network
+	writeJSON(w, v)
+}
+
+func (n *Node) serveBlock(w http.ResponseWriter, r *http.Request, id blockID, path []string) {
+	ctx := r.Context()
+	b, err := n.Chain.BlockByID(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	switch {
+	case len(path) == 0:
+		writeJSON(w, b)
+	case match(path, "header"):
+		writeJSON(w, b.Header)
+	case match(path, "metadata"):
+		writeJSON(w, b.Metadata)
+	case match(path, "hash"):
+		writeJSON(w, b.Hash)
+	case path[0] == "operations":
+		n.serveOperations(w, r, b, path[1:], false)
+	case path[0] == "operation_hashes":
+		n.serveOperations(w, r, b, path[1:], true)
+	case match(path, "context", "constants"):
+		writeJSON(w, constants(n.Chain.Params))
+	case len(path) >= 3 && match(path[:2], "context", "contracts"):
+		addr, err := mavryk.ParseAddress(path[2])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.serveContract(w, r, addr, path[3:])
+	case len(path) == 6 && match(path[:5], "context", "raw", "json", "contracts", "index"):
+		addr, err := mavryk.ParseAddress(path[5])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		info, err := n.Chain.GetContractExt(ctx, addr, id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, info)
+	case len(path) == 4 && match(path[:2], "context", "big_maps"):
+		bigmap, err := strconv.ParseInt(path[2], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hash, err := mavryk.ParseExprHash(path[3])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v, err := n.Chain.GetBigmapValue(ctx, bigmap, hash, id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, v)
+	case match(path, "helpers", "scripts", "simulate_operation"),
+		match(path, "helpers", "scripts", "run_operation"):
+		n.serveSimulation(w, r)
+	case match(path, "helpers", "forge", "operations"):
+		n.serveForge(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveOperations serves operations and operation hashes of block b by
+// validation list and list position.
+func (n *Node) serveOperations(w http.ResponseWriter, r *http.Request, b *rpc.Block, path []string, hashes bool) {
+	pos := make([]int, len(path))
+	for i, v := range path {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 0 || i > 1 {
+			http.NotFound(w, r)
+			return
+		}
+		pos[i] = p
+	}
+	value := func(op *rpc.Operation) any {
+		if hashes {
+			return op.Hash
+		}
+		return op
+	}
+	list := func(ops []*rpc.Operation) []any {
+		vals := make([]any, len(ops))
+		for i, op := range ops {
+			vals[i] = value(op)
+		}
+		return vals
+	}
+	switch len(pos) {
+	case 0:
+		all := make([][]any, len(b.Operations))
+		for i, ops := range b.Operations {
+			all[i] = list(ops)
+		}
+		writeJSON(w, all)
+	case 1:
+		if pos[0] >= len(b.Operations) {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, list(b.Operations[pos[0]]))
+	case 2:
+		if pos[0] >= len(b.Operations) || pos[1] >= len(b.Operations[pos[0]]) {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, value(b.Operations[pos[0]][pos[1]]))
+	}
+}
+
+// serveContract serves contract state. Contract state is only tracked at
+// the chain head, so all block ids return head state.
+func (n *Node) serveContract(w http.ResponseWriter, r *http.Request, addr mavryk.Address, path []string) {
+	acc, ok := n.Chain.Account(addr)
+	if !ok {
+		writeError(w, rpctest.ErrNotFound)
+		return
+	}
+	switch {
+	case len(path) == 0:
+		info, _ := n.Chain.GetContractExt(r.Context(), addr, rpc.Head)
+		writeJSON(w, struct {
+			*rpc.ContractInfo
+			Script *micheline.Script `json:"script,omitempty"`
+		}{info, acc.Script})
+	case match(path, "balance"):
+		writeJSON(w, strconv.FormatInt(acc.Balance, 10))
+	case match(path, "counter"):
+		writeJSON(w, strconv.FormatInt(acc.Counter, 10))
+	case match(path, "manager_key"):
+		if !acc.Key.IsValid() {
+			writeJSON(w, nil)
+			return
+		}
+		writeJSON(w, acc.Key)
+	case match(path, "delegate"):
+		if !acc.Delegate.IsValid() {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, acc.Delegate)
+	case acc.Script == nil:
+		http.NotFound(w, r)
+	case match(path, "script"), match(path, "script", "normalized"):
+		writeJSON(w, acc.Script)
+	case match(path, "storage"), match(path, "storage", "normalized"):
+		writeJSON(w, acc.Script.Storage)
+	case match(path, "entrypoints"):
+		eps, err := acc.Script.Entrypoints(false)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		types := make(map[string]micheline.Prim, len(eps))
+		for name, ep := range eps {
+			types[name] = ep.Type().Prim
+		}
+		writeJSON(w, map[string]any{"entrypoints": types})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveSimulation replies with the simulated operation like a node. Failing
+// operations are reported in their results with failed status, errors are
+// only returned when the operation cannot be simulated at all.
+func (n *Node) serveSimulation(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Operation *codec.Op `json:"operation"`
+	}{
+		Operation: &codec.Op{Params: n.Chain.Params},
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rcpt, err := n.Chain.Simulate(r.Context(), req.Operation, nil)
+	if rcpt == nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, rcpt.Op)
+}
+
+func (n *Node) serveForge(w http.ResponseWriter, r *http.Request) {
+	o := &codec.Op{Params: n.Chain.Params}
+	if err := json.NewDecoder(r.Body).Decode(o); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, hex.EncodeToString(o.Bytes()))
+}
+
+func (n *Node) serveInjection(w http.ResponseWriter, r *http.Request) {
+	var body string
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buf, err := hex.DecodeString(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hash, err := n.Chain.BroadcastOperation(r.Context(), buf)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// notify mempool monitors
+	mem, _ := n.Chain.GetMempool(r.Context())
+	for _, op := range mem.Applied {
+		if op.Hash.Equal(hash) {
+			n.publish(op)
+			break
+		}
+	}
+	writeJSON(w, hash)
+}
+
+// serveHeadMonitor streams the current head and all new heads until the
+// client disconnects or the node is closed.
+func (n *Node) serveHeadMonitor(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	mon := rpc.NewBlockHeaderMonitor()
+	defer mon.Close()
+	if err := n.Chain.MonitorBlockHeader(ctx, mon); err != nil {
+		writeError(w, err)
+		return
+	}
+	go func() {
+		select {
+		case <-n.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	s := newStream(w)
+	if err := s.send(n.Chain.Head().LogEntry()); err != nil {
+		return
+	}
+	for {
+		head, err := mon.Recv(ctx)
+		if err != nil {
+			return
+		}
+		if err := s.send(head); err != nil {
+			return
+		}
+	}
+}
+
+// serveMempoolMonitor streams mempool operations like a node does: the
+// stream starts with all pending operations, continues with newly injected
+// operations and ends when a new block is produced.
+func (n *Node) serveMempoolMonitor(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	mon := rpc.NewBlockHeaderMonitor()
+	defer mon.Close()
+	if err := n.Chain.MonitorBlockHeader(ctx, mon); err != nil {
+		writeError(w, err)
+		return
+	}
+	ops := make(chan *rpc.Operation, 64)
+	n.mu.Lock()
+	n.subs[ops] = struct{}{}
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.subs, ops)
+		n.mu.Unlock()
+	}()
+	go func() {
+		// the stream ends on the next head
+		mon.Recv(ctx)
+		cancel()
+	}()
+	s := newStream(w)
+	mem, _ := n.Chain.GetMempool(ctx)
+	if err := s.send(mem.Applied); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.quit:
+			return
+		case op := <-ops:
+			if err := s.send([]*rpc.Operation{op}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (n *Node) publish(op *rpc.Operation) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.subs {
+		select {
+		case ch <- op:
+		default:
+		}
+	}
+}
+
+// stream writes JSON values to a chunked HTTP response.
+type stream struct {
+	w   http.ResponseWriter
+	enc *json.Encoder
+}
+
+func newStream(w http.ResponseWriter) *stream {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	return &stream{w: w, enc: json.NewEncoder(w)}
+}
+
+func (s *stream) send(v any) error {
+	if err := s.enc.Encode(v); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// blockID is a block identifier as used in RPC paths.
+type blockID string
+
+func (b blockID) String() string {
+	return string(b)
+}
+
+func (b blockID) Int64() int64 {
+	if n, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+		return n
+	}
+	return -1
+}
+
+func match(path []string, elems ...string) bool {
+	if len(path) != len(elems) {
+		return false
+	}
+	for i, v := range elems {
+		if path[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// nodeError is the JSON representation of node errors.
+type nodeError struct {
+	Kind     string          `json:"kind"`
+	ID       string          `json:"id"`
+	Msg      string          `json:"msg,omitempty"`
+	With     *micheline.Prim `json:"with,omitempty"`
+	Location *int            `json:"location,omitempty"`
+}
+
+// writeError translates errors into node error responses. Missing state
+// returns 404 Not Found like a node, script failures and rejected
+// operations return a node error list. Simulations report failures in their
+// receipts instead.
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, rpctest.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	e := nodeError{
+		Kind: "permanent",
+		ID:   "mocknode.operation_rejected",
+		Msg:  err.Error(),
+	}
+	var rerr *micheline.RuntimeError
+	if errors.As(err, &rerr) {
+		e.Kind = "temporary"
+		e.ID = "proto.mocknode.michelson_v1.runtime_error"
+		if rerr.IsFailwith() {
+			e.ID = "proto.mocknode.michelson_v1.script_rejected"
+			e.With = &rerr.Value
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode([]nodeError{e})
+}
+
+// constants returns protocol constants for params p.
+func constants(p *mavryk.Params) rpc.Constants {
+	return rpc.Constants{
+		BlocksPerCycle:               p.BlocksPerCycle,
+		BlocksPerStakeSnapshot:       p.BlocksPerSnapshot,
+		ConsensusRightsDelay:         p.ConsensusRightsDelay,
+		HardGasLimitPerOperation:     p.HardGasLimitPerOperation,
+		HardGasLimitPerBlock:         p.HardGasLimitPerBlock,
+		OriginationSize:              p.OriginationSize,
+		CostPerByte:                  p.CostPerByte,
+		HardStorageLimitPerOperation: p.HardStorageLimitPerOperation,
+		MaxOperationDataLength:       p.MaxOperationDataLength,
+		MaxOperationsTimeToLive:      p.MaxOperationsTTL,
+		MinimalBlockDelay:            int(p.MinimalBlockDelay / time.Second),
+	}
+}
+
+// Server is a mock node listening on a local HTTP test server.
+type Server struct {
+	*httptest.Server
+	Node *Node
+}
+
+// NewServer starts a mock node for chain on a local test server. When
+// blockTime is positive a new block is produced at this interval. Otherwise
+// blocks are only produced by calling Chain.Bake. The chain defaults to an
+// empty chain with default params when nil.
+func NewServer(chain *rpctest.Fake, blockTime time.Duration) *Server {
+	n := New(chain)
+	if blockTime > 0 {
+		n.Run(blockTime)
+	}
+	return &Server{
+		Server: httptest.NewServer(n),
+		Node:   n,
+	}
+}
+
+// Chain returns the chain served by the node.
+func (s *Server) Chain() *rpctest.Fake {
+	return s.Node.Chain
+}
+
+// NewClient returns an initialized RPC client connected to the server.
+func (s *Server) NewClient(ctx context.Context) (*rpc.Client, error) {
+	c, err := rpc.NewClient(s.URL, s.Server.Client())
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Init(ctx); err != nil {
+		return nil, fmt.Errorf("mocknode: %w", err)
+	}
+	return c, nil
+}
+
+// Close stops block production, terminates open streams and shuts down the
+// server.
+func (s *Server) Close() {
+	s.Node.Close()
+	s.Server.Close()
+}
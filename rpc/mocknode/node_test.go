@@ -0,0 +1,161 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package mocknode_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/micheline"
+	"github.com/mavryk-network/gomavryk/rpc"
+	"github.com/mavryk-network/gomavryk/rpc/mocknode"
+	"github.com/mavryk-network/gomavryk/rpc/rpctest"
+	"github.com/mavryk-network/gomavryk/signer"
+)
+
+var (
+	testKey  = mavryk.MustParsePrivateKey("edsk4FTF78Qf1m2rykGpHqostAiq5gYW4YZEoGUSWBTJr2njsDHSnd")
+	testDest = mavryk.NewAddress(mavryk.AddressTypeEd25519, make([]byte, 20))
+)
+
+// newTestNode starts a node which bakes blocks every d and returns an
+// initialized client connected to it.
+func newTestNode(t *testing.T, d time.Duration) (*mocknode.Node, *rpc.Client) {
+	t.Helper()
+	node := mocknode.New(nil)
+	node.Chain.SetAccount(testKey.Address(), rpctest.Account{
+		Balance: 1_000_000_000,
+		Key:     testKey.Public(),
+	})
+	ts := httptest.NewServer(node)
+	t.Cleanup(ts.Close)
+	t.Cleanup(node.Close)
+	node.Run(d)
+	c, err := rpc.NewClient(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	if err := c.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return node, c
+}
+
+func TestSend(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	node, c := newTestNode(t, 20*time.Millisecond)
+	if !c.ChainId.Equal(node.Chain.Params.ChainId) {
+		t.Errorf("mismatched chain id got=%s want=%s", c.ChainId, node.Chain.Params.ChainId)
+	}
+
+	opts := rpc.DefaultOptions
+	opts.Confirmations = 1
+	opts.Signer = signer.NewFromKey(testKey)
+	rcpt, err := c.Send(ctx, codec.NewOp().WithTransfer(testDest, 1_000_000), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rcpt.IsSuccess() {
+		t.Fatalf("operation failed: %v", rcpt.Error())
+	}
+	if rcpt.Height <= 0 || rcpt.List != 3 {
+		t.Errorf("mismatched receipt position height=%d list=%d", rcpt.Height, rcpt.List)
+	}
+	if costs := rcpt.TotalCosts(); costs.Fee <= 0 || costs.GasUsed <= 0 || costs.AllocationBurn <= 0 {
+		t.Errorf("mismatched costs %+v", costs)
+	}
+
+	// chain state is visible through the client
+	bal, err := c.GetContractBalance(ctx, testDest, rpc.Head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bal.Int64() != 1_000_000 {
+		t.Errorf("mismatched balance got=%d want=%d", bal.Int64(), 1_000_000)
+	}
+	ops, err := c.GetBlockOperations(ctx, rpc.BlockLevel(rcpt.Height))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops[3]) != 1 || !ops[3][0].Hash.Equal(rcpt.Op.Hash) {
+		t.Errorf("operation missing from block %d", rcpt.Height)
+	}
+}
+
+func TestSimulateFailed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	node, c := newTestNode(t, time.Hour)
+	code, err := micheline.ParseMichelsonCode(`parameter unit; storage unit; code { DROP ; PUSH string "no" ; FAILWITH }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kt1 := mavryk.NewAddress(mavryk.AddressTypeContract, make([]byte, 20))
+	node.Chain.SetAccount(kt1, rpctest.Account{
+		Script: &micheline.Script{Code: code, Storage: micheline.NewCode(micheline.D_UNIT)},
+	})
+	op := codec.NewOp().
+		WithSource(testKey.Address()).
+		WithCall(kt1, micheline.Parameters{Entrypoint: "default", Value: micheline.NewCode(micheline.D_UNIT)})
+	if err := c.Complete(ctx, op, testKey.Public()); err != nil {
+		t.Fatal(err)
+	}
+
+	// like a node the simulation succeeds with a failed operation result
+	rcpt, err := c.Simulate(ctx, op, nil)
+	if rcpt == nil {
+		t.Fatalf("expected receipt, got %v", err)
+	}
+	if rcpt.IsSuccess() || rcpt.Op.Contents[0].Result().Status != mavryk.OpStatusFailed {
+		t.Fatalf("expected failed result")
+	}
+	var gerr rpc.GenericError
+	if !errors.As(err, &gerr) || gerr.ID != "proto.rpctest.michelson_v1.script_rejected" || gerr.With.String != "no" {
+		t.Errorf("mismatched error %v", err)
+	}
+}
+
+func TestMonitorHeads(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, c := newTestNode(t, 10*time.Millisecond)
+	mon := rpc.NewBlockHeaderMonitor()
+	defer mon.Close()
+	if err := c.MonitorBlockHeader(ctx, mon); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream starts with the current head and follows new blocks
+	var last int64 = -1
+	for i := 0; i < 3; i++ {
+		head, err := mon.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head.Level <= last {
+			t.Errorf("head %d: level %d does not advance from %d", i, head.Level, last)
+		}
+		last = head.Level
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	_, c := newTestNode(t, time.Hour)
+	resp, err := http.Get(c.BaseURL.String() + "/unknown/endpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("mismatched status got=%d want=%d", resp.StatusCode, http.StatusNotFound)
+	}
+}
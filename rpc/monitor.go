@@ -8,6 +8,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"net/url"
 	"time"
 
 	"github.com/mavryk-network/gomavryk/mavryk"
@@ -236,6 +237,7 @@ type MempoolMonitor struct {
 	result chan *[]*Operation
 	closed chan struct{}
 	err    error
+	status []MempoolStatus
 }
 
 // make sure MempoolMonitor implements Monitor interface
@@ -248,6 +250,14 @@ func NewMempoolMonitor() *MempoolMonitor {
 	}
 }
 
+// WithStatus selects which mempool classes the node streams. Without explicit
+// selection a node only reports validated operations. Non-validated operations
+// carry the error trace responsible for their classification.
+func (m *MempoolMonitor) WithStatus(status ...MempoolStatus) *MempoolMonitor {
+	m.status = append(m.status, status...)
+	return m
+}
+
 func (m *MempoolMonitor) New() interface{} {
 	slice := make([]*Operation, 0)
 	return &slice
@@ -475,9 +485,17 @@ func (c *Client) MonitorBlockHeader(ctx context.Context, monitor *BlockHeaderMon
 	return c.GetAsync(ctx, "monitor/heads/main", monitor)
 }
 
-// MonitorMempool reads from the chain heads stream http://protocol.mavryk.org/mainnet/api/rpc.html#get-monitor-heads-chain-id
+// MonitorMempool reads from the mempool operations stream http://protocol.mavryk.org/mainnet/api/rpc.html#get-chains-chain-id-mempool-monitor-operations
 func (c *Client) MonitorMempool(ctx context.Context, monitor *MempoolMonitor) error {
-	return c.GetAsync(ctx, "chains/main/mempool/monitor_operations", monitor)
+	u := "chains/main/mempool/monitor_operations"
+	if len(monitor.status) > 0 {
+		q := make(url.Values)
+		for _, v := range monitor.status {
+			q.Set(v.String(), "true")
+		}
+		u += "?" + q.Encode()
+	}
+	return c.GetAsync(ctx, u, monitor)
 }
 
 // MonitorNetworkPointLog monitors network events related to an `IP:addr`.
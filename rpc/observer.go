@@ -5,6 +5,8 @@ package rpc
 
 import (
 	"context"
+	"errors"
+	"io"
 	"sync"
 	"time"
 
@@ -16,29 +18,69 @@ import (
 // TODO:
 // - support AdressObserver with address subscription filter
 // - disable events/polling when no subscriber exists
-// - handle reorgs (inclusion may switch to a different block hash)
 
+// maxObserverWindow is the number of recent block headers an observer keeps
+// to detect reorgs and gaps.
+const maxObserverWindow = 64
+
+// ObserverCallback is called with the current block header, the block height
+// and the list and position of a matched operation (or -1 for block
+// subscriptions). After a match, callbacks receive each new block with list
+// and position -1 until the subscription is removed. The reorg flag signals
+// that the block in which an operation was previously matched has been
+// orphaned. Block subscribers see the flag on the first block of a new branch
+// or on the known block the node switched back to. Return true to remove the
+// subscription.
 type ObserverCallback func(*BlockHeaderLogEntry, int64, int, int, bool) bool
 
+// MempoolCallback is called when the mempool classification of a watched
+// operation changes. Errors contains the node's error trace for operations
+// which are not validated. Return true to remove the subscription.
+type MempoolCallback func(mavryk.OpHash, MempoolStatus, []OperationError) bool
+
 type observerSubscription struct {
 	id      int
 	cb      ObserverCallback
+	mcb     MempoolCallback
 	oh      mavryk.OpHash
 	matched bool
+	status  MempoolStatus
+	block   mavryk.BlockHash
+	height  int64
+	list    int
+	pos     int
+}
+
+// recentOp is the inclusion block and position of a recently seen operation.
+type recentOp struct {
+	block *BlockHeaderLogEntry
+	list  int
+	pos   int
+}
+
+type mempoolEntry struct {
+	status MempoolStatus
+	errs   []OperationError
 }
 
 type Observer struct {
 	subs     map[int]*observerSubscription
 	watched  map[mavryk.OpHash][]int
-	recent   map[mavryk.OpHash][3]int64
+	recent   map[mavryk.OpHash]recentOp
+	pending  map[mavryk.OpHash][]int
+	mempool  map[mavryk.OpHash]mempoolEntry
+	mstop    context.CancelFunc // stops the running mempool stream
 	seq      int
-	once     sync.Once
+	once     sync.Once // starts the block listener
+	monce    sync.Once // binds the mempool listener
 	mu       sync.Mutex
 	ctx      context.Context
 	cancel   context.CancelFunc
 	c        *Client
 	minDelay time.Duration
 	head     *BlockHeaderLogEntry
+	window   []*BlockHeaderLogEntry
+	reorg    bool
 }
 
 func NewObserver() *Observer {
@@ -46,7 +88,9 @@ func NewObserver() *Observer {
 	m := &Observer{
 		subs:     make(map[int]*observerSubscription),
 		watched:  make(map[mavryk.OpHash][]int),
-		recent:   make(map[mavryk.OpHash][3]int64),
+		recent:   make(map[mavryk.OpHash]recentOp),
+		pending:  make(map[mavryk.OpHash][]int),
+		mempool:  make(map[mavryk.OpHash]mempoolEntry),
 		minDelay: mavryk.DefaultParams.MinimalBlockDelay,
 		ctx:      ctx,
 		cancel:   cancel,
@@ -57,7 +101,11 @@ func NewObserver() *Observer {
 	return m
 }
 
+// Head returns the most recent canonical block seen by the observer. Like
+// other observer methods it must not be called from subscription callbacks.
 func (m *Observer) Head() *BlockHeaderLogEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.head
 }
 
@@ -72,7 +120,9 @@ func (m *Observer) Close() {
 	m.cancel()
 	m.subs = make(map[int]*observerSubscription)
 	m.watched = make(map[mavryk.OpHash][]int)
-	m.recent = make(map[mavryk.OpHash][3]int64)
+	m.recent = make(map[mavryk.OpHash]recentOp)
+	m.pending = make(map[mavryk.OpHash][]int)
+	m.mempool = make(map[mavryk.OpHash]mempoolEntry)
 }
 
 func (m *Observer) Subscribe(oh mavryk.OpHash, cb ObserverCallback) int {
@@ -80,71 +130,258 @@ func (m *Observer) Subscribe(oh mavryk.OpHash, cb ObserverCallback) int {
 	defer m.mu.Unlock()
 	m.seq++
 	seq := m.seq
-	m.subs[seq] = &observerSubscription{
+	sub := &observerSubscription{
 		id: seq,
 		cb: cb,
 		oh: oh,
 	}
-	if pos, ok := m.recent[oh]; ok {
-		match := m.subs[seq]
+	m.subs[seq] = sub
+	m.c.Log.Debugf("monitor: %03d subscribed %s", seq, oh)
+	if rec, ok := m.recent[oh]; ok {
 		m.c.Log.Debugf("monitor: %03d direct match %s", seq, oh)
-		if remove := match.cb(m.head, pos[0], int(pos[1]), int(pos[2]), false); remove {
-			delete(m.subs, match.id)
+		if remove := m.match(sub, rec.block, rec.list, rec.pos); remove {
+			delete(m.subs, seq)
+			return seq
+		}
+		// signal blocks which already confirm the inclusion block
+		if !rec.block.Hash.Equal(m.head.Hash) {
+			if remove := cb(m.head, m.head.Level, -1, -1, false); remove {
+				delete(m.subs, seq)
+				return seq
+			}
 		}
 	}
-	m.c.Log.Debugf("monitor: %03d subscribed %s", seq, oh)
 	m.watched[oh] = append(m.watched[oh], seq)
 	return seq
 }
 
+// match signals the inclusion of a watched operation in block at list and
+// position pos and remembers it for reorg handling. It must be called with
+// m.mu held.
+func (m *Observer) match(sub *observerSubscription, block *BlockHeaderLogEntry, list, pos int) bool {
+	if remove := sub.cb(block, block.Level, list, pos, false); remove {
+		return true
+	}
+	sub.matched = true
+	sub.block = block.Hash
+	sub.height = block.Level
+	sub.list = list
+	sub.pos = pos
+	return false
+}
+
+// SubscribeMempool registers a callback for mempool classification changes of
+// operation oh. Requires an observer bound to a client with ListenMempool. The
+// first subscription opens the mempool stream. When the operation has already
+// been seen, cb is called immediately.
+func (m *Observer) SubscribeMempool(oh mavryk.OpHash, cb MempoolCallback) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	seq := m.seq
+	sub := &observerSubscription{
+		id:  seq,
+		mcb: cb,
+		oh:  oh,
+	}
+	m.subs[seq] = sub
+	m.c.Log.Debugf("monitor: %03d subscribed mempool %s", seq, oh)
+	if e, ok := m.mempool[oh]; ok {
+		m.c.Log.Debugf("monitor: %03d direct mempool match %s %s", seq, oh, e.status)
+		sub.status = e.status
+		if remove := cb(oh, e.status, e.errs); remove {
+			delete(m.subs, seq)
+			return seq
+		}
+	}
+	m.pending[oh] = append(m.pending[oh], seq)
+	if m.mstop == nil && m.ctx.Err() == nil {
+		ctx, cancel := context.WithCancel(m.ctx)
+		m.mstop = cancel
+		go m.listenMempool(ctx)
+	}
+	return seq
+}
+
 func (m *Observer) Unsubscribe(id int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	req, ok := m.subs[id]
 	if ok {
-		m.removeWatcher(req.oh, id)
+		if req.mcb != nil {
+			m.removePending(req.oh, id)
+		} else {
+			m.removeWatcher(req.oh, id)
+		}
 		delete(m.subs, id)
 		m.c.Log.Debugf("monitor: %03d unsubscribed %s", id, req.oh)
 	}
 }
 
 func (m *Observer) removeWatcher(oh mavryk.OpHash, id int) {
+	removeSubscription(m.watched, oh, id)
+}
+
+// removePending removes a mempool subscription and stops the mempool stream
+// after the last one is gone. It must be called with m.mu held.
+func (m *Observer) removePending(oh mavryk.OpHash, id int) {
+	removeSubscription(m.pending, oh, id)
+	if len(m.pending) == 0 && m.mstop != nil {
+		m.mstop()
+		m.mstop = nil
+	}
+}
+
+func removeSubscription(list map[mavryk.OpHash][]int, oh mavryk.OpHash, id int) {
 	n := 0
-	for _, v := range m.watched[oh] {
+	for _, v := range list[oh] {
 		if v != id {
-			m.watched[oh][n] = v
+			list[oh][n] = v
 			n++
 		}
 	}
 	if n == 0 {
-		delete(m.watched, oh)
+		delete(list, oh)
 	} else {
-		m.watched[oh] = m.watched[oh][:n]
+		list[oh] = list[oh][:n]
 	}
 }
 
 func (m *Observer) Listen(cli *Client) {
 	m.once.Do(func() {
-		m.c = cli
-		if m.c.Params != nil {
-			m.minDelay = m.c.Params.MinimalBlockDelay
-		}
+		m.bind(cli)
 		go m.listenBlocks()
 	})
 }
 
+// ListenMempool binds the observer to cli for mempool monitoring. The mempool
+// stream is opened lazily by the first SubscribeMempool call and closed when
+// no subscriptions remain, so idle clients keep no stream open.
 func (m *Observer) ListenMempool(cli *Client) {
-	m.once.Do(func() {
-		m.c = cli
-		if m.c.Params != nil {
-			m.minDelay = m.c.Params.MinimalBlockDelay
-		}
-		go m.listenMempool()
+	m.monce.Do(func() {
+		m.bind(cli)
 	})
 }
 
-func (m *Observer) listenMempool() {
-	// TODO
+// bind sets the client used by block and mempool listeners. The first call
+// wins, so a running listener never sees its client change.
+func (m *Observer) bind(cli *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.c != nil {
+		return
+	}
+	m.c = cli
+	if m.c.Params != nil {
+		m.minDelay = m.c.Params.MinimalBlockDelay
+	}
+}
+
+func (m *Observer) listenMempool(ctx context.Context) {
+	var mon *MempoolMonitor
+	defer func() {
+		if mon != nil {
+			mon.Close()
+		}
+	}()
+
+	for {
+		// handle close request
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		// (re)connect, the node closes the stream on every new head
+		if mon == nil {
+			mon = NewMempoolMonitor().WithStatus(
+				MempoolStatusValidated,
+				MempoolStatusBranchDelayed,
+				MempoolStatusBranchRefused,
+				MempoolStatusOutdated,
+				MempoolStatusRefused,
+			)
+			if err := m.c.MonitorMempool(ctx, mon); err != nil {
+				mon.Close()
+				mon = nil
+				if ErrorStatus(err) == 404 {
+					m.c.Log.Debug("monitor: mempool monitoring unsupported.")
+					return
+				}
+				// wait 5 sec, but also return on close
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(5 * time.Second):
+				}
+				continue
+			}
+
+			// a new stream starts with the full mempool content, so we can
+			// forget operations which were included or dropped meanwhile
+			m.mu.Lock()
+			for n := range m.mempool {
+				delete(m.mempool, n)
+			}
+			m.mu.Unlock()
+		}
+
+		ops, err := mon.Recv(ctx)
+		if err != nil {
+			// reconnect unless context was cancelled, the node ends the
+			// stream on every new head, other errors wait before retrying
+			mon.Close()
+			mon = nil
+			if !errors.Is(err, io.EOF) {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(5 * time.Second):
+				}
+			}
+			continue
+		}
+
+		// fan-out classification changes unless the stream was stopped and
+		// a newer one owns mempool state
+		m.mu.Lock()
+		if ctx.Err() != nil {
+			m.mu.Unlock()
+			return
+		}
+		for _, op := range ops {
+			status := MempoolStatusFromErrors(op.Errors)
+			m.mempool[op.Hash] = mempoolEntry{
+				status: status,
+				errs:   op.Errors,
+			}
+			ids, ok := m.pending[op.Hash]
+			if !ok {
+				continue
+			}
+			var removed []*observerSubscription
+			for _, id := range ids {
+				sub, ok := m.subs[id]
+				if !ok {
+					continue
+				}
+				if sub.status == status {
+					continue
+				}
+				sub.status = status
+				m.c.Log.Debugf("monitor: mempool %d %s %s", sub.id, sub.oh, status)
+				if remove := sub.mcb(op.Hash, status, op.Errors); remove {
+					delete(m.subs, sub.id)
+					removed = append(removed, sub)
+				}
+			}
+			for _, sub := range removed {
+				m.removePending(sub.oh, sub.id)
+			}
+		}
+		m.mu.Unlock()
+	}
 }
 
 func (m *Observer) listenBlocks() {
@@ -230,106 +467,258 @@ func (m *Observer) listenBlocks() {
 		}
 		m.c.Log.Debugf("monitor: new block %d %s", head.Level, head.Hash)
 
-		// TODO: check for reorg and gaps
-
-		// handle block watchers
-		m.mu.Lock()
-		for _, id := range m.watched[mavryk.ZeroOpHash] {
-			sub, ok := m.subs[id]
-			if !ok {
-				m.removeWatcher(mavryk.ZeroOpHash, id)
-				continue
-			}
-			if remove := sub.cb(head, head.Level, -1, -1, false); remove {
-				delete(m.subs, id)
-				m.removeWatcher(mavryk.ZeroOpHash, id)
+		// connect the new head to the known chain, backfill missed blocks
+		// and identify blocks orphaned by a reorg
+		blocks, orphaned, err := m.resolveBranch(head)
+		if err != nil {
+			m.c.Log.Warnf("monitor: cannot resolve branch for block %s: %v", head.Hash, err)
+			// wait 5 sec, but also return on close
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
 			}
+			continue
 		}
-
-		// callback for all previous matches who have not yet unregistered (i.e. waiting for
-		// additional confirmations)
-		for _, v := range m.subs {
-			if v.matched {
-				m.c.Log.Debugf("monitor: signal n-th match for %d %s", v.id, v.oh)
-				if remove := v.cb(head, head.Level, -1, -1, false); remove {
-					delete(m.subs, v.id)
-					m.removeWatcher(v.oh, v.id)
-				}
+		if len(orphaned) > 0 {
+			m.c.Log.Infof("monitor: reorg at block %d, %d orphaned block(s)", orphaned[0].Level, len(orphaned))
+			m.rollback(orphaned)
+		}
+		if len(blocks) == 0 {
+			// node switched back to a known block
+			m.mu.Lock()
+			if m.reorg {
+				m.signalBlock(m.head, true)
+				m.reorg = false
 			}
+			m.mu.Unlock()
+		}
+		if len(blocks) > 1 {
+			m.c.Log.Debugf("monitor: backfilling %d block(s) from %d", len(blocks)-1, blocks[0].Level)
 		}
+
 		// clear recent op hashes
+		m.mu.Lock()
 		for n := range m.recent {
 			delete(m.recent, n)
 		}
-
-		numSubs := len(m.subs)
 		m.mu.Unlock()
 
-		// pull block ops when subs exist
-		var (
-			ohs [][]mavryk.OpHash
-			err error
-		)
-		if numSubs > 0 {
-			ohs, err = m.c.GetBlockOperationHashes(m.ctx, head.Hash)
-			if err != nil {
+		for _, b := range blocks {
+			if err := m.processBlock(b); err != nil {
 				m.c.Log.Warnf("monitor: cannot fetch block ops: %v", err)
-				continue
+				break
 			}
 		}
 
-		// fan-out matches
-		m.mu.Lock()
-		for l, list := range ohs {
-			for n, h := range list {
-				// keep as recent
-				m.recent[h] = [3]int64{head.Level, int64(l), int64(n)}
+		// wait in poll mode
+		if !useEvents {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-time.After(m.minDelay):
+			}
+		}
+	}
+}
+
+// resolveBranch links head to the window of recently processed blocks. It returns
+// the list of blocks to process in chain order (including blocks missed since
+// the last head) and the list of previously processed blocks which are no longer
+// part of the canonical chain.
+func (m *Observer) resolveBranch(head *BlockHeaderLogEntry) ([]*BlockHeaderLogEntry, []*BlockHeaderLogEntry, error) {
+	m.mu.Lock()
+	window := m.window
+	m.mu.Unlock()
+
+	// nothing to compare against or simple extension of the current head
+	if len(window) == 0 || head.Predecessor.Equal(window[len(window)-1].Hash) {
+		return []*BlockHeaderLogEntry{head}, nil, nil
+	}
+
+	// head may be a block we already know (node switched back)
+	if idx := findBlock(window, head.Hash); idx >= 0 {
+		return nil, cloneBlocks(window[idx+1:]), nil
+	}
+
+	// walk back via predecessors until we reach a known block,
+	// blocks are collected in reverse order
+	blocks := []*BlockHeaderLogEntry{head}
+	for {
+		first := blocks[len(blocks)-1]
+		if idx := findBlock(window, first.Predecessor); idx >= 0 {
+			reverseBlocks(blocks)
+			return blocks, cloneBlocks(window[idx+1:]), nil
+		}
+		// stop when the branch point is outside the window and
+		// treat all overlapping blocks as orphaned
+		if first.Level <= window[0].Level || len(blocks) >= maxObserverWindow {
+			reverseBlocks(blocks)
+			idx := len(window)
+			for idx > 0 && window[idx-1].Level >= blocks[0].Level {
+				idx--
+			}
+			return blocks, cloneBlocks(window[idx:]), nil
+		}
+		h, err := m.c.GetBlockHeader(m.ctx, first.Predecessor)
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks = append(blocks, h.LogEntry())
+	}
+}
+
+// rollback removes orphaned blocks from the window and notifies subscribers
+// whose operations were included in one of them. Such subscriptions are reset
+// and may match again when the operation is included on the new branch. Block
+// subscribers are notified with the next processed block.
+func (m *Observer) rollback(orphaned []*BlockHeaderLogEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, sub := range m.subs {
+		if !sub.matched {
+			continue
+		}
+		idx := findBlock(orphaned, sub.block)
+		if idx < 0 {
+			continue
+		}
+		m.c.Log.Debugf("monitor: orphaned match %d %s in block %s", sub.id, sub.oh, sub.block)
+		sub.matched = false
+		if remove := sub.cb(orphaned[idx], sub.height, sub.list, sub.pos, true); remove {
+			delete(m.subs, sub.id)
+			m.removeWatcher(sub.oh, sub.id)
+		}
+		sub.block = mavryk.BlockHash{}
+	}
+	m.reorg = true
+	m.window = m.window[:len(m.window)-len(orphaned)]
+	if l := len(m.window); l > 0 {
+		m.head = m.window[l-1]
+	} else {
+		m.head = &BlockHeaderLogEntry{Level: -1}
+	}
+}
 
-				// match op hash against subs
-				ids, ok := m.watched[h]
+// processBlock signals a new canonical block to subscribers and matches
+// block operations against watched operation hashes. Block operations are
+// fetched before any callback runs, so that a failed block can be processed
+// again without signalling it twice.
+func (m *Observer) processBlock(head *BlockHeaderLogEntry) error {
+	// pull block ops when subs exist
+	m.mu.Lock()
+	numSubs := len(m.subs)
+	m.mu.Unlock()
+	var ohs [][]mavryk.OpHash
+	if numSubs > 0 {
+		var err error
+		ohs, err = m.c.GetBlockOperationHashes(m.ctx, head.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// handle block watchers
+	m.signalBlock(head, m.reorg)
+	m.reorg = false
+
+	// callback for all previous matches who have not yet unregistered (i.e. waiting for
+	// additional confirmations)
+	for _, v := range m.subs {
+		if v.matched && v.cb != nil {
+			m.c.Log.Debugf("monitor: signal n-th match for %d %s", v.id, v.oh)
+			if remove := v.cb(head, head.Level, -1, -1, false); remove {
+				delete(m.subs, v.id)
+				m.removeWatcher(v.oh, v.id)
+			}
+		}
+	}
+
+	// fan-out matches
+	for l, list := range ohs {
+		for n, h := range list {
+			// keep as recent
+			m.recent[h] = recentOp{block: head, list: l, pos: n}
+
+			// match op hash against subs
+			ids, ok := m.watched[h]
+			if !ok {
+				m.c.Log.Debugf("monitor: --- !! %s", h)
+				continue
+			}
+
+			// handle all subscriptions for this op hash
+			var removed []*observerSubscription
+			for _, id := range ids {
+				sub, ok := m.subs[id]
 				if !ok {
 					m.c.Log.Debugf("monitor: --- !! %s", h)
 					continue
 				}
 
-				// handle all subscriptions for this op hash
-				var removed []*observerSubscription
-				for _, id := range ids {
-					sub, ok := m.subs[id]
-					if !ok {
-						m.c.Log.Debugf("monitor: --- !! %s", h)
-						continue
-					}
-
-					m.c.Log.Debugf("monitor: matched %d %s", sub.id, sub.oh)
+				m.c.Log.Debugf("monitor: matched %d %s", sub.id, sub.oh)
 
-					// callback
-					if remove := sub.cb(head, head.Level, l, n, false); remove {
-						delete(m.subs, sub.id)
-						removed = append(removed, sub)
-					} else {
-						sub.matched = true
-					}
+				// callback
+				if remove := m.match(sub, head, l, n); remove {
+					delete(m.subs, sub.id)
+					removed = append(removed, sub)
 				}
+			}
 
-				// remove deleted subs from watch list
-				for _, sub := range removed {
-					m.removeWatcher(sub.oh, sub.id)
-				}
+			// remove deleted subs from watch list
+			for _, sub := range removed {
+				m.removeWatcher(sub.oh, sub.id)
 			}
 		}
+	}
 
-		// update monitor state
-		m.head = head
-		m.mu.Unlock()
+	// update monitor state
+	m.head = head
+	m.window = append(m.window, head)
+	if l := len(m.window); l > maxObserverWindow {
+		m.window = m.window[l-maxObserverWindow:]
+	}
+	return nil
+}
 
-		// wait in poll mode
-		if !useEvents {
-			select {
-			case <-m.ctx.Done():
-				return
-			case <-time.After(m.minDelay):
-			}
+// signalBlock calls block subscribers with head. It must be called with
+// m.mu held.
+func (m *Observer) signalBlock(head *BlockHeaderLogEntry, reorg bool) {
+	// iterate a copy, removals compact the watch list in place
+	for _, id := range append([]int(nil), m.watched[mavryk.ZeroOpHash]...) {
+		sub, ok := m.subs[id]
+		if !ok {
+			m.removeWatcher(mavryk.ZeroOpHash, id)
+			continue
+		}
+		if remove := sub.cb(head, head.Level, -1, -1, reorg); remove {
+			delete(m.subs, id)
+			m.removeWatcher(mavryk.ZeroOpHash, id)
+		}
+	}
+}
+
+func findBlock(list []*BlockHeaderLogEntry, hash mavryk.BlockHash) int {
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].Hash.Equal(hash) {
+			return i
 		}
 	}
+	return -1
+}
+
+func cloneBlocks(list []*BlockHeaderLogEntry) []*BlockHeaderLogEntry {
+	if len(list) == 0 {
+		return nil
+	}
+	return append([]*BlockHeaderLogEntry(nil), list...)
+}
+
+func reverseBlocks(list []*BlockHeaderLogEntry) {
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
 }
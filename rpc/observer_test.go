@@ -0,0 +1,222 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/rpc"
+	"github.com/mavryk-network/gomavryk/rpc/mocknode"
+	"github.com/mavryk-network/gomavryk/rpc/rpctest"
+)
+
+// observerTest records observer callbacks in the order they are called.
+type observerTest struct {
+	t      *testing.T
+	chain  *rpctest.Fake
+	obs    *rpc.Observer
+	events chan string
+	fail   atomic.Bool // fail the next operation hash request
+}
+
+func newObserverTest(t *testing.T) *observerTest {
+	t.Helper()
+	ot := &observerTest{
+		t:      t,
+		chain:  rpctest.NewFake(nil),
+		events: make(chan string, 128),
+	}
+	node := mocknode.New(ot.chain)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/operation_hashes") && ot.fail.CompareAndSwap(true, false) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		node.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	t.Cleanup(node.Close)
+	c, err := rpc.NewClient(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot.obs = rpc.NewObserver()
+	t.Cleanup(ot.obs.Close)
+	ot.obs.Listen(c)
+	ot.obs.Subscribe(mavryk.ZeroOpHash, func(head *rpc.BlockHeaderLogEntry, _ int64, _, _ int, reorg bool) bool {
+		if reorg {
+			ot.events <- fmt.Sprintf("block %d reorg", head.Level)
+		} else {
+			ot.events <- fmt.Sprintf("block %d", head.Level)
+		}
+		return false
+	})
+
+	// sync on the first block, the genesis block may or may not be seen
+	ot.chain.Bake()
+	for ev := ot.next(); ev != "block 1"; ev = ot.next() {
+	}
+	return ot
+}
+
+// watch subscribes to op hash oh and records callbacks with name.
+func (ot *observerTest) watch(name string, oh mavryk.OpHash) {
+	ot.obs.Subscribe(oh, func(head *rpc.BlockHeaderLogEntry, height int64, list, pos int, reorg bool) bool {
+		switch {
+		case reorg:
+			ot.events <- fmt.Sprintf("%s orphan %d", name, head.Level)
+		case list < 0:
+			ot.events <- fmt.Sprintf("%s confirm %d", name, head.Level)
+		default:
+			ot.events <- fmt.Sprintf("%s match %d %d/%d", name, height, list, pos)
+		}
+		return false
+	})
+}
+
+func (ot *observerTest) next() string {
+	ot.t.Helper()
+	select {
+	case ev := <-ot.events:
+		return ev
+	case <-time.After(5 * time.Second):
+		ot.t.Fatal("timeout waiting for observer callback")
+		return ""
+	}
+}
+
+// expect checks the next callbacks. Operation callbacks between two block
+// callbacks run in random order and are compared sorted.
+func (ot *observerTest) expect(want ...string) {
+	ot.t.Helper()
+	got := make([]string, len(want))
+	for i := range got {
+		got[i] = ot.next()
+	}
+	sortEvents(got)
+	sortEvents(want)
+	if g, w := strings.Join(got, ", "), strings.Join(want, ", "); g != w {
+		ot.t.Fatalf("mismatched callbacks\n    got:  %s\n    want: %s", g, w)
+	}
+}
+
+func sortEvents(list []string) {
+	start := 0
+	for i := 0; i <= len(list); i++ {
+		if i == len(list) || strings.HasPrefix(list[i], "block") {
+			sort.Strings(list[start:i])
+			start = i + 1
+		}
+	}
+}
+
+func (ot *observerTest) inject(oh mavryk.OpHash) {
+	ot.chain.AddMempool(&rpc.Operation{Hash: oh})
+}
+
+func testOpHash(n byte) mavryk.OpHash {
+	buf := make([]byte, 32)
+	buf[0] = n
+	return mavryk.NewOpHash(buf)
+}
+
+func TestObserverReorg(t *testing.T) {
+	ot := newObserverTest(t)
+	x, y := testOpHash(1), testOpHash(2)
+	ot.watch("x", x)
+	res := rpc.NewResult(x).WithConfirmations(5)
+	res.Listen(ot.obs)
+
+	ot.inject(x)
+	ot.chain.Bake()
+	ot.chain.Bake()
+	ot.chain.Bake()
+	ot.expect(
+		"block 2", "x match 2 3/0",
+		"block 3", "x confirm 3",
+		"block 4", "x confirm 4",
+	)
+
+	// switch back to the inclusion block, blocks on top are orphaned but
+	// x stays included
+	ot.chain.Reorg(2)
+	ot.chain.Bake()
+	ot.expect(
+		"block 2 reorg",
+		"block 3", "x confirm 3",
+	)
+
+	// y is included and orphaned again
+	ot.watch("y", y)
+	ot.inject(y)
+	ot.chain.Bake()
+	ot.expect("block 4", "x confirm 4", "y match 4 3/0")
+	ot.chain.Reorg(1)
+	ot.chain.Bake()
+	ot.expect(
+		"y orphan 4",
+		"block 3 reorg",
+		"block 4", "x confirm 4", "y match 4 3/0",
+	)
+
+	// confirmations of orphaned blocks do not count
+	ot.chain.Bake()
+	ot.expect("block 5", "x confirm 5", "y confirm 5")
+	select {
+	case <-res.Done():
+		t.Fatalf("result done early with %d confirmations", res.Confirmations())
+	default:
+	}
+	ot.chain.Bake()
+	ot.expect("block 6")
+	res.Wait()
+	if err := res.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n := res.Confirmations(); n != 5 {
+		t.Errorf("mismatched confirmations got=%d want=%d", n, 5)
+	}
+}
+
+func TestObserverRetry(t *testing.T) {
+	ot := newObserverTest(t)
+	x, z := testOpHash(1), testOpHash(3)
+	ot.watch("x", x)
+	ot.inject(x)
+	ot.chain.Bake()
+	ot.expect("block 2", "x match 2 3/0")
+
+	// a failed block is processed again with the next block, but its
+	// callbacks run only once
+	ot.inject(z)
+	ot.fail.Store(true)
+	ot.chain.Bake()
+	ot.chain.Bake()
+	ot.expect(
+		"block 3", "x confirm 3",
+		"block 4", "x confirm 4",
+	)
+
+	// z was included in a backfilled block before the head, a late
+	// subscription matches it directly and sees the current head
+	ot.watch("z", z)
+	ot.expect("z match 3 3/0", "z confirm 4")
+
+	// the direct match is rolled back when its block is orphaned
+	ot.chain.Reorg(2)
+	ot.chain.Bake()
+	ot.expect(
+		"z orphan 3",
+		"block 2 reorg",
+		"block 3", "x confirm 3", "z match 3 3/0",
+	)
+}
@@ -0,0 +1,365 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrNoEndpoint is returned when a pool has no endpoint to send a request to.
+	ErrNoEndpoint = errors.New("rpc: no endpoint available")
+
+	// DefaultPoolOptions are used by NewPoolClient when no options are given.
+	DefaultPoolOptions = PoolOptions{
+		CheckInterval: 10 * time.Second,
+		CheckTimeout:  5 * time.Second,
+		MaxLag:        2,
+		MaxRetries:    3,
+		RetryDelay:    250 * time.Millisecond,
+	}
+)
+
+// PoolOptions controls health checks and retries of an endpoint pool.
+type PoolOptions struct {
+	CheckInterval time.Duration // time between health checks
+	CheckTimeout  time.Duration // timeout for a single endpoint health check
+	MaxLag        int64         // max number of blocks an endpoint may lag behind the best head
+	MaxRetries    int           // max number of retries for idempotent requests
+	RetryDelay    time.Duration // initial retry delay, doubled on each attempt
+}
+
+// EndpointStatus is a snapshot of an endpoint's health.
+type EndpointStatus struct {
+	URL          string
+	Healthy      bool
+	Bootstrapped bool
+	Level        int64
+	LastCheck    time.Time
+	LastError    error
+}
+
+type poolEndpoint struct {
+	url    *url.URL
+	apiKey string
+	cli    *Client // used for health checks only
+
+	// protected by pool mutex
+	healthy      bool
+	bootstrapped bool
+	level        int64
+	lastCheck    time.Time
+	lastErr      error
+}
+
+// Pool is an http.RoundTripper that distributes Mavryk RPC requests across
+// multiple nodes. It periodically checks node status and head level and only
+// routes requests to bootstrapped nodes which are no more than MaxLag blocks
+// behind the best known head. Idempotent requests (GET, HEAD) are retried up
+// to MaxRetries times after transport errors and 502, 503 and 504 status codes.
+// Retries rotate through all endpoints, so pools with fewer endpoints than
+// retries try the same endpoint again after a backoff delay.
+// Mavryk nodes report protocol errors with status 500, so these replies are
+// passed on. Other requests like operation injection are never retried.
+//
+// Requests are addressed to the first endpoint URL and rewritten to the
+// selected endpoint. Requests to other hosts (e.g. IPFS) pass through.
+type Pool struct {
+	opts      PoolOptions
+	transport http.RoundTripper
+	base      *url.URL
+	endpoints []*poolEndpoint
+	next      uint32
+	mu        sync.RWMutex
+	once      sync.Once
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// NewPool creates an endpoint pool from a list of node URLs. The transport is used
+// for sending requests and defaults to http.DefaultTransport. API keys may be
+// passed as `api_key` query argument per URL and take precedence over the
+// client's default API key.
+func NewPool(urls []string, transport http.RoundTripper, opts *PoolOptions) (*Pool, error) {
+	if len(urls) == 0 {
+		return nil, ErrNoEndpoint
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if opts == nil {
+		opts = &DefaultPoolOptions
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		opts:      *opts,
+		transport: transport,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	for _, v := range urls {
+		if !strings.HasPrefix(v, "http") {
+			v = "http://" + v
+		}
+		u, err := url.Parse(v)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		q := u.Query()
+		key := q.Get("api_key")
+		if key != "" {
+			q.Del("api_key")
+			u.RawQuery = q.Encode()
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		cli, err := NewClient(u.String(), &http.Client{Transport: transport})
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		if key != "" {
+			cli.ApiKey = key
+		}
+		p.endpoints = append(p.endpoints, &poolEndpoint{
+			url:     u,
+			apiKey:  key,
+			cli:     cli,
+			healthy: true, // optimistic until first check
+		})
+	}
+	p.base = p.endpoints[0].url
+	return p, nil
+}
+
+// NewPoolClient returns a client which sends requests to a pool of nodes. The
+// client's BaseURL is set to the first URL in the list. Use Client.Close to stop
+// pool health checks.
+func NewPoolClient(urls []string, httpClient *http.Client, opts *PoolOptions) (*Client, error) {
+	var transport http.RoundTripper
+	if httpClient != nil {
+		transport = httpClient.Transport
+	}
+	pool, err := NewPool(urls, transport, opts)
+	if err != nil {
+		return nil, err
+	}
+	hc := &http.Client{Transport: pool}
+	if httpClient != nil {
+		cp := *httpClient
+		cp.Transport = pool
+		hc = &cp
+	}
+	c, err := NewClient(pool.base.String(), hc)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	c.pool = pool
+	return c, nil
+}
+
+// Close stops background health checks.
+func (p *Pool) Close() {
+	p.cancel()
+}
+
+// Status returns a snapshot of all endpoint states.
+func (p *Pool) Status() []EndpointStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	list := make([]EndpointStatus, len(p.endpoints))
+	for i, e := range p.endpoints {
+		list[i] = EndpointStatus{
+			URL:          e.url.Redacted(),
+			Healthy:      e.healthy,
+			Bootstrapped: e.bootstrapped,
+			Level:        e.level,
+			LastCheck:    e.lastCheck,
+			LastError:    e.lastErr,
+		}
+	}
+	return list
+}
+
+// Check runs a health check on all endpoints and waits for the results.
+func (p *Pool) Check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, e := range p.endpoints {
+		wg.Add(1)
+		go func(e *poolEndpoint) {
+			defer wg.Done()
+			p.checkEndpoint(ctx, e)
+		}(e)
+	}
+	wg.Wait()
+}
+
+func (p *Pool) checkEndpoint(ctx context.Context, e *poolEndpoint) {
+	if p.opts.CheckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.opts.CheckTimeout)
+		defer cancel()
+	}
+	var level int64
+	status, err := e.cli.GetStatus(ctx)
+	if err == nil {
+		var head *BlockHeader
+		head, err = e.cli.GetTipHeader(ctx)
+		if err == nil {
+			level = head.Level
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e.lastCheck = time.Now()
+	e.lastErr = err
+	e.healthy = err == nil
+	e.bootstrapped = status.Bootstrapped
+	if err == nil {
+		e.level = level
+	}
+}
+
+func (p *Pool) run() {
+	p.Check(p.ctx)
+	if p.opts.CheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.opts.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.Check(p.ctx)
+		}
+	}
+}
+
+// candidates returns endpoints ordered by preference starting with a rotating
+// healthy and up-to-date endpoint. Lagging and unhealthy endpoints follow as
+// last resort.
+func (p *Pool) candidates() []*poolEndpoint {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var best int64
+	for _, e := range p.endpoints {
+		if e.healthy && e.level > best {
+			best = e.level
+		}
+	}
+	var good, bad []*poolEndpoint
+	for _, e := range p.endpoints {
+		if e.healthy && (e.bootstrapped || e.lastCheck.IsZero()) && e.level >= best-p.opts.MaxLag {
+			good = append(good, e)
+		} else {
+			bad = append(bad, e)
+		}
+	}
+	if n := len(good); n > 1 {
+		offset := int(atomic.AddUint32(&p.next, 1) % uint32(n))
+		good = append(good[offset:], good[:offset]...)
+	}
+	return append(good, bad...)
+}
+
+func (p *Pool) markFailed(e *poolEndpoint, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e.healthy = false
+	e.lastErr = err
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (p *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != p.base.Host {
+		return p.transport.RoundTrip(req)
+	}
+	p.once.Do(func() {
+		go p.run()
+	})
+
+	retry := req.Method == http.MethodGet || req.Method == http.MethodHead
+	delay := p.opts.RetryDelay
+	list := p.candidates()
+	var lastErr error
+	for i := 0; i <= p.opts.MaxRetries; i++ {
+		if i > 0 {
+			select {
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+		e := list[i%len(list)]
+		r, err := p.rewrite(req, e)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := p.transport.RoundTrip(r)
+		if err != nil {
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+			p.markFailed(e, err)
+			lastErr = err
+			if retry {
+				continue
+			}
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			err = fmt.Errorf("rpc: %s status %d", e.url.Redacted(), resp.StatusCode)
+			p.markFailed(e, err)
+			if retry && i < p.opts.MaxRetries {
+				resp.Body.Close()
+				lastErr = err
+				continue
+			}
+		}
+		return resp, nil
+	}
+	if lastErr == nil {
+		lastErr = ErrNoEndpoint
+	}
+	return nil, lastErr
+}
+
+// rewrite clones req and replaces the base URL with the endpoint URL.
+func (p *Pool) rewrite(req *http.Request, e *poolEndpoint) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	u := *req.URL
+	u.Scheme = e.url.Scheme
+	u.Host = e.url.Host
+	u.User = e.url.User
+	u.Path = e.url.Path + strings.TrimPrefix(req.URL.Path, p.base.Path)
+	u.RawPath = ""
+	r.URL = &u
+	r.Host = ""
+	if e.apiKey != "" {
+		r.Header.Set("X-Api-Key", e.apiKey)
+	}
+	return r, nil
+}
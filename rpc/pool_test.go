@@ -0,0 +1,165 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/rpc"
+)
+
+// poolNode is a node endpoint which passes health checks at level and
+// answers other requests with the status codes in replies. The last status
+// repeats.
+type poolNode struct {
+	*httptest.Server
+	level   int64
+	replies []int
+	calls   atomic.Int32
+}
+
+func newPoolNode(t *testing.T, level int64, replies ...int) *poolNode {
+	t.Helper()
+	n := &poolNode{level: level, replies: replies}
+	n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chains/main/is_bootstrapped":
+			io.WriteString(w, `{"bootstrapped":true,"sync_state":"synced"}`)
+			return
+		case "/chains/main/blocks/head/header":
+			fmt.Fprintf(w, `{"level":%d}`, n.level)
+			return
+		}
+		i := int(n.calls.Add(1)) - 1
+		if i >= len(n.replies) {
+			i = len(n.replies) - 1
+		}
+		w.WriteHeader(n.replies[i])
+		io.WriteString(w, r.Method)
+	}))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func newTestPool(t *testing.T, opts rpc.PoolOptions, nodes ...*poolNode) *http.Client {
+	t.Helper()
+	urls := make([]string, len(nodes))
+	for i, n := range nodes {
+		urls[i] = n.URL
+	}
+	opts.CheckTimeout = time.Second
+	pool, err := rpc.NewPool(urls, nil, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	pool.Check(context.Background())
+	return &http.Client{Transport: pool}
+}
+
+func poolGet(t *testing.T, c *http.Client, base, method string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, base+"/test", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestPoolRetrySingleEndpoint(t *testing.T) {
+	n := newPoolNode(t, 10, 503, 502, 200)
+	c := newTestPool(t, rpc.PoolOptions{MaxLag: 2, MaxRetries: 3, RetryDelay: time.Millisecond}, n)
+	if code := poolGet(t, c, n.URL, http.MethodGet); code != 200 {
+		t.Errorf("mismatched status got=%d want=%d", code, 200)
+	}
+	if calls := n.calls.Load(); calls != 3 {
+		t.Errorf("mismatched attempts got=%d want=%d", calls, 3)
+	}
+}
+
+func TestPoolBackoff(t *testing.T) {
+	n := newPoolNode(t, 10, 503)
+	c := newTestPool(t, rpc.PoolOptions{MaxLag: 2, MaxRetries: 2, RetryDelay: 20 * time.Millisecond}, n)
+	start := time.Now()
+	if code := poolGet(t, c, n.URL, http.MethodGet); code != 503 {
+		t.Errorf("mismatched status got=%d want=%d", code, 503)
+	}
+	if calls := n.calls.Load(); calls != 3 {
+		t.Errorf("mismatched attempts got=%d want=%d", calls, 3)
+	}
+	// delays of 20ms and 40ms
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Errorf("retries without backoff after %s", d)
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	bad := newPoolNode(t, 10, 503)
+	good := newPoolNode(t, 10, 200)
+	c := newTestPool(t, rpc.PoolOptions{MaxLag: 2, MaxRetries: 1, RetryDelay: time.Millisecond}, bad, good)
+	for i := 0; i < 4; i++ {
+		if code := poolGet(t, c, bad.URL, http.MethodGet); code != 200 {
+			t.Errorf("request %d: mismatched status got=%d want=%d", i, code, 200)
+		}
+	}
+	if calls := good.calls.Load(); calls != 4 {
+		t.Errorf("mismatched requests on healthy endpoint got=%d want=%d", calls, 4)
+	}
+
+	// transport errors fail over too
+	down := newPoolNode(t, 10, 200)
+	down.Close()
+	c = newTestPool(t, rpc.PoolOptions{MaxLag: 2, MaxRetries: 1, RetryDelay: time.Millisecond}, good, down)
+	for i := 0; i < 4; i++ {
+		if code := poolGet(t, c, good.URL, http.MethodGet); code != 200 {
+			t.Errorf("request %d: mismatched status got=%d want=%d", i, code, 200)
+		}
+	}
+}
+
+func TestPoolNoRetry(t *testing.T) {
+	bad := newPoolNode(t, 10, 503)
+	good := newPoolNode(t, 10, 200)
+	c := newTestPool(t, rpc.PoolOptions{MaxLag: 2, MaxRetries: 3, RetryDelay: time.Millisecond}, bad, good)
+
+	// injection and other posts are sent once
+	for i := 0; i < 4; i++ {
+		poolGet(t, c, bad.URL, http.MethodPost)
+	}
+	if calls := bad.calls.Load() + good.calls.Load(); calls != 4 {
+		t.Errorf("mismatched attempts got=%d want=%d", calls, 4)
+	}
+
+	// node errors are passed on
+	n := newPoolNode(t, 10, 500, 200)
+	c = newTestPool(t, rpc.PoolOptions{MaxLag: 2, MaxRetries: 3, RetryDelay: time.Millisecond}, n)
+	if code := poolGet(t, c, n.URL, http.MethodGet); code != 500 {
+		t.Errorf("mismatched status got=%d want=%d", code, 500)
+	}
+}
+
+func TestPoolLag(t *testing.T) {
+	lagging := newPoolNode(t, 10, 200)
+	synced := newPoolNode(t, 100, 200)
+	c := newTestPool(t, rpc.PoolOptions{MaxLag: 2, MaxRetries: 1, RetryDelay: time.Millisecond}, lagging, synced)
+	for i := 0; i < 4; i++ {
+		poolGet(t, c, lagging.URL, http.MethodGet)
+	}
+	if calls := lagging.calls.Load(); calls != 0 {
+		t.Errorf("lagging endpoint received %d requests", calls)
+	}
+}
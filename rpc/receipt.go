@@ -6,6 +6,7 @@ package rpc
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 
 	"github.com/mavryk-network/gomavryk/mavryk"
@@ -16,6 +17,36 @@ var (
 	TTLExceeded = errors.New("operation ttl exceeded")
 )
 
+// MempoolError is returned when a node's mempool rejects an operation for good.
+type MempoolError struct {
+	Hash   mavryk.OpHash
+	Status MempoolStatus
+	Errors []OperationError
+}
+
+func (e *MempoolError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("operation %s %s", e.Hash, e.Status)
+	}
+	return fmt.Sprintf("operation %s %s: %v", e.Hash, e.Status, e.Errors[len(e.Errors)-1].GenericError)
+}
+
+// ErrorID returns the Mavryk error id of the last error in trace
+func (e *MempoolError) ErrorID() string {
+	if len(e.Errors) == 0 {
+		return ""
+	}
+	return e.Errors[len(e.Errors)-1].ID
+}
+
+// ErrorKind returns the Mavryk error kind of the last error in trace
+func (e *MempoolError) ErrorKind() string {
+	if len(e.Errors) == 0 {
+		return ""
+	}
+	return e.Errors[len(e.Errors)-1].Kind
+}
+
 type Receipt struct {
 	Block  mavryk.BlockHash
 	Height int64
@@ -117,8 +148,11 @@ type Result struct {
 	blocks int64            // number of confirmation blocks seen
 	obs    *Observer        // blockchain observer
 	subId  int              // monitor subscription id
+	mobs   *Observer        // mempool observer
+	memId  int              // mempool subscription id
 	done   chan struct{}    // channel used to signal completion
 	once   sync.Once        // ensures only one completion state exists
+	mu     sync.Mutex       // protects subscription ids
 }
 
 func NewResult(oh mavryk.OpHash) *Result {
@@ -136,18 +170,73 @@ func (r *Result) Hash() mavryk.OpHash {
 func (r *Result) Listen(o *Observer) {
 	if o != nil {
 		r.obs = o
-		r.subId = r.obs.Subscribe(r.oh, r.callback)
+		if id := o.Subscribe(r.oh, r.callback); !r.keep(&r.subId, id) {
+			o.Unsubscribe(id)
+		}
+	}
+}
+
+// ListenMempool fails the result early when the mempool observer o reports
+// the operation as refused or outdated.
+func (r *Result) ListenMempool(o *Observer) {
+	if o != nil {
+		r.mobs = o
+		if id := o.SubscribeMempool(r.oh, r.mempoolCallback); !r.keep(&r.memId, id) {
+			o.Unsubscribe(id)
+		}
+	}
+}
+
+// keep stores subscription id in p unless the result completed meanwhile.
+// Callbacks may run before Subscribe returns.
+func (r *Result) keep(p *int, id int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.done:
+		return false
+	default:
+		*p = id
+		return true
 	}
 }
 
 func (r *Result) Cancel() {
+	r.mu.Lock()
+	listening := r.subId > 0
+	r.mu.Unlock()
+	var err error
+	if listening {
+		err = Canceled
+	}
+	r.finish(err, false)
+}
+
+// finish completes the result with err and releases its subscriptions.
+// Callbacks run under the observer lock, so they unsubscribe asynchronously.
+func (r *Result) finish(err error, async bool) {
 	r.once.Do(func() {
-		if r.subId > 0 {
-			r.obs.Unsubscribe(r.subId)
-			r.err = Canceled
-			r.subId = 0
+		r.mu.Lock()
+		if err != nil {
+			r.err = err
 		}
+		subId, memId := r.subId, r.memId
+		r.subId, r.memId = 0, 0
 		close(r.done)
+		r.mu.Unlock()
+		unsubscribe := func() {
+			if subId > 0 {
+				r.obs.Unsubscribe(subId)
+			}
+			if memId > 0 {
+				r.mobs.Unsubscribe(memId)
+			}
+		}
+		if async {
+			go unsubscribe()
+		} else {
+			unsubscribe()
+		}
 	})
 }
 
@@ -207,12 +296,14 @@ func (r *Result) WaitContext(ctx context.Context) bool {
 	}
 }
 
-func (r *Result) callback(block *BlockHeaderLogEntry, height int64, list, pos int, force bool) bool {
-	if force {
-		r.block = block.Hash
-		r.height = height
-		r.list = list
-		r.pos = pos
+func (r *Result) callback(block *BlockHeaderLogEntry, height int64, list, pos int, reorg bool) bool {
+	// inclusion block was orphaned, wait for the operation to be included again
+	if reorg {
+		r.block = mavryk.BlockHash{}
+		r.height = 0
+		r.list = 0
+		r.pos = 0
+		r.blocks = 0
 		return false
 	}
 	if !r.block.IsValid() {
@@ -221,21 +312,33 @@ func (r *Result) callback(block *BlockHeaderLogEntry, height int64, list, pos in
 		r.list = list
 		r.pos = pos
 	}
-	r.blocks++
+	// count from levels, so that blocks orphaned on top of a canonical
+	// inclusion block and repeated callbacks do not add confirmations
+	r.blocks = block.Level - r.height + 1
 	if r.ttl > 0 && r.blocks >= r.ttl {
-		r.once.Do(func() {
-			r.err = TTLExceeded
-			r.subId = 0
-			close(r.done)
-		})
+		r.finish(TTLExceeded, true)
 		return true
 	}
 	if r.blocks >= r.wait {
-		r.once.Do(func() {
-			r.subId = 0
-			close(r.done)
-		})
+		r.finish(nil, true)
 		return true
 	}
 	return false
 }
+
+func (r *Result) mempoolCallback(oh mavryk.OpHash, status MempoolStatus, errs []OperationError) bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+	}
+	if !status.IsFinal() {
+		return false
+	}
+	r.finish(&MempoolError{
+		Hash:   oh,
+		Status: status,
+		Errors: errs,
+	}, true)
+	return true
+}
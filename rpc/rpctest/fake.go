@@ -0,0 +1,1161 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpctest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/micheline"
+	"github.com/mavryk-network/gomavryk/rpc"
+	"github.com/mavryk-network/gomavryk/signer"
+)
+
+// ErrNotFound is returned when a block, account, script or big_map value
+// does not exist in a fake chain.
+var ErrNotFound = errors.New("rpctest: not found")
+
+// Account is the state of an account or contract in a fake chain.
+type Account struct {
+	Balance  int64
+	Counter  int64
+	Key      mavryk.Key        // revealed manager key, zero when not revealed
+	Delegate mavryk.Address    // optional
+	Script   *micheline.Script // code and current storage of originated contracts
+}
+
+// Fake is an in-memory rpc.RpcClient backed by a programmable chain of
+// blocks, accounts, contracts, big_maps and a mempool. It implements the
+// methods used to read chain state and to send operations. Other methods
+// are forwarded to the embedded RpcClient, which is nil by default and
+// panics when called. Use a client with a replaying Recorder as fallback to
+// serve them from golden files.
+//
+// Broadcast validates counters, balances and signatures and adds operations
+// to the mempool. Like a node it accepts one pending manager operation per
+// source, set AllowPipelining to accept operations with later counters too.
+// Simulate returns receipts with failed, backtracked and skipped results when
+// an operation fails, like a node's simulation. Bake includes pending operations into a new block and
+// applies their effects: counters, fees, transfers, reveals, delegations,
+// originations and storage and big_map updates of contract calls, which run
+// on the local Michelson interpreter. Internal operations emitted by
+// contracts are not applied and storage burns are not charged. Costs in
+// receipts are estimated with codec.Estimator. Reorg removes recent blocks
+// to script chain reorganizations.
+//
+// Fake is safe for concurrent use.
+type Fake struct {
+	rpc.RpcClient                // optional fallback for methods without fake state
+	Params        *mavryk.Params // chain params, defaults to mavryk.DefaultParams
+	Signer        signer.Signer  // used by Send
+	Start         time.Time      // genesis block time
+
+	// AllowPipelining accepts manager operations from sources with pending
+	// operations in the mempool. Nodes refuse them.
+	AllowPipelining bool
+
+	mu       sync.Mutex
+	blocks   []*rpc.Block
+	accounts map[mavryk.Address]*Account
+	bigmaps  map[int64]map[mavryk.ExprHash]micheline.Prim
+	mempool  []*rpc.Operation
+	pending  []*codec.Op
+	monitors []*fakeMonitor
+	forks    int
+}
+
+var _ rpc.RpcClient = (*Fake)(nil)
+
+// NewFake returns a fake chain with a genesis block for params p. It defaults
+// to mavryk.DefaultParams when p is nil.
+func NewFake(p *mavryk.Params) *Fake {
+	if p == nil {
+		p = mavryk.DefaultParams
+	}
+	f := &Fake{
+		Params:   p,
+		Start:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		accounts: make(map[mavryk.Address]*Account),
+		bigmaps:  make(map[int64]map[mavryk.ExprHash]micheline.Prim),
+	}
+	f.blocks = append(f.blocks, f.newBlock(nil))
+	return f
+}
+
+// SetAccount creates or replaces the state of account addr.
+func (f *Fake) SetAccount(addr mavryk.Address, acc Account) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if acc.Script != nil {
+		s := *acc.Script
+		acc.Script = &s
+	}
+	f.accounts[addr] = &acc
+}
+
+// Account returns the current state of account addr.
+func (f *Fake) Account(addr mavryk.Address) (Account, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	acc, ok := f.accounts[addr]
+	if !ok {
+		return Account{}, false
+	}
+	return *acc, true
+}
+
+// SetBigmapValue stores value under key hash in big_map id. An invalid
+// value removes the key.
+func (f *Fake) SetBigmapValue(id int64, hash mavryk.ExprHash, value micheline.Prim) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setBigmapValue(id, hash, value)
+}
+
+func (f *Fake) setBigmapValue(id int64, hash mavryk.ExprHash, value micheline.Prim) {
+	m, ok := f.bigmaps[id]
+	if !ok {
+		m = make(map[mavryk.ExprHash]micheline.Prim)
+		f.bigmaps[id] = m
+	}
+	if value.IsValid() {
+		m[hash] = value
+	} else {
+		delete(m, hash)
+	}
+}
+
+// AddMempool adds an operation to the mempool without validation. It will be
+// listed by GetMempool and included by the next block, but not applied.
+func (f *Fake) AddMempool(op *rpc.Operation) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	op.Protocol, op.ChainID = f.Params.Protocol, f.Params.ChainId
+	f.mempool = append(f.mempool, op)
+	f.pending = append(f.pending, nil)
+}
+
+// Head returns the current head block.
+func (f *Fake) Head() *rpc.Block {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.blocks[len(f.blocks)-1]
+}
+
+// Bake produces a new block which includes all mempool operations and
+// applies broadcast operations. Block header monitors receive the new
+// head.
+func (f *Fake) Bake() *rpc.Block {
+	f.mu.Lock()
+	ctx := context.Background()
+	for _, o := range f.pending {
+		if o != nil {
+			// operations were validated on broadcast
+			_ = f.apply(ctx, o)
+		}
+	}
+	b := f.newBlock(f.mempool)
+	f.blocks = append(f.blocks, b)
+	f.mempool, f.pending = nil, nil
+	mons := append([]*fakeMonitor(nil), f.monitors...)
+	f.mu.Unlock()
+	head := b.LogEntry()
+	for _, m := range mons {
+		m.push(head)
+	}
+	return b
+}
+
+// Reorg removes the last n blocks like a node switching to another branch
+// and returns the new head. Operations of removed blocks return to the
+// mempool and are included again by the next block without being applied
+// a second time, account state is not rolled back. Blocks baked after a
+// reorg get new hashes. Block header monitors receive the new head.
+func (f *Fake) Reorg(n int) *rpc.Block {
+	f.mu.Lock()
+	if l := len(f.blocks) - 1; n > l {
+		n = l
+	}
+	var ops []*rpc.Operation
+	for _, b := range f.blocks[len(f.blocks)-n:] {
+		for _, list := range b.Operations {
+			ops = append(ops, list...)
+		}
+	}
+	f.blocks = f.blocks[:len(f.blocks)-n]
+	f.mempool = append(ops, f.mempool...)
+	f.pending = append(make([]*codec.Op, len(ops)), f.pending...)
+	f.forks++
+	b := f.blocks[len(f.blocks)-1]
+	mons := append([]*fakeMonitor(nil), f.monitors...)
+	f.mu.Unlock()
+	head := b.LogEntry()
+	for _, m := range mons {
+		m.push(head)
+	}
+	return b
+}
+
+func (f *Fake) newBlock(ops []*rpc.Operation) *rpc.Block {
+	level := int64(len(f.blocks))
+	var pred mavryk.BlockHash
+	if level > 0 {
+		pred = f.blocks[level-1].Hash
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(level))
+	msg := append(f.Params.ChainId.Bytes(), buf[:]...)
+	if f.forks > 0 {
+		// blocks on a new branch must not reuse orphaned block hashes
+		msg = binary.BigEndian.AppendUint64(msg, uint64(f.forks))
+	}
+	d := mavryk.Digest(msg)
+	hash := mavryk.NewBlockHash(d[:])
+	bpc := f.Params.BlocksPerCycle
+	if bpc <= 0 {
+		bpc = 1
+	}
+	ts := f.Start.Add(time.Duration(level) * f.Params.MinimalBlockDelay)
+	if ops == nil {
+		ops = []*rpc.Operation{}
+	}
+	return &rpc.Block{
+		Protocol: f.Params.Protocol,
+		ChainId:  f.Params.ChainId,
+		Hash:     hash,
+		Header: rpc.BlockHeader{
+			Level:                     level,
+			Proto:                     1,
+			Predecessor:               pred,
+			Timestamp:                 ts,
+			Signature:                 mavryk.ZeroSignature,
+			LiquidityBakingToggleVote: mavryk.FeatureVotePass,
+			AdaptiveIssuanceVote:      mavryk.FeatureVotePass,
+			Hash:                      hash,
+			Protocol:                  f.Params.Protocol,
+			ChainId:                   f.Params.ChainId,
+		},
+		Metadata: rpc.BlockMetadata{
+			Protocol:     f.Params.Protocol,
+			NextProtocol: f.Params.Protocol,
+			LevelInfo: &rpc.LevelInfo{
+				Level:         level,
+				LevelPosition: level,
+				Cycle:         level / bpc,
+				CyclePosition: level % bpc,
+			},
+		},
+		Operations: [][]*rpc.Operation{{}, {}, {}, ops},
+	}
+}
+
+// block resolves block ids like head, genesis, levels, hashes and offsets
+// such as head~2. Offsets before genesis resolve to the genesis block. It must
+// be called with f.mu held.
+func (f *Fake) block(id rpc.BlockID) (*rpc.Block, error) {
+	s := id.String()
+	var ofs int64
+	if i := strings.LastIndexAny(s, "~+"); i > 0 {
+		n, err := strconv.ParseInt(s[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("rpctest: invalid block id %q", s)
+		}
+		if s[i] == '~' {
+			n = -n
+		}
+		s, ofs = s[:i], n
+	}
+	idx := int64(-1)
+	switch s {
+	case "head":
+		idx = int64(len(f.blocks) - 1)
+	case "genesis":
+		idx = 0
+	default:
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			idx = n
+		} else if h, err := mavryk.ParseBlockHash(s); err == nil {
+			for i, b := range f.blocks {
+				if b.Hash.Equal(h) {
+					idx = int64(i)
+					break
+				}
+			}
+		}
+	}
+	if idx >= 0 {
+		// short test chains have no history, so offsets before genesis
+		// resolve to genesis which keeps TTL branch lookups working
+		idx = max64(idx+ofs, 0)
+	}
+	if idx < 0 || idx >= int64(len(f.blocks)) {
+		return nil, fmt.Errorf("rpctest: block %s: %w", id, ErrNotFound)
+	}
+	return f.blocks[idx], nil
+}
+
+// BlockByID returns the block with id, for example head, genesis, a level,
+// a hash or an offset like head~2. Offsets before genesis resolve to the
+// genesis block.
+func (f *Fake) BlockByID(id rpc.BlockID) (*rpc.Block, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.block(id)
+}
+
+func (f *Fake) Init(_ context.Context) error               { return nil }
+func (f *Fake) Listen()                                    {}
+func (f *Fake) Close()                                     {}
+func (f *Fake) ResolveChainConfig(_ context.Context) error { return nil }
+func (f *Fake) GetChainId(_ context.Context) (mavryk.ChainIdHash, error) {
+	return f.Params.ChainId, nil
+}
+
+func (f *Fake) GetParams(_ context.Context, _ rpc.BlockID) (*mavryk.Params, error) {
+	return f.Params, nil
+}
+
+func (f *Fake) GetBlock(_ context.Context, id rpc.BlockID) (*rpc.Block, error) {
+	return f.BlockByID(id)
+}
+
+func (f *Fake) GetBlockHeight(ctx context.Context, height int64) (*rpc.Block, error) {
+	return f.GetBlock(ctx, rpc.BlockLevel(height))
+}
+
+func (f *Fake) GetHeadBlock(ctx context.Context) (*rpc.Block, error) {
+	return f.GetBlock(ctx, rpc.Head)
+}
+
+func (f *Fake) GetGenesisBlock(ctx context.Context) (*rpc.Block, error) {
+	return f.GetBlock(ctx, rpc.Genesis)
+}
+
+func (f *Fake) GetTipHeader(ctx context.Context) (*rpc.BlockHeader, error) {
+	return f.GetBlockHeader(ctx, rpc.Head)
+}
+
+func (f *Fake) GetBlockHeader(_ context.Context, id rpc.BlockID) (*rpc.BlockHeader, error) {
+	b, err := f.BlockByID(id)
+	if err != nil {
+		return nil, err
+	}
+	h := b.Header
+	return &h, nil
+}
+
+func (f *Fake) GetBlockMetadata(_ context.Context, id rpc.BlockID) (*rpc.BlockMetadata, error) {
+	b, err := f.BlockByID(id)
+	if err != nil {
+		return nil, err
+	}
+	m := b.Metadata
+	return &m, nil
+}
+
+func (f *Fake) GetBlockHash(_ context.Context, id rpc.BlockID) (mavryk.BlockHash, error) {
+	b, err := f.BlockByID(id)
+	if err != nil {
+		return mavryk.BlockHash{}, err
+	}
+	return b.Hash, nil
+}
+
+func (f *Fake) GetBlockOperations(_ context.Context, id rpc.BlockID) ([][]rpc.Operation, error) {
+	b, err := f.BlockByID(id)
+	if err != nil {
+		return nil, err
+	}
+	list := make([][]rpc.Operation, len(b.Operations))
+	for i, l := range b.Operations {
+		list[i] = make([]rpc.Operation, len(l))
+		for j, op := range l {
+			list[i][j] = *op
+		}
+	}
+	return list, nil
+}
+
+func (f *Fake) GetBlockOperationHashes(_ context.Context, id rpc.BlockID) ([][]mavryk.OpHash, error) {
+	b, err := f.BlockByID(id)
+	if err != nil {
+		return nil, err
+	}
+	list := make([][]mavryk.OpHash, len(b.Operations))
+	for i, l := range b.Operations {
+		list[i] = make([]mavryk.OpHash, len(l))
+		for j, op := range l {
+			list[i][j] = op.Hash
+		}
+	}
+	return list, nil
+}
+
+func (f *Fake) account(addr mavryk.Address) (*Account, error) {
+	acc, ok := f.accounts[addr]
+	if !ok {
+		return nil, fmt.Errorf("rpctest: account %s: %w", addr, ErrNotFound)
+	}
+	return acc, nil
+}
+
+func (f *Fake) GetContract(ctx context.Context, addr mavryk.Address, id rpc.BlockID) (*rpc.ContractInfo, error) {
+	return f.GetContractExt(ctx, addr, id)
+}
+
+func (f *Fake) GetContractExt(_ context.Context, addr mavryk.Address, _ rpc.BlockID) (*rpc.ContractInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	acc, err := f.account(addr)
+	if err != nil {
+		return nil, err
+	}
+	info := &rpc.ContractInfo{
+		Balance:  acc.Balance,
+		Delegate: acc.Delegate,
+		Counter:  acc.Counter,
+	}
+	if acc.Key.IsValid() {
+		info.Manager = acc.Key.String()
+	}
+	return info, nil
+}
+
+func (f *Fake) GetContractBalance(_ context.Context, addr mavryk.Address, _ rpc.BlockID) (mavryk.Z, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	acc, err := f.account(addr)
+	if err != nil {
+		return mavryk.Z{}, err
+	}
+	return mavryk.NewZ(acc.Balance), nil
+}
+
+func (f *Fake) GetManagerKey(_ context.Context, addr mavryk.Address, _ rpc.BlockID) (mavryk.Key, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	acc, err := f.account(addr)
+	if err != nil {
+		return mavryk.Key{}, err
+	}
+	return acc.Key, nil
+}
+
+func (f *Fake) GetContractScript(_ context.Context, addr mavryk.Address) (*micheline.Script, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	acc, err := f.account(addr)
+	if err != nil {
+		return nil, err
+	}
+	if acc.Script == nil {
+		return nil, fmt.Errorf("rpctest: script %s: %w", addr, ErrNotFound)
+	}
+	s := *acc.Script
+	return &s, nil
+}
+
+func (f *Fake) GetContractStorage(ctx context.Context, addr mavryk.Address, _ rpc.BlockID) (micheline.Prim, error) {
+	s, err := f.GetContractScript(ctx, addr)
+	if err != nil {
+		return micheline.InvalidPrim, err
+	}
+	return s.Storage, nil
+}
+
+func (f *Fake) GetBigmapValue(_ context.Context, bigmap int64, hash mavryk.ExprHash, _ rpc.BlockID) (micheline.Prim, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.bigmaps[bigmap][hash]
+	if !ok {
+		return micheline.InvalidPrim, fmt.Errorf("rpctest: big_map %d key %s: %w", bigmap, hash, ErrNotFound)
+	}
+	return v, nil
+}
+
+func (f *Fake) GetActiveBigmapValue(ctx context.Context, bigmap int64, hash mavryk.ExprHash) (micheline.Prim, error) {
+	return f.GetBigmapValue(ctx, bigmap, hash, rpc.Head)
+}
+
+func (f *Fake) GetMempool(_ context.Context) (*rpc.Mempool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &rpc.Mempool{
+		Applied: append([]*rpc.Operation{}, f.mempool...),
+	}, nil
+}
+
+// MonitorBlockHeader streams new heads produced by Bake until ctx is
+// canceled or the monitor is closed.
+func (f *Fake) MonitorBlockHeader(ctx context.Context, mon *rpc.BlockHeaderMonitor) error {
+	m := &fakeMonitor{
+		mon:   mon,
+		queue: make(chan *rpc.BlockHeaderLogEntry, 64),
+	}
+	f.mu.Lock()
+	f.monitors = append(f.monitors, m)
+	f.mu.Unlock()
+	go func() {
+		defer func() {
+			f.mu.Lock()
+			for i, v := range f.monitors {
+				if v == m {
+					f.monitors = append(f.monitors[:i], f.monitors[i+1:]...)
+					break
+				}
+			}
+			f.mu.Unlock()
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-mon.Closed():
+				return
+			case head := <-m.queue:
+				mon.Send(ctx, head)
+			}
+		}
+	}()
+	return nil
+}
+
+type fakeMonitor struct {
+	mon   *rpc.BlockHeaderMonitor
+	queue chan *rpc.BlockHeaderLogEntry
+}
+
+func (m *fakeMonitor) push(head *rpc.BlockHeaderLogEntry) {
+	select {
+	case m.queue <- head:
+	default:
+	}
+}
+
+// Complete sets branch, counters and adds a reveal like rpc.Client.Complete.
+func (f *Fake) Complete(_ context.Context, o *codec.Op, key mavryk.Key) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !o.Branch.IsValid() {
+		o.WithBranch(f.blocks[len(f.blocks)-1].Hash)
+	}
+	var (
+		counter  int64
+		revealed bool
+	)
+	if acc, ok := f.accounts[key.Address()]; ok {
+		counter, revealed = acc.Counter, acc.Key.IsValid()
+	}
+	needCounter := o.NeedCounter()
+	if !revealed && len(o.Contents) > 0 && o.Contents[0].Kind() != mavryk.OpTypeReveal {
+		reveal := &codec.Reveal{
+			Manager: codec.Manager{
+				Source: key.Address(),
+			},
+			PublicKey: key,
+		}
+		reveal.WithLimits(rpc.DefaultRevealLimits)
+		o.WithContentsFront(reveal)
+		needCounter = true
+	}
+	if needCounter {
+		for _, op := range o.Contents {
+			if op.GetCounter() < 0 {
+				continue
+			}
+			counter++
+			op.WithCounter(counter)
+		}
+	}
+	return nil
+}
+
+// Simulate estimates costs of o against current state and returns a receipt.
+// When an operation fails, like a failing contract call, its result has
+// failed status and holds the error, earlier operations are backtracked and
+// later operations are skipped. Like rpc.Client.Simulate the receipt is
+// returned together with the error of the failed operation.
+func (f *Fake) Simulate(ctx context.Context, o *codec.Op, _ *rpc.CallOptions) (*rpc.Receipt, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	op, err := f.receipt(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+	rcpt := &rpc.Receipt{Op: op}
+	if !rcpt.IsSuccess() {
+		return rcpt, rcpt.Error()
+	}
+	return rcpt, nil
+}
+
+// Validate is a no-op since the fake has no remote encoder.
+func (f *Fake) Validate(_ context.Context, _ *codec.Op) error {
+	return nil
+}
+
+// Broadcast validates a signed operation and adds it to the mempool.
+func (f *Fake) Broadcast(ctx context.Context, o *codec.Op) (mavryk.OpHash, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.validate(ctx, o); err != nil {
+		return mavryk.OpHash{}, err
+	}
+	if _, err := f.estimator().Costs(ctx, o); err != nil {
+		return mavryk.OpHash{}, err
+	}
+	op, err := f.receipt(ctx, o)
+	if err != nil {
+		return mavryk.OpHash{}, err
+	}
+	f.mempool = append(f.mempool, op)
+	f.pending = append(f.pending, o)
+	return op.Hash, nil
+}
+
+// BroadcastOperation decodes and broadcasts a signed binary operation.
+func (f *Fake) BroadcastOperation(ctx context.Context, body []byte) (mavryk.OpHash, error) {
+	o, err := codec.DecodeOp(body)
+	if err != nil {
+		return mavryk.OpHash{}, err
+	}
+	return f.Broadcast(ctx, o.WithParams(f.Params))
+}
+
+// CheckBranch fails when branch is unknown or older than MaxOperationsTTL
+// blocks.
+func (f *Fake) CheckBranch(_ context.Context, branch mavryk.BlockHash) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	block, err := f.block(branch)
+	if err != nil {
+		return fmt.Errorf("rpctest: branch %s: %w", branch, err)
+	}
+	head := f.blocks[len(f.blocks)-1]
+	if age := head.Header.Level - block.Header.Level; age >= f.Params.MaxOperationsTTL {
+		return fmt.Errorf("%w: %s is %d blocks old, max age %d", rpc.ErrBranchExpired, branch, age, f.Params.MaxOperationsTTL-1)
+	}
+	return nil
+}
+
+// BroadcastSigned checks the branch of a signed binary operation and
+// broadcasts it.
+func (f *Fake) BroadcastSigned(ctx context.Context, data []byte) (mavryk.OpHash, error) {
+	o, err := codec.DecodeOp(data)
+	if err != nil {
+		return mavryk.OpHash{}, err
+	}
+	if !o.Signature.IsValid() {
+		return mavryk.OpHash{}, fmt.Errorf("rpctest: operation is not signed")
+	}
+	if err := f.CheckBranch(ctx, o.Branch); err != nil {
+		return mavryk.OpHash{}, err
+	}
+	return f.Broadcast(ctx, o.WithParams(f.Params))
+}
+
+// BroadcastEnvelope broadcasts the signed operation in envelope e.
+func (f *Fake) BroadcastEnvelope(ctx context.Context, e *codec.Envelope) (mavryk.OpHash, error) {
+	if !e.ChainId.Equal(f.Params.ChainId) {
+		return mavryk.OpHash{}, fmt.Errorf("rpctest: envelope chain %s does not match %s", e.ChainId, f.Params.ChainId)
+	}
+	buf, err := e.SignedBytes()
+	if err != nil {
+		return mavryk.OpHash{}, err
+	}
+	return f.BroadcastSigned(ctx, buf)
+}
+
+// Send completes, simulates, signs and broadcasts op like rpc.Client.Send
+// and bakes a block which includes it.
+func (f *Fake) Send(ctx context.Context, op *codec.Op, opts *rpc.CallOptions) (*rpc.Receipt, error) {
+	if opts == nil {
+		opts = &rpc.DefaultOptions
+	}
+	sgn := f.Signer
+	if opts.Signer != nil {
+		sgn = opts.Signer
+	}
+	if sgn == nil {
+		return nil, fmt.Errorf("rpctest: missing signer")
+	}
+	addr := opts.Sender
+	if !addr.IsValid() {
+		addrs, err := sgn.ListAddresses(ctx)
+		if err != nil {
+			return nil, err
+		}
+		addr = addrs[0]
+	}
+	key, err := sgn.GetKey(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	op.WithSource(key.Address()).WithParams(f.Params)
+	if err := f.Complete(ctx, op, key); err != nil {
+		return nil, err
+	}
+	sim, err := f.Simulate(ctx, op, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.IgnoreLimits {
+		op.WithLimits(sim.MinLimits(), opts.ExtraGasMargin)
+	}
+	if opts.MaxFee > 0 {
+		if l := op.Limits(); l.Fee > opts.MaxFee {
+			return nil, fmt.Errorf("estimated cost %d > max %d", l.Fee, opts.MaxFee)
+		}
+	}
+	sig, err := sgn.SignOperation(ctx, addr, op)
+	if err != nil {
+		return nil, err
+	}
+	op.WithSignature(sig)
+	hash, err := f.Broadcast(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	b := f.Bake()
+	for i, v := range b.Operations[3] {
+		if v.Hash.Equal(hash) {
+			return &rpc.Receipt{
+				Block:  b.Hash,
+				Height: b.Header.Level,
+				List:   3,
+				Pos:    i,
+				Op:     v,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("rpctest: operation %s not included", hash)
+}
+
+// validate checks signature, counters and balances of o. Balances must cover
+// fees, amounts and origination balances of o and of pending operations from
+// the same source. It must be called with f.mu held.
+func (f *Fake) validate(_ context.Context, o *codec.Op) error {
+	if !o.Signature.IsValid() {
+		return fmt.Errorf("rpctest: missing signature")
+	}
+	counters := make(map[mavryk.Address]int64)
+	balances := make(map[mavryk.Address]int64)
+	var key mavryk.Key
+	for i, v := range o.Contents {
+		m, ok := v.(interface{ GetSource() mavryk.Address })
+		if !ok || v.GetCounter() < 0 {
+			continue
+		}
+		src := m.GetSource()
+		acc, err := f.account(src)
+		if err != nil {
+			return err
+		}
+		if !f.AllowPipelining {
+			if oh, ok := f.pendingOp(src); ok {
+				return fmt.Errorf("rpctest: %s has pending manager operation %s", src, oh)
+			}
+		}
+		if i == 0 {
+			key = acc.Key
+			if r, ok := v.(*codec.Reveal); ok {
+				key = r.PublicKey
+			}
+		}
+		next, ok := counters[src]
+		if !ok {
+			next = f.pendingCounter(src, acc.Counter)
+		}
+		if next++; v.GetCounter() != next {
+			return fmt.Errorf("rpctest: %s counter %d, expected %d", src, v.GetCounter(), next)
+		}
+		counters[src] = next
+		if _, ok := balances[src]; !ok {
+			balances[src] = acc.Balance - f.pendingSpend(src)
+		}
+		balances[src] -= spend(v)
+		if balances[src] < 0 {
+			return fmt.Errorf("rpctest: %s balance too low", src)
+		}
+	}
+	if key.IsValid() {
+		if err := key.VerifyMessage(o.WatermarkedBytes(), o.Signature); err != nil {
+			return fmt.Errorf("rpctest: invalid signature: %w", err)
+		}
+	}
+	return nil
+}
+
+// pendingOp returns the hash of a pending manager operation from src. It must
+// be called with f.mu held.
+func (f *Fake) pendingOp(src mavryk.Address) (mavryk.OpHash, bool) {
+	for _, o := range f.pending {
+		if o == nil {
+			continue
+		}
+		for _, v := range o.Contents {
+			m, ok := v.(interface{ GetSource() mavryk.Address })
+			if ok && m.GetSource().Equal(src) {
+				return o.Hash(), true
+			}
+		}
+	}
+	return mavryk.OpHash{}, false
+}
+
+// pendingCounter returns the last counter of src including operations in
+// the mempool. Without AllowPipelining sources have no pending operations
+// when validated. It must be called with f.mu held.
+func (f *Fake) pendingCounter(src mavryk.Address, counter int64) int64 {
+	for _, o := range f.pending {
+		if o == nil {
+			continue
+		}
+		for _, v := range o.Contents {
+			m, ok := v.(interface{ GetSource() mavryk.Address })
+			if ok && m.GetSource().Equal(src) && v.GetCounter() > counter {
+				counter = v.GetCounter()
+			}
+		}
+	}
+	return counter
+}
+
+// pendingSpend returns the sum of fees and amounts src spends in mempool
+// operations. It must be called with f.mu held.
+func (f *Fake) pendingSpend(src mavryk.Address) int64 {
+	var n int64
+	for _, o := range f.pending {
+		if o == nil {
+			continue
+		}
+		for _, v := range o.Contents {
+			m, ok := v.(interface{ GetSource() mavryk.Address })
+			if ok && m.GetSource().Equal(src) {
+				n += spend(v)
+			}
+		}
+	}
+	return n
+}
+
+// spend returns the fee and the amount an operation moves from its source.
+func spend(v codec.Operation) int64 {
+	n := v.Limits().Fee
+	switch op := v.(type) {
+	case *codec.Transaction:
+		n += op.Amount.Int64()
+	case *codec.Origination:
+		n += op.Balance.Int64()
+	}
+	return n
+}
+
+// apply executes o against chain state. It must be called with f.mu held.
+func (f *Fake) apply(ctx context.Context, o *codec.Op) error {
+	contracts := o.ContractAddresses()
+	var norig int
+	for _, v := range o.Contents {
+		m, ok := v.(interface{ GetSource() mavryk.Address })
+		if !ok {
+			continue
+		}
+		src, err := f.account(m.GetSource())
+		if err != nil {
+			return err
+		}
+		if c := v.GetCounter(); c >= 0 {
+			src.Counter = c
+		}
+		src.Balance -= v.Limits().Fee
+		switch op := v.(type) {
+		case *codec.Reveal:
+			src.Key = op.PublicKey
+		case *codec.Delegation:
+			src.Delegate = op.Delegate
+		case *codec.Transaction:
+			if err := f.transfer(ctx, m.GetSource(), src, op); err != nil {
+				return err
+			}
+		case *codec.Origination:
+			if norig >= len(contracts) {
+				return fmt.Errorf("rpctest: cannot derive contract address")
+			}
+			script := op.Script
+			src.Balance -= op.Balance.Int64()
+			f.accounts[contracts[norig]] = &Account{
+				Balance:  op.Balance.Int64(),
+				Delegate: op.Delegate,
+				Script:   &script,
+			}
+			norig++
+		}
+	}
+	return nil
+}
+
+func (f *Fake) transfer(ctx context.Context, from mavryk.Address, src *Account, op *codec.Transaction) error {
+	amount := op.Amount.Int64()
+	dst, ok := f.accounts[op.Destination]
+	if !ok {
+		dst = &Account{}
+		f.accounts[op.Destination] = dst
+	}
+	src.Balance -= amount
+	dst.Balance += amount
+	if dst.Script == nil {
+		return nil
+	}
+	var param micheline.Parameters
+	if op.Parameters != nil {
+		param = *op.Parameters
+	}
+	value := param.Value
+	if !value.IsValid() {
+		value = micheline.NewCode(micheline.D_UNIT)
+	}
+	head := f.blocks[len(f.blocks)-1]
+	res, err := dst.Script.Code.Run(ctx, value, dst.Script.Storage, &micheline.RunEnv{
+		Self:       op.Destination,
+		Source:     from,
+		Sender:     from,
+		Amount:     amount,
+		Balance:    dst.Balance,
+		Now:        head.Header.Timestamp.Add(f.Params.MinimalBlockDelay),
+		Level:      head.Header.Level + 1,
+		ChainId:    f.Params.ChainId,
+		Entrypoint: param.Entrypoint,
+		Bigmaps:    fakeStore{f},
+		Contracts:  fakeStore{f},
+	})
+	if err != nil {
+		return err
+	}
+	script := *dst.Script
+	script.Storage = res.Storage
+	dst.Script = &script
+	for _, e := range res.BigmapDiff {
+		if e.Id < 0 {
+			continue
+		}
+		switch e.Action {
+		case micheline.DiffActionUpdate:
+			f.setBigmapValue(e.Id, e.KeyHash, e.Value)
+		case micheline.DiffActionRemove:
+			f.setBigmapValue(e.Id, e.KeyHash, micheline.InvalidPrim)
+		}
+	}
+	return nil
+}
+
+// estimator returns an estimator for the next block. It must be called with
+// f.mu held.
+func (f *Fake) estimator() *codec.Estimator {
+	head := f.blocks[len(f.blocks)-1]
+	est := codec.NewEstimator(f.Params).WithStore(fakeStore{f}, fakeStore{f})
+	est.Now = head.Header.Timestamp.Add(f.Params.MinimalBlockDelay)
+	est.Level = head.Header.Level + 1
+	est.ChainId = f.Params.ChainId
+	return est
+}
+
+// failure returns the position and error of the first operation in o which
+// fails on its own or -1 when none fails. It must be called with f.mu held.
+func (f *Fake) failure(ctx context.Context, est *codec.Estimator, o *codec.Op) (int, error) {
+	for i, v := range o.Contents {
+		single := &codec.Op{Contents: []codec.Operation{v}, Params: o.Params}
+		if _, err := est.Costs(ctx, single); err != nil {
+			return i, err
+		}
+	}
+	return -1, nil
+}
+
+// receipt builds an operation receipt for o with estimated costs. When an
+// operation fails the receipt lists its error like a node. It must be called
+// with f.mu held.
+func (f *Fake) receipt(ctx context.Context, o *codec.Op) (*rpc.Operation, error) {
+	est := f.estimator()
+	var ferr error
+	failed := -1
+	costs, err := est.Costs(ctx, o)
+	if err != nil {
+		if failed, ferr = f.failure(ctx, est, o); failed < 0 {
+			return nil, err
+		}
+		costs = make([]mavryk.Costs, len(o.Contents))
+	}
+	buf, err := o.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Contents []json.RawMessage `json:"contents"`
+	}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return nil, err
+	}
+	// rpc operation decoding expects kind as first field, so metadata is
+	// appended to the encoded contents to keep field order
+	var norig int
+	addrs := o.ContractAddresses()
+	for i, c := range raw.Contents {
+		res := fakeResult{
+			Status:              mavryk.OpStatusApplied,
+			ConsumedMilliGas:    costs[i].GasUsed * 1000,
+			PaidStorageSizeDiff: costs[i].StorageUsed,
+			Allocated:           costs[i].AllocationBurn > 0,
+		}
+		switch {
+		case failed < 0:
+		case i < failed:
+			res.Status = mavryk.OpStatusBacktracked
+		case i == failed:
+			res.Status = mavryk.OpStatusFailed
+			res.Errors = []fakeError{newFakeError(ferr)}
+		default:
+			res.Status = mavryk.OpStatusSkipped
+		}
+		var src mavryk.Address
+		if m, ok := o.Contents[i].(interface{ GetSource() mavryk.Address }); ok {
+			src = m.GetSource()
+		}
+		if costs[i].StorageBurn > 0 {
+			res.BalanceUpdates = append(res.BalanceUpdates, fakeBalanceUpdate{
+				Kind: "contract", Origin: "block", Contract: src, Change: -costs[i].StorageBurn,
+			})
+		}
+		if o.Contents[i].Kind() == mavryk.OpTypeOrigination && norig < len(addrs) {
+			res.OriginatedContracts = []mavryk.Address{addrs[norig]}
+			res.Allocated = false
+			norig++
+		}
+		if costs[i].AllocationBurn > 0 {
+			res.BalanceUpdates = append(res.BalanceUpdates, fakeBalanceUpdate{
+				Kind: "contract", Origin: "block", Contract: src, Change: -costs[i].AllocationBurn,
+			})
+		}
+		meta, err := json.Marshal(res)
+		if err != nil {
+			return nil, err
+		}
+		c = bytes.TrimSuffix(bytes.TrimSpace(c), []byte("}"))
+		c = append(c, `,"metadata":{"operation_result":`...)
+		raw.Contents[i] = append(append(c, meta...), "}}"...)
+	}
+	out := struct {
+		Protocol  mavryk.ProtocolHash `json:"protocol"`
+		ChainId   mavryk.ChainIdHash  `json:"chain_id"`
+		Hash      *mavryk.OpHash      `json:"hash,omitempty"`
+		Branch    mavryk.BlockHash    `json:"branch"`
+		Contents  []json.RawMessage   `json:"contents"`
+		Signature *mavryk.Signature   `json:"signature,omitempty"`
+	}{
+		Protocol: f.Params.Protocol,
+		ChainId:  f.Params.ChainId,
+		Branch:   o.Branch,
+		Contents: raw.Contents,
+	}
+	if o.Signature.IsValid() {
+		hash := o.Hash()
+		out.Hash, out.Signature = &hash, &o.Signature
+	}
+	if buf, err = json.Marshal(out); err != nil {
+		return nil, err
+	}
+	op := &rpc.Operation{}
+	if err := json.Unmarshal(buf, op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// fakeResult is the subset of an operation result produced by the fake.
+type fakeResult struct {
+	Status              mavryk.OpStatus     `json:"status"`
+	BalanceUpdates      []fakeBalanceUpdate `json:"balance_updates,omitempty"`
+	ConsumedMilliGas    int64               `json:"consumed_milligas,string"`
+	PaidStorageSizeDiff int64               `json:"paid_storage_size_diff,string"`
+	Allocated           bool                `json:"allocated_destination_contract,omitempty"`
+	OriginatedContracts []mavryk.Address    `json:"originated_contracts,omitempty"`
+	Errors              []fakeError         `json:"errors,omitempty"`
+}
+
+// fakeError is an operation error in a receipt. Script failures use the
+// protocol's error ids, other errors keep their message in with.
+type fakeError struct {
+	Kind string          `json:"kind"`
+	ID   string          `json:"id"`
+	With *micheline.Prim `json:"with,omitempty"`
+}
+
+func newFakeError(err error) fakeError {
+	var rerr *micheline.RuntimeError
+	if errors.As(err, &rerr) {
+		e := fakeError{Kind: "temporary", ID: "proto.rpctest.michelson_v1.runtime_error"}
+		if rerr.IsFailwith() {
+			e.ID = "proto.rpctest.michelson_v1.script_rejected"
+			e.With = &rerr.Value
+		}
+		return e
+	}
+	msg := micheline.NewString(err.Error())
+	return fakeError{Kind: "temporary", ID: "proto.rpctest.operation_failed", With: &msg}
+}
+
+type fakeBalanceUpdate struct {
+	Kind     string         `json:"kind"`
+	Origin   string         `json:"origin"`
+	Contract mavryk.Address `json:"contract"`
+	Change   int64          `json:"change,string"`
+}
+
+// fakeStore exposes fake chain state to the local Michelson interpreter. Its
+// methods must be called with f.mu held.
+type fakeStore struct {
+	f *Fake
+}
+
+var (
+	_ micheline.BigmapStore   = fakeStore{}
+	_ micheline.ContractStore = fakeStore{}
+)
+
+func (s fakeStore) GetBigmapValue(_ context.Context, id int64, _ micheline.Prim, hash mavryk.ExprHash) (micheline.Prim, bool, error) {
+	v, ok := s.f.bigmaps[id][hash]
+	return v, ok, nil
+}
+
+func (s fakeStore) GetScript(_ context.Context, addr mavryk.Address) (*micheline.Script, error) {
+	acc, ok := s.f.accounts[addr]
+	if !ok || acc.Script == nil {
+		return nil, nil
+	}
+	script := *acc.Script
+	return &script, nil
+}
+
+func (s fakeStore) GetBalance(_ context.Context, addr mavryk.Address) (int64, error) {
+	if acc, ok := s.f.accounts[addr]; ok {
+		return acc.Balance, nil
+	}
+	return 0, nil
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
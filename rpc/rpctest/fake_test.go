@@ -0,0 +1,244 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpctest_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/micheline"
+	"github.com/mavryk-network/gomavryk/rpc"
+	"github.com/mavryk-network/gomavryk/rpc/rpctest"
+)
+
+var (
+	testKey    = mavryk.MustParsePrivateKey("edsk4FTF78Qf1m2rykGpHqostAiq5gYW4YZEoGUSWBTJr2njsDHSnd")
+	testDest   = mavryk.NewAddress(mavryk.AddressTypeEd25519, make([]byte, 20))
+	testOpHash = mavryk.NewOpHash(make([]byte, 32))
+)
+
+func newTestFake() *rpctest.Fake {
+	f := rpctest.NewFake(nil)
+	f.SetAccount(testKey.Address(), rpctest.Account{
+		Balance: 10_000,
+		Counter: 10,
+		Key:     testKey.Public(),
+	})
+	// an allocated destination keeps allocation burns out of the way
+	f.SetAccount(testDest, rpctest.Account{Balance: 1})
+	return f
+}
+
+// transferOp returns a transfer from the test key with counter and fee
+// signed by key.
+func transferOp(f *rpctest.Fake, counter, amount, fee int64, key mavryk.PrivateKey) *codec.Op {
+	op := codec.NewOp().
+		WithParams(f.Params).
+		WithBranch(f.Head().Hash).
+		WithSource(testKey.Address()).
+		WithTransfer(testDest, amount)
+	op.Contents[0].WithLimits(mavryk.Limits{Fee: fee, GasLimit: 2000})
+	op.Contents[0].WithCounter(counter)
+	if key.IsValid() {
+		if err := op.Sign(key); err != nil {
+			panic(err)
+		}
+	}
+	return op
+}
+
+func TestFakeValidate(t *testing.T) {
+	ctx := context.Background()
+	for _, v := range []struct {
+		name   string
+		op     func(*rpctest.Fake) *codec.Op
+		errMsg string
+	}{
+		{"unsigned", func(f *rpctest.Fake) *codec.Op {
+			return transferOp(f, 11, 1, 100, mavryk.PrivateKey{})
+		}, "missing signature"},
+		{"bad signature", func(f *rpctest.Fake) *codec.Op {
+			other, err := mavryk.GenerateKey(mavryk.KeyTypeEd25519)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return transferOp(f, 11, 1, 100, other)
+		}, "invalid signature"},
+		{"counter in the past", func(f *rpctest.Fake) *codec.Op {
+			return transferOp(f, 10, 1, 100, testKey)
+		}, "counter 10, expected 11"},
+		{"counter gap", func(f *rpctest.Fake) *codec.Op {
+			return transferOp(f, 12, 1, 100, testKey)
+		}, "counter 12, expected 11"},
+		{"fee above balance", func(f *rpctest.Fake) *codec.Op {
+			return transferOp(f, 11, 0, 10_001, testKey)
+		}, "balance too low"},
+		{"amount above balance", func(f *rpctest.Fake) *codec.Op {
+			return transferOp(f, 11, 9_901, 100, testKey)
+		}, "balance too low"},
+		{"unknown source", func(f *rpctest.Fake) *codec.Op {
+			f.SetAccount(testKey.Address(), rpctest.Account{})
+			return transferOp(f, 1, 1, 100, testKey)
+		}, "balance too low"},
+	} {
+		f := newTestFake()
+		_, err := f.Broadcast(ctx, v.op(f))
+		if err == nil || !strings.Contains(err.Error(), v.errMsg) {
+			t.Errorf("%s: mismatched error got=%v want=%s", v.name, err, v.errMsg)
+		}
+		if mem, _ := f.GetMempool(ctx); len(mem.Applied) != 0 {
+			t.Errorf("%s: invalid operation added to mempool", v.name)
+		}
+	}
+}
+
+func TestFakeValidateBls(t *testing.T) {
+	ctx := context.Background()
+	key, err := mavryk.GenerateKey(mavryk.KeyTypeBls12_381)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := mavryk.GenerateKey(mavryk.KeyTypeBls12_381)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newTestFake()
+	f.SetAccount(key.Address(), rpctest.Account{
+		Balance: 10_000,
+		Counter: 10,
+		Key:     key.Public(),
+	})
+	blsOp := func(signer mavryk.PrivateKey) *codec.Op {
+		op := codec.NewOp().
+			WithParams(f.Params).
+			WithBranch(f.Head().Hash).
+			WithSource(key.Address()).
+			WithTransfer(testDest, 1)
+		op.Contents[0].WithLimits(mavryk.Limits{Fee: 100, GasLimit: 2000})
+		op.Contents[0].WithCounter(11)
+		if err := op.Sign(signer); err != nil {
+			t.Fatal(err)
+		}
+		return op
+	}
+
+	// BLS signatures cover the watermarked bytes, not their digest
+	if _, err := f.Broadcast(ctx, blsOp(other)); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("mismatched error got=%v want=invalid signature", err)
+	}
+	if _, err := f.Broadcast(ctx, blsOp(key)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakePending(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFake()
+
+	// nodes accept one pending manager operation per source
+	if _, err := f.Broadcast(ctx, transferOp(f, 11, 1, 100, testKey)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Broadcast(ctx, transferOp(f, 12, 1, 100, testKey)); err == nil || !strings.Contains(err.Error(), "pending manager operation") {
+		t.Errorf("mismatched error got=%v want=pending manager operation", err)
+	}
+	f = newTestFake()
+	f.AllowPipelining = true
+
+	// pending operations advance counters and spend balance
+	if _, err := f.Broadcast(ctx, transferOp(f, 11, 5_000, 100, testKey)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Broadcast(ctx, transferOp(f, 12, 4_801, 100, testKey)); err == nil {
+		t.Errorf("expected balance error for pending spend")
+	}
+	if _, err := f.Broadcast(ctx, transferOp(f, 12, 4_800, 100, testKey)); err != nil {
+		t.Fatal(err)
+	}
+	mem, err := f.GetMempool(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mem.Applied) != 2 {
+		t.Fatalf("mismatched mempool size got=%d want=%d", len(mem.Applied), 2)
+	}
+
+	// baking applies fees, amounts and counters
+	b := f.Bake()
+	if n := len(b.Operations[3]); n != 2 {
+		t.Errorf("mismatched included operations got=%d want=%d", n, 2)
+	}
+	src, _ := f.Account(testKey.Address())
+	if src.Balance != 0 || src.Counter != 12 {
+		t.Errorf("mismatched source balance=%d counter=%d", src.Balance, src.Counter)
+	}
+	if dst, _ := f.Account(testDest); dst.Balance != 9_801 {
+		t.Errorf("mismatched destination balance got=%d want=%d", dst.Balance, 9_801)
+	}
+	if mem, _ := f.GetMempool(ctx); len(mem.Applied) != 0 {
+		t.Errorf("mempool not empty after baking")
+	}
+
+	// applied state is validated against
+	if _, err := f.Broadcast(ctx, transferOp(f, 13, 0, 1, testKey)); err == nil {
+		t.Errorf("expected balance error after baking")
+	}
+}
+
+func TestFakeAddMempool(t *testing.T) {
+	f := newTestFake()
+	f.AddMempool(&rpc.Operation{Hash: testOpHash})
+	b := f.Bake()
+	if len(b.Operations[3]) != 1 {
+		t.Fatalf("mismatched included operations got=%d want=%d", len(b.Operations[3]), 1)
+	}
+	op := b.Operations[3][0]
+	if !op.Hash.Equal(testOpHash) || !op.ChainID.Equal(f.Params.ChainId) || !op.Protocol.Equal(f.Params.Protocol) {
+		t.Errorf("mismatched operation hash=%s chain=%s protocol=%s", op.Hash, op.ChainID, op.Protocol)
+	}
+	// raw operations are not applied
+	if src, _ := f.Account(testKey.Address()); src.Counter != 10 {
+		t.Errorf("mismatched counter got=%d want=%d", src.Counter, 10)
+	}
+}
+
+func TestFakeSimulateFailed(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFake()
+	code, err := micheline.ParseMichelsonCode(`parameter unit; storage unit; code { DROP ; PUSH string "no" ; FAILWITH }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kt1 := mavryk.NewAddress(mavryk.AddressTypeContract, make([]byte, 20))
+	f.SetAccount(kt1, rpctest.Account{
+		Balance: 1,
+		Script:  &micheline.Script{Code: code, Storage: micheline.NewCode(micheline.D_UNIT)},
+	})
+	op := codec.NewOp().
+		WithParams(f.Params).
+		WithBranch(f.Head().Hash).
+		WithSource(testKey.Address()).
+		WithTransfer(testDest, 1).
+		WithCall(kt1, micheline.Parameters{Entrypoint: "default", Value: micheline.NewCode(micheline.D_UNIT)}).
+		WithTransfer(testDest, 2)
+
+	// failing operations are reported in the receipt like by a node
+	rcpt, err := f.Simulate(ctx, op, nil)
+	if rcpt == nil || rcpt.IsSuccess() {
+		t.Fatalf("expected failed receipt, got %v", err)
+	}
+	for i, want := range []mavryk.OpStatus{mavryk.OpStatusBacktracked, mavryk.OpStatusFailed, mavryk.OpStatusSkipped} {
+		if got := rcpt.Op.Contents[i].Result().Status; got != want {
+			t.Errorf("op %d: mismatched status got=%s want=%s", i, got, want)
+		}
+	}
+	var gerr rpc.GenericError
+	if !errors.As(err, &gerr) || gerr.ID != "proto.rpctest.michelson_v1.script_rejected" || gerr.With.String != "no" {
+		t.Errorf("mismatched error %v", err)
+	}
+}
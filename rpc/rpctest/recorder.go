@@ -0,0 +1,259 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+// Package rpctest provides test helpers for code that talks to a Mavryk
+// node: a transport which records node interactions to golden files and
+// replays them, and an in-memory fake implementing rpc.RpcClient.
+package rpctest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Mode selects whether a Recorder forwards requests to a node or replays
+// previously recorded responses.
+type Mode byte
+
+const (
+	ModeReplay Mode = iota // serve requests from the golden file
+	ModeRecord             // forward requests and record responses
+	ModeAuto               // replay when the golden file exists, record otherwise
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeReplay:
+		return "replay"
+	case ModeRecord:
+		return "record"
+	case ModeAuto:
+		return "auto"
+	default:
+		return "invalid"
+	}
+}
+
+// Interaction is a recorded request and response pair. URLs are stored
+// without scheme and host so recordings replay against any base URL.
+type Interaction struct {
+	Method      string `json:"method"`
+	URL         string `json:"url"`
+	Request     string `json:"request,omitempty"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Response    string `json:"response"`
+
+	done bool
+}
+
+// Recorder is a http.RoundTripper which records node interactions to a
+// golden file and replays them deterministically. In replay mode requests
+// match recorded interactions by method, URL path, query and body. Identical
+// requests are answered in recorded order. Streaming responses like
+// monitor endpoints are recorded up to the point where the client closes
+// the body.
+//
+// Recorder is safe for concurrent use, however replay order is only
+// deterministic when identical requests are not sent concurrently.
+type Recorder struct {
+	path string
+	mode Mode
+	next http.RoundTripper
+	mu   sync.Mutex
+	list []*Interaction
+	used []bool
+}
+
+// NewRecorder returns a recorder for golden file path. In record mode
+// requests are forwarded to next, which defaults to http.DefaultTransport.
+// In replay mode the golden file must exist.
+func NewRecorder(path string, mode Mode, next http.RoundTripper) (*Recorder, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if mode == ModeAuto {
+		mode = ModeRecord
+		if _, err := os.Stat(path); err == nil {
+			mode = ModeReplay
+		}
+	}
+	r := &Recorder{
+		path: path,
+		mode: mode,
+		next: next,
+	}
+	if mode == ModeReplay {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("rpctest: %w", err)
+		}
+		if err := json.Unmarshal(buf, &r.list); err != nil {
+			return nil, fmt.Errorf("rpctest: reading %s: %w", path, err)
+		}
+		r.used = make([]bool, len(r.list))
+	}
+	return r, nil
+}
+
+// Mode returns the active mode.
+func (r *Recorder) Mode() Mode {
+	return r.mode
+}
+
+// Client returns a HTTP client which uses the recorder as transport.
+func (r *Recorder) Client() *http.Client {
+	return &http.Client{Transport: r}
+}
+
+// Interactions returns a copy of all recorded interactions.
+func (r *Recorder) Interactions() []Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]Interaction, len(r.list))
+	for i, v := range r.list {
+		list[i] = *v
+	}
+	return list
+}
+
+// Unused returns the number of recorded interactions which have not been
+// replayed. Tests can use it to detect code paths which stopped calling the
+// node.
+func (r *Recorder) Unused() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int
+	for _, v := range r.used {
+		if !v {
+			n++
+		}
+	}
+	return n
+}
+
+// Save writes recorded interactions to the golden file. It is a no-op in
+// replay mode.
+func (r *Recorder) Save() error {
+	if r.mode != ModeRecord {
+		return nil
+	}
+	r.mu.Lock()
+	list := make([]*Interaction, 0, len(r.list))
+	for _, v := range r.list {
+		if v.done {
+			list = append(list, v)
+		}
+	}
+	buf, err := json.MarshalIndent(list, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, append(buf, '\n'), 0o644)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if r.mode == ModeReplay {
+		return r.replay(req, body)
+	}
+	return r.record(req, body)
+}
+
+func (r *Recorder) replay(req *http.Request, body []byte) (*http.Response, error) {
+	url := req.URL.RequestURI()
+	reqBody := string(bytes.TrimSpace(body))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, v := range r.list {
+		if r.used[i] || v.Method != req.Method || v.URL != url || v.Request != reqBody {
+			continue
+		}
+		r.used[i] = true
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", v.Status, http.StatusText(v.Status)),
+			StatusCode:    v.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{v.ContentType}},
+			Body:          io.NopCloser(bytes.NewReader([]byte(v.Response))),
+			ContentLength: int64(len(v.Response)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("rpctest: no recorded response for %s %s", req.Method, url)
+}
+
+func (r *Recorder) record(req *http.Request, body []byte) (*http.Response, error) {
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	it := &Interaction{
+		Method:      req.Method,
+		URL:         req.URL.RequestURI(),
+		Request:     string(bytes.TrimSpace(body)),
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	// keep request order, streaming responses complete later
+	r.mu.Lock()
+	r.list = append(r.list, it)
+	r.mu.Unlock()
+	resp.Body = &recordBody{ReadCloser: resp.Body, rec: r, it: it}
+	return resp, nil
+}
+
+// recordBody captures a response body while the client reads it.
+type recordBody struct {
+	io.ReadCloser
+	rec  *Recorder
+	it   *Interaction
+	buf  bytes.Buffer
+	once sync.Once
+}
+
+func (b *recordBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *recordBody) Close() error {
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+func (b *recordBody) finish() {
+	b.once.Do(func() {
+		b.rec.mu.Lock()
+		b.it.Response = b.buf.String()
+		b.it.done = true
+		b.rec.mu.Unlock()
+	})
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpctest_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/rpc/rpctest"
+)
+
+// testNode answers /counter with an increasing number, echoes POST bodies
+// on /echo and streams a first chunk on /stream which is followed by more
+// data only after the client went away.
+func testNode(t *testing.T) *httptest.Server {
+	t.Helper()
+	var n atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/counter":
+			fmt.Fprintf(w, "%d", n.Add(1))
+		case "/echo":
+			buf, _ := io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			w.Write(buf)
+		case "/stream":
+			io.WriteString(w, `{"level":1}`)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func get(t *testing.T, c *http.Client, url string) string {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestRecorderRoundTrip(t *testing.T) {
+	ts := testNode(t)
+	path := filepath.Join(t.TempDir(), "golden", "node.json")
+	rec, err := rpctest.NewRecorder(path, rpctest.ModeAuto, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Mode() != rpctest.ModeRecord {
+		t.Fatalf("mismatched mode got=%s want=%s", rec.Mode(), rpctest.ModeRecord)
+	}
+	c := rec.Client()
+	for i, want := range []string{"1", "2"} {
+		if got := get(t, c, ts.URL+"/counter?x=1"); got != want {
+			t.Errorf("record %d: mismatched response got=%s want=%s", i, got, want)
+		}
+	}
+	resp, err := c.Post(ts.URL+"/echo", "application/json", strings.NewReader(`{"a":1}`+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := rec.Save(); err != nil {
+		t.Fatal(err)
+	}
+	list := rec.Interactions()
+	if len(list) != 3 {
+		t.Fatalf("mismatched interactions got=%d want=%d", len(list), 3)
+	}
+	if it := list[2]; it.Method != http.MethodPost || it.URL != "/echo" || it.Request != `{"a":1}` || it.Status != http.StatusCreated {
+		t.Errorf("mismatched interaction %+v", it)
+	}
+
+	// replay against another base URL, identical requests match in order
+	rec, err = rpctest.NewRecorder(path, rpctest.ModeAuto, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Mode() != rpctest.ModeReplay {
+		t.Fatalf("mismatched mode got=%s want=%s", rec.Mode(), rpctest.ModeReplay)
+	}
+	if n := rec.Unused(); n != 3 {
+		t.Errorf("mismatched unused got=%d want=%d", n, 3)
+	}
+	c = rec.Client()
+	base := "http://replay.invalid"
+	resp, err = c.Post(base+"/echo", "application/json", strings.NewReader(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || string(buf) != `{"a":1}`+"\n" {
+		t.Errorf("mismatched replay status=%d body=%q", resp.StatusCode, buf)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("mismatched content type got=%s", ct)
+	}
+	if n := rec.Unused(); n != 2 {
+		t.Errorf("mismatched unused got=%d want=%d", n, 2)
+	}
+	for i, want := range []string{"1", "2"} {
+		if got := get(t, c, base+"/counter?x=1"); got != want {
+			t.Errorf("replay %d: mismatched response got=%s want=%s", i, got, want)
+		}
+	}
+	if n := rec.Unused(); n != 0 {
+		t.Errorf("mismatched unused got=%d want=%d", n, 0)
+	}
+
+	// used, unknown and differing requests have no recorded response
+	for _, url := range []string{"/counter?x=1", "/counter?x=2", "/other"} {
+		if _, err := c.Get(base + url); err == nil {
+			t.Errorf("%s: expected replay error", url)
+		}
+	}
+	if _, err := c.Post(base+"/echo", "application/json", strings.NewReader(`{"a":2}`)); err == nil {
+		t.Errorf("expected replay error for different body")
+	}
+
+	// saving in replay mode keeps the golden file
+	if err := rec.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rpctest.NewRecorder(filepath.Join(t.TempDir(), "missing.json"), rpctest.ModeReplay, nil); err == nil {
+		t.Errorf("expected error for missing golden file")
+	}
+}
+
+func TestRecorderStream(t *testing.T) {
+	ts := testNode(t)
+	path := filepath.Join(t.TempDir(), "stream.json")
+	rec, err := rpctest.NewRecorder(path, rpctest.ModeRecord, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := rec.Client()
+
+	// a stream read partially is recorded up to where the client closed it
+	resp, err := c.Get(ts.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(`{"level":1}`))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// a response which is neither read to the end nor closed is not saved
+	if _, err := c.Get(ts.URL + "/counter"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err = rpctest.NewRecorder(path, rpctest.ModeReplay, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := rec.Interactions()
+	if len(list) != 1 {
+		t.Fatalf("mismatched interactions got=%d want=%d", len(list), 1)
+	}
+	if list[0].URL != "/stream" || list[0].Response != `{"level":1}` {
+		t.Errorf("mismatched stream interaction %+v", list[0])
+	}
+	if got := get(t, rec.Client(), "http://replay.invalid/stream"); got != `{"level":1}` {
+		t.Errorf("mismatched stream replay got=%s", got)
+	}
+}
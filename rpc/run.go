@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 
 	"github.com/mavryk-network/gomavryk/codec"
@@ -17,6 +18,10 @@ import (
 
 const ExtraSafetyMargin int64 = 100 // used to adjust gas and storage estimations
 
+// ErrBranchExpired is returned when an operation's branch is too old for the
+// operation to be included in the next block.
+var ErrBranchExpired = errors.New("rpc: branch expired")
+
 var (
 	// for reveal
 	DefaultRevealLimits = mavryk.Limits{
@@ -95,6 +100,7 @@ type RunViewRequest struct {
 	Mode         string             `json:"unparsing_mode"`          // "Readable" | "Optimized"
 	UnlimitedGas bool               `json:"unlimited_gas,omitempty"` // view
 	Now          string             `json:"now,omitempty"`           // view
+	Level        *mavryk.N          `json:"level,omitempty"`
 }
 
 type RunViewResponse struct {
@@ -102,16 +108,39 @@ type RunViewResponse struct {
 }
 
 type RunCodeRequest struct {
-	ChainId    mavryk.ChainIdHash `json:"chain_id"`
-	Script     micheline.Code     `json:"script"`
-	Storage    micheline.Prim     `json:"storage"`
-	Input      micheline.Prim     `json:"input"`
-	Amount     mavryk.N           `json:"amount"`
-	Balance    mavryk.N           `json:"balance"`
-	Source     *mavryk.Address    `json:"source,omitempty"`
-	Payer      *mavryk.Address    `json:"payer,omitempty"`
-	Gas        *mavryk.N          `json:"gas,omitempty"`
-	Entrypoint string             `json:"entrypoint,omitempty"`
+	ChainId        mavryk.ChainIdHash `json:"chain_id"`
+	Script         micheline.Code     `json:"script"`
+	Storage        micheline.Prim     `json:"storage"`
+	Input          micheline.Prim     `json:"input"`
+	Amount         mavryk.N           `json:"amount"`
+	Balance        mavryk.N           `json:"balance"`
+	Source         *mavryk.Address    `json:"source,omitempty"`
+	Payer          *mavryk.Address    `json:"payer,omitempty"`
+	Self           *mavryk.Address    `json:"self,omitempty"`
+	Sender         *mavryk.Address    `json:"sender,omitempty"`
+	Gas            *mavryk.N          `json:"gas,omitempty"`
+	Entrypoint     string             `json:"entrypoint,omitempty"`
+	Mode           UnparsingMode      `json:"unparsing_mode,omitempty"`
+	Now            string             `json:"now,omitempty"` // RFC3339 or unix seconds
+	Level          *mavryk.N          `json:"level,omitempty"`
+	OtherContracts []OtherContract    `json:"other_contracts,omitempty"`
+	ExtraBigmaps   []ExtraBigmap      `json:"extra_big_maps,omitempty"`
+}
+
+// OtherContract declares the parameter type of a contract which does not
+// exist on-chain for CONTRACT instructions in run_code and trace_code.
+type OtherContract struct {
+	Address mavryk.Address `json:"address"`
+	Type    micheline.Prim `json:"type"`
+}
+
+// ExtraBigmap declares a big_map which does not exist on-chain for
+// run_code and trace_code. Values is a sequence of Elt literals.
+type ExtraBigmap struct {
+	Id        int64          `json:"id,string"`
+	KeyType   micheline.Prim `json:"key_type"`
+	ValueType micheline.Prim `json:"val_type"`
+	Values    micheline.Prim `json:"map_literal"`
 }
 
 // RunCodeResponse -
@@ -136,12 +165,9 @@ func (c *Client) Complete(ctx context.Context, o *codec.Op, key mavryk.Key) erro
 
 	// add branch for TTL control
 	if needBranch {
-		ofs := o.Params.MaxOperationsTTL - o.TTL
-		hash, err := c.GetBlockHash(ctx, NewBlockOffset(Head, -ofs))
-		if err != nil {
+		if err := c.completeBranch(ctx, o); err != nil {
 			return err
 		}
-		o.WithBranch(hash)
 	}
 
 	if needCounter || mayNeedReveal {
@@ -150,34 +176,51 @@ func (c *Client) Complete(ctx context.Context, o *codec.Op, key mavryk.Key) erro
 		if err != nil {
 			return err
 		}
+		completeCounters(o, key, state.Counter, mayNeedReveal && !state.IsRevealed(), needCounter)
+	}
+	return nil
+}
 
-		// add reveal if necessary
-		if mayNeedReveal && !state.IsRevealed() {
-			reveal := &codec.Reveal{
-				Manager: codec.Manager{
-					Source: key.Address(),
-				},
-				PublicKey: key,
-			}
-			reveal.WithLimits(DefaultRevealLimits)
-			o.WithContentsFront(reveal)
-			needCounter = true
+// completeBranch sets the operation branch to the block which yields the
+// operation's desired TTL.
+func (c *Client) completeBranch(ctx context.Context, o *codec.Op) error {
+	ofs := o.Params.MaxOperationsTTL - o.TTL
+	hash, err := c.GetBlockHash(ctx, NewBlockOffset(Head, -ofs))
+	if err != nil {
+		return err
+	}
+	o.WithBranch(hash)
+	return nil
+}
+
+// completeCounters adds a reveal if necessary and assigns consecutive counters
+// to all manager operations starting after the source's current counter.
+func completeCounters(o *codec.Op, key mavryk.Key, counter int64, needReveal, needCounter bool) {
+	// add reveal if necessary
+	if needReveal {
+		reveal := &codec.Reveal{
+			Manager: codec.Manager{
+				Source: key.Address(),
+			},
+			PublicKey: key,
 		}
+		reveal.WithLimits(DefaultRevealLimits)
+		o.WithContentsFront(reveal)
+		needCounter = true
+	}
 
-		// add counters
-		if needCounter {
-			nextCounter := state.Counter + 1
-			for _, op := range o.Contents {
-				// skip non-manager ops
-				if op.GetCounter() < 0 {
-					continue
-				}
-				op.WithCounter(nextCounter)
-				nextCounter++
+	// add counters
+	if needCounter {
+		nextCounter := counter + 1
+		for _, op := range o.Contents {
+			// skip non-manager ops
+			if op.GetCounter() < 0 {
+				continue
 			}
+			op.WithCounter(nextCounter)
+			nextCounter++
 		}
 	}
-	return nil
 }
 
 // Simulate dry-runs the execution of the operation against the current state
@@ -226,17 +269,19 @@ func (c *Client) Simulate(ctx context.Context, o *codec.Op, opts *CallOptions) (
 		Operation: sim,
 		ChainId:   c.ChainId,
 	}
-	var err error
-	resp := &Operation{}
+	var (
+		resp *Operation
+		err  error
+	)
 
 	// select simulation method based on requested block
 	if opts.SimulationBlockID != nil {
 		// simulate in the past
-		err = c.RunOperation(ctx, opts.SimulationBlockID, req, resp)
+		resp, err = c.RunOp(ctx, opts.SimulationBlockID, req)
 	} else {
 		// simulate in the future
 		req.Latency = opts.SimulationOffset
-		err = c.SimulateOperation(ctx, Head, req, resp)
+		resp, err = c.SimulateOp(ctx, Head, req)
 	}
 	if err != nil {
 		return nil, err
@@ -263,11 +308,11 @@ func (c *Client) Validate(ctx context.Context, o *codec.Op) error {
 		Contents: o.Contents,
 	}
 	local := op.Bytes()
-	var remote mavryk.HexBytes
-	if err := c.ForgeOperation(ctx, Head, op, &remote); err != nil {
+	remote, err := c.ForgeOp(ctx, Head, op)
+	if err != nil {
 		return err
 	}
-	if !bytes.Equal(local, remote.Bytes()) {
+	if !bytes.Equal(local, remote) {
 		return fmt.Errorf("mavryk: mismatch between local and remote serialized operations:\n local=%s\n remote=%s",
 			hex.EncodeToString(local), hex.EncodeToString(remote))
 	}
@@ -280,10 +325,65 @@ func (c *Client) Broadcast(ctx context.Context, o *codec.Op) (mavryk.OpHash, err
 	return c.BroadcastOperation(ctx, o.Bytes())
 }
 
+// CheckBranch fails when branch is unknown to the node or when it is too old
+// for an operation to be included in the next block, i.e. when it is not among
+// the last MaxOperationsTTL blocks.
+func (c *Client) CheckBranch(ctx context.Context, branch mavryk.BlockHash) error {
+	head, err := c.GetTipHeader(ctx)
+	if err != nil {
+		return err
+	}
+	block, err := c.GetBlockHeader(ctx, branch)
+	if err != nil {
+		return fmt.Errorf("rpc: branch %s: %w", branch, err)
+	}
+	if age := head.Level - block.Level; age >= c.Params.MaxOperationsTTL {
+		return fmt.Errorf("%w: %s is %d blocks old, max age %d", ErrBranchExpired, branch, age, c.Params.MaxOperationsTTL-1)
+	}
+	return nil
+}
+
+// BroadcastSigned sends a signed binary operation, e.g. produced by an offline
+// signer, to the network and returns the operation hash on successful
+// pre-validation. Fails with ErrBranchExpired when the operation's branch is
+// too old to be included.
+func (c *Client) BroadcastSigned(ctx context.Context, data []byte) (mavryk.OpHash, error) {
+	o, err := codec.DecodeOp(data)
+	if err != nil {
+		return mavryk.OpHash{}, err
+	}
+	if !o.Signature.IsValid() {
+		return mavryk.OpHash{}, fmt.Errorf("rpc: operation is not signed")
+	}
+	if err := c.CheckBranch(ctx, o.Branch); err != nil {
+		return mavryk.OpHash{}, err
+	}
+	return c.BroadcastOperation(ctx, data)
+}
+
+// BroadcastEnvelope sends the signed operation in envelope e to the network.
+// The envelope must be built for the client's chain.
+func (c *Client) BroadcastEnvelope(ctx context.Context, e *codec.Envelope) (mavryk.OpHash, error) {
+	if !e.ChainId.Equal(c.ChainId) {
+		return mavryk.OpHash{}, fmt.Errorf("rpc: envelope chain %s does not match %s", e.ChainId, c.ChainId)
+	}
+	buf, err := e.SignedBytes()
+	if err != nil {
+		return mavryk.OpHash{}, err
+	}
+	return c.BroadcastSigned(ctx, buf)
+}
+
 // Send is a convenience wrapper for sending operations. It auto-completes gas and storage limit,
 // ensures minimum fees are set, protects against fee overpayment, signs and broadcasts the final
 // operation and waits for a defined number of confirmations.
-func (c *Client) Send(ctx context.Context, op *codec.Op, opts *CallOptions) (*Receipt, error) {
+//
+// Operations from the same sender may be sent concurrently when the client has a
+// CounterManager. Nodes accept one pending manager operation per source, so Send
+// then waits until earlier operations from the sender are included or have failed
+// and assigns counters following them. Without a CounterManager concurrent
+// operations are completed with the same on-chain counters.
+func (c *Client) Send(ctx context.Context, op *codec.Op, opts *CallOptions) (rcpt *Receipt, err error) {
 	if opts == nil {
 		opts = &DefaultOptions
 	}
@@ -308,24 +408,33 @@ func (c *Client) Send(ctx context.Context, op *codec.Op, opts *CallOptions) (*Re
 		return nil, err
 	}
 
-	// use custom observer when provided
-	mon := c.BlockObserver
-	if opts.Observer != nil {
-		mon = opts.Observer
-	}
-
-	// ensure block observer is running
-	mon.Listen(c)
-
 	// set source and params on all ops
 	op.WithSource(key.Address()).WithParams(c.Params)
 
+	// manage counters unless set by the caller
+	manageCounter := c.Counters != nil && op.NeedCounter()
+
 	// auto-complete op with branch/ttl, source counter, reveal
 	err = c.Complete(ctx, op, key)
 	if err != nil {
 		return nil, err
 	}
 
+	// wait for earlier operations from the same sender and reserve counters
+	// after them before simulation so that the simulated and signed operations
+	// match, release when the operation is included or has failed, counters of
+	// injected operations are kept because the node may still include them
+	var sent bool
+	if manageCounter {
+		release, err := c.Counters.Reserve(ctx, key.Address(), op)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			release(!reuseCounters(sent, err))
+		}()
+	}
+
 	// simulate to check tx validity and estimate cost
 	sim, err := c.Simulate(ctx, op, opts)
 	if err != nil {
@@ -358,17 +467,46 @@ func (c *Client) Send(ctx context.Context, op *codec.Op, opts *CallOptions) (*Re
 		}
 	})
 
+	var res *Result
+	res, sent, err = c.signAndBroadcast(ctx, op, signer, addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return waitReceipt(ctx, res)
+}
+
+// signAndBroadcast checks the fee of a completed and simulated operation
+// against opts.MaxFee, signs it with signer for addr and broadcasts it. The
+// returned result observes confirmations of the injected operation. Sent is
+// true unless the operation was never sent or the node rejected it, so the
+// operation may have been injected even when err is not nil.
+func (c *Client) signAndBroadcast(ctx context.Context, op *codec.Op, signer signer.Signer, addr mavryk.Address, opts *CallOptions) (res *Result, sent bool, err error) {
 	// check minFee calc against maxFee if set
 	if opts.MaxFee > 0 {
 		if l := op.Limits(); l.Fee > opts.MaxFee {
-			return nil, fmt.Errorf("estimated cost %d > max %d", l.Fee, opts.MaxFee)
+			return nil, false, fmt.Errorf("estimated cost %d > max %d", l.Fee, opts.MaxFee)
 		}
 	}
 
+	// use custom observer when provided
+	mon := c.BlockObserver
+	if opts.Observer != nil {
+		mon = opts.Observer
+	}
+
+	// ensure block observer is running
+	mon.Listen(c)
+
+	// bind the mempool observer to detect refused operations early, its
+	// stream is only open while operations are watched
+	if c.MempoolObserver != nil {
+		c.MempoolObserver.ListenMempool(c)
+	}
+
 	// sign digest
 	sig, err := signer.SignOperation(ctx, addr, op)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	op.WithSignature(sig)
 
@@ -378,23 +516,28 @@ func (c *Client) Send(ctx context.Context, op *codec.Op, opts *CallOptions) (*Re
 		c.Log.Tracef("Broadcast: %s", string(buf))
 	})
 
-	// broadcast
-	hash, err := c.Broadcast(ctx, op)
-	if err != nil {
-		return nil, err
-	}
+	// watch confirmations before broadcast, so that an inclusion in the next
+	// block is not missed, fail fast when the mempool refuses the operation
+	res = NewResult(op.Hash()).WithTTL(op.TTL).WithConfirmations(opts.Confirmations)
+	res.Listen(mon)
+	res.ListenMempool(c.MempoolObserver)
 
-	// wait for confirmations
-	res := NewResult(hash).WithTTL(op.TTL).WithConfirmations(opts.Confirmations)
+	// broadcast, transport errors leave it open whether the node has
+	// injected the operation
+	if _, err := c.Broadcast(ctx, op); err != nil {
+		res.Cancel()
+		var rerr RPCError
+		return nil, !errors.As(err, &rerr), err
+	}
+	return res, true, nil
+}
 
-	// wait for confirmations
-	res.Listen(mon)
+// waitReceipt waits for confirmations of res and returns its receipt.
+func waitReceipt(ctx context.Context, res *Result) (*Receipt, error) {
 	res.WaitContext(ctx)
 	if err := res.Err(); err != nil {
 		return nil, err
 	}
-
-	// return receipt
 	return res.GetReceipt(ctx)
 }
 
@@ -424,12 +567,105 @@ func (c *Client) RunView(ctx context.Context, id BlockID, body, resp interface{}
 }
 
 // TraceCode simulates executing of code on the context of a contract at selected block and
-// returns a full execution trace.
+// returns a full execution trace. Use TraceCodeResponse as resp for typed trace entries.
 func (c *Client) TraceCode(ctx context.Context, id BlockID, body, resp interface{}) error {
 	u := fmt.Sprintf("chains/main/blocks/%s/helpers/scripts/trace_code", id)
 	return c.Post(ctx, u, body, resp)
 }
 
+// RunScript executes script code on the context of a contract at block id.
+// ChainId defaults to the client's chain id. Script failures are returned
+// as *ScriptError.
+func (c *Client) RunScript(ctx context.Context, id BlockID, req RunCodeRequest) (*RunCodeResponse, error) {
+	if !req.ChainId.IsValid() {
+		req.ChainId = c.ChainId
+	}
+	var resp RunCodeResponse
+	if err := c.RunCode(ctx, id, &req, &resp); err != nil {
+		return nil, scriptError(err)
+	}
+	return &resp, nil
+}
+
+// TraceScript executes script code like RunScript and returns a full
+// execution trace. Script failures are returned as *ScriptError.
+func (c *Client) TraceScript(ctx context.Context, id BlockID, req RunCodeRequest) (*TraceCodeResponse, error) {
+	if !req.ChainId.IsValid() {
+		req.ChainId = c.ChainId
+	}
+	var resp TraceCodeResponse
+	if err := c.TraceCode(ctx, id, &req, &resp); err != nil {
+		return nil, scriptError(err)
+	}
+	return &resp, nil
+}
+
+// RunScriptView executes on-chain view req.View of contract req.Contract at
+// block id. Script failures are returned as *ScriptError.
+func (c *Client) RunScriptView(ctx context.Context, id BlockID, req RunViewRequest) (*RunViewResponse, error) {
+	if !req.ChainId.IsValid() {
+		req.ChainId = c.ChainId
+	}
+	var resp RunViewResponse
+	if err := c.RunView(ctx, id, &req, &resp); err != nil {
+		return nil, scriptError(err)
+	}
+	return &resp, nil
+}
+
+// RunScriptCallback executes TZIP-4 view req.Entrypoint of contract
+// req.Contract at block id. Script failures are returned as *ScriptError.
+func (c *Client) RunScriptCallback(ctx context.Context, id BlockID, req RunViewRequest) (*RunViewResponse, error) {
+	if !req.ChainId.IsValid() {
+		req.ChainId = c.ChainId
+	}
+	var resp RunViewResponse
+	if err := c.RunCallback(ctx, id, &req, &resp); err != nil {
+		return nil, scriptError(err)
+	}
+	return &resp, nil
+}
+
+// RunOp simulates executing an operation at block id without requiring
+// a valid signature and returns the result as operation receipt.
+func (c *Client) RunOp(ctx context.Context, id BlockID, req RunOperationRequest) (*Operation, error) {
+	if !req.ChainId.IsValid() {
+		req.ChainId = c.ChainId
+	}
+	resp := &Operation{}
+	if err := c.RunOperation(ctx, id, &req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// SimulateOp simulates executing an operation in a future block like
+// SimulateOperation and returns the result as operation receipt.
+func (c *Client) SimulateOp(ctx context.Context, id BlockID, req RunOperationRequest) (*Operation, error) {
+	if !req.ChainId.IsValid() {
+		req.ChainId = c.ChainId
+	}
+	resp := &Operation{}
+	if err := c.SimulateOperation(ctx, id, &req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ForgeOp uses a remote node to serialize the unsigned contents of o. Like
+// ForgeOperation the result must not be used for signing.
+func (c *Client) ForgeOp(ctx context.Context, id BlockID, o *codec.Op) ([]byte, error) {
+	op := &codec.Op{
+		Branch:   o.Branch,
+		Contents: o.Contents,
+	}
+	var remote mavryk.HexBytes
+	if err := c.ForgeOperation(ctx, id, op, &remote); err != nil {
+		return nil, err
+	}
+	return remote.Bytes(), nil
+}
+
 // BroadcastOperation sends a signed operation to the network (injection).
 // The call returns the operation hash on success. If theoperation was rejected
 // by the node error is of type RPCError.
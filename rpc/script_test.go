@@ -0,0 +1,242 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/micheline"
+	"github.com/mavryk-network/gomavryk/rpc"
+)
+
+var (
+	testChainId = mavryk.MustParseChainIdHash("NetXdQprcVkpaWU")
+	testKT1     = mavryk.MustParseAddress("KT1Puc9St8wdNoGtLiD2WXaHbWU7styaxYhD")
+	testScript  = `[{"prim":"parameter","args":[{"prim":"unit"}]},{"prim":"storage","args":[{"prim":"int"}]},{"prim":"code","args":[[{"prim":"CDR"},{"prim":"NIL","args":[{"prim":"operation"}]},{"prim":"PAIR"}]]}]`
+)
+
+// scriptNode answers POST requests to path with status and reply and
+// stores the decoded request body in req.
+func scriptNode(t *testing.T, path string, status int, reply string, req *map[string]any) *rpc.Client {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != path {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		buf, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(buf, req); err != nil {
+			t.Errorf("invalid request body %s: %v", string(buf), err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, reply)
+	}))
+	t.Cleanup(ts.Close)
+	c, err := rpc.NewClient(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ChainId = testChainId
+	return c
+}
+
+func testRunCodeRequest(t *testing.T) rpc.RunCodeRequest {
+	t.Helper()
+	var code micheline.Code
+	if err := json.Unmarshal([]byte(testScript), &code); err != nil {
+		t.Fatal(err)
+	}
+	return rpc.RunCodeRequest{
+		Script:  code,
+		Storage: micheline.NewInt64(1),
+		Input:   micheline.NewPrim(micheline.D_UNIT),
+		Self:    &testKT1,
+		Now:     "1700000000",
+		OtherContracts: []rpc.OtherContract{{
+			Address: testDest,
+			Type:    micheline.NewPrim(micheline.T_UNIT),
+		}},
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	var req map[string]any
+	c := scriptNode(t, "/chains/main/blocks/head/helpers/scripts/run_code", 200,
+		`{"storage":{"int":"2"},"operations":[]}`, &req)
+	res, err := c.RunScript(context.Background(), rpc.Head, testRunCodeRequest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Storage.Int.Int64(); got != 2 {
+		t.Errorf("mismatched storage got=%d want=%d", got, 2)
+	}
+	// the chain id defaults to the client's chain
+	for key, want := range map[string]string{
+		"chain_id": testChainId.String(),
+		"self":     testKT1.String(),
+		"now":      "1700000000",
+	} {
+		if got, _ := req[key].(string); got != want {
+			t.Errorf("mismatched request %s got=%s want=%s", key, got, want)
+		}
+	}
+	other, _ := req["other_contracts"].([]any)
+	if len(other) != 1 || other[0].(map[string]any)["address"] != testDest.String() {
+		t.Errorf("mismatched request other_contracts got=%v", req["other_contracts"])
+	}
+}
+
+func TestTraceScript(t *testing.T) {
+	var req map[string]any
+	c := scriptNode(t, "/chains/main/blocks/head/helpers/scripts/trace_code", 200,
+		`{"storage":{"int":"1"},"operations":[],"trace":[{"location":7,"gas":"1039991.33","stack":[{"item":{"int":"1"},"annot":"@x"}]}]}`, &req)
+	res, err := c.TraceScript(context.Background(), rpc.Head, testRunCodeRequest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Trace) != 1 {
+		t.Fatalf("mismatched trace length got=%d want=%d", len(res.Trace), 1)
+	}
+	if e := res.Trace[0]; e.Location != 7 || e.Gas != 1039991330 || len(e.Stack) != 1 || e.Stack[0].Int.Int64() != 1 {
+		t.Errorf("mismatched trace entry got=%+v", e)
+	}
+}
+
+func TestRunScriptView(t *testing.T) {
+	for _, v := range []struct {
+		path string
+		call func(*rpc.Client, rpc.RunViewRequest) (*rpc.RunViewResponse, error)
+	}{
+		{"/chains/main/blocks/head/helpers/scripts/run_script_view", func(c *rpc.Client, r rpc.RunViewRequest) (*rpc.RunViewResponse, error) {
+			return c.RunScriptView(context.Background(), rpc.Head, r)
+		}},
+		{"/chains/main/blocks/head/helpers/scripts/run_view", func(c *rpc.Client, r rpc.RunViewRequest) (*rpc.RunViewResponse, error) {
+			return c.RunScriptCallback(context.Background(), rpc.Head, r)
+		}},
+	} {
+		var req map[string]any
+		c := scriptNode(t, v.path, 200, `{"data":{"string":"ok"}}`, &req)
+		res, err := v.call(c, rpc.RunViewRequest{
+			Contract: testKT1,
+			View:     "get",
+			Input:    micheline.NewPrim(micheline.D_UNIT),
+			Mode:     "Readable",
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", v.path, err)
+		}
+		if res.Data.String != "ok" {
+			t.Errorf("%s: mismatched data got=%s", v.path, res.Data.Dump())
+		}
+		if got := req["contract"]; got != testKT1.String() {
+			t.Errorf("%s: mismatched contract got=%v", v.path, got)
+		}
+		if got := req["chain_id"]; got != testChainId.String() {
+			t.Errorf("%s: mismatched chain id got=%v", v.path, got)
+		}
+	}
+}
+
+func TestRunOp(t *testing.T) {
+	reply := `{"contents":[{"kind":"transaction","source":"` + testKey.Address().String() + `","fee":"0","counter":"11","gas_limit":"1040000","storage_limit":"60000","amount":"1","destination":"` + testDest.String() + `","metadata":{"operation_result":{"status":"applied","consumed_milligas":"100000"}}}]}`
+	op := testCounterOp(10, 1, false).WithBranch(mavryk.MustParseBlockHash("BKnYk1T5a49bb8me4WfQeugyFnMEH9h8cm6jqvL3BxRwE23EVBJ"))
+	for _, v := range []struct {
+		path string
+		call func(*rpc.Client, rpc.RunOperationRequest) (*rpc.Operation, error)
+	}{
+		{"/chains/main/blocks/head/helpers/scripts/run_operation", func(c *rpc.Client, r rpc.RunOperationRequest) (*rpc.Operation, error) {
+			return c.RunOp(context.Background(), rpc.Head, r)
+		}},
+		{"/chains/main/blocks/head/helpers/scripts/simulate_operation", func(c *rpc.Client, r rpc.RunOperationRequest) (*rpc.Operation, error) {
+			return c.SimulateOp(context.Background(), rpc.Head, r)
+		}},
+	} {
+		var req map[string]any
+		c := scriptNode(t, v.path, 200, reply, &req)
+		res, err := v.call(c, rpc.RunOperationRequest{Operation: op})
+		if err != nil {
+			t.Fatalf("%s: %v", v.path, err)
+		}
+		if len(res.Contents) != 1 {
+			t.Fatalf("%s: mismatched contents got=%d want=%d", v.path, len(res.Contents), 1)
+		}
+		if gas := res.TotalCosts().GasUsed; gas != 100 {
+			t.Errorf("%s: mismatched gas got=%d want=%d", v.path, gas, 100)
+		}
+		if got := req["chain_id"]; got != testChainId.String() {
+			t.Errorf("%s: mismatched chain id got=%v", v.path, got)
+		}
+		if _, ok := req["operation"].(map[string]any); !ok {
+			t.Errorf("%s: missing operation in request", v.path)
+		}
+	}
+
+	// forge returns the node's bytes
+	var req map[string]any
+	c := scriptNode(t, "/chains/main/blocks/head/helpers/forge/operations", 200, `"0a0b0c"`, &req)
+	buf, err := c.ForgeOp(context.Background(), rpc.Head, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mavryk.HexBytes(buf).String(); got != "0a0b0c" {
+		t.Errorf("mismatched forged bytes got=%s want=%s", got, "0a0b0c")
+	}
+	if got := req["branch"]; got != op.Branch.String() {
+		t.Errorf("mismatched branch got=%v", got)
+	}
+}
+
+func TestScriptError(t *testing.T) {
+	var req map[string]any
+	c := scriptNode(t, "/chains/main/blocks/head/helpers/scripts/run_code", 500,
+		`[{"kind":"temporary","id":"proto.001-PtAtLas.michelson_v1.runtime_error","contract_handle":"`+testKT1.String()+`","contract_code":"Deprecated"},`+
+			`{"kind":"temporary","id":"proto.001-PtAtLas.michelson_v1.script_rejected","location":42,"with":{"string":"NOT_OWNER"}}]`, &req)
+	_, err := c.RunScript(context.Background(), rpc.Head, testRunCodeRequest(t))
+	var serr *rpc.ScriptError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected script error, got %T %v", err, err)
+	}
+	if serr.Location != 42 {
+		t.Errorf("mismatched location got=%d want=%d", serr.Location, 42)
+	}
+	if !serr.IsFailwith() || serr.With.String != "NOT_OWNER" {
+		t.Errorf("mismatched failwith value got=%s", serr.With.Dump())
+	}
+	if status := rpc.ErrorStatus(err); status != 500 {
+		t.Errorf("mismatched status got=%d want=%d", status, 500)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "at location 42") || !strings.Contains(msg, "NOT_OWNER") {
+		t.Errorf("incomplete error message %q", msg)
+	}
+
+	// interpreter errors without FAILWITH keep the location
+	c = scriptNode(t, "/chains/main/blocks/head/helpers/scripts/run_code", 500,
+		`[{"kind":"temporary","id":"proto.001-PtAtLas.michelson_v1.script_overflow","location":17}]`, &req)
+	_, err = c.RunScript(context.Background(), rpc.Head, testRunCodeRequest(t))
+	if !errors.As(err, &serr) || serr.Location != 17 || serr.IsFailwith() {
+		t.Errorf("overflow: mismatched script error %v", err)
+	}
+
+	// other node errors are passed on unchanged
+	c = scriptNode(t, "/chains/main/blocks/head/helpers/scripts/run_code", 500,
+		`[{"kind":"temporary","id":"proto.001-PtAtLas.gas_exhausted.operation"}]`, &req)
+	_, err = c.RunScript(context.Background(), rpc.Head, testRunCodeRequest(t))
+	if errors.As(err, &serr) {
+		t.Errorf("unexpected script error for %v", err)
+	}
+	var rerr rpc.RPCError
+	if !errors.As(err, &rerr) || rerr.ErrorID() != "proto.001-PtAtLas.gas_exhausted.operation" {
+		t.Errorf("mismatched rpc error %v", err)
+	}
+}
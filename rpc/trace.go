@@ -0,0 +1,106 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mavryk-network/gomavryk/micheline"
+)
+
+// TraceCodeResponse is the result of the trace_code RPC.
+type TraceCodeResponse struct {
+	Operations      []Operation            `json:"operations"`
+	Storage         micheline.Prim         `json:"storage"`
+	BigmapDiff      micheline.BigmapEvents `json:"big_map_diff,omitempty"`
+	LazyStorageDiff micheline.LazyEvents   `json:"lazy_storage_diff,omitempty"`
+	Trace           []TraceEntry           `json:"trace"`
+}
+
+// TraceEntry is a single execution step in a trace_code result. Location is
+// the canonical Micheline location of the executed instruction, Gas the
+// remaining milligas and Stack the untyped stack after the instruction with
+// the top element first.
+type TraceEntry struct {
+	Location int              `json:"location"`
+	Gas      int64            `json:"gas"`
+	Stack    []micheline.Prim `json:"stack"`
+}
+
+// {"location":7,"gas":"1039991.33","stack":[{"item":{"int":"1"},"annot":"@x"}]}
+func (e *TraceEntry) UnmarshalJSON(buf []byte) error {
+	var v struct {
+		Location int               `json:"location"`
+		Gas      json.RawMessage   `json:"gas"`
+		Stack    []json.RawMessage `json:"stack"`
+	}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return err
+	}
+	gas, err := parseMilligas(string(bytes.Trim(v.Gas, `"`)))
+	if err != nil {
+		return fmt.Errorf("trace entry: invalid gas %s: %w", string(v.Gas), err)
+	}
+	e.Location = v.Location
+	e.Gas = gas
+	e.Stack = make([]micheline.Prim, len(v.Stack))
+	for i, data := range v.Stack {
+		var item struct {
+			Item *micheline.Prim `json:"item"`
+		}
+		if err := json.Unmarshal(data, &item); err == nil && item.Item != nil {
+			e.Stack[i] = *item.Item
+			continue
+		}
+		if err := json.Unmarshal(data, &e.Stack[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMilligas converts a decimal gas amount like 1039991.33 or the
+// literal unaccounted into milligas. Unaccounted gas is returned as -1.
+func parseMilligas(s string) (int64, error) {
+	if s == "" || s == "null" {
+		return 0, nil
+	}
+	if s == "unaccounted" {
+		return -1, nil
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	n, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if len(frac) > 3 {
+		frac = frac[:3]
+	}
+	frac += strings.Repeat("0", 3-len(frac))
+	f, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n*1000 + f, nil
+}
+
+// Steps converts the trace into typed steps of script code using the local
+// typechecker. Stack values are typed with the stack types after each
+// instruction. When the script was parsed from Michelson source with a
+// source map, steps carry source positions. The source map is optional.
+func (r TraceCodeResponse) Steps(code micheline.Code, src *micheline.SourceMap) ([]micheline.TraceStep, error) {
+	t, err := micheline.NewTracer(code, src)
+	if err != nil {
+		return nil, err
+	}
+	steps := make([]micheline.TraceStep, len(r.Trace))
+	for i, v := range r.Trace {
+		steps[i] = t.Step(v.Location, v.Gas, v.Stack)
+	}
+	return steps, nil
+}
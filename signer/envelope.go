@@ -0,0 +1,52 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package signer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+// SignEnvelope signs the operation in an unsigned envelope and stores the
+// signature in the envelope. The operation is decoded from the envelope's
+// forged bytes after checking that the envelope's summary and other
+// descriptive fields match them. The envelope source selects the signing key.
+// Envelopes without source are signed with the signer's first address.
+// The signature is verified against the signer's public key before it is
+// stored. SignEnvelope needs no network access and is meant for offline
+// machines.
+func SignEnvelope(ctx context.Context, s Signer, e *codec.Envelope) error {
+	op, err := e.Op()
+	if err != nil {
+		return err
+	}
+	addr := e.Source
+	if !addr.IsValid() {
+		addrs, err := s.ListAddresses(ctx)
+		if err != nil {
+			return err
+		}
+		if len(addrs) == 0 {
+			return fmt.Errorf("signer: no signing address")
+		}
+		addr = addrs[0]
+	}
+	key, err := s.GetKey(ctx, addr)
+	if err != nil {
+		return err
+	}
+	op.Signature = mavryk.InvalidSignature
+	sig, err := s.SignOperation(ctx, addr, op)
+	if err != nil {
+		return err
+	}
+	if err := key.VerifyMessage(op.WatermarkedBytes(), sig); err != nil {
+		return fmt.Errorf("signer: invalid signature for %s: %w", addr, err)
+	}
+	e.WithSignature(sig)
+	return nil
+}
@@ -39,13 +39,7 @@ func (s MemorySigner) SignMessage(_ context.Context, addr mavryk.Address, msg st
 	if !s.key.Address().Equal(addr) {
 		return mavryk.InvalidSignature, ErrAddressMismatch
 	}
-	op := codec.NewOp().
-		WithBranch(mavryk.ZeroBlockHash).
-		WithContents(&codec.FailingNoop{
-			Arbitrary: msg,
-		})
-	digest := mavryk.Digest(op.Bytes())
-	return s.key.Sign(digest[:])
+	return s.key.SignMessage(codec.WatermarkedMessage(msg, nil))
 }
 
 func (s MemorySigner) SignOperation(_ context.Context, addr mavryk.Address, op *codec.Op) (mavryk.Signature, error) {
@@ -6,6 +6,7 @@ package remote
 import (
 	"context"
 	"net/http"
+	"sync"
 
 	"github.com/mavryk-network/gomavryk/codec"
 	"github.com/mavryk-network/gomavryk/mavryk"
@@ -19,6 +20,33 @@ type RemoteSigner struct {
 	c     *rpc.Client
 	addrs []mavryk.Address
 	auth  mavryk.PrivateKey
+	keys  *keyCache
+}
+
+// keyCache stores public keys fetched from the remote signer. A nil cache
+// stores nothing, so signers which are not created by New still work.
+type keyCache struct {
+	sync.RWMutex
+	m map[mavryk.Address]mavryk.Key
+}
+
+func (c *keyCache) get(addr mavryk.Address) (mavryk.Key, bool) {
+	if c == nil {
+		return mavryk.InvalidKey, false
+	}
+	c.RLock()
+	defer c.RUnlock()
+	k, ok := c.m[addr]
+	return k, ok
+}
+
+func (c *keyCache) put(addr mavryk.Address, k mavryk.Key) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.m[addr] = k
 }
 
 // New creates a new remote signer client and initializes it with the remote url.
@@ -29,7 +57,10 @@ func New(url string, client *http.Client) (*RemoteSigner, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &RemoteSigner{c: c}, nil
+	return &RemoteSigner{
+		c:    c,
+		keys: &keyCache{m: make(map[mavryk.Address]mavryk.Key)},
+	}, nil
 }
 
 func (s *RemoteSigner) WithAddress(addr mavryk.Address) *RemoteSigner {
@@ -37,6 +68,8 @@ func (s *RemoteSigner) WithAddress(addr mavryk.Address) *RemoteSigner {
 	return s
 }
 
+// WithAuthKey sets the key used to authenticate signing and nonce requests
+// for remote signers which require authorized keys.
 func (s *RemoteSigner) WithAuthKey(sk mavryk.PrivateKey) *RemoteSigner {
 	s.auth = sk
 	return s
@@ -56,19 +89,92 @@ func (s RemoteSigner) AuthorizedKeys(ctx context.Context) ([]mavryk.Address, err
 	return resp.Addrs, nil
 }
 
+// KnownKeys returns a list of addresses the remote signer manages. Signers may
+// not expose this list, in which case the request fails with 404 Not Found.
+func (s RemoteSigner) KnownKeys(ctx context.Context) ([]mavryk.Address, error) {
+	type response struct {
+		Addrs []mavryk.Address `json:"known_keys"`
+	}
+	var resp response
+	err := s.c.Get(ctx, "/known_keys", &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Addrs, nil
+}
+
 // ListAddresses returns a list of addresses the remote signer can produce signatures for.
+// Without addresses configured by WithAddress, the remote signer's known keys are
+// used when available.
 func (s RemoteSigner) ListAddresses(ctx context.Context) ([]mavryk.Address, error) {
-	return s.addrs, nil
+	if len(s.addrs) > 0 {
+		return s.addrs, nil
+	}
+	addrs, err := s.KnownKeys(ctx)
+	if err != nil && rpc.ErrorStatus(err) != http.StatusNotFound {
+		return nil, err
+	}
+	return addrs, nil
 }
 
-// GetKey returns the public key associated with address.
+// GetKey returns the public key associated with address. Keys are fetched
+// once and cached.
 func (s RemoteSigner) GetKey(ctx context.Context, address mavryk.Address) (mavryk.Key, error) {
+	if pk, ok := s.keys.get(address); ok {
+		return pk, nil
+	}
 	type response struct {
 		Pk mavryk.Key `json:"public_key"`
 	}
 	var resp response
 	err := s.c.Get(ctx, "/keys/"+address.String(), &resp)
-	return resp.Pk, err
+	if err != nil {
+		return resp.Pk, err
+	}
+	s.keys.put(address, resp.Pk)
+	return resp.Pk, nil
+}
+
+// SupportsDeterministicNonces returns true when the remote signer can derive
+// deterministic nonces for address.
+func (s RemoteSigner) SupportsDeterministicNonces(ctx context.Context, address mavryk.Address) (bool, error) {
+	var ok bool
+	err := s.c.Get(ctx, "/keys/"+address.String()+"/supports_deterministic_nonces", &ok)
+	if err != nil && rpc.ErrorStatus(err) == http.StatusNotFound {
+		return false, nil
+	}
+	return ok, err
+}
+
+// DeterministicNonce returns a nonce the remote signer derives from data and the
+// secret key of address. Bakers use it to create seed nonces which can be
+// recovered from the signer.
+func (s RemoteSigner) DeterministicNonce(ctx context.Context, address mavryk.Address, data []byte) ([]byte, error) {
+	type response struct {
+		Nonce mavryk.HexBytes `json:"deterministic_nonce"`
+	}
+	var resp response
+	path, err := s.authorize("/keys/"+address.String()+"/deterministic_nonce", authTagNonce, address, data)
+	if err != nil {
+		return nil, err
+	}
+	err = s.c.Post(ctx, path, mavryk.HexBytes(data), &resp)
+	return resp.Nonce, err
+}
+
+// DeterministicNonceHash returns the hash of the deterministic nonce for data
+// without revealing the nonce itself.
+func (s RemoteSigner) DeterministicNonceHash(ctx context.Context, address mavryk.Address, data []byte) ([]byte, error) {
+	type response struct {
+		Hash mavryk.HexBytes `json:"deterministic_nonce_hash"`
+	}
+	var resp response
+	path, err := s.authorize("/keys/"+address.String()+"/deterministic_nonce_hash", authTagNonceHash, address, data)
+	if err != nil {
+		return nil, err
+	}
+	err = s.c.Post(ctx, path, mavryk.HexBytes(data), &resp)
+	return resp.Hash, err
 }
 
 // SignMessage signs msg for address by wrapping it into a failing noop operation
@@ -78,12 +184,7 @@ func (s RemoteSigner) GetKey(ctx context.Context, address mavryk.Address) (mavry
 // Note that most remote signers for Mavryk do not support signing of operation kinds other
 // than baking related operations.
 func (s RemoteSigner) SignMessage(ctx context.Context, address mavryk.Address, msg string) (mavryk.Signature, error) {
-	op := codec.NewOp().
-		WithBranch(mavryk.ZeroBlockHash).
-		WithContents(&codec.FailingNoop{
-			Arbitrary: msg,
-		})
-	return s.SignOperation(ctx, address, op)
+	return s.sign(ctx, address, codec.WatermarkedMessage(msg, nil))
 }
 
 // SignOperation signs operation op for address using the configured remote signer's
@@ -92,21 +193,38 @@ func (s RemoteSigner) SignMessage(ctx context.Context, address mavryk.Address, m
 // Note that most remote signers for Mavryk do not support signing of operation kinds other
 // than baking related operations.
 func (s RemoteSigner) SignOperation(ctx context.Context, address mavryk.Address, op *codec.Op) (mavryk.Signature, error) {
-	type response struct {
-		Sig mavryk.Signature `json:"signature"`
-	}
-	var resp response
-	err := s.c.Post(ctx, "/keys/"+address.String(), mavryk.HexBytes(op.WatermarkedBytes()), &resp)
-	return resp.Sig, err
+	return s.sign(ctx, address, op.WatermarkedBytes())
 }
 
 // SignOperation signs a block header for address using the configured remote signer's
 // REST API. This call requires branch_id to be present.
 func (s RemoteSigner) SignBlock(ctx context.Context, address mavryk.Address, head *codec.BlockHeader) (mavryk.Signature, error) {
+	return s.sign(ctx, address, head.WatermarkedBytes())
+}
+
+// sign sends watermarked data to the remote signer.
+func (s RemoteSigner) sign(ctx context.Context, address mavryk.Address, data []byte) (mavryk.Signature, error) {
 	type response struct {
 		Sig mavryk.Signature `json:"signature"`
 	}
 	var resp response
-	err := s.c.Post(ctx, "/keys/"+address.String(), mavryk.HexBytes(head.WatermarkedBytes()), &resp)
+	path, err := s.authorize("/keys/"+address.String(), authTagSign, address, data)
+	if err != nil {
+		return mavryk.InvalidSignature, err
+	}
+	err = s.c.Post(ctx, path, mavryk.HexBytes(data), &resp)
 	return resp.Sig, err
 }
+
+// authorize adds an authentication signature to request path when an auth key
+// is configured. The auth key signs the request tag, address and data.
+func (s RemoteSigner) authorize(path string, tag byte, address mavryk.Address, data []byte) (string, error) {
+	if !s.auth.IsValid() {
+		return path, nil
+	}
+	sig, err := s.auth.SignMessage(authMessage(tag, address, data))
+	if err != nil {
+		return "", err
+	}
+	return path + "?authentication=" + sig.String(), nil
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/rpc"
+)
+
+// stubSigner is a remote signer endpoint which records requests and checks
+// authentication signatures.
+type stubSigner struct {
+	sync.Mutex
+	sk      mavryk.PrivateKey
+	auth    mavryk.Key
+	known   bool
+	nonces  bool
+	calls   map[string]int
+	authErr []string
+}
+
+func (s *stubSigner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.calls[r.Method+" "+r.URL.Path]++
+	s.Unlock()
+	pkh := "/keys/" + s.sk.Address().String()
+	switch {
+	case r.URL.Path == "/known_keys" && s.known:
+		writeJSON(w, map[string][]mavryk.Address{"known_keys": {s.sk.Address()}})
+	case r.URL.Path == pkh && r.Method == http.MethodGet:
+		writeJSON(w, map[string]mavryk.Key{"public_key": s.sk.Public()})
+	case r.URL.Path == pkh+"/supports_deterministic_nonces" && s.nonces:
+		writeJSON(w, true)
+	case r.URL.Path == pkh && r.Method == http.MethodPost:
+		data := s.check(w, r, authTagSign)
+		if data == nil {
+			return
+		}
+		sig, _ := s.sk.Sign(data)
+		writeJSON(w, map[string]mavryk.Signature{"signature": sig})
+	case r.URL.Path == pkh+"/deterministic_nonce" && s.nonces:
+		if data := s.check(w, r, authTagNonce); data != nil {
+			writeJSON(w, map[string]mavryk.HexBytes{"deterministic_nonce": data})
+		}
+	case r.URL.Path == pkh+"/deterministic_nonce_hash" && s.nonces:
+		if data := s.check(w, r, authTagNonceHash); data != nil {
+			d := mavryk.Digest(data)
+			writeJSON(w, map[string]mavryk.HexBytes{"deterministic_nonce_hash": d[:]})
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// check decodes the request body and verifies the authentication query
+// against authMessage for tag.
+func (s *stubSigner) check(w http.ResponseWriter, r *http.Request, tag byte) []byte {
+	var data mavryk.HexBytes
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	sig, err := mavryk.ParseSignature(r.URL.Query().Get("authentication"))
+	if err == nil {
+		msg := authMessage(tag, s.sk.Address(), data)
+		if s.auth.Type != mavryk.KeyTypeBls12_381 {
+			d := mavryk.Digest(msg)
+			msg = d[:]
+		}
+		err = s.auth.Verify(msg, sig)
+	}
+	if err != nil {
+		s.Lock()
+		s.authErr = append(s.authErr, r.URL.Path+": "+err.Error())
+		s.Unlock()
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil
+	}
+	return data
+}
+
+func newStubSigner(t *testing.T, sk mavryk.PrivateKey, auth mavryk.Key) (*stubSigner, *RemoteSigner) {
+	t.Helper()
+	stub := &stubSigner{
+		sk:    sk,
+		auth:  auth,
+		calls: make(map[string]int),
+	}
+	ts := httptest.NewServer(stub)
+	t.Cleanup(ts.Close)
+	rs, err := New(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stub, rs
+}
+
+func TestClientAuthentication(t *testing.T) {
+	ctx := context.Background()
+	sk := testKeys[0]
+	for _, ak := range testKeys {
+		stub, rs := newStubSigner(t, sk, ak.Public())
+		stub.nonces = true
+		op := testTransfer(sk.Address())
+
+		// unauthenticated requests are rejected
+		if _, err := rs.SignOperation(ctx, sk.Address(), op); rpc.ErrorStatus(err) != http.StatusUnauthorized {
+			t.Errorf("%s: unauthenticated: unexpected error %v", ak.Type, err)
+		}
+
+		rs.WithAuthKey(ak)
+		if _, err := rs.SignOperation(ctx, sk.Address(), op); err != nil {
+			t.Errorf("%s: operation: %v", ak.Type, err)
+		}
+		if _, err := rs.SignBlock(ctx, sk.Address(), testBlock(1, 0)); err != nil {
+			t.Errorf("%s: block: %v", ak.Type, err)
+		}
+		if _, err := rs.SignMessage(ctx, sk.Address(), "hello"); err != nil {
+			t.Errorf("%s: message: %v", ak.Type, err)
+		}
+		nonce, err := rs.DeterministicNonce(ctx, sk.Address(), []byte{1, 2, 3})
+		if err != nil || mavryk.HexBytes(nonce).String() != "010203" {
+			t.Errorf("%s: nonce: %x %v", ak.Type, nonce, err)
+		}
+		if _, err := rs.DeterministicNonceHash(ctx, sk.Address(), []byte{1, 2, 3}); err != nil {
+			t.Errorf("%s: nonce hash: %v", ak.Type, err)
+		}
+		if len(stub.authErr) != 1 || !strings.HasPrefix(stub.authErr[0], "/keys/") {
+			t.Errorf("%s: unexpected authentication failures %v", ak.Type, stub.authErr)
+		}
+	}
+}
+
+func TestClientMessagePayload(t *testing.T) {
+	sk := testKeys[0]
+	var body mavryk.HexBytes
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		writeJSON(w, map[string]mavryk.Signature{"signature": mavryk.InvalidSignature})
+	}))
+	defer ts.Close()
+	rs, _ := New(ts.URL, nil)
+	_, _ = rs.SignMessage(context.Background(), sk.Address(), "hello")
+	if want := mavryk.HexBytes(codec.WatermarkedMessage("hello", nil)); body.String() != want.String() {
+		t.Errorf("mismatched message payload\n    have: %s\n    want: %s", body, want)
+	}
+}
+
+func TestClientKnownKeys(t *testing.T) {
+	ctx := context.Background()
+	sk := testKeys[0]
+	stub, rs := newStubSigner(t, sk, mavryk.InvalidKey)
+
+	// signer without known keys
+	if _, err := rs.KnownKeys(ctx); rpc.ErrorStatus(err) != http.StatusNotFound {
+		t.Errorf("known keys: unexpected error %v", err)
+	}
+	addrs, err := rs.ListAddresses(ctx)
+	if err != nil || len(addrs) != 0 {
+		t.Errorf("list without known keys: %v %v", addrs, err)
+	}
+
+	// signer with known keys
+	stub.known = true
+	addrs, err = rs.ListAddresses(ctx)
+	if err != nil || len(addrs) != 1 || !addrs[0].Equal(sk.Address()) {
+		t.Errorf("list with known keys: %v %v", addrs, err)
+	}
+
+	// configured addresses take precedence
+	other := testKeys[1].Address()
+	rs.WithAddress(other)
+	calls := stub.calls["GET /known_keys"]
+	addrs, err = rs.ListAddresses(ctx)
+	if err != nil || len(addrs) != 1 || !addrs[0].Equal(other) {
+		t.Errorf("list with address: %v %v", addrs, err)
+	}
+	if stub.calls["GET /known_keys"] != calls {
+		t.Errorf("list with address: unexpected known keys request")
+	}
+}
+
+func TestClientGetKey(t *testing.T) {
+	ctx := context.Background()
+	sk := testKeys[3]
+	stub, rs := newStubSigner(t, sk, mavryk.InvalidKey)
+	path := "GET /keys/" + sk.Address().String()
+	for i := 0; i < 3; i++ {
+		pk, err := rs.GetKey(ctx, sk.Address())
+		if err != nil || pk.String() != sk.Public().String() {
+			t.Fatalf("get key: %s %v", pk, err)
+		}
+	}
+	if n := stub.calls[path]; n != 1 {
+		t.Errorf("get key: expected 1 request, got %d", n)
+	}
+
+	// unknown keys are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := rs.GetKey(ctx, testKeys[0].Address()); rpc.ErrorStatus(err) != http.StatusNotFound {
+			t.Errorf("unknown key: unexpected error %v", err)
+		}
+	}
+	if n := stub.calls["GET /keys/"+testKeys[0].Address().String()]; n != 2 {
+		t.Errorf("unknown key: expected 2 requests, got %d", n)
+	}
+
+	// signers without cache fetch every time
+	plain := RemoteSigner{c: rs.c}
+	for i := 0; i < 2; i++ {
+		if _, err := plain.GetKey(ctx, sk.Address()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := stub.calls[path]; n != 3 {
+		t.Errorf("no cache: expected 3 requests, got %d", n)
+	}
+}
+
+func TestClientDeterministicNonces(t *testing.T) {
+	ctx := context.Background()
+	sk := testKeys[0]
+	stub, rs := newStubSigner(t, sk, mavryk.InvalidKey)
+	ok, err := rs.SupportsDeterministicNonces(ctx, sk.Address())
+	if err != nil || ok {
+		t.Errorf("unsupported: %v %v", ok, err)
+	}
+	stub.nonces = true
+	ok, err = rs.SupportsDeterministicNonces(ctx, sk.Address())
+	if err != nil || !ok {
+		t.Errorf("supported: %v %v", ok, err)
+	}
+
+	// the server package never supports nonces
+	_, _, srs := newTestServer(t, nil)
+	ok, err = srs.SupportsDeterministicNonces(ctx, sk.Address())
+	if err != nil || ok {
+		t.Errorf("server: %v %v", ok, err)
+	}
+}
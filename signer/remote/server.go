@@ -0,0 +1,364 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/signer"
+)
+
+// maxRequestSize limits the size of signing request bodies.
+const maxRequestSize = 1 << 20
+
+// Tags which prefix authenticated request messages.
+const (
+	authTagSign      byte = 0x04
+	authTagNonce     byte = 0x05
+	authTagNonceHash byte = 0x06
+)
+
+var (
+	ErrUnauthorized    = errors.New("remote: unauthorized request")
+	ErrMagicNotAllowed = errors.New("remote: magic byte not allowed")
+)
+
+// Server is a http.Handler which serves the Mavryk remote signer protocol
+// backed by any signer.Signer. Supported endpoints are
+//
+//   - GET /authorized_keys
+//   - GET /known_keys (when enabled)
+//   - GET /keys/<pkh>
+//   - GET /keys/<pkh>/supports_deterministic_nonces (always false)
+//   - POST /keys/<pkh>?authentication=<signature>
+//
+// Signing requests contain a watermarked operation (0x03), block (0x11),
+// preattestation (0x12) or attestation (0x13) as hex string. Payloads are
+// decoded and passed to the signer's SignOperation or SignBlock methods.
+// Other magic bytes are rejected.
+//
+// When authorized keys are configured, signing requests must be
+// authenticated by one of these keys. Each signing request creates an
+// AuditRecord which is logged at info level unless a custom audit
+// function is set.
+type Server struct {
+	signer signer.Signer
+	auth   []mavryk.Key
+	magic  []byte
+	known  bool
+	params *mavryk.Params
+	audit  func(AuditRecord)
+}
+
+// AuditRecord describes a signing request and its outcome.
+type AuditRecord struct {
+	Time      time.Time       `json:"time"`
+	Remote    string          `json:"remote"`
+	Address   mavryk.Address  `json:"address"`
+	AuthKey   string          `json:"auth_key,omitempty"`
+	Magic     string          `json:"magic,omitempty"`
+	Kind      string          `json:"kind,omitempty"`
+	ChainId   string          `json:"chain_id,omitempty"`
+	Level     int64           `json:"level,omitempty"`
+	Round     int64           `json:"round,omitempty"`
+	Digest    mavryk.HexBytes `json:"digest,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+	Status    int             `json:"status"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// NewServer creates a remote signer server for signer s. By default requests
+// are unauthenticated and all supported magic bytes are allowed.
+func NewServer(s signer.Signer) *Server {
+	return &Server{
+		signer: s,
+		params: mavryk.DefaultParams,
+		audit:  logAudit,
+	}
+}
+
+// WithAuthorizedKeys requires signing requests to be authenticated by one of keys.
+func (s *Server) WithAuthorizedKeys(keys ...mavryk.Key) *Server {
+	s.auth = append(s.auth, keys...)
+	return s
+}
+
+// WithMagicBytes restricts signing requests to payloads starting with one
+// of magic bytes, e.g. 0x11, 0x12 and 0x13 for a baker.
+func (s *Server) WithMagicBytes(magic ...byte) *Server {
+	s.magic = append(s.magic, magic...)
+	return s
+}
+
+// WithKnownKeys exposes the addresses managed by the signer at /known_keys.
+func (s *Server) WithKnownKeys() *Server {
+	s.known = true
+	return s
+}
+
+// WithParams sets the protocol params used to decode operations.
+func (s *Server) WithParams(p *mavryk.Params) *Server {
+	s.params = p
+	return s
+}
+
+// WithAudit replaces the default audit log with fn. Fn is called for every
+// signing request and must be safe for concurrent use.
+func (s *Server) WithAudit(fn func(AuditRecord)) *Server {
+	s.audit = fn
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/authorized_keys":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveAuthorizedKeys(w)
+	case r.URL.Path == "/known_keys" && s.known:
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveKnownKeys(w, r)
+	case strings.HasPrefix(r.URL.Path, "/keys/"):
+		pkh, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/keys/"), "/")
+		addr, err := mavryk.ParseAddress(pkh)
+		if err != nil || !addr.IsEOA() {
+			http.Error(w, "invalid public key hash", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case sub == "supports_deterministic_nonces" && r.Method == http.MethodGet:
+			// signer.Signer cannot derive nonces
+			writeJSON(w, false)
+			return
+		case sub != "":
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.serveKey(w, r, addr)
+		case http.MethodPost:
+			s.serveSign(w, r, addr)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveAuthorizedKeys(w http.ResponseWriter) {
+	// an empty object tells clients that no authentication is required
+	resp := make(map[string][]mavryk.Address)
+	if len(s.auth) > 0 {
+		addrs := make([]mavryk.Address, len(s.auth))
+		for i, k := range s.auth {
+			addrs[i] = k.Address()
+		}
+		resp["authorized_keys"] = addrs
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) serveKnownKeys(w http.ResponseWriter, r *http.Request) {
+	addrs, err := s.signer.ListAddresses(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string][]mavryk.Address{"known_keys": addrs})
+}
+
+func (s *Server) serveKey(w http.ResponseWriter, r *http.Request, addr mavryk.Address) {
+	key, err := s.signer.GetKey(r.Context(), addr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]mavryk.Key{"public_key": key})
+}
+
+func (s *Server) serveSign(w http.ResponseWriter, r *http.Request, addr mavryk.Address) {
+	rec := AuditRecord{
+		Time:    time.Now().UTC(),
+		Remote:  r.RemoteAddr,
+		Address: addr,
+	}
+	sig, status, err := s.sign(r, addr, &rec)
+	rec.Status = status
+	if err != nil {
+		rec.Error = err.Error()
+	} else {
+		rec.Signature = sig.String()
+	}
+	if s.audit != nil {
+		s.audit(rec)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, map[string]mavryk.Signature{"signature": sig})
+}
+
+// sign authenticates, checks and decodes a signing request and signs the
+// payload. It returns the HTTP status to reply with.
+func (s *Server) sign(r *http.Request, addr mavryk.Address, rec *AuditRecord) (mavryk.Signature, int, error) {
+	var data mavryk.HexBytes
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(&data); err != nil {
+		return mavryk.InvalidSignature, http.StatusBadRequest, fmt.Errorf("remote: invalid request: %w", err)
+	}
+	if len(data) == 0 {
+		return mavryk.InvalidSignature, http.StatusBadRequest, fmt.Errorf("remote: empty request")
+	}
+	rec.Magic = fmt.Sprintf("0x%02x", data[0])
+	digest := mavryk.Digest(data)
+	rec.Digest = digest[:]
+
+	// authenticate
+	if len(s.auth) > 0 {
+		key, err := s.authenticate(addr, data, r.URL.Query().Get("authentication"))
+		if err != nil {
+			return mavryk.InvalidSignature, http.StatusUnauthorized, err
+		}
+		rec.AuthKey = key.Address().String()
+	}
+
+	// check allow-list
+	if len(s.magic) > 0 && bytes.IndexByte(s.magic, data[0]) < 0 {
+		return mavryk.InvalidSignature, http.StatusForbidden, fmt.Errorf("%w: %s", ErrMagicNotAllowed, rec.Magic)
+	}
+
+	// decode and sign, the signer must sign exactly what was requested
+	ctx := r.Context()
+	switch data[0] {
+	case codec.TenderbakeBlockWatermark:
+		head, err := codec.DecodeWatermarkedBlock(data)
+		if err != nil {
+			return mavryk.InvalidSignature, http.StatusBadRequest, err
+		}
+		rec.Kind = "block"
+		rec.ChainId = head.ChainId.String()
+		rec.Level = int64(head.Level)
+		rec.Round = int64(head.Round())
+		if !bytes.Equal(head.WatermarkedBytes(), data) {
+			return mavryk.InvalidSignature, http.StatusBadRequest, fmt.Errorf("remote: unsupported block encoding")
+		}
+		sig, err := s.signer.SignBlock(ctx, addr, head)
+		if err != nil {
+			return mavryk.InvalidSignature, signStatus(err), err
+		}
+		return sig, http.StatusOK, nil
+
+	case codec.OperationWatermark, codec.TenderbakePreendorsementWatermark, codec.TenderbakeEndorsementWatermark:
+		op, err := codec.DecodeWatermarkedOp(data, s.params)
+		if err == nil && len(op.Contents) == 0 {
+			err = fmt.Errorf("remote: empty operation contents")
+		}
+		if err != nil {
+			return mavryk.InvalidSignature, http.StatusBadRequest, err
+		}
+		kinds := make([]string, len(op.Contents))
+		for i, v := range op.Contents {
+			kinds[i] = v.Kind().String()
+		}
+		rec.Kind = strings.Join(kinds, ",")
+		if op.ChainId != nil {
+			rec.ChainId = op.ChainId.String()
+		}
+		switch v := op.Contents[0].(type) {
+		case *codec.TenderbakeEndorsement:
+			rec.Level, rec.Round = int64(v.Level), int64(v.Round)
+		case *codec.TenderbakePreendorsement:
+			rec.Level, rec.Round = int64(v.Level), int64(v.Round)
+		}
+		if !op.Branch.IsValid() {
+			// off-chain messages use a zero branch and have no Op encoding
+			noop, ok := op.Contents[0].(*codec.FailingNoop)
+			if !ok || len(op.Contents) > 1 || !bytes.Equal(codec.WatermarkedMessage(noop.Arbitrary, s.params), data) {
+				return mavryk.InvalidSignature, http.StatusBadRequest, fmt.Errorf("remote: unsupported operation with zero branch")
+			}
+			sig, err := s.signer.SignMessage(ctx, addr, noop.Arbitrary)
+			if err != nil {
+				return mavryk.InvalidSignature, signStatus(err), err
+			}
+			return sig, http.StatusOK, nil
+		}
+		if !bytes.Equal(op.WatermarkedBytes(), data) {
+			return mavryk.InvalidSignature, http.StatusBadRequest, fmt.Errorf("remote: unsupported operation encoding")
+		}
+		sig, err := s.signer.SignOperation(ctx, addr, op)
+		if err != nil {
+			return mavryk.InvalidSignature, signStatus(err), err
+		}
+		return sig, http.StatusOK, nil
+
+	default:
+		return mavryk.InvalidSignature, http.StatusBadRequest, fmt.Errorf("remote: unsupported magic byte %s", rec.Magic)
+	}
+}
+
+// signStatus returns the HTTP status for signer errors.
+func signStatus(err error) int {
+	if errors.Is(err, signer.ErrDoubleSigning) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// authenticate checks the authentication signature of a signing request
+// and returns the authorized key which created it.
+func (s *Server) authenticate(addr mavryk.Address, data []byte, auth string) (mavryk.Key, error) {
+	if auth == "" {
+		return mavryk.InvalidKey, ErrUnauthorized
+	}
+	sig, err := mavryk.ParseSignature(auth)
+	if err != nil {
+		return mavryk.InvalidKey, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	msg := authMessage(authTagSign, addr, data)
+	for _, k := range s.auth {
+		if k.VerifyMessage(msg, sig) == nil {
+			return k, nil
+		}
+	}
+	return mavryk.InvalidKey, ErrUnauthorized
+}
+
+// authMessage returns the message an authentication key signs to authorize
+// request tag on data with the key for addr.
+func authMessage(tag byte, addr mavryk.Address, data []byte) []byte {
+	msg := make([]byte, 0, 22+len(data))
+	msg = append(msg, tag)
+	msg = append(msg, addr.Encode()...)
+	return append(msg, data...)
+}
+
+func logAudit(rec AuditRecord) {
+	buf, _ := json.Marshal(rec)
+	if rec.Error != "" {
+		log.Warnf("audit: %s", buf)
+		return
+	}
+	log.Infof("audit: %s", buf)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,359 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+	"github.com/mavryk-network/gomavryk/rpc"
+	"github.com/mavryk-network/gomavryk/signer"
+)
+
+var (
+	testKeys = []mavryk.PrivateKey{
+		mavryk.MustParsePrivateKey("edsk4FTF78Qf1m2rykGpHqostAiq5gYW4YZEoGUSWBTJr2njsDHSnd"),
+		mavryk.MustParsePrivateKey("spsk2oTAhiaSywh9ctt8yZLRxL3bo8Mayd3hKFi5iBaoqj2R8bx7ow"),
+		mavryk.MustParsePrivateKey("p2sk35q9MJHLN1SBHNhKq7oho1vnZL28bYfsSKDUrDn2e4XVcp6ohZ"),
+		mavryk.MustParsePrivateKey("BLsk1eGhiPQXKtvvkBeXzmtVVJs6KPhEF45drF7MLjoCDcSnTGuyjL"),
+	}
+	testBranch  = mavryk.MustParseBlockHash("BKnYk1T5a49bb8me4WfQeugyFnMEH9h8cm6jqvL3BxRwE23EVBJ")
+	testChainId = mavryk.MustParseChainIdHash("NetXdQprcVkpaWU")
+	testPayload = mavryk.MustParsePayloadHash("vh1hqtJCryS2Uzb8KDU2PAp33U1nDCeUB4g9yWKTjgVhiy4x9pQA")
+)
+
+// auditLog collects audit records of a test server.
+type auditLog struct {
+	sync.Mutex
+	recs []AuditRecord
+}
+
+func (l *auditLog) add(r AuditRecord) {
+	l.Lock()
+	defer l.Unlock()
+	l.recs = append(l.recs, r)
+}
+
+func (l *auditLog) last(t *testing.T) AuditRecord {
+	t.Helper()
+	l.Lock()
+	defer l.Unlock()
+	if len(l.recs) == 0 {
+		t.Fatal("missing audit record")
+	}
+	return l.recs[len(l.recs)-1]
+}
+
+func newTestServer(t *testing.T, s signer.Signer) (*Server, *auditLog, *RemoteSigner) {
+	t.Helper()
+	log := new(auditLog)
+	srv := NewServer(s).WithAudit(log.add)
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	rs, err := New(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, log, rs
+}
+
+// verify checks sig over msg the way Mavryk nodes do.
+func verify(t *testing.T, pk mavryk.Key, msg []byte, sig mavryk.Signature) {
+	t.Helper()
+	if pk.Type != mavryk.KeyTypeBls12_381 {
+		d := mavryk.Digest(msg)
+		msg = d[:]
+	}
+	if err := pk.Verify(msg, sig); err != nil {
+		t.Errorf("%s: invalid signature: %v", pk.Type, err)
+	}
+}
+
+func testTransfer(src mavryk.Address) *codec.Op {
+	return codec.NewOp().
+		WithBranch(testBranch).
+		WithSource(src).
+		WithTransfer(src, 1000).
+		WithLimits([]mavryk.Limits{{Fee: 400, GasLimit: 1000}}, 0)
+}
+
+func testAttestation(level, round int32, slot int16) *codec.Op {
+	return codec.NewOp().
+		WithBranch(testBranch).
+		WithChainId(testChainId).
+		WithContents(&codec.TenderbakeEndorsement{
+			Slot:             slot,
+			Level:            level,
+			Round:            round,
+			BlockPayloadHash: testPayload,
+		})
+}
+
+func testBlock(level int32, round byte) *codec.BlockHeader {
+	h := &codec.BlockHeader{
+		Level:            level,
+		Proto:            1,
+		Predecessor:      testBranch,
+		Fitness:          []mavryk.HexBytes{{2}, {0, 0, 0, byte(level)}, {}, {0xff, 0xff, 0xff, 0xff}, {0, 0, 0, round}},
+		PayloadHash:      testPayload,
+		ProofOfWorkNonce: make([]byte, 8),
+		LbVote:           mavryk.FeatureVoteOn,
+		AiVote:           mavryk.FeatureVoteOn,
+	}
+	return h.WithChainId(testChainId)
+}
+
+func TestServerSign(t *testing.T) {
+	ctx := context.Background()
+	for _, sk := range testKeys {
+		_, log, rs := newTestServer(t, signer.NewFromKey(sk))
+		addr, pk := sk.Address(), sk.Public()
+
+		key, err := rs.GetKey(ctx, addr)
+		if err != nil {
+			t.Fatalf("%s: %v", sk.Type, err)
+		}
+		if key.String() != pk.String() {
+			t.Errorf("%s: mismatched key %s", sk.Type, key)
+		}
+
+		// off-chain message with zero branch
+		sig, err := rs.SignMessage(ctx, addr, "hello world")
+		if err != nil {
+			t.Fatalf("%s: message: %v", sk.Type, err)
+		}
+		verify(t, pk, codec.WatermarkedMessage("hello world", nil), sig)
+		if rec := log.last(t); rec.Kind != "failing_noop" || rec.Magic != "0x03" || rec.Status != http.StatusOK {
+			t.Errorf("%s: message: mismatched audit record %+v", sk.Type, rec)
+		}
+
+		// manager operation
+		op := testTransfer(addr)
+		sig, err = rs.SignOperation(ctx, addr, op)
+		if err != nil {
+			t.Fatalf("%s: operation: %v", sk.Type, err)
+		}
+		verify(t, pk, op.WatermarkedBytes(), sig)
+
+		// attestation
+		att := testAttestation(100, 2, 1)
+		sig, err = rs.SignOperation(ctx, addr, att)
+		if err != nil {
+			t.Fatalf("%s: attestation: %v", sk.Type, err)
+		}
+		verify(t, pk, att.WatermarkedBytes(), sig)
+		rec := log.last(t)
+		if rec.Magic != "0x13" || rec.Level != 100 || rec.Round != 2 || rec.ChainId != testChainId.String() || rec.Signature != sig.String() {
+			t.Errorf("%s: attestation: mismatched audit record %+v", sk.Type, rec)
+		}
+
+		// block
+		head := testBlock(5, 3)
+		sig, err = rs.SignBlock(ctx, addr, head)
+		if err != nil {
+			t.Fatalf("%s: block: %v", sk.Type, err)
+		}
+		verify(t, pk, head.WatermarkedBytes(), sig)
+		if rec := log.last(t); rec.Kind != "block" || rec.Level != 5 || rec.Round != 3 {
+			t.Errorf("%s: block: mismatched audit record %+v", sk.Type, rec)
+		}
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	ctx := context.Background()
+	sk := testKeys[0]
+	_, log, rs := newTestServer(t, signer.NewFromKey(sk))
+
+	// unknown key
+	if _, err := rs.GetKey(ctx, testKeys[1].Address()); rpc.ErrorStatus(err) != http.StatusNotFound {
+		t.Errorf("unknown key: unexpected error %v", err)
+	}
+
+	// wrong signing key
+	if _, err := rs.SignOperation(ctx, testKeys[1].Address(), testTransfer(testKeys[1].Address())); rpc.ErrorStatus(err) != http.StatusInternalServerError {
+		t.Errorf("wrong key: unexpected error %v", err)
+	}
+	if rec := log.last(t); rec.Status != http.StatusInternalServerError || !strings.Contains(rec.Error, signer.ErrAddressMismatch.Error()) {
+		t.Errorf("wrong key: mismatched audit record %+v", rec)
+	}
+
+	// unsupported magic byte
+	if _, err := rs.sign(ctx, sk.Address(), []byte{0x05, 0x01, 0x00}); rpc.ErrorStatus(err) != http.StatusBadRequest {
+		t.Errorf("micheline: unexpected error %v", err)
+	}
+
+	// zero branch operations must be messages
+	data := testTransfer(sk.Address()).WatermarkedBytes()
+	copy(data[1:33], make([]byte, 32))
+	if _, err := rs.sign(ctx, sk.Address(), data); rpc.ErrorStatus(err) != http.StatusBadRequest {
+		t.Errorf("zero branch: unexpected error %v", err)
+	}
+}
+
+func TestServerMagicBytes(t *testing.T) {
+	ctx := context.Background()
+	sk := testKeys[0]
+	srv, log, rs := newTestServer(t, signer.NewFromKey(sk))
+	srv.WithMagicBytes(codec.TenderbakeBlockWatermark, codec.TenderbakePreendorsementWatermark, codec.TenderbakeEndorsementWatermark)
+
+	_, err := rs.SignOperation(ctx, sk.Address(), testTransfer(sk.Address()))
+	if rpc.ErrorStatus(err) != http.StatusForbidden {
+		t.Errorf("transfer: unexpected error %v", err)
+	}
+	rec := log.last(t)
+	if rec.Status != http.StatusForbidden || rec.Magic != "0x03" || !strings.Contains(rec.Error, ErrMagicNotAllowed.Error()) {
+		t.Errorf("transfer: mismatched audit record %+v", rec)
+	}
+	if _, err := rs.SignMessage(ctx, sk.Address(), "hello"); rpc.ErrorStatus(err) != http.StatusForbidden {
+		t.Errorf("message: unexpected error %v", err)
+	}
+	if _, err := rs.SignOperation(ctx, sk.Address(), testAttestation(1, 0, 0)); err != nil {
+		t.Errorf("attestation: %v", err)
+	}
+	if _, err := rs.SignBlock(ctx, sk.Address(), testBlock(1, 0)); err != nil {
+		t.Errorf("block: %v", err)
+	}
+}
+
+func TestServerAuthentication(t *testing.T) {
+	sk := testKeys[0]
+	for _, ak := range testKeys {
+		srv := NewServer(signer.NewFromKey(sk)).WithAuthorizedKeys(ak.Public())
+		log := new(auditLog)
+		srv.WithAudit(log.add)
+		ts := httptest.NewServer(srv)
+
+		// authorized keys are listed
+		var resp struct {
+			Addrs []mavryk.Address `json:"authorized_keys"`
+		}
+		post := func(query string, data []byte) int {
+			body, _ := json.Marshal(mavryk.HexBytes(data))
+			res, err := http.Post(ts.URL+"/keys/"+sk.Address().String()+query, "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			return res.StatusCode
+		}
+		res, err := http.Get(ts.URL + "/authorized_keys")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(res.Body).Decode(&resp)
+		res.Body.Close()
+		if err != nil || len(resp.Addrs) != 1 || !resp.Addrs[0].Equal(ak.Address()) {
+			t.Errorf("%s: mismatched authorized keys %v %v", ak.Type, resp.Addrs, err)
+		}
+
+		data := testAttestation(1, 0, 0).WatermarkedBytes()
+		msg := authMessage(authTagSign, sk.Address(), data)
+		if ak.Type != mavryk.KeyTypeBls12_381 {
+			d := mavryk.Digest(msg)
+			msg = d[:]
+		}
+		auth, err := ak.Sign(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// missing, malformed and wrong authentication
+		if code := post("", data); code != http.StatusUnauthorized {
+			t.Errorf("%s: missing auth: unexpected status %d", ak.Type, code)
+		}
+		if rec := log.last(t); !strings.Contains(rec.Error, ErrUnauthorized.Error()) || rec.AuthKey != "" {
+			t.Errorf("%s: missing auth: mismatched audit record %+v", ak.Type, rec)
+		}
+		if code := post("?authentication=invalid", data); code != http.StatusUnauthorized {
+			t.Errorf("%s: malformed auth: unexpected status %d", ak.Type, code)
+		}
+		other := testAttestation(2, 0, 0).WatermarkedBytes()
+		if code := post("?authentication="+auth.String(), other); code != http.StatusUnauthorized {
+			t.Errorf("%s: auth for other data: unexpected status %d", ak.Type, code)
+		}
+
+		// valid authentication
+		if code := post("?authentication="+auth.String(), data); code != http.StatusOK {
+			t.Errorf("%s: valid auth: unexpected status %d", ak.Type, code)
+		}
+		if rec := log.last(t); rec.AuthKey != ak.Address().String() || rec.Status != http.StatusOK {
+			t.Errorf("%s: valid auth: mismatched audit record %+v", ak.Type, rec)
+		}
+		ts.Close()
+	}
+}
+
+func TestServerAudit(t *testing.T) {
+	var buf bytes.Buffer
+	rec := AuditRecord{
+		Address: testKeys[0].Address(),
+		Magic:   "0x11",
+		Kind:    "block",
+		Level:   5,
+		Status:  http.StatusOK,
+	}
+	if err := json.NewEncoder(&buf).Encode(rec); err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"auth_key", "error", "signature", "round"} {
+		if _, ok := m[k]; ok {
+			t.Errorf("unexpected field %s in %s", k, buf.String())
+		}
+	}
+	if m["kind"] != "block" || m["magic"] != "0x11" || m["status"] != float64(200) {
+		t.Errorf("mismatched audit record %s", buf.String())
+	}
+}
+
+func TestServerDoubleSigning(t *testing.T) {
+	ctx := context.Background()
+	sk := testKeys[0]
+	hwm, err := signer.NewHighWatermarkSigner(signer.NewFromKey(sk), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, log, rs := newTestServer(t, hwm)
+	addr := sk.Address()
+
+	sig, err := rs.SignBlock(ctx, addr, testBlock(10, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := rs.SignBlock(ctx, addr, testBlock(10, 1))
+	if err != nil || again.String() != sig.String() {
+		t.Errorf("repeated block: %s %v", again, err)
+	}
+	if _, err := rs.SignBlock(ctx, addr, testBlock(10, 0)); rpc.ErrorStatus(err) != http.StatusConflict {
+		t.Errorf("lower round: unexpected error %v", err)
+	}
+	rec := log.last(t)
+	if rec.Status != http.StatusConflict || rec.Level != 10 || rec.Round != 0 || rec.Signature != "" || rec.Error == "" {
+		t.Errorf("mismatched audit record %#v", rec)
+	}
+
+	if _, err := rs.SignOperation(ctx, addr, testAttestation(10, 1, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.SignOperation(ctx, addr, testAttestation(10, 1, 4)); rpc.ErrorStatus(err) != http.StatusConflict {
+		t.Errorf("different attestation: unexpected error %v", err)
+	}
+
+	// other operations are not affected
+	if _, err := rs.SignOperation(ctx, addr, testTransfer(addr)); err != nil {
+		t.Errorf("transfer: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package signer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+var ErrDoubleSigning = errors.New("signer: level and round already signed")
+
+// Consensus message kinds protected by HighWatermarkSigner.
+const (
+	WatermarkBlock          = "block"
+	WatermarkPreattestation = "preattestation"
+	WatermarkAttestation    = "attestation"
+)
+
+var _ Signer = (*HighWatermarkSigner)(nil)
+
+// Watermark is the highest level and round a key has signed for a kind of
+// consensus message on a chain.
+type Watermark struct {
+	Level     int64            `json:"level"`
+	Round     int64            `json:"round"`
+	Digest    mavryk.HexBytes  `json:"digest"`
+	Signature mavryk.Signature `json:"signature"`
+}
+
+// watermarks are the high watermarks of a single key by chain id and kind.
+type watermarks map[string]map[string]*Watermark
+
+// HighWatermarkSigner protects a signer against double signing. It refuses
+// to sign blocks, preattestations and attestations at or below the highest
+// level and round signed before with the same key on the same chain.
+// Repeated requests for the same payload return the previous signature.
+// All other operations and messages are passed through.
+//
+// Watermarks are stored per key as JSON files in a directory and written
+// atomically before a signature is returned. Only one process may use the
+// same directory at a time.
+type HighWatermarkSigner struct {
+	Signer
+	dir  string
+	mu   sync.Mutex
+	keys map[mavryk.Address]watermarks
+}
+
+// NewHighWatermarkSigner wraps signer s and stores watermarks in directory dir
+// which is created when missing.
+func NewHighWatermarkSigner(s Signer, dir string) (*HighWatermarkSigner, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &HighWatermarkSigner{
+		Signer: s,
+		dir:    dir,
+		keys:   make(map[mavryk.Address]watermarks),
+	}, nil
+}
+
+// Watermark returns the current high watermark of addr for kind on chain id
+// or nil when addr has not signed such messages yet.
+func (s *HighWatermarkSigner) Watermark(addr mavryk.Address, id mavryk.ChainIdHash, kind string) (*Watermark, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wm, err := s.load(addr)
+	if err != nil {
+		return nil, err
+	}
+	if w, ok := wm[id.String()][kind]; ok {
+		clone := *w
+		return &clone, nil
+	}
+	return nil, nil
+}
+
+// SignOperation signs op. Preattestations and attestations are checked
+// against and update the high watermark. They require a chain id.
+func (s *HighWatermarkSigner) SignOperation(ctx context.Context, addr mavryk.Address, op *codec.Op) (mavryk.Signature, error) {
+	if len(op.Contents) == 0 {
+		return s.Signer.SignOperation(ctx, addr, op)
+	}
+	var (
+		kind         string
+		level, round int64
+	)
+	switch v := op.Contents[0].(type) {
+	case *codec.TenderbakePreendorsement:
+		kind, level, round = WatermarkPreattestation, int64(v.Level), int64(v.Round)
+	case *codec.TenderbakeEndorsement:
+		kind, level, round = WatermarkAttestation, int64(v.Level), int64(v.Round)
+	default:
+		return s.Signer.SignOperation(ctx, addr, op)
+	}
+	if op.ChainId == nil {
+		return mavryk.InvalidSignature, fmt.Errorf("signer: missing chain id for %s", kind)
+	}
+	return s.sign(addr, *op.ChainId, kind, level, round, op.WatermarkedBytes(), func() (mavryk.Signature, error) {
+		return s.Signer.SignOperation(ctx, addr, op)
+	})
+}
+
+// SignBlock signs block header head which must have a chain id and a
+// Tenderbake fitness. The block level and round are checked against and
+// update the high watermark.
+func (s *HighWatermarkSigner) SignBlock(ctx context.Context, addr mavryk.Address, head *codec.BlockHeader) (mavryk.Signature, error) {
+	if head.ChainId == nil {
+		return mavryk.InvalidSignature, fmt.Errorf("signer: missing chain id for %s", WatermarkBlock)
+	}
+	// Round falls back to zero which would let lower rounds pass
+	if len(head.Fitness) != 5 || len(head.Fitness[4]) != 4 {
+		return mavryk.InvalidSignature, fmt.Errorf("signer: block fitness without round")
+	}
+	return s.sign(addr, *head.ChainId, WatermarkBlock, int64(head.Level), int64(head.Round()), head.WatermarkedBytes(), func() (mavryk.Signature, error) {
+		return s.Signer.SignBlock(ctx, addr, head)
+	})
+}
+
+// sign checks a consensus message against the high watermark, signs it
+// with fn and stores the new watermark.
+func (s *HighWatermarkSigner) sign(addr mavryk.Address, id mavryk.ChainIdHash, kind string, level, round int64, data []byte, fn func() (mavryk.Signature, error)) (mavryk.Signature, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wm, err := s.load(addr)
+	if err != nil {
+		return mavryk.InvalidSignature, err
+	}
+	digest := mavryk.Digest(data)
+	chain := id.String()
+	if last, ok := wm[chain][kind]; ok {
+		switch {
+		case level > last.Level, level == last.Level && round > last.Round:
+			// above watermark
+		case level == last.Level && round == last.Round && bytes.Equal(last.Digest, digest[:]):
+			// same payload, return the previous signature
+			return last.Signature, nil
+		default:
+			return mavryk.InvalidSignature, fmt.Errorf("%w: %s %s at level %d round %d, watermark level %d round %d",
+				ErrDoubleSigning, addr, kind, level, round, last.Level, last.Round)
+		}
+	}
+	sig, err := fn()
+	if err != nil {
+		return mavryk.InvalidSignature, err
+	}
+	if wm[chain] == nil {
+		wm[chain] = make(map[string]*Watermark)
+	}
+	prev := wm[chain][kind]
+	wm[chain][kind] = &Watermark{
+		Level:     level,
+		Round:     round,
+		Digest:    digest[:],
+		Signature: sig,
+	}
+	if err := s.store(addr, wm); err != nil {
+		// keep the signature secret when the watermark cannot be persisted
+		if prev != nil {
+			wm[chain][kind] = prev
+		} else {
+			delete(wm[chain], kind)
+		}
+		return mavryk.InvalidSignature, err
+	}
+	return sig, nil
+}
+
+func (s *HighWatermarkSigner) filename(addr mavryk.Address) string {
+	return filepath.Join(s.dir, addr.String()+".json")
+}
+
+// load returns the watermarks of addr and reads them from disk on first use.
+func (s *HighWatermarkSigner) load(addr mavryk.Address) (watermarks, error) {
+	if wm, ok := s.keys[addr]; ok {
+		return wm, nil
+	}
+	wm := make(watermarks)
+	buf, err := os.ReadFile(s.filename(addr))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(buf, &wm); err != nil {
+			return nil, fmt.Errorf("signer: reading watermarks for %s: %w", addr, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	s.keys[addr] = wm
+	return wm, nil
+}
+
+// store writes the watermarks of addr to a temporary file and renames it
+// so that the file on disk is always complete.
+func (s *HighWatermarkSigner) store(addr mavryk.Address, wm watermarks) error {
+	buf, err := json.MarshalIndent(wm, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := s.filename(addr)
+	f, err := os.CreateTemp(s.dir, filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	// persist the rename, not supported on all platforms
+	if d, err := os.Open(s.dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
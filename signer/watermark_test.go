@@ -0,0 +1,277 @@
+// Copyright (c) 2024 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package signer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/mavryk-network/gomavryk/codec"
+	"github.com/mavryk-network/gomavryk/mavryk"
+)
+
+var (
+	testKey     = mavryk.MustParsePrivateKey("edsk4FTF78Qf1m2rykGpHqostAiq5gYW4YZEoGUSWBTJr2njsDHSnd")
+	testBranch  = mavryk.MustParseBlockHash("BKnYk1T5a49bb8me4WfQeugyFnMEH9h8cm6jqvL3BxRwE23EVBJ")
+	testChainId = mavryk.MustParseChainIdHash("NetXdQprcVkpaWU")
+	testPayload = mavryk.MustParsePayloadHash("vh1hqtJCryS2Uzb8KDU2PAp33U1nDCeUB4g9yWKTjgVhiy4x9pQA")
+)
+
+// countingSigner counts calls which reach the wrapped signer.
+type countingSigner struct {
+	Signer
+	n int
+}
+
+func (s *countingSigner) SignOperation(ctx context.Context, addr mavryk.Address, op *codec.Op) (mavryk.Signature, error) {
+	s.n++
+	return s.Signer.SignOperation(ctx, addr, op)
+}
+
+func (s *countingSigner) SignBlock(ctx context.Context, addr mavryk.Address, head *codec.BlockHeader) (mavryk.Signature, error) {
+	s.n++
+	return s.Signer.SignBlock(ctx, addr, head)
+}
+
+func testAttestation(level, round int32, slot int16) *codec.Op {
+	return codec.NewOp().
+		WithBranch(testBranch).
+		WithChainId(testChainId).
+		WithContents(&codec.TenderbakeEndorsement{
+			Slot:             slot,
+			Level:            level,
+			Round:            round,
+			BlockPayloadHash: testPayload,
+		})
+}
+
+func testBlock(level int32, round byte) *codec.BlockHeader {
+	h := &codec.BlockHeader{
+		Level:            level,
+		Proto:            1,
+		Predecessor:      testBranch,
+		Fitness:          []mavryk.HexBytes{{2}, {0, 0, 0, byte(level)}, {}, {0xff, 0xff, 0xff, 0xff}, {0, 0, 0, round}},
+		PayloadHash:      testPayload,
+		ProofOfWorkNonce: make([]byte, 8),
+		LbVote:           mavryk.FeatureVoteOn,
+		AiVote:           mavryk.FeatureVoteOn,
+	}
+	return h.WithChainId(testChainId)
+}
+
+func newTestWatermarkSigner(t *testing.T, dir string) (*HighWatermarkSigner, *countingSigner) {
+	t.Helper()
+	cs := &countingSigner{Signer: NewFromKey(testKey)}
+	s, err := NewHighWatermarkSigner(cs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, cs
+}
+
+func checkWatermark(t *testing.T, s *HighWatermarkSigner, kind string, level, round int64) {
+	t.Helper()
+	w, err := s.Watermark(testKey.Address(), testChainId, kind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w == nil || w.Level != level || w.Round != round {
+		t.Errorf("mismatched %s watermark got=%v want=%d/%d", kind, w, level, round)
+	}
+}
+
+func TestWatermarkAccept(t *testing.T) {
+	ctx := context.Background()
+	s, cs := newTestWatermarkSigner(t, t.TempDir())
+	addr := testKey.Address()
+	for i, h := range []*codec.BlockHeader{
+		testBlock(10, 0),
+		testBlock(10, 1), // higher round
+		testBlock(11, 0), // higher level, lower round
+	} {
+		if _, err := s.SignBlock(ctx, addr, h); err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+	}
+	checkWatermark(t, s, WatermarkBlock, 11, 0)
+
+	for i, op := range []*codec.Op{
+		testAttestation(10, 0, 1),
+		testAttestation(10, 2, 1),
+		testAttestation(12, 0, 1),
+	} {
+		if _, err := s.SignOperation(ctx, addr, op); err != nil {
+			t.Fatalf("attestation %d: %v", i, err)
+		}
+	}
+	checkWatermark(t, s, WatermarkAttestation, 12, 0)
+
+	// kinds are independent
+	if w, _ := s.Watermark(addr, testChainId, WatermarkPreattestation); w != nil {
+		t.Errorf("unexpected preattestation watermark %v", w)
+	}
+	if cs.n != 6 {
+		t.Errorf("mismatched sign calls got=%d want=%d", cs.n, 6)
+	}
+}
+
+func TestWatermarkRepeat(t *testing.T) {
+	ctx := context.Background()
+	s, cs := newTestWatermarkSigner(t, t.TempDir())
+	addr := testKey.Address()
+
+	sig, err := s.SignOperation(ctx, addr, testAttestation(10, 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := s.SignOperation(ctx, addr, testAttestation(10, 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != sig.String() {
+		t.Errorf("mismatched repeated signature got=%s want=%s", again, sig)
+	}
+	if cs.n != 1 {
+		t.Errorf("repeated payload reached signer %d times", cs.n)
+	}
+
+	// same level and round with a different payload
+	_, err = s.SignOperation(ctx, addr, testAttestation(10, 1, 2))
+	if !errors.Is(err, ErrDoubleSigning) {
+		t.Errorf("different payload: expected double signing error, got %v", err)
+	}
+
+	// lower level and round
+	for _, op := range []*codec.Op{testAttestation(10, 0, 1), testAttestation(9, 5, 1)} {
+		if _, err := s.SignOperation(ctx, addr, op); !errors.Is(err, ErrDoubleSigning) {
+			t.Errorf("below watermark: expected double signing error, got %v", err)
+		}
+	}
+	if cs.n != 1 {
+		t.Errorf("rejected payloads reached signer %d times", cs.n)
+	}
+	checkWatermark(t, s, WatermarkAttestation, 10, 1)
+}
+
+func TestWatermarkPersist(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	addr := testKey.Address()
+	s, _ := newTestWatermarkSigner(t, dir)
+	sig, err := s.SignBlock(ctx, addr, testBlock(10, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new signer on the same directory reads the stored watermark
+	s2, cs := newTestWatermarkSigner(t, dir)
+	checkWatermark(t, s2, WatermarkBlock, 10, 2)
+	if _, err := s2.SignBlock(ctx, addr, testBlock(10, 1)); !errors.Is(err, ErrDoubleSigning) {
+		t.Errorf("expected double signing error, got %v", err)
+	}
+	again, err := s2.SignBlock(ctx, addr, testBlock(10, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != sig.String() || cs.n != 0 {
+		t.Errorf("mismatched stored signature got=%s want=%s calls=%d", again, sig, cs.n)
+	}
+
+	// watermarks are separate per chain
+	other := testBlock(10, 1).WithChainId(mavryk.MustParseChainIdHash("NetXnHfVqm9iesp"))
+	if _, err := s2.SignBlock(ctx, addr, other); err != nil {
+		t.Errorf("other chain: %v", err)
+	}
+}
+
+func TestWatermarkStoreFailure(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	addr := testKey.Address()
+	s, cs := newTestWatermarkSigner(t, dir)
+	if _, err := s.SignBlock(ctx, addr, testBlock(10, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// replace the directory with a file so that writes fail even for root
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := s.SignBlock(ctx, addr, testBlock(11, 0))
+	if err == nil {
+		t.Fatal("expected store error")
+	}
+	if sig.IsValid() {
+		t.Errorf("signature returned without stored watermark")
+	}
+	if cs.n != 2 {
+		t.Errorf("mismatched sign calls got=%d want=%d", cs.n, 2)
+	}
+	checkWatermark(t, s, WatermarkBlock, 10, 0)
+
+	// a new kind is removed again on failure
+	if _, err := s.SignOperation(ctx, addr, testAttestation(11, 0, 1)); err == nil {
+		t.Fatal("expected store error")
+	}
+	if w, _ := s.Watermark(addr, testChainId, WatermarkAttestation); w != nil {
+		t.Errorf("unexpected attestation watermark %v", w)
+	}
+
+	// signing resumes once the directory is writable again
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SignBlock(ctx, addr, testBlock(11, 0)); err != nil {
+		t.Fatal(err)
+	}
+	checkWatermark(t, s, WatermarkBlock, 11, 0)
+}
+
+func TestWatermarkInvalid(t *testing.T) {
+	ctx := context.Background()
+	s, cs := newTestWatermarkSigner(t, t.TempDir())
+	addr := testKey.Address()
+
+	// block without chain id
+	h := testBlock(10, 0)
+	h.ChainId = nil
+	if _, err := s.SignBlock(ctx, addr, h); err == nil {
+		t.Error("missing chain id: expected error")
+	}
+
+	// block fitness without round
+	h = testBlock(10, 0)
+	h.Fitness = h.Fitness[:4]
+	if _, err := s.SignBlock(ctx, addr, h); err == nil {
+		t.Error("missing round: expected error")
+	}
+
+	// attestation without chain id
+	op := testAttestation(10, 0, 1)
+	op.ChainId = nil
+	if _, err := s.SignOperation(ctx, addr, op); err == nil {
+		t.Error("attestation without chain id: expected error")
+	}
+
+	// other operations pass through
+	tx := codec.NewOp().
+		WithBranch(testBranch).
+		WithSource(addr).
+		WithTransfer(addr, 1000).
+		WithLimits([]mavryk.Limits{{Fee: 400, GasLimit: 1000}}, 0)
+	if _, err := s.SignOperation(ctx, addr, tx); err != nil {
+		t.Errorf("transfer: %v", err)
+	}
+	if cs.n != 1 {
+		t.Errorf("mismatched sign calls got=%d want=%d", cs.n, 1)
+	}
+}